@@ -0,0 +1,61 @@
+package lager
+
+import (
+	"encoding/gob"
+	"math/big"
+	"reflect"
+)
+
+// writeBig writes a big.Int, big.Float or big.Rat as its gob encoding,
+// which keeps the precision and rounding mode of floats.
+func (e *Encoder) writeBig(w reflect.Value) error {
+	p := reflect.New(w.Type())
+	p.Elem().Set(w)
+	data, err := p.Interface().(gob.GobEncoder).GobEncode()
+	if err != nil {
+		return err
+	}
+	e.writeBytes(data)
+	return nil
+}
+
+// readBig reads a big.Int, big.Float or big.Rat into v.
+func (d *Decoder) readBig(v reflect.Value) error {
+	data, err := d.readBytes()
+	if err != nil {
+		return err
+	}
+	return v.Addr().Interface().(gob.GobDecoder).GobDecode(data)
+}
+
+// bigText returns the text of a big.Int, big.Float or big.Rat value, as
+// it's written by the converters to other formats, and whether the value
+// was one.
+func bigText(value interface{}) (string, bool) {
+	switch b := value.(type) {
+	case big.Int:
+		return b.String(), true
+	case big.Float:
+		return b.Text('g', -1), true
+	case big.Rat:
+		return b.RatString(), true
+	}
+	return "", false
+}
+
+// setBig sets a big.Int, big.Float or big.Rat to the number in the given
+// text, and returns whether it was valid. Floats get enough precision for
+// every digit of it.
+func setBig(v reflect.Value, text string) bool {
+	ok := false
+	switch b := v.Addr().Interface().(type) {
+	case *big.Int:
+		_, ok = b.SetString(text, 10)
+	case *big.Float:
+		b.SetPrec(max(64, 4*uint(len(text))))
+		_, ok = b.SetString(text)
+	case *big.Rat:
+		_, ok = b.SetString(text)
+	}
+	return ok
+}
@@ -0,0 +1,514 @@
+package lager
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"reflect"
+	"time"
+)
+
+// ToCBOR converts the lager stream read from r into CBOR (RFC 8949)
+// written to w, without needing its types to be registered, so that
+// systems without lager can read archived streams. The document is an
+// indefinite-length array holding each object in the stream, mapped as
+// follows:
+//
+//   - Structs are maps keyed by field name, in the order the fields were
+//     written. Maps are maps keyed by their keys' values, and slices are
+//     arrays.
+//   - Byte slices and types with their own binary encoding are byte
+//     strings, and strings are text strings.
+//   - Integers of every size, durations in nanoseconds included, are
+//     integers, and floats are floats of the same size. Complex numbers
+//     are arrays of their real and imaginary parts. The numbers of
+//     math/big are text strings.
+//   - Times are RFC 3339 strings in tag 0.
+//   - Nil pointers, interfaces, slices and maps are null. Values held in
+//     interfaces are written as the value itself.
+//   - Pointers use the value-sharing tags: where a pointer is first seen,
+//     the value it points to is written in tag 28, and after that the
+//     pointer is tag 29 holding the index of that tag 28 among all of
+//     those in the document, so that shared and cyclic pointers are kept.
+//
+// Type names are left out, as they're only known for structs.
+func ToCBOR(r io.Reader, w io.Writer) error {
+	out := bufio.NewWriter(w)
+	out.WriteByte(0x9f)
+	if err := transcode(r, out, &cborWriter{}); err != nil {
+		return err
+	}
+	out.WriteByte(0xff)
+	return out.Flush()
+}
+
+// ToMsgpack converts the lager stream read from r into MessagePack written
+// to w, without needing its types to be registered, so that systems
+// without lager can read archived streams. Each object in the stream is
+// written as a value of its own, one after the other, mapped as by ToCBOR
+// except that:
+//
+//   - Times use the timestamp extension type, -1, in its 96-bit form.
+//   - Pointers are written as {"$id": n, "value": value} where first seen,
+//     and as {"$ref": n} after that, as by ToJSON, numbering them from 1
+//     across the whole stream.
+func ToMsgpack(r io.Reader, w io.Writer) error {
+	out := bufio.NewWriter(w)
+	if err := transcode(r, out, &msgpackWriter{}); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// valueWriter writes values in another format for transcode, to its
+// buffer. Pointers are written with shared, given the pointer's id, in the
+// order first seen from 0, and whether this is the first time it's seen,
+// followed by the value it points to if it is.
+type valueWriter interface {
+	buffer() *bytes.Buffer
+	setBuffer(buf *bytes.Buffer)
+	null()
+	bool(v bool)
+	int(v int64)
+	uint(v uint64)
+	float32(v float32)
+	float64(v float64)
+	string(v string)
+	bytes(v []byte)
+	time(v time.Time)
+	array(n int)
+	mapHeader(n int)
+	shared(id int, first bool)
+}
+
+// objectTokens reads the tokens of a stream's objects, keeping the tokens
+// of the values pointers point to, so that each can be read where it's
+// referred to.
+type objectTokens struct {
+	d    *Decoder
+	ptrs map[uint][]Token
+}
+
+// tokenSource returns the next token of the value being read.
+type tokenSource func() (Token, error)
+
+// newObjectTokens creates a decoder reading tokens from r.
+func newObjectTokens(r io.Reader) (*objectTokens, error) {
+	d, err := NewDecoderWithOptions(r, DecoderOptions{Tokens: true})
+	if err != nil {
+		return nil, err
+	}
+	return &objectTokens{d, make(map[uint][]Token)}, nil
+}
+
+// next returns the first token of the next object, whose other tokens are
+// read from the decoder, keeping the pointers before it.
+func (o *objectTokens) next() (Token, error) {
+	for {
+		tok, err := o.d.Token()
+		if err != nil {
+			return nil, err
+		}
+		p, ok := tok.(StartPointer)
+		if !ok {
+			return tok, nil
+		}
+		var tokens []Token
+		for {
+			if tok, err = o.d.Token(); err != nil {
+				return nil, err
+			}
+			if _, ok := tok.(EndPointer); ok {
+				break
+			}
+			tokens = append(tokens, tok)
+		}
+		o.ptrs[p.Ref] = tokens
+	}
+}
+
+// ptr returns the first token of the value a pointer points to, and a
+// source of the rest of its tokens.
+func (o *objectTokens) ptr(ref uint) (Token, tokenSource, error) {
+	tokens, ok := o.ptrs[ref]
+	if !ok || len(tokens) == 0 {
+		return nil, nil, MissingPointer{ref}
+	}
+	rest := tokens[1:]
+	return tokens[0], func() (Token, error) {
+		if len(rest) == 0 {
+			return nil, CorruptStream{"pointer"}
+		}
+		tok := rest[0]
+		rest = rest[1:]
+		return tok, nil
+	}, nil
+}
+
+// transcoder writes the values read as tokens from a decoder in another
+// format, writing the value of each pointer where it's first referred to.
+type transcoder struct {
+	*objectTokens
+	w   valueWriter
+	ids map[uint]int
+}
+
+// transcode writes each object of the lager stream read from r to out, as
+// written by w.
+func transcode(r io.Reader, out io.Writer, w valueWriter) error {
+	o, err := newObjectTokens(r)
+	if err != nil {
+		return err
+	}
+	t := &transcoder{o, w, make(map[uint]int)}
+	w.setBuffer(new(bytes.Buffer))
+	for {
+		tok, err := o.next()
+		if err == (EndOfStream{}) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := t.value(tok, o.d.Token); err != nil {
+			return err
+		}
+		if _, err := w.buffer().WriteTo(out); err != nil {
+			return err
+		}
+	}
+}
+
+// value writes the value begun by tok, reading the rest of its tokens
+// from next.
+func (t *transcoder) value(tok Token, next tokenSource) error {
+	w := t.w
+	switch v := tok.(type) {
+	case nil:
+		w.null()
+	case StartStruct:
+		return t.structure(next)
+	case StartSlice:
+		w.array(v.Len)
+		return t.entries(v.Len, EndSlice{}, next)
+	case StartMap:
+		w.mapHeader(v.Len)
+		return t.entries(2*v.Len, EndMap{}, next)
+	case Ref:
+		return t.ref(uint(v))
+	case bool:
+		w.bool(v)
+	case string:
+		w.string(v)
+	case []byte:
+		w.bytes(v)
+	case float32:
+		w.float32(v)
+	case float64:
+		w.float64(v)
+	case complex64:
+		w.array(2)
+		w.float32(real(v))
+		w.float32(imag(v))
+	case complex128:
+		w.array(2)
+		w.float64(real(v))
+		w.float64(imag(v))
+	case time.Time:
+		w.time(v)
+	default:
+		if text, ok := bigText(tok); ok {
+			w.string(text)
+			break
+		}
+		rv := reflect.ValueOf(tok)
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			w.int(rv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			w.uint(rv.Uint())
+		default:
+			return CorruptStream{"token"}
+		}
+	}
+	return nil
+}
+
+// structure writes a struct as a map. Its fields are written to a buffer
+// of their own first, as their number isn't known until its end.
+func (t *transcoder) structure(next tokenSource) error {
+	buf := t.w.buffer()
+	fields := new(bytes.Buffer)
+	t.w.setBuffer(fields)
+	n := 0
+	for {
+		tok, err := next()
+		if err != nil {
+			t.w.setBuffer(buf)
+			return err
+		}
+		if _, ok := tok.(EndStruct); ok {
+			break
+		}
+		name, ok := tok.(Field)
+		if !ok {
+			t.w.setBuffer(buf)
+			return CorruptStream{"token"}
+		}
+		t.w.string(string(name))
+		if tok, err = next(); err == nil {
+			err = t.value(tok, next)
+		}
+		if err != nil {
+			t.w.setBuffer(buf)
+			return err
+		}
+		n++
+	}
+	t.w.setBuffer(buf)
+	t.w.mapHeader(n)
+	buf.Write(fields.Bytes())
+	return nil
+}
+
+// entries writes the given number of values, which must be followed by
+// the given end token.
+func (t *transcoder) entries(n int, end Token, next tokenSource) error {
+	for i := 0; i <= n; i++ {
+		tok, err := next()
+		if err != nil {
+			return err
+		}
+		if i == n {
+			if tok != end {
+				return CorruptStream{"token"}
+			}
+			return nil
+		}
+		if err := t.value(tok, next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ref writes a pointer, along with the value it points to if this is the
+// first time it's seen.
+func (t *transcoder) ref(ref uint) error {
+	if id, ok := t.ids[ref]; ok {
+		t.w.shared(id, false)
+		return nil
+	}
+	tok, next, err := t.ptr(ref)
+	if err != nil {
+		return err
+	}
+	id := len(t.ids)
+	t.ids[ref] = id
+	t.w.shared(id, true)
+	return t.value(tok, next)
+}
+
+// cborWriter writes values as CBOR.
+type cborWriter struct {
+	buf *bytes.Buffer
+}
+
+func (c *cborWriter) buffer() *bytes.Buffer       { return c.buf }
+func (c *cborWriter) setBuffer(buf *bytes.Buffer) { c.buf = buf }
+
+// head writes the initial bytes of a data item of the given major type,
+// holding the given argument.
+func (c *cborWriter) head(major byte, arg uint64) {
+	major <<= 5
+	switch {
+	case arg < 24:
+		c.buf.WriteByte(major | byte(arg))
+	case arg <= math.MaxUint8:
+		c.buf.Write([]byte{major | 24, byte(arg)})
+	case arg <= math.MaxUint16:
+		c.buf.Write(binary.BigEndian.AppendUint16([]byte{major | 25}, uint16(arg)))
+	case arg <= math.MaxUint32:
+		c.buf.Write(binary.BigEndian.AppendUint32([]byte{major | 26}, uint32(arg)))
+	default:
+		c.buf.Write(binary.BigEndian.AppendUint64([]byte{major | 27}, arg))
+	}
+}
+
+func (c *cborWriter) null() {
+	c.buf.WriteByte(0xf6)
+}
+
+func (c *cborWriter) bool(v bool) {
+	if v {
+		c.buf.WriteByte(0xf5)
+	} else {
+		c.buf.WriteByte(0xf4)
+	}
+}
+
+func (c *cborWriter) int(v int64) {
+	if v < 0 {
+		c.head(1, uint64(-1-v))
+	} else {
+		c.head(0, uint64(v))
+	}
+}
+
+func (c *cborWriter) uint(v uint64) {
+	c.head(0, v)
+}
+
+func (c *cborWriter) float32(v float32) {
+	c.buf.Write(binary.BigEndian.AppendUint32([]byte{0xfa}, math.Float32bits(v)))
+}
+
+func (c *cborWriter) float64(v float64) {
+	c.buf.Write(binary.BigEndian.AppendUint64([]byte{0xfb}, math.Float64bits(v)))
+}
+
+func (c *cborWriter) string(v string) {
+	c.head(3, uint64(len(v)))
+	c.buf.WriteString(v)
+}
+
+func (c *cborWriter) bytes(v []byte) {
+	c.head(2, uint64(len(v)))
+	c.buf.Write(v)
+}
+
+func (c *cborWriter) time(v time.Time) {
+	c.head(6, 0)
+	c.string(v.Format(time.RFC3339Nano))
+}
+
+func (c *cborWriter) array(n int) {
+	c.head(4, uint64(n))
+}
+
+func (c *cborWriter) mapHeader(n int) {
+	c.head(5, uint64(n))
+}
+
+func (c *cborWriter) shared(id int, first bool) {
+	if first {
+		c.head(6, 28)
+		return
+	}
+	c.head(6, 29)
+	c.head(0, uint64(id))
+}
+
+// msgpackWriter writes values as MessagePack.
+type msgpackWriter struct {
+	buf *bytes.Buffer
+}
+
+func (m *msgpackWriter) buffer() *bytes.Buffer       { return m.buf }
+func (m *msgpackWriter) setBuffer(buf *bytes.Buffer) { m.buf = buf }
+
+// head writes the first byte of a value whose length or size is n, and n
+// itself: as part of the first byte if it's below fixed, or following
+// the first of the given bytes which fits it, for 8, 16 and 32 bits.
+func (m *msgpackWriter) head(n int, fixed int, fix byte, sized [3]byte) {
+	switch {
+	case n < fixed:
+		m.buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint8 && sized[0] != 0:
+		m.buf.Write([]byte{sized[0], byte(n)})
+	case n <= math.MaxUint16:
+		m.buf.Write(binary.BigEndian.AppendUint16([]byte{sized[1]}, uint16(n)))
+	default:
+		m.buf.Write(binary.BigEndian.AppendUint32([]byte{sized[2]}, uint32(n)))
+	}
+}
+
+func (m *msgpackWriter) null() {
+	m.buf.WriteByte(0xc0)
+}
+
+func (m *msgpackWriter) bool(v bool) {
+	if v {
+		m.buf.WriteByte(0xc3)
+	} else {
+		m.buf.WriteByte(0xc2)
+	}
+}
+
+func (m *msgpackWriter) int(v int64) {
+	switch {
+	case v >= 0:
+		m.uint(uint64(v))
+	case v >= -32:
+		m.buf.WriteByte(byte(v))
+	case v >= math.MinInt8:
+		m.buf.Write([]byte{0xd0, byte(v)})
+	case v >= math.MinInt16:
+		m.buf.Write(binary.BigEndian.AppendUint16([]byte{0xd1}, uint16(v)))
+	case v >= math.MinInt32:
+		m.buf.Write(binary.BigEndian.AppendUint32([]byte{0xd2}, uint32(v)))
+	default:
+		m.buf.Write(binary.BigEndian.AppendUint64([]byte{0xd3}, uint64(v)))
+	}
+}
+
+func (m *msgpackWriter) uint(v uint64) {
+	switch {
+	case v < 128:
+		m.buf.WriteByte(byte(v))
+	case v <= math.MaxUint8:
+		m.buf.Write([]byte{0xcc, byte(v)})
+	case v <= math.MaxUint16:
+		m.buf.Write(binary.BigEndian.AppendUint16([]byte{0xcd}, uint16(v)))
+	case v <= math.MaxUint32:
+		m.buf.Write(binary.BigEndian.AppendUint32([]byte{0xce}, uint32(v)))
+	default:
+		m.buf.Write(binary.BigEndian.AppendUint64([]byte{0xcf}, v))
+	}
+}
+
+func (m *msgpackWriter) float32(v float32) {
+	m.buf.Write(binary.BigEndian.AppendUint32([]byte{0xca}, math.Float32bits(v)))
+}
+
+func (m *msgpackWriter) float64(v float64) {
+	m.buf.Write(binary.BigEndian.AppendUint64([]byte{0xcb}, math.Float64bits(v)))
+}
+
+func (m *msgpackWriter) string(v string) {
+	m.head(len(v), 32, 0xa0, [3]byte{0xd9, 0xda, 0xdb})
+	m.buf.WriteString(v)
+}
+
+func (m *msgpackWriter) bytes(v []byte) {
+	m.head(len(v), 0, 0, [3]byte{0xc4, 0xc5, 0xc6})
+	m.buf.Write(v)
+}
+
+func (m *msgpackWriter) time(v time.Time) {
+	m.buf.Write([]byte{0xc7, 12, 0xff})
+	m.buf.Write(binary.BigEndian.AppendUint32(nil, uint32(v.Nanosecond())))
+	m.buf.Write(binary.BigEndian.AppendUint64(nil, uint64(v.Unix())))
+}
+
+func (m *msgpackWriter) array(n int) {
+	m.head(n, 16, 0x90, [3]byte{0, 0xdc, 0xdd})
+}
+
+func (m *msgpackWriter) mapHeader(n int) {
+	m.head(n, 16, 0x80, [3]byte{0, 0xde, 0xdf})
+}
+
+func (m *msgpackWriter) shared(id int, first bool) {
+	if first {
+		m.mapHeader(2)
+		m.string("$id")
+		m.uint(uint64(id + 1))
+		m.string("value")
+		return
+	}
+	m.mapHeader(1)
+	m.string("$ref")
+	m.uint(uint64(id + 1))
+}
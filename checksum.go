@@ -0,0 +1,67 @@
+package lager
+
+import (
+	"bufio"
+	"bytes"
+	"hash/crc32"
+	"io"
+)
+
+// crcTable is used for all checksums, which are CRC-32C.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum computes the CRC-32C checksum of the given bytes, continuing
+// from a previous checksum.
+func checksum(crc uint32, p []byte) uint32 {
+	return crc32.Update(crc, crcTable, p)
+}
+
+// checksumReader is a reader which keeps running checksums of the bytes
+// read through it: one for the current record, which can be reset, and
+// one for the whole stream. It also counts the bytes read, and keeps a
+// copy of them in tee, if set.
+type checksumReader struct {
+	r      *bufio.Reader
+	record uint32
+	stream uint32
+	n      int64
+	tee    *bytes.Buffer
+}
+
+// ReadByte reads a single byte. Running out of input is always
+// unexpected, as the stream marks its own end, so io.EOF is reported as
+// UnexpectedEOF.
+func (c *checksumReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return b, unexpected(err)
+	}
+	c.record = checksum(c.record, []byte{b})
+	c.stream = checksum(c.stream, []byte{b})
+	c.n++
+	if c.tee != nil {
+		c.tee.WriteByte(b)
+	}
+	return b, nil
+}
+
+// Read fills p entirely, unless the end of the input is reached first.
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := io.ReadFull(c.r, p)
+	c.record = checksum(c.record, p[:n])
+	c.stream = checksum(c.stream, p[:n])
+	c.n += int64(n)
+	if c.tee != nil {
+		c.tee.Write(p[:n])
+	}
+	return n, unexpected(err)
+}
+
+// unexpected replaces the errors for running out of input with
+// UnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return UnexpectedEOF{}
+	}
+	return err
+}
@@ -0,0 +1,326 @@
+// Command lager inspects lager streams without knowing the types they hold.
+//
+// Usage:
+//
+//	lager dump [-text | -tokens | -csv] [file]
+//	lager head [file]
+//	lager verify [file]
+//	lager explain [file]
+//	lager diff file1 file2
+//	lager proto [-package name] [file]
+//
+// The dump subcommand prints the stream as JSON, in the form written by
+// lager.ToJSON, each object as text with -text, or each token read by
+// lager.Decoder.Token on a line of its own with -tokens, or as CSV, as
+// written by lager.ToCSV, with -csv. The head subcommand
+// prints what the stream's header and footer record about it, and verify
+// reads the whole stream, checking its structure and any checksums. The
+// explain subcommand prints each region of the stream with its offsets,
+// what it encodes and its bytes, as written by lager.Explain. With no
+// file, the standard input is read. The diff subcommand prints where two
+// streams differ, as found by lager.Diff, and exits with status 1 if they
+// do. The proto subcommand prints a .proto file declaring a message for
+// each struct type in a stream written with the Schema option, as written
+// by lager.Schema.WriteProto.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	lager "github.com/lowentropy/go-lager"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "dump":
+		err = dump(args)
+	case "head":
+		err = head(args)
+	case "verify":
+		err = verify(args)
+	case "explain":
+		err = explain(args)
+	case "diff":
+		err = diff(args)
+	case "proto":
+		err = proto(args)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "lager:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: lager dump [-text | -tokens | -csv] [file]")
+	fmt.Fprintln(os.Stderr, "       lager head [file]")
+	fmt.Fprintln(os.Stderr, "       lager verify [file]")
+	fmt.Fprintln(os.Stderr, "       lager explain [file]")
+	fmt.Fprintln(os.Stderr, "       lager diff file1 file2")
+	fmt.Fprintln(os.Stderr, "       lager proto [-package name] [file]")
+	os.Exit(2)
+}
+
+// open parses a subcommand's flags and opens the stream named by its
+// argument, or the standard input if there is none. Files are returned
+// as they are so that streaming-mode footers can be read.
+func open(fs *flag.FlagSet, args []string) (io.Reader, error) {
+	fs.Parse(args)
+	switch fs.NArg() {
+	case 0:
+		return os.Stdin, nil
+	case 1:
+		return os.Open(fs.Arg(0))
+	}
+	usage()
+	return nil, nil
+}
+
+// decode opens a stream as by open, and creates a decoder for it which
+// doesn't know any types.
+func decode(fs *flag.FlagSet, args []string) (*lager.Decoder, error) {
+	r, err := open(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	return lager.NewDecoderWithOptions(r, lager.DecoderOptions{Registry: lager.NewRegistry()})
+}
+
+func dump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	text := fs.Bool("text", false, "print objects as text rather than JSON")
+	tokens := fs.Bool("tokens", false, "print each token of the stream rather than JSON")
+	csv := fs.Bool("csv", false, "print a stream of records as CSV rather than JSON")
+	r, err := open(fs, args)
+	if err != nil {
+		return err
+	}
+	if *tokens {
+		return dumpTokens(r)
+	}
+	if *csv {
+		return lager.ToCSV(r, os.Stdout)
+	}
+	if !*text {
+		return lager.ToJSON(r, os.Stdout)
+	}
+	dec, err := lager.NewDecoderWithOptions(r, lager.DecoderOptions{Registry: lager.NewRegistry()})
+	if err != nil {
+		return err
+	}
+	p := &printer{ids: make(map[*interface{}]int)}
+	for i := 0; dec.More(); i++ {
+		value, err := dec.ReadGeneric()
+		if err != nil {
+			return fmt.Errorf("object %d: %w", i, err)
+		}
+		fmt.Printf("%d: %v\n", i, p.convert(value))
+	}
+	return nil
+}
+
+// dumpTokens prints each token of a stream on a line of its own, indented
+// by how deeply it is nested.
+func dumpTokens(r io.Reader) error {
+	dec, err := lager.NewDecoderWithOptions(r, lager.DecoderOptions{Registry: lager.NewRegistry(), Tokens: true})
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err == (lager.EndOfStream{}) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch tok.(type) {
+		case lager.EndStruct, lager.EndSlice, lager.EndMap, lager.EndPointer:
+			depth--
+		}
+		switch t := tok.(type) {
+		case lager.Field:
+			fmt.Fprintf(out, "%*s.%s\n", 2*depth, "", t)
+		case string:
+			fmt.Fprintf(out, "%*s%q\n", 2*depth, "", t)
+		default:
+			fmt.Fprintf(out, "%*s%v\n", 2*depth, "", t)
+		}
+		switch tok.(type) {
+		case lager.StartStruct, lager.StartSlice, lager.StartMap, lager.StartPointer:
+			depth++
+		}
+	}
+}
+
+func head(args []string) error {
+	r, err := open(flag.NewFlagSet("head", flag.ExitOnError), args)
+	if err != nil {
+		return err
+	}
+	h, err := lager.ReadHeader(r)
+	if err != nil {
+		return err
+	}
+	fmt.Println("encrypted:", h.Encrypted)
+	fmt.Println("checksums:", h.Checksums)
+	fmt.Println("streaming:", h.Streaming)
+	fmt.Println("footer:   ", h.Footer)
+	fmt.Println("index:    ", h.Index)
+	fmt.Println("field ids:", h.FieldIds)
+	fmt.Println("str ids:  ", h.StringIds)
+	fmt.Println("omit zero:", h.OmitZero)
+	fmt.Println("markers:  ", h.Markers)
+	for _, key := range slices.Sorted(maps.Keys(h.Metadata)) {
+		fmt.Printf("metadata:  %s=%s\n", key, h.Metadata[key])
+	}
+	if h.Objects < 0 {
+		fmt.Println("objects:   unknown")
+	} else {
+		fmt.Println("objects:  ", h.Objects)
+	}
+	fmt.Println("pointers: ", h.Pointers)
+	fmt.Println("types:    ", len(h.Types))
+	for i, name := range h.Types {
+		if h.Schema == nil {
+			fmt.Println("  " + name)
+			continue
+		}
+		s := h.Schema[i]
+		fmt.Println("  "+name, s.Kind, s.Underlying)
+		for _, f := range s.Fields {
+			fmt.Println("    "+f.Name, f.Type)
+		}
+	}
+	return nil
+}
+
+func verify(args []string) error {
+	dec, err := decode(flag.NewFlagSet("verify", flag.ExitOnError), args)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for ; dec.More(); n++ {
+		if _, err := dec.ReadGeneric(); err != nil {
+			return fmt.Errorf("object %d: %w", n, err)
+		}
+	}
+	if _, err := dec.ReadGeneric(); err != (lager.EndOfStream{}) {
+		return fmt.Errorf("object %d: %w", n, err)
+	}
+	fmt.Printf("ok: %d objects, %d pointers\n", n, dec.Header().Pointers)
+	return nil
+}
+
+func explain(args []string) error {
+	r, err := open(flag.NewFlagSet("explain", flag.ExitOnError), args)
+	if err != nil {
+		return err
+	}
+	return lager.Explain(r, os.Stdout)
+}
+
+func diff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+	}
+	a, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	b, err := os.Open(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	diffs, err := lager.Diff(a, b)
+	if err != nil {
+		return err
+	}
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	if len(diffs) > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// printer converts generic values into ones which can be printed as text,
+// numbering each pointer the first time it is seen.
+type printer struct {
+	ids map[*interface{}]int
+}
+
+func (p *printer) convert(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *interface{}:
+		if id, ok := p.ids[v]; ok {
+			return map[string]interface{}{"$ref": id}
+		}
+		id := len(p.ids) + 1
+		p.ids[v] = id
+		return map[string]interface{}{"$id": id, "value": p.convert(*v)}
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			m[key] = p.convert(elem)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			m[fmt.Sprint(key)] = p.convert(elem)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, elem := range v {
+			s[i] = p.convert(elem)
+		}
+		return s
+	}
+	return value
+}
+
+func proto(args []string) error {
+	fs := flag.NewFlagSet("proto", flag.ExitOnError)
+	pkg := fs.String("package", "", "the package to declare the messages in")
+	r, err := open(fs, args)
+	if err != nil {
+		return err
+	}
+	h, err := lager.ReadHeader(r)
+	if err != nil {
+		return err
+	}
+	if h.Schema == nil {
+		return errors.New("stream wasn't written with the Schema option")
+	}
+	// Streams are only read in the current format version.
+	schema := lager.Schema{Version: lager.DescribeTypes().Version, Types: slices.Clone(h.Schema)}
+	slices.SortFunc(schema.Types, func(a, b lager.TypeSchema) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return schema.WriteProto(os.Stdout, *pkg)
+}
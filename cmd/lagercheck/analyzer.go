@@ -0,0 +1,306 @@
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"reflect"
+	"slices"
+	"strings"
+
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/passes/inspect"
+	"golang.org/x/tools/go/ast/inspector"
+	"golang.org/x/tools/go/types/typeutil"
+)
+
+// lagerPath is the import path of the package whose calls are checked.
+const lagerPath = "github.com/lowentropy/go-lager"
+
+// Analyzer reports types written with lager which are never registered.
+var Analyzer = &analysis.Analyzer{
+	Name:      "lagercheck",
+	Doc:       "report types written with lager which are never registered",
+	Requires:  []*analysis.Analyzer{inspect.Analyzer},
+	FactTypes: []analysis.Fact{new(registered)},
+	Run:       run,
+}
+
+// registered is exported for each package which registers types, holding
+// their names, so that the packages importing it know about them.
+type registered struct {
+	Types []string
+}
+
+func (*registered) AFact() {}
+
+func (r *registered) String() string {
+	return "registered(" + strings.Join(r.Types, ", ") + ")"
+}
+
+// written is a value passed to one of the functions which write it.
+type written struct {
+	pos token.Pos
+	t   types.Type
+}
+
+// checker holds the state of one pass.
+type checker struct {
+	pass       *analysis.Pass
+	registered map[string]bool
+	own        []string
+	written    []written
+	reported   map[string]bool
+}
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	c := &checker{
+		pass:       pass,
+		registered: make(map[string]bool),
+		reported:   make(map[string]bool),
+	}
+	for _, fact := range pass.AllPackageFacts() {
+		for _, name := range fact.Fact.(*registered).Types {
+			c.registered[name] = true
+		}
+	}
+	ins := pass.ResultOf[inspect.Analyzer].(*inspector.Inspector)
+	ins.Preorder([]ast.Node{(*ast.CallExpr)(nil)}, func(n ast.Node) {
+		c.call(n.(*ast.CallExpr))
+	})
+	if len(c.own) > 0 {
+		slices.Sort(c.own)
+		pass.ExportPackageFact(&registered{slices.Compact(c.own)})
+	}
+	for _, w := range c.written {
+		c.walk(w.pos, w.t, make(map[string]bool))
+	}
+	return nil, nil
+}
+
+// call records the types written or registered by a call to the lager
+// package.
+func (c *checker) call(call *ast.CallExpr) {
+	fn, ok := typeutil.Callee(c.pass.TypesInfo, call).(*types.Func)
+	if !ok || fn.Pkg() == nil || fn.Pkg().Path() != lagerPath {
+		return
+	}
+	name := fn.Name()
+	if recv := fn.Type().(*types.Signature).Recv(); recv != nil {
+		name = recvName(recv.Type()) + "." + name
+	}
+	args := call.Args
+	if call.Ellipsis.IsValid() {
+		// The values of a spread slice can't be known.
+		args = args[:len(args)-1]
+	}
+	switch name {
+	case "Encoder.Write", "Session.Marshal", "MessageConn.Send", "Marshal", "Hash":
+		c.write(args)
+	case "Encoder.WriteKeyed", "WriteFile":
+		c.write(args[min(1, len(args)):])
+	case "Register", "Registry.Register", "Encoder.Register", "Decoder.Register", "RegisterAll", "Registry.RegisterAll":
+		c.register(args)
+	case "RegisterName", "Registry.RegisterName":
+		c.register(args[min(1, len(args)):])
+	case "RegisterType", "Registry.RegisterType":
+		c.registerReflected(args)
+	case "Registry.RegisterImplementations":
+		c.registerReflected(args[:min(1, len(args))])
+		c.register(args[min(1, len(args)):])
+	case "RegisterInterface":
+		if inst, ok := c.pass.TypesInfo.Instances[calleeIdent(call.Fun)]; ok && inst.TypeArgs.Len() == 1 {
+			c.add(inst.TypeArgs.At(0))
+		}
+		c.register(args)
+	}
+}
+
+// write records the types of the given values as written.
+func (c *checker) write(args []ast.Expr) {
+	for _, arg := range args {
+		if t := c.pass.TypesInfo.TypeOf(arg); t != nil {
+			c.written = append(c.written, written{arg.Pos(), t})
+		}
+	}
+}
+
+// register records the types of the given values as registered.
+func (c *checker) register(args []ast.Expr) {
+	for _, arg := range args {
+		if t := c.pass.TypesInfo.TypeOf(arg); t != nil && !types.IsInterface(t) {
+			c.add(t)
+		}
+	}
+}
+
+// registerReflected records the types described by the given
+// reflect.Type expressions as registered, where they can be worked out.
+func (c *checker) registerReflected(args []ast.Expr) {
+	for _, arg := range args {
+		if t := c.reflected(arg); t != nil {
+			c.add(t)
+		}
+	}
+}
+
+// reflected returns the type described by an expression of the forms
+// reflect.TypeOf(x), reflect.TypeFor[T]() or reflect.TypeOf(p).Elem(), or
+// nil for anything else.
+func (c *checker) reflected(expr ast.Expr) types.Type {
+	call, ok := ast.Unparen(expr).(*ast.CallExpr)
+	if !ok {
+		return nil
+	}
+	if sel, ok := call.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "Elem" && len(call.Args) == 0 {
+		if ptr, ok := c.reflected(sel.X).(*types.Pointer); ok {
+			return ptr.Elem()
+		}
+		return nil
+	}
+	fn, ok := typeutil.Callee(c.pass.TypesInfo, call).(*types.Func)
+	if !ok || fn.Pkg() == nil || fn.Pkg().Path() != "reflect" {
+		return nil
+	}
+	switch fn.Name() {
+	case "TypeOf":
+		if len(call.Args) == 1 {
+			return c.pass.TypesInfo.TypeOf(call.Args[0])
+		}
+	case "TypeFor":
+		if inst, ok := c.pass.TypesInfo.Instances[calleeIdent(call.Fun)]; ok && inst.TypeArgs.Len() == 1 {
+			return inst.TypeArgs.At(0)
+		}
+	}
+	return nil
+}
+
+// add records a type as registered by the package being checked.
+func (c *checker) add(t types.Type) {
+	name := types.TypeString(types.Unalias(t), nil)
+	c.registered[name] = true
+	c.own = append(c.own, name)
+}
+
+// walk checks that a written type and every type reachable from it is
+// registered, following the encoder's rules: defined types need to be
+// registered, apart from interfaces, time.Time and time.Duration, and the
+// fields of structs are followed unless they are excluded from the stream.
+func (c *checker) walk(pos token.Pos, t types.Type, seen map[string]bool) {
+	t = types.Unalias(t)
+	name := types.TypeString(t, nil)
+	if seen[name] {
+		return
+	}
+	seen[name] = true
+	if named, ok := t.(*types.Named); ok && named.Obj().Pkg() != nil && !types.IsInterface(t) {
+		if name == "time.Time" || name == "time.Duration" {
+			return
+		}
+		if !c.registered[name] && !c.reported[name] {
+			c.reported[name] = true
+			c.pass.Reportf(pos, "%s is written with lager but never registered",
+				types.TypeString(t, types.RelativeTo(c.pass.Pkg)))
+		}
+		if isBinary(t) {
+			return
+		}
+	}
+	switch u := t.Underlying().(type) {
+	case *types.Pointer:
+		c.walk(pos, u.Elem(), seen)
+	case *types.Slice:
+		c.walk(pos, u.Elem(), seen)
+	case *types.Array:
+		c.walk(pos, u.Elem(), seen)
+	case *types.Map:
+		c.walk(pos, u.Key(), seen)
+		c.walk(pos, u.Elem(), seen)
+	case *types.Struct:
+		for i := 0; i < u.NumFields(); i++ {
+			if f := u.Field(i); encoded(f, u.Tag(i)) {
+				c.walk(pos, f.Type(), seen)
+			}
+		}
+	case *types.Interface:
+		for _, impl := range c.implementations(t, u) {
+			c.walk(pos, impl, seen)
+		}
+	}
+}
+
+// encoded returns whether a struct field is written by default: it must
+// be exported or tagged `lager:",export"`, and not tagged `lager:"-"`.
+func encoded(f *types.Var, tag string) bool {
+	name, opts, _ := strings.Cut(reflect.StructTag(tag).Get("lager"), ",")
+	if name == "-" && opts == "" {
+		return false
+	}
+	return f.Exported() || slices.Contains(strings.Split(opts, ","), "export")
+}
+
+// implementations returns the types declared in the package being checked,
+// or in the interface's own package, which implement a non-empty interface.
+// Where only the pointer type implements it, that is returned instead.
+func (c *checker) implementations(t types.Type, iface *types.Interface) []types.Type {
+	if iface.NumMethods() == 0 {
+		return nil
+	}
+	pkgs := []*types.Package{c.pass.Pkg}
+	if named, ok := t.(*types.Named); ok && named.Obj().Pkg() != nil && named.Obj().Pkg() != c.pass.Pkg {
+		pkgs = append(pkgs, named.Obj().Pkg())
+	}
+	var impls []types.Type
+	for _, pkg := range pkgs {
+		scope := pkg.Scope()
+		for _, name := range scope.Names() {
+			obj, ok := scope.Lookup(name).(*types.TypeName)
+			if !ok || obj.IsAlias() || types.IsInterface(obj.Type()) {
+				continue
+			}
+			if named, ok := obj.Type().(*types.Named); ok && named.TypeParams().Len() > 0 {
+				continue
+			}
+			if types.Implements(obj.Type(), iface) {
+				impls = append(impls, obj.Type())
+			} else if ptr := types.NewPointer(obj.Type()); types.Implements(ptr, iface) {
+				impls = append(impls, ptr)
+			}
+		}
+	}
+	return impls
+}
+
+// isBinary returns whether a type is encoded using its own MarshalBinary
+// and UnmarshalBinary methods, so that its contents aren't followed.
+func isBinary(t types.Type) bool {
+	ptr := types.NewMethodSet(types.NewPointer(t))
+	return ptr.Lookup(nil, "MarshalBinary") != nil && ptr.Lookup(nil, "UnmarshalBinary") != nil
+}
+
+// recvName returns the name of a method's receiver type.
+func recvName(t types.Type) string {
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	if named, ok := t.(*types.Named); ok {
+		return named.Obj().Name()
+	}
+	return ""
+}
+
+// calleeIdent returns the identifier naming a called function, through
+// any package qualifier and explicit type arguments.
+func calleeIdent(fun ast.Expr) *ast.Ident {
+	switch f := ast.Unparen(fun).(type) {
+	case *ast.Ident:
+		return f
+	case *ast.SelectorExpr:
+		return f.Sel
+	case *ast.IndexExpr:
+		return calleeIdent(f.X)
+	case *ast.IndexListExpr:
+		return calleeIdent(f.X)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+// Command lagercheck reports types which are written with lager but never
+// registered, so that a decoder elsewhere would fail to find them by name.
+//
+// Usage:
+//
+//	lagercheck [packages]
+//
+// A type counts as written when a value of it is passed to Encoder.Write,
+// Encoder.WriteKeyed, Session.Marshal, MessageConn.Send, lager.Marshal,
+// lager.Hash or lager.WriteFile, or is reachable from such a value through
+// pointers, slices, maps and struct fields. A field holding a non-empty
+// interface reaches every type in the package which implements it. Types
+// are registered by passing them to any of the Register functions and
+// methods, in the package writing them or in a package it imports.
+package main
+
+import (
+	"golang.org/x/tools/go/analysis/singlechecker"
+)
+
+func main() {
+	singlechecker.Main(Analyzer)
+}
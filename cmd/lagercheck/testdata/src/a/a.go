@@ -0,0 +1,51 @@
+package a // want package:`registered\(a.Config, a.Drawing, a.ID, a.Square\)`
+
+import (
+	"reflect"
+	"time"
+
+	lager "github.com/lowentropy/go-lager"
+
+	"b"
+)
+
+type ID int64
+
+type Shape interface{ Area() float64 }
+
+type Square struct{ Side float64 }
+
+func (s Square) Area() float64 { return s.Side * s.Side }
+
+type Circle struct{ Radius float64 }
+
+func (c *Circle) Area() float64 { return c.Radius * c.Radius * 3 }
+
+type Drawing struct {
+	Id      ID
+	Shapes  []Shape
+	Created time.Time
+	Shared  *b.Shared
+	Other   map[string]b.Unshared
+	cache   *Cache
+	Skipped Cache `lager:"-"`
+}
+
+type Cache struct{}
+
+type Config struct{ Name string }
+
+type Keyed struct{ Name string }
+
+func init() {
+	lager.RegisterAll(Drawing{}, Square{})
+	lager.RegisterType(reflect.TypeOf(ID(0)))
+	lager.RegisterName("a.config", Config{})
+}
+
+func write(enc *lager.Encoder) {
+	enc.Write(&Drawing{}) // want `Circle is written with lager but never registered` `b.Unshared is written with lager but never registered`
+	enc.Write(Config{})
+	enc.WriteKeyed("keyed", Keyed{}) // want `Keyed is written with lager but never registered`
+	lager.WriteFile("x", 1, "two", []Config{})
+}
@@ -0,0 +1,11 @@
+package b
+
+import lager "github.com/lowentropy/go-lager"
+
+type Shared struct{ N int }
+
+type Unshared struct{ N int }
+
+func init() {
+	lager.Register(Shared{})
+}
@@ -0,0 +1,118 @@
+// Command lagergen writes a file registering every exported type of a
+// package with lager, so that none is forgotten.
+//
+// Usage:
+//
+//	lagergen [-o file] [dir ...]
+//
+// For each package directory given, or the current directory if there are
+// none, lagergen writes an init function registering the package's exported
+// structs, interfaces and other defined types to the named file in that
+// directory, lager_register.go by default. Generic types and aliases are
+// left out, as are test files. It is meant to be run by go generate:
+//
+//	//go:generate lagergen
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+func main() {
+	out := flag.String("o", "lager_register.go", "name of the file to write in each package")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: lagergen [-o file] [dir ...]")
+		os.Exit(2)
+	}
+	flag.Parse()
+	dirs := flag.Args()
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+	for _, dir := range dirs {
+		src, err := generate(dir, *out)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(dir, *out), src, 0o644)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "lagergen:", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// generate returns the source of the file registering the exported types
+// of the package in dir, ignoring the file previously generated there.
+func generate(dir, out string) ([]byte, error) {
+	pkg, err := build.ImportDir(dir, 0)
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	var values, ifaces []string
+	for _, name := range pkg.GoFiles {
+		if name == out {
+			continue
+		}
+		file, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, err
+		}
+		if ast.IsGenerated(file) {
+			continue
+		}
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				ts := spec.(*ast.TypeSpec)
+				if !ts.Name.IsExported() || ts.Assign.IsValid() || ts.TypeParams != nil {
+					continue
+				}
+				switch ts.Type.(type) {
+				case *ast.InterfaceType:
+					ifaces = append(ifaces, ts.Name.Name)
+				case *ast.StructType:
+					values = append(values, ts.Name.Name+"{}")
+				default:
+					values = append(values, "*new("+ts.Name.Name+")")
+				}
+			}
+		}
+	}
+	slices.Sort(values)
+	slices.Sort(ifaces)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by lagergen. DO NOT EDIT.\n\npackage %s\n\n", pkg.Name)
+	if len(ifaces) > 0 {
+		fmt.Fprintf(&buf, "import (\n\t\"reflect\"\n\n\tlager \"github.com/lowentropy/go-lager\"\n)\n\n")
+	} else {
+		fmt.Fprintf(&buf, "import lager \"github.com/lowentropy/go-lager\"\n\n")
+	}
+	fmt.Fprintf(&buf, "func init() {\n")
+	if len(values) > 0 {
+		fmt.Fprintf(&buf, "\tlager.RegisterAll(\n")
+		for _, v := range values {
+			fmt.Fprintf(&buf, "\t\t%s,\n", v)
+		}
+		fmt.Fprintf(&buf, "\t)\n")
+	}
+	for _, iface := range ifaces {
+		fmt.Fprintf(&buf, "\tlager.RegisterType(reflect.TypeOf((*%s)(nil)).Elem())\n", iface)
+	}
+	fmt.Fprintf(&buf, "}\n")
+	return format.Source(buf.Bytes())
+}
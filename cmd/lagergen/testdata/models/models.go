@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+type User struct {
+	Name    string
+	Created time.Time
+}
+
+type ID int64
+
+type Shape interface{ Area() float64 }
+
+type Pair[T any] struct{ A, B T }
+
+type Alias = User
+
+type internal struct{}
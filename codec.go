@@ -0,0 +1,45 @@
+package lager
+
+import (
+	"encoding/binary"
+)
+
+// The wire byte order and integer encodings are defined here, and shared by
+// the encoder and decoder so that the two can't disagree.
+//
+// Fixed-size values are written in little-endian order, whatever the byte
+// order of the platform. Signed integers are zigzag encoded first, so that
+// the low bit holds the sign: 0, -1, 1, -2 are written as 0, 1, 2, 3.
+// Floats are written as their IEEE 754 bits, and booleans as a single byte
+// which is 1 for true.
+
+// byteOrder is the order in which the bytes of fixed-size values are
+// written.
+var byteOrder = binary.LittleEndian
+
+// signed and unsigned are the integer types with a fixed size.
+type (
+	signed interface {
+		int8 | int16 | int32 | int64
+	}
+	unsigned interface {
+		uint8 | uint16 | uint32 | uint64
+	}
+)
+
+// zigzag maps a signed integer to an unsigned one of the same size, with
+// the sign in the low bit.
+func zigzag[U unsigned, S signed](v S) U {
+	if v < 0 {
+		return U(^v<<1) | 1
+	}
+	return U(v << 1)
+}
+
+// unzigzag reverses zigzag.
+func unzigzag[S signed, U unsigned](u U) S {
+	if u&1 != 0 {
+		return ^S(u >> 1)
+	}
+	return S(u >> 1)
+}
@@ -0,0 +1,596 @@
+package lager
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+)
+
+// Concat merges the streams read from the given readers into a single
+// streaming-mode stream written to w, holding the objects of each in
+// order. The streams are copied as they are encoded, so their types don't
+// need to be registered: type ids and pointer reference ids are remapped
+// so that they don't collide, and types used by several of the streams are
+// only defined once. The streams' metadata isn't copied.
+func Concat(w io.Writer, readers ...io.Reader) error {
+	out := newShard(w)
+	for _, r := range readers {
+		out.reset()
+		if err := copyStream(r, func() *shard { return out }); err != nil {
+			return err
+		}
+	}
+	return out.finish()
+}
+
+// Split deals the objects of the stream read from r out to the given
+// writers in turn, so that each receives a streaming-mode stream holding
+// an equal share of them, to within one. Each stream holds only the types
+// and pointers which its own objects need, and none of the stream's
+// metadata. Split does nothing if there are no writers.
+func Split(r io.Reader, ws ...io.Writer) error {
+	if len(ws) == 0 {
+		return nil
+	}
+	shards := make([]*shard, len(ws))
+	for i, w := range ws {
+		shards[i] = newShard(w)
+	}
+	next := 0
+	err := copyStream(r, func() *shard {
+		sh := shards[next]
+		next = (next + 1) % len(shards)
+		return sh
+	})
+	if err != nil {
+		return err
+	}
+	for _, sh := range shards {
+		if err := sh.finish(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// typeKey identifies a type across streams, by its name and fingerprint.
+type typeKey struct {
+	name        string
+	fingerprint uint64
+}
+
+// shard is an output stream of Concat or Split. The type and pointer
+// records needed by each object are collected as it is copied, and sent
+// just before it.
+type shard struct {
+	enc     *Encoder
+	named   map[typeKey]uint
+	typeIds map[uint]uint
+	refs    map[uint]uint
+	types   bytes.Buffer
+	ptrs    bytes.Buffer
+}
+
+func newShard(w io.Writer) *shard {
+	return &shard{
+		enc:     NewEncoderWithOptions(w, EncoderOptions{Streaming: true}),
+		named:   make(map[typeKey]uint),
+		typeIds: make(map[uint]uint),
+		refs:    make(map[uint]uint),
+	}
+}
+
+// reset forgets the ids of the stream being copied, before the next one.
+// Types already defined are still shared with the next stream.
+func (sh *shard) reset() {
+	clear(sh.typeIds)
+	clear(sh.refs)
+}
+
+// send writes the records for an object, and the object itself.
+func (sh *shard) send(object *bytes.Buffer) error {
+	e := sh.enc
+	out := getBuffer()
+	defer putBuffer(out)
+	e.buf, out = out, e.buf
+	defer func() { e.buf = out }()
+	if !e.started {
+		e.writePreamble()
+		e.started = true
+	}
+	e.buf.Write(sh.types.Bytes())
+	e.buf.Write(sh.ptrs.Bytes())
+	e.writeUint8(objectRecord)
+	e.buf.Write(object.Bytes())
+	sh.types.Reset()
+	sh.ptrs.Reset()
+	return e.send(e.buf)
+}
+
+func (sh *shard) finish() error {
+	return sh.enc.finishRecords()
+}
+
+// record writes a type or pointer record into its own buffer, and then
+// appends it to dst. Records needed by the one being written are appended
+// first.
+func (sh *shard) record(dst *bytes.Buffer, write func() error) error {
+	e := sh.enc
+	buf := e.buf
+	e.buf = getBuffer()
+	defer func() {
+		putBuffer(e.buf)
+		e.buf = buf
+	}()
+	if err := write(); err != nil {
+		return err
+	}
+	dst.Write(e.buf.Bytes())
+	return nil
+}
+
+// source is a stream being copied by Concat or Split. Pointer records are
+// kept in a normal form, with plain strings and field names, so that they
+// can be copied into each shard whose objects refer to them.
+type source struct {
+	d    *Decoder
+	ptrs map[uint][]byte
+}
+
+// copier copies encoded values from a source to an encoder's buffer. With
+// a shard, type and reference ids are remapped into the shard, and the
+// records they need are added to it; without one, values are copied into
+// the source's normal form.
+type copier struct {
+	src *source
+	e   *Encoder
+	sh  *shard
+}
+
+// copyStream copies every object of the stream read from r into the shard
+// chosen for it.
+func copyStream(r io.Reader, next func() *shard) (err error) {
+	d := newDecoder(DecoderOptions{})
+	defer d.recoverPanic(&err)
+	d.reader.r.Reset(r)
+	if err := d.readMagic(); err != nil {
+		return err
+	}
+	if d.flags, err = d.readUint16(); err != nil {
+		return err
+	}
+	if d.flags&flagEncrypted != 0 {
+		return WrongKey{}
+	}
+	if err := d.readMetadata(); err != nil {
+		return err
+	}
+	src := &source{d: d, ptrs: make(map[uint][]byte)}
+	if d.flags&flagStreaming != 0 {
+		return src.copyRecords(next)
+	}
+	return src.copyTables(next)
+}
+
+// copyTables copies a stream whose type and pointer tables precede its
+// objects.
+func (src *source) copyTables(next func() *shard) error {
+	d := src.d
+	objects, err := d.readInt()
+	if err != nil {
+		return err
+	}
+	if err := d.readTypeMap(); err != nil {
+		return err
+	}
+	if d.flags&flagFieldIds != 0 {
+		if err := d.readFieldTable(); err != nil {
+			return err
+		}
+	}
+	if d.flags&flagStringIds != 0 {
+		if err := d.readStringTable(); err != nil {
+			return err
+		}
+	}
+	n, err := d.readInt()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if err := src.readPtr(); err != nil {
+			return err
+		}
+	}
+	if d.flags&flagChecksums != 0 {
+		if err := d.verifyChecksum(d.reader.record, "header"); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < objects; i++ {
+		d.reader.record = 0
+		if err := src.copyObject(next()); err != nil {
+			return err
+		}
+	}
+	if d.flags&flagChecksums != 0 {
+		return d.verifyChecksum(d.reader.stream, "stream")
+	}
+	return nil
+}
+
+// copyRecords copies a streaming-mode stream. Any footer is ignored.
+func (src *source) copyRecords(next func() *shard) error {
+	d := src.d
+	if err := d.readPreambleChecksum(); err != nil {
+		return err
+	}
+	d.reader.record = 0
+	for {
+		tag, err := d.readUint8()
+		if err != nil {
+			return err
+		}
+		switch tag {
+		case typeRecord:
+			err = d.readTypeEntry()
+		case pointerRecord:
+			err = src.readPtr()
+		case fieldRecord:
+			err = d.readFieldEntry()
+		case stringRecord:
+			err = d.readStringEntry()
+		case markerRecord:
+			err = d.readMarker()
+		case objectRecord:
+			err = src.copyObject(next())
+			d.reader.record = 0
+		case endRecord:
+			if d.flags&flagChecksums != 0 {
+				return d.verifyChecksum(d.reader.stream, "stream")
+			}
+			return nil
+		default:
+			return UnknownRecord{tag}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readPtr reads a pointer record, and keeps its type and value in normal
+// form.
+func (src *source) readPtr() error {
+	ref, err := src.d.readUint()
+	if err != nil {
+		return err
+	}
+	c := copier{src: src, e: NewEncoder(nil)}
+	if err := c.copyElem(); err != nil {
+		return err
+	}
+	src.ptrs[ref] = c.e.buf.Bytes()
+	return nil
+}
+
+// copyObject copies the next object into a shard, and sends it.
+func (src *source) copyObject(sh *shard) error {
+	object := getBuffer()
+	defer putBuffer(object)
+	buf := sh.enc.buf
+	sh.enc.buf = object
+	c := copier{src: src, e: sh.enc, sh: sh}
+	err := c.copyElem()
+	sh.enc.buf = buf
+	if err != nil {
+		return err
+	}
+	if src.d.flags&flagChecksums != 0 {
+		if err := src.d.verifyChecksum(src.d.reader.record, "object"); err != nil {
+			return err
+		}
+	}
+	return sh.send(object)
+}
+
+// copyElem copies a type, and a value of that type.
+func (c copier) copyElem() error {
+	wt, err := c.src.d.readWireType()
+	if err != nil {
+		return err
+	}
+	if err := c.copyType(wt); err != nil {
+		return err
+	}
+	return c.copyValue(wt)
+}
+
+// copyType writes a type read from the source.
+func (c copier) copyType(wt *wireType) error {
+	c.e.writeUint8(uint8(wt.kind))
+	switch wt.kind {
+	case reflect.Map:
+		if err := c.copyType(wt.key); err != nil {
+			return err
+		}
+		return c.copyType(wt.elem)
+	case reflect.Ptr, reflect.Slice, typedNilKind:
+		return c.copyType(wt.elem)
+	case reflect.Struct, reflect.Interface, binaryKind, namedKind, codecKind:
+		id, err := c.typeId(wt.id)
+		if err != nil {
+			return err
+		}
+		c.e.writeUint(id)
+		if wt.kind == namedKind {
+			return c.copyType(wt.elem)
+		}
+	}
+	return nil
+}
+
+// copyValue copies a value of the given type, as skip reads past one.
+func (c copier) copyValue(wt *wireType) error {
+	d, e := c.src.d, c.e
+	defer d.leave()
+	if err := d.enter(); err != nil {
+		return err
+	}
+	if isExtension(wt.kind) {
+		return c.copyCustom()
+	}
+	switch wt.kind {
+	case nilKind, typedNilKind:
+		return nil
+	case reflect.Bool, reflect.Int8, reflect.Uint8:
+		return c.copyBytes(1)
+	case reflect.Int16, reflect.Uint16:
+		return c.copyBytes(2)
+	case reflect.Int32, reflect.Uint32, reflect.Float32:
+		return c.copyBytes(4)
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64, reflect.Uintptr,
+		reflect.Float64, reflect.Complex64, durationKind:
+		return c.copyBytes(8)
+	case reflect.Complex128:
+		return c.copyBytes(16)
+	case reflect.Ptr:
+		return c.copyRef()
+	case reflect.String:
+		s, err := d.readStringValue()
+		e.writeString(s)
+		return err
+	case binaryKind, bigIntKind, bigFloatKind, bigRatKind:
+		data, err := d.readBytes()
+		e.writeBytes(data)
+		return err
+	case timeKind:
+		if err := c.copyBytes(12); err != nil {
+			return err
+		}
+		zone, err := d.readString()
+		if err != nil {
+			return err
+		}
+		e.writeString(zone)
+		return c.copyBytes(4)
+	case namedKind:
+		return c.copyValue(wt.elem)
+	case reflect.Interface:
+		return c.copyElem()
+	case codecKind:
+		return c.copyCustom()
+	case errorKind:
+		msg, err := d.readString()
+		if err != nil {
+			return err
+		}
+		e.writeString(msg)
+		hasValue, err := d.readBool()
+		if err != nil {
+			return err
+		}
+		e.writeBool(hasValue)
+		if hasValue {
+			return c.copyElem()
+		}
+		return nil
+	case reflect.Map, reflect.Slice:
+		var n, capacity int
+		var err error
+		if wt.kind == reflect.Map {
+			n, err = d.readMapLength()
+			capacity = n
+		} else {
+			n, capacity, err = d.readSliceCap()
+		}
+		if err != nil {
+			return err
+		}
+		if capacity > n {
+			e.writeInt(cappedLength)
+			e.writeInt(capacity)
+		}
+		e.writeInt(n)
+		if n == sharedLength && wt.kind == reflect.Map {
+			return c.copyRef()
+		}
+		if n == sharedLength {
+			return c.copyShared()
+		}
+		for i := 0; i < n; i++ {
+			if wt.kind == reflect.Map {
+				if err := c.copyValue(wt.key); err != nil {
+					return err
+				}
+			}
+			if err := c.copyValue(wt.elem); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Struct:
+		n, err := d.readLength()
+		if err != nil {
+			return err
+		}
+		e.writeInt(n)
+		for i := 0; i < n; i++ {
+			name, err := d.readFieldName()
+			if err != nil {
+				return err
+			}
+			e.writeString(name)
+			if err := c.copyElem(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return UnsupportedRead{wt.kind}
+}
+
+// copyCustom copies a value written by a codec, which needn't be
+// registered to be copied.
+func (c copier) copyCustom() error {
+	n, err := c.src.d.readLength()
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return CorruptStream{"codec"}
+	}
+	c.e.writeInt(n)
+	for i := 0; i < n; i++ {
+		if err := c.copyElem(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyRef copies the reference id of a pointer, or of a map which
+// contains itself.
+func (c copier) copyRef() error {
+	ref, err := c.src.d.readUint()
+	if err != nil {
+		return err
+	}
+	if ref, err = c.ref(ref); err != nil {
+		return err
+	}
+	c.e.writeUint(ref)
+	return nil
+}
+
+// copyShared copies the rest of a slice sharing its backing array,
+// with the array's reference id remapped.
+func (c copier) copyShared() error {
+	ref, n, offset, length, err := c.src.d.readSharedHeader()
+	if err != nil {
+		return err
+	}
+	if ref, err = c.ref(ref); err != nil {
+		return err
+	}
+	c.e.writeUint(ref)
+	c.e.writeInt(n)
+	c.e.writeInt(offset)
+	c.e.writeInt(length)
+	return nil
+}
+
+// copyBytes copies the given number of bytes as they are.
+func (c copier) copyBytes(n int) error {
+	buf := c.e.word[:n]
+	if n > len(c.e.word) {
+		buf = make([]byte, n)
+	}
+	if _, err := c.src.d.reader.Read(buf); err != nil {
+		return err
+	}
+	c.e.buf.Write(buf)
+	return nil
+}
+
+// typeId returns the id in the shard of a type in the source, defining it
+// in the shard if this is its first use there.
+func (c copier) typeId(id uint) (uint, error) {
+	sh := c.sh
+	if sh == nil {
+		return id, nil
+	}
+	if out, ok := sh.typeIds[id]; ok {
+		return out, nil
+	}
+	d := c.src.d
+	name, ok := d.typeNames[id]
+	if !ok {
+		return 0, MissingTypeId{id}
+	}
+	key := typeKey{name, d.fingerprints[id]}
+	if out, ok := sh.named[key]; ok {
+		sh.typeIds[id] = out
+		return out, nil
+	}
+	out := sh.enc.nextId
+	sh.enc.nextId++
+	sh.typeIds[id] = out
+	sh.named[key] = out
+	return out, sh.record(&sh.types, func() error {
+		e := sh.enc
+		e.writeUint8(typeRecord)
+		e.writeString(name)
+		e.writeUint(out)
+		e.writeUint64(key.fingerprint)
+		e.writeInt(d.versions[name])
+		fields, ok := d.structures[id]
+		e.writeBool(ok)
+		if !ok {
+			return nil
+		}
+		e.writeInt(len(fields))
+		for _, f := range fields {
+			e.writeString(f.name)
+			if err := c.copyType(f.typ); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ref returns the reference id in the shard of a pointer in the source,
+// adding its record to the shard if this is its first use there.
+func (c copier) ref(ref uint) (uint, error) {
+	sh := c.sh
+	if sh == nil || ref == nilRef {
+		return ref, nil
+	}
+	if out, ok := sh.refs[ref]; ok {
+		return out, nil
+	}
+	data, ok := c.src.ptrs[ref]
+	if !ok {
+		return 0, MissingPointer{ref}
+	}
+	out := sh.enc.nextRef
+	sh.enc.nextRef++
+	sh.refs[ref] = out
+	return out, sh.record(&sh.ptrs, func() error {
+		sh.enc.writeUint8(pointerRecord)
+		sh.enc.writeUint(out)
+		return c.src.normal(data, c.copyElem)
+	})
+}
+
+// normal runs f with the source reading the given data in normal form.
+func (src *source) normal(data []byte, f func() error) error {
+	d := src.d
+	reader, flags := d.reader, d.flags
+	defer func() { d.reader, d.flags = reader, flags }()
+	d.reader = &checksumReader{r: bufio.NewReader(bytes.NewReader(data))}
+	d.flags = 0
+	return f()
+}
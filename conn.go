@@ -0,0 +1,102 @@
+package lager
+
+import (
+	"io"
+	"net"
+	"slices"
+)
+
+// MessageConn exchanges values over a network connection, as the messages
+// of a Session, each framed by its length. Each type is only described
+// once per connection.
+//
+// Send and Receive may be called concurrently with each other, but not
+// with themselves.
+type MessageConn struct {
+	conn    net.Conn
+	session *Session
+
+	// The frame being received is kept between calls to Receive, so that
+	// one interrupted by a timeout or deadline can be resumed.
+	head  [4]byte
+	got   int
+	frame []byte
+}
+
+// NewMessageConn returns a MessageConn using the given connection, which
+// uses the global registry.
+func NewMessageConn(conn net.Conn) *MessageConn {
+	return NewMessageConnWithOptions(conn, EncoderOptions{}, DecoderOptions{})
+}
+
+// NewMessageConnWithOptions returns a MessageConn using the given
+// connection, whose session uses the given options.
+func NewMessageConnWithOptions(conn net.Conn, encOpts EncoderOptions, decOpts DecoderOptions) *MessageConn {
+	return &MessageConn{conn: conn, session: NewSessionWithOptions(encOpts, decOpts)}
+}
+
+// Send writes a value to the connection as a single message.
+func (c *MessageConn) Send(value interface{}) error {
+	data, err := c.session.Marshal(value)
+	if err != nil {
+		return err
+	}
+	frame := byteOrder.AppendUint32(make([]byte, 0, 4+len(data)), uint32(len(data)))
+	_, err = c.conn.Write(append(frame, data...))
+	return err
+}
+
+// Receive reads the next message from the connection, and returns the
+// value it holds. If the connection fails before the whole message has
+// arrived, for instance because its read deadline passed, the part read
+// so far is kept, and the next call to Receive resumes reading it. It
+// returns io.EOF once the connection is closed between messages.
+func (c *MessageConn) Receive() (interface{}, error) {
+	if err := c.readFrame(); err != nil {
+		return nil, err
+	}
+	return c.session.read(c.frame)
+}
+
+// readFrame reads the next whole message into c.frame, continuing from
+// any part of it read by an earlier call.
+func (c *MessageConn) readFrame() error {
+	for c.got < len(c.head) {
+		n, err := c.conn.Read(c.head[c.got:])
+		c.got += n
+		if c.got == len(c.head) {
+			c.frame = c.frame[:0]
+			break
+		}
+		if err == io.EOF && c.got > 0 {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	size := int(byteOrder.Uint32(c.head[:]))
+	for len(c.frame) < size {
+		if len(c.frame) == cap(c.frame) {
+			c.frame = slices.Grow(c.frame, preallocLength(size-len(c.frame), 1))
+		}
+		n, err := c.conn.Read(c.frame[len(c.frame):min(size, cap(c.frame))])
+		c.frame = c.frame[:len(c.frame)+n]
+		if len(c.frame) == size {
+			break
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	c.got = 0
+	return nil
+}
+
+// Close closes the connection.
+func (c *MessageConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,40 @@
+package lager
+
+import (
+	"context"
+)
+
+// contextInterval is how many elements of a map or slice are encoded or
+// decoded between checks for cancellation.
+const contextInterval = 1024
+
+// WriteContext is like Write, but gives up with the context's error if it
+// is cancelled before or while the object is encoded.
+func (e *Encoder) WriteContext(ctx context.Context, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	e.ctx = ctx
+	defer func() { e.ctx = nil }()
+	return e.Write(value)
+}
+
+// ReadContext is like Read, but gives up with the context's error if it
+// is cancelled before or while the object is decoded.
+func (d *Decoder) ReadContext(ctx context.Context) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d.ctx = ctx
+	defer func() { d.ctx = nil }()
+	return d.Read()
+}
+
+// checkContext returns the error of the given context, if any, once in
+// every contextInterval calls with successive values of i.
+func checkContext(ctx context.Context, i int) error {
+	if ctx == nil || i%contextInterval != 0 {
+		return nil
+	}
+	return ctx.Err()
+}
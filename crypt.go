@@ -0,0 +1,271 @@
+package lager
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+)
+
+// An encrypted stream begins with an envelope: the magic sequence, format
+// version, flagEncrypted, the id of the key and a random nonce prefix. The
+// rest is an ordinary stream, split into chunks which are each sealed with
+// AES-GCM. Every chunk holds chunkSize bytes of the inner stream except the
+// last, which holds fewer, and possibly none. Each chunk's nonce is the
+// prefix followed by its index, and the envelope and whether the chunk is
+// the last one are authenticated with it, so that chunks can't be
+// reordered, dropped or truncated without detection. Because every chunk
+// has the same size, a decoder can seek within the inner stream by
+// decrypting only the chunks it needs.
+const (
+	chunkSize    = 64 << 10
+	sealedChunk  = chunkSize + 16
+	envelopeSize = len(magic) + 3 + 8 + 8
+)
+
+// keyId identifies an encryption key without revealing it, so that a
+// decoder given the wrong key can say so rather than failing to decrypt.
+func keyId(key []byte) uint64 {
+	sum := sha256.Sum256(key)
+	return byteOrder.Uint64(sum[:])
+}
+
+// envelope returns the envelope of an encrypted stream.
+func envelope(id uint64, prefix [8]byte) []byte {
+	buf := make([]byte, 0, envelopeSize)
+	buf = append(buf, magic[:]...)
+	buf = append(buf, formatVersion)
+	buf = byteOrder.AppendUint16(buf, flagEncrypted)
+	buf = byteOrder.AppendUint64(buf, id)
+	return append(buf, prefix[:]...)
+}
+
+// chunkNonce returns the nonce of the i'th chunk.
+func chunkNonce(prefix [8]byte, i int64) []byte {
+	return byteOrder.AppendUint32(append(make([]byte, 0, 12), prefix[:]...), uint32(i))
+}
+
+// chunkData returns the additional data authenticated with a chunk.
+func chunkData(header []byte, last bool) []byte {
+	data := append(make([]byte, 0, len(header)+1), header...)
+	if last {
+		return append(data, 1)
+	}
+	return append(data, 0)
+}
+
+// sealedWriter encrypts the stream written to it. Errors are sticky.
+type sealedWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	prefix [8]byte
+	index  int64
+	buf    []byte
+	out    []byte
+	err    error
+}
+
+func newSealedWriter(w io.Writer, key []byte) *sealedWriter {
+	s := &sealedWriter{w: w}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		s.err = err
+		return s
+	}
+	if s.aead, s.err = cipher.NewGCM(block); s.err != nil {
+		return s
+	}
+	if _, s.err = rand.Read(s.prefix[:]); s.err != nil {
+		return s
+	}
+	s.header = envelope(keyId(key), s.prefix)
+	return s
+}
+
+// Write buffers the given bytes, and seals each chunk once it's full.
+func (s *sealedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for s.err == nil && len(p) > 0 {
+		if s.buf == nil {
+			s.buf = make([]byte, 0, chunkSize)
+		}
+		n := copy(s.buf[len(s.buf):chunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+		if len(s.buf) == chunkSize {
+			s.seal(false)
+		}
+	}
+	return written, s.err
+}
+
+// Close seals the last chunk, which ends the stream.
+func (s *sealedWriter) Close() error {
+	if s.err == nil {
+		s.seal(true)
+	}
+	return s.err
+}
+
+func (s *sealedWriter) seal(last bool) {
+	if s.index == 0 {
+		if _, s.err = s.w.Write(s.header); s.err != nil {
+			return
+		}
+	}
+	s.out = s.aead.Seal(s.out[:0], chunkNonce(s.prefix, s.index), s.buf, chunkData(s.header, last))
+	s.index++
+	s.buf = s.buf[:0]
+	_, s.err = s.w.Write(s.out)
+}
+
+// sealedReader decrypts an encrypted stream, one chunk at a time. Its
+// source is read sequentially, unless it's seekable, in which case chunks
+// are read wherever they are needed.
+type sealedReader struct {
+	aead   cipher.AEAD
+	header []byte
+	prefix [8]byte
+	r      io.Reader
+	rs     io.ReadSeeker
+	pos    int64
+	index  int64
+	last   bool
+	plain  []byte
+	sealed []byte
+}
+
+// sealedFile is a sealedReader whose source is seekable, so that it can
+// be used for streams with footers and indexes.
+type sealedFile struct {
+	*sealedReader
+}
+
+// unseal reads the rest of the envelope of an encrypted stream, whose
+// magic sequence, version and flags have been read from r, and returns
+// a reader for the stream inside it.
+func (d *Decoder) unseal(r io.Reader) (io.Reader, error) {
+	id, err := d.readUint64()
+	if err != nil {
+		return nil, err
+	}
+	s := &sealedReader{r: d.reader.r, index: -1}
+	if _, err := d.reader.Read(s.prefix[:]); err != nil {
+		return nil, err
+	}
+	if d.opts.EncryptionKey == nil || keyId(d.opts.EncryptionKey) != id {
+		return nil, WrongKey{}
+	}
+	block, err := aes.NewCipher(d.opts.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if s.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	s.header = envelope(id, s.prefix)
+	d.encrypted = true
+	d.reader = &checksumReader{r: bufio.NewReader(s)}
+	if rs, ok := r.(io.ReadSeeker); ok {
+		s.rs = rs
+		return sealedFile{s}, nil
+	}
+	return s, nil
+}
+
+// load decrypts the i'th chunk, unless it's the one already held.
+func (s *sealedReader) load(i int64) error {
+	if i == s.index {
+		return nil
+	}
+	r := s.r
+	if s.rs != nil {
+		if _, err := s.rs.Seek(int64(envelopeSize)+i*sealedChunk, io.SeekStart); err != nil {
+			return err
+		}
+		r = s.rs
+	} else if i != s.index+1 {
+		return CorruptStream{"encryption"}
+	}
+	if s.sealed == nil {
+		s.sealed = make([]byte, sealedChunk)
+	}
+	n, err := io.ReadFull(r, s.sealed)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := n < sealedChunk
+	s.plain, err = s.aead.Open(s.plain[:0], chunkNonce(s.prefix, i), s.sealed[:n], chunkData(s.header, last))
+	if err != nil {
+		s.index = -1
+		return CorruptStream{"encryption"}
+	}
+	s.index, s.last = i, last
+	return nil
+}
+
+func (s *sealedReader) Read(p []byte) (int, error) {
+	i, off := s.pos/chunkSize, int(s.pos%chunkSize)
+	if s.last && i >= s.index {
+		if i > s.index || off >= len(s.plain) {
+			return 0, io.EOF
+		}
+	} else if err := s.load(i); err != nil {
+		return 0, err
+	}
+	if off >= len(s.plain) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.plain[off:])
+	s.pos += int64(n)
+	return n, nil
+}
+
+// Seek sets the position in the decrypted stream. The size of the stream
+// is worked out from the size of the source.
+func (s sealedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		end, err := s.rs.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		size := end - int64(envelopeSize)
+		rem := size % sealedChunk
+		if size < 0 || rem < sealedChunk-chunkSize {
+			return 0, CorruptStream{"encryption"}
+		}
+		offset += size/sealedChunk*chunkSize + rem - (sealedChunk - chunkSize)
+	}
+	if offset < 0 {
+		return 0, CorruptStream{"offset"}
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+// ReadAt reads from the given position in the decrypted stream, without
+// moving the position Read continues from.
+func (s sealedFile) ReadAt(p []byte, offset int64) (int, error) {
+	pos := s.pos
+	defer func() { s.pos = pos }()
+	s.pos = offset
+	n := 0
+	for n < len(p) {
+		m, err := s.Read(p[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,325 @@
+package lager
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// ToCSV converts a lager stream of records, read from r, into CSV written
+// to w, for loading into analytics tools, without needing the records'
+// type to be registered. Every object in the stream must be a struct of
+// the same type, or ToCSV fails with NotRecords. The first line names the
+// columns, and each object is a line after it:
+//
+//   - Each field is a column named after it, and the fields of structs
+//     held in fields are columns of their own, named by their paths, as in
+//     "Address.City".
+//   - Strings are written as they are, numbers and booleans as by the
+//     strconv package, the numbers of math/big as their text, durations as
+//     nanoseconds, times in RFC 3339 format, and byte slices and types with
+//     their own binary encoding as base64.
+//   - Pointers to basic values are written as the values, and nil values
+//     of any kind as empty cells.
+//   - Slices, maps and pointers to other values are written as JSON, in the
+//     form written by ToJSON.
+//
+// Columns are in the order their fields were first seen. Fields left out
+// of some objects, by the OmitZero option or when structs of different
+// types are held in the same interface field, are empty where they're
+// missing. The columns of every object are found before the first line is
+// written, by reading the stream twice if r is an io.ReadSeeker, and
+// otherwise by keeping every line in memory until the end.
+func ToCSV(r io.Reader, w io.Writer) error {
+	c := &csvExporter{columns: make(map[string]int)}
+	var rows []map[string]string
+	s, seekable := r.(io.ReadSeeker)
+	var start int64
+	if seekable {
+		var err error
+		if start, err = s.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+	err := c.read(r, func(row map[string]string) error {
+		if !seekable {
+			rows = append(rows, row)
+		}
+		return nil
+	})
+	if err != nil || len(c.names) == 0 {
+		return err
+	}
+
+	out := csv.NewWriter(w)
+	out.Write(c.names)
+	line := make([]string, len(c.names))
+	write := func(row map[string]string) error {
+		for i, name := range c.names {
+			line[i] = row[name]
+		}
+		return out.Write(line)
+	}
+	if seekable {
+		if _, err := s.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		err = c.read(r, write)
+	} else {
+		for _, row := range rows {
+			if err = write(row); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// csvExporter reads the records of a stream for ToCSV, as rows keyed by
+// column name, and collects the names of the columns.
+type csvExporter struct {
+	*objectTokens
+	typ     string
+	names   []string
+	columns map[string]int
+
+	// values holds the value of each pointer written as JSON, decoded from
+	// its tokens where first needed.
+	values map[uint]*interface{}
+}
+
+// read calls row with each record of the stream read from r.
+func (c *csvExporter) read(r io.Reader, row func(map[string]string) error) error {
+	o, err := newObjectTokens(r)
+	if err != nil {
+		return err
+	}
+	c.objectTokens = o
+	c.values = make(map[uint]*interface{})
+	for {
+		tok, err := o.next()
+		if err == (EndOfStream{}) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		s, ok := tok.(StartStruct)
+		if !ok {
+			return NotRecords{csvTypeName(tok)}
+		}
+		if c.typ == "" {
+			c.typ = s.Type
+		} else if s.Type != c.typ {
+			return NotRecords{s.Type}
+		}
+		cells := make(map[string]string)
+		if err := c.fields("", cells, o.d.Token); err != nil {
+			return withRootName(err, s.Type)
+		}
+		if err := row(cells); err != nil {
+			return err
+		}
+	}
+}
+
+// fields adds the fields of a struct to a row, as the columns under the
+// given prefix.
+func (c *csvExporter) fields(prefix string, row map[string]string, next tokenSource) error {
+	for {
+		tok, err := next()
+		if err != nil {
+			return err
+		}
+		if _, ok := tok.(EndStruct); ok {
+			return nil
+		}
+		name, ok := tok.(Field)
+		if !ok {
+			return CorruptStream{"token"}
+		}
+		column := prefix + string(name)
+		if tok, err = next(); err != nil {
+			return err
+		}
+		if _, ok := tok.(StartStruct); ok {
+			if err := c.fields(column+".", row, next); err != nil {
+				return err
+			}
+			continue
+		}
+		cell, err := c.cell(tok, next)
+		if err != nil {
+			return withPath(err, "."+column)
+		}
+		if _, ok := c.columns[column]; !ok {
+			c.columns[column] = len(c.names)
+			c.names = append(c.names, column)
+		}
+		row[column] = cell
+	}
+}
+
+// cell returns the text of the value begun by tok.
+func (c *csvExporter) cell(tok Token, next tokenSource) (string, error) {
+	switch v := tok.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v), nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case complex64:
+		return strconv.FormatComplex(complex128(v), 'g', -1, 64), nil
+	case complex128:
+		return strconv.FormatComplex(v, 'g', -1, 128), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case Ref:
+		if first, _, err := c.ptr(uint(v)); err != nil {
+			return "", err
+		} else if csvBasic(first) {
+			return c.cell(first, nil)
+		}
+	case StartStruct, StartSlice, StartMap:
+	default:
+		if text, ok := bigText(tok); ok {
+			return text, nil
+		}
+		rv := reflect.ValueOf(tok)
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return strconv.FormatInt(rv.Int(), 10), nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return strconv.FormatUint(rv.Uint(), 10), nil
+		}
+		return "", CorruptStream{"token"}
+	}
+	value, err := c.generic(tok, next)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(jsonConverter{make(map[*interface{}]int)}.convert(value))
+	return string(data), err
+}
+
+// generic returns the value begun by tok as a generic value, as ToJSON
+// converts them, with pointers as *interface{}.
+func (c *csvExporter) generic(tok Token, next tokenSource) (interface{}, error) {
+	switch v := tok.(type) {
+	case StartStruct:
+		m := make(map[string]interface{})
+		for {
+			tok, err := next()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := tok.(EndStruct); ok {
+				return m, nil
+			}
+			name, ok := tok.(Field)
+			if !ok {
+				return nil, CorruptStream{"token"}
+			}
+			if tok, err = next(); err == nil {
+				m[string(name)], err = c.generic(tok, next)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	case StartSlice:
+		s := make([]interface{}, v.Len)
+		for i := range s {
+			tok, err := next()
+			if err == nil {
+				s[i], err = c.generic(tok, next)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return s, csvEnd(EndSlice{}, next)
+	case StartMap:
+		m := make(map[interface{}]interface{}, v.Len)
+		for i := 0; i < v.Len; i++ {
+			tok, err := next()
+			if err != nil {
+				return nil, err
+			}
+			key, err := c.generic(tok, next)
+			if err == nil {
+				tok, err = next()
+			}
+			if err == nil {
+				m[key], err = c.generic(tok, next)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return m, csvEnd(EndMap{}, next)
+	case Ref:
+		if p, ok := c.values[uint(v)]; ok {
+			return p, nil
+		}
+		first, rest, err := c.ptr(uint(v))
+		if err != nil {
+			return nil, err
+		}
+		p := new(interface{})
+		c.values[uint(v)] = p
+		*p, err = c.generic(first, rest)
+		return p, err
+	}
+	return tok, nil
+}
+
+// csvEnd reads the token ending a slice or map.
+func csvEnd(end Token, next tokenSource) error {
+	tok, err := next()
+	if err == nil && tok != end {
+		err = CorruptStream{"token"}
+	}
+	return err
+}
+
+// csvBasic returns whether a token is a basic value, written to a cell as
+// it is.
+func csvBasic(tok Token) bool {
+	switch tok.(type) {
+	case nil, StartStruct, StartSlice, StartMap, Ref:
+		return false
+	}
+	return true
+}
+
+// csvTypeName returns the name of the type of an object which isn't a
+// struct, for NotRecords.
+func csvTypeName(tok Token) string {
+	switch v := tok.(type) {
+	case nil:
+		return "nil"
+	case StartSlice:
+		return "[]" + v.Elem
+	case StartMap:
+		return "map[" + v.Key + "]" + v.Elem
+	case Ref:
+		return "pointer"
+	}
+	return fmt.Sprintf("%T", tok)
+}
@@ -0,0 +1,267 @@
+package lager
+
+import (
+	"reflect"
+	"strconv"
+)
+
+// customCodec is a pair of functions registered with RegisterCodec, and
+// the wire kind its values are written with: codecKind, or an extension
+// kind once it's given an id with RegisterExtension.
+type customCodec struct {
+	enc  func(*Encoder, interface{}) error
+	dec  func(*Decoder) (interface{}, error)
+	kind reflect.Kind
+}
+
+// RegisterCodec registers functions encoding and decoding the given type
+// in the global registry, as Registry.RegisterCodec does.
+func RegisterCodec(t reflect.Type, enc func(*Encoder, interface{}) error, dec func(*Decoder) (interface{}, error)) {
+	defaultRegistry.RegisterCodec(t, enc, dec)
+}
+
+// RegisterCodec registers the given type along with functions encoding
+// and decoding it, which are used for its values in place of reflection,
+// so that types from other packages which can't be encoded as they are,
+// such as those with unexported fields, needn't be wrapped. The encoder
+// calls enc with each value of the type, which writes it as any number of
+// values of other types with Encoder.EncodeValue. The decoder calls dec,
+// which reads them back with Decoder.DecodeValue and returns the value, a
+// pointer to it, or nil for its zero value. Values which dec doesn't read
+// are skipped.
+func (r *Registry) RegisterCodec(t reflect.Type, enc func(*Encoder, interface{}) error, dec func(*Decoder) (interface{}, error)) {
+	r.lock()
+	defer r.mu.Unlock()
+	r.registerType(t)
+	kind := codecKind
+	if c, ok := r.codecs[t]; ok {
+		kind = c.kind
+	}
+	r.codecs[t] = customCodec{enc, dec, kind}
+	r.hasCodecs.Store(true)
+}
+
+// RegisterExtension gives an id to a type registered with RegisterCodec
+// in the global registry, as Registry.RegisterExtension does.
+func RegisterExtension(id uint8, t reflect.Type) error {
+	return defaultRegistry.RegisterExtension(id, t)
+}
+
+// RegisterExtension gives the type's codec, which must be registered with
+// RegisterCodec in the same registry, an extension id up to MaxExtensionId.
+// Its values are then written under that id instead of the type's name,
+// so that a stream's own format describes them, and decoders which don't
+// have the extension registered fail with UnknownExtension rather than
+// reading them as something else. Each id can only be given to one type,
+// and each type only one id; otherwise it fails with InvalidExtension.
+func (r *Registry) RegisterExtension(id uint8, t reflect.Type) error {
+	r.lock()
+	defer r.mu.Unlock()
+	kind := extensionKind + reflect.Kind(id)
+	c, ok := r.codecs[t]
+	if id > MaxExtensionId || !ok || c.kind != codecKind && c.kind != kind {
+		return InvalidExtension{id, t}
+	}
+	if other, ok := r.extensions[kind]; ok && other != t {
+		return InvalidExtension{id, t}
+	}
+	c.kind = kind
+	r.codecs[t] = c
+	r.extensions[kind] = t
+	return nil
+}
+
+// lookupCodec finds the codec registered for a type, falling back to the
+// global registry. Registries without codecs aren't locked.
+func lookupCodec(r *Registry, t reflect.Type) (customCodec, bool) {
+	for _, reg := range []*Registry{r, defaultRegistry} {
+		if reg == nil || !reg.hasCodecs.Load() {
+			continue
+		}
+		unlock := reg.rlock()
+		c, ok := reg.codecs[t]
+		unlock()
+		if ok {
+			return c, true
+		}
+	}
+	return customCodec{}, false
+}
+
+// lookupExtension finds the type given an extension kind, falling back to
+// the global registry.
+func lookupExtension(r *Registry, kind reflect.Kind) (reflect.Type, bool) {
+	for _, reg := range []*Registry{r, defaultRegistry} {
+		if reg == nil || !reg.hasCodecs.Load() {
+			continue
+		}
+		unlock := reg.rlock()
+		t, ok := reg.extensions[kind]
+		unlock()
+		if ok {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// isExtension returns whether a wire kind is one reserved for extensions.
+func isExtension(kind reflect.Kind) bool {
+	return kind >= extensionKind
+}
+
+// EncodeValue writes a value, preceded by its type, as part of the value
+// being written by a codec registered with RegisterCodec. It can only be
+// called by the codec's encoding function, and fails with OutsideCodec
+// otherwise.
+func (e *Encoder) EncodeValue(v interface{}) error {
+	if e.parts == nil {
+		return OutsideCodec{}
+	}
+	*e.parts = append(*e.parts, v)
+	return nil
+}
+
+// writeCustom writes a value with its registered codec, as the number of
+// values the codec gave and each of those values with its type.
+func (e *Encoder) writeCustom(c customCodec, w reflect.Value) error {
+	var parts []interface{}
+	outer := e.parts
+	e.parts = &parts
+	err := c.enc(e, w.Interface())
+	e.parts = outer
+	if err != nil {
+		return err
+	}
+	e.writeInt(len(parts))
+	for i, part := range parts {
+		if err := e.write(reflect.ValueOf(part), true); err != nil {
+			return withFieldPath(err, "["+strconv.Itoa(i)+"]")
+		}
+	}
+	return nil
+}
+
+// DecodeValue reads the next of the values making up the value being read
+// by a codec registered with RegisterCodec, as written by EncodeValue. It
+// can only be called by the codec's decoding function, and fails with
+// OutsideCodec otherwise, or with CorruptStream once every value has been
+// read.
+func (d *Decoder) DecodeValue() (interface{}, error) {
+	if d.parts == nil {
+		return nil, OutsideCodec{}
+	}
+	if *d.parts == 0 {
+		return nil, CorruptStream{"codec"}
+	}
+	*d.parts--
+	v := reflect.New(emptyInterfaceType).Elem()
+	if err := d.readValue(v); err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
+}
+
+// readCustom reads a value with its registered codec into v, skipping any
+// of the values written for it which the codec doesn't read.
+func (d *Decoder) readCustom(c customCodec, v reflect.Value) error {
+	n, err := d.readLength()
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return CorruptStream{"codec"}
+	}
+	outer := d.parts
+	d.parts = &n
+	value, err := c.dec(d)
+	d.parts = outer
+	if err != nil {
+		return err
+	}
+	if err := d.skipParts(n); err != nil {
+		return err
+	}
+	t := v.Type()
+	src := reflect.ValueOf(value)
+	if !src.IsValid() {
+		v.SetZero()
+		return nil
+	}
+	if src.Type() == reflect.PtrTo(t) && !src.IsNil() {
+		src = src.Elem()
+	}
+	if src.Type() != t {
+		return TypeMismatch{src.Type(), t}
+	}
+	v.Set(src)
+	return nil
+}
+
+// skipCustom reads past a value written by a codec.
+func (d *Decoder) skipCustom() error {
+	n, err := d.readLength()
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return CorruptStream{"codec"}
+	}
+	return d.skipParts(n)
+}
+
+// skipParts reads past the given number of values written by a codec.
+func (d *Decoder) skipParts(n int) error {
+	for i := 0; i < n; i++ {
+		wt, err := d.readWireType()
+		if err != nil {
+			return err
+		}
+		if err := d.skip(wt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readGenericExtension reads a value of an extension generically, as its
+// own type since its id names no type in the stream's type table, or as
+// the values its codec wrote if it isn't registered.
+func (d *Decoder) readGenericExtension(wt *wireType) (interface{}, error) {
+	t, err := d.resolve(wt)
+	if _, ok := err.(UnknownExtension); ok {
+		return d.readGenericCustom()
+	} else if err != nil {
+		return nil, err
+	}
+	v := reflect.New(t).Elem()
+	if err := d.readValue(v); err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
+}
+
+// readGenericCustom reads a value written by a codec generically, as the
+// []interface{} of the values the codec wrote.
+func (d *Decoder) readGenericCustom() (interface{}, error) {
+	n, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, CorruptStream{"codec"}
+	}
+	parts := make([]interface{}, 0, preallocLength(n, 16))
+	for i := 0; i < n; i++ {
+		wt, err := d.readWireType()
+		if err != nil {
+			return nil, err
+		}
+		part, err := d.readGeneric(wt)
+		if err != nil {
+			return nil, withPath(err, "["+strconv.Itoa(i)+"]")
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
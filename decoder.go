@@ -2,66 +2,511 @@ package lager
 
 import (
 	"bufio"
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
 	"io"
+	"maps"
 	"math"
 	"reflect"
-	"unsafe"
+	"slices"
+	"strconv"
+	"time"
 )
 
 // Decoder is used to read Go objects from a stream of encoded bytes.
 // Please note that the decoder is not thread-safe, and should only be
 // used by a single goroutine.
 type Decoder struct {
-	reader     io.ByteReader
-	objects    int
-	typeMap    map[uint]reflect.Type
-	ptrMap     map[uintptr]uintptr
-	postHeader bool
+	reader         *checksumReader
+	registry       *Registry
+	opts           DecoderOptions
+	flags          uint16
+	objects        int
+	typeNames      map[uint]string
+	schemas        map[uint]TypeSchema
+	fingerprints   map[uint]uint64
+	versions       map[string]int
+	structures     map[uint][]wireField
+	synthesizing   map[uint]bool
+	typeMap        map[uint]reflect.Type
+	wireTypes      map[wireKey]*wireType
+	generic        map[uint]*interface{}
+	genericPending map[uint]bool
+	unresolved     map[uint]error
+	fieldNames     map[uint32]string
+	strs           map[uint32]string
+	metadata       map[string]string
+	ptrMap         map[uint]reflect.Value
+	graph          map[uint]reflect.Value
+	graphRoot      interface{}
+	pending        map[uint]bool
+	inPlace        bool
+	ptrIndex       map[uint]int64
+	ptrOffsets     map[uint]int64
+	objIndex       []int64
+	keys           map[string]int64
+	source         io.ReaderAt
+	size           int64
+	done           bool
+	footerRead     bool
+	encrypted      bool
+	path           []string
+	explain        func(offset int64, text string)
+	start          int64
+	damaged        bool
+	skipped        []SkippedRange
+	scratch        []byte
+	depth          int
+	consumed       int
+	ctx            context.Context
+	tagged         bool
+	frames         []tokenFrame
+	tokenPtrs      int
+	tokenHeader    bool
+	inRecords      bool
+	parts          *int
+	word           [8]byte
+}
+
+// DecoderOptions configures how a Decoder reads its stream. The zero
+// value is the default used by NewDecoder.
+type DecoderOptions struct {
+	// Registry is used for looking up the types read, before falling back
+	// to the global registry.
+	Registry *Registry
+
+	// IgnoreUnknownFields skips the values of struct fields which no
+	// longer exist in the type being decoded, or whose types can no longer
+	// hold them, instead of failing with MissingField or TypeMismatch.
+	// Structs with an UnknownFields field keep the former there regardless
+	// of this option.
+	IgnoreUnknownFields bool
+
+	// Unexported reads the unexported fields of structs as well as the
+	// exported ones, as written by an encoder with the same option.
+	Unexported bool
+
+	// CheckSchema compares the fingerprint of each type in the stream with
+	// that of the registered type, and fails with SchemaMismatch when they
+	// differ, rather than decoding objects whose fields have changed. Types
+	// written with an older version are migrated instead.
+	CheckSchema bool
+
+	// RemapTypes decodes the types written under the given names as the
+	// given types instead of looking them up in the registry, so that data
+	// written from types which have since been renamed or moved can still
+	// be read. Struct fields are matched by name as usual, and fail with
+	// TypeMismatch if their new types can't hold the values written.
+	RemapTypes map[string]reflect.Type
+
+	// Recover skips past objects which fail to decode in streams written
+	// with the Markers option, to the next marker, and reads on from there,
+	// rather than returning the error. The ranges skipped are recorded for
+	// Decoder.Skipped. Objects needing types or pointers defined in a
+	// skipped range are skipped as well. ReadInto may have filled in part
+	// of its target before the object failed.
+	Recover bool
+
+	// Tokens leaves the pointer table at the start of a stream which isn't
+	// streaming, and the pointer records of a streaming one, to be read as
+	// tokens by Token rather than decoded. A decoder with this option can
+	// only be read with Token.
+	Tokens bool
+
+	// Alloc allocates memory for the value of each pointer read, instead of
+	// reflect.New, so that the values of a stream can be kept in an arena
+	// and freed together. It's given the type pointed to, and must return a
+	// new pointer to a zero value of it; decoding fails with InvalidAlloc
+	// otherwise. Memory reused by ReadIntoGraph isn't allocated.
+	Alloc func(t reflect.Type) reflect.Value
+
+	// Trace receives a line for each record and struct field read, with
+	// its offset in the stream, its type and its field path, for debugging.
+	Trace io.Writer
+
+	// EncryptionKey decrypts streams written with the same encryption
+	// key. Reading an encrypted stream with a different key, or none,
+	// fails with WrongKey.
+	EncryptionKey []byte
 }
 
 // NewDecoder creates a new Decoder whose input source is the given
 // io.Reader. On creation, the decoder reads the header section
-// from the stream. Errors can occur during this phase.
+// from the stream. Errors can occur during this phase. If the stream
+// has a footer and r is an io.ReadSeeker, the footer is read as well.
 func NewDecoder(r io.Reader) (*Decoder, error) {
-	d := &Decoder{
-		reader:     bufio.NewReader(r),
-		objects:    0,
-		typeMap:    make(map[uint]reflect.Type),
-		ptrMap:     make(map[uintptr]uintptr),
-		postHeader: false,
-	}
-	if err := d.readHeader(); err != nil {
+	return NewDecoderWithOptions(r, DecoderOptions{})
+}
+
+// NewDecoderWithOptions creates a new Decoder whose input source is the
+// given io.Reader, using the given options.
+func NewDecoderWithOptions(r io.Reader, opts DecoderOptions) (*Decoder, error) {
+	d := newDecoder(opts)
+	if err := d.Reset(r); err != nil {
 		return nil, err
 	}
-	d.postHeader = true
 	return d, nil
 }
 
+// newDecoder creates a Decoder with the given options, which must be Reset
+// with an input before use.
+func newDecoder(opts DecoderOptions) *Decoder {
+	return &Decoder{
+		reader:         &checksumReader{r: bufio.NewReader(nil)},
+		registry:       opts.Registry,
+		opts:           opts,
+		objects:        0,
+		typeNames:      make(map[uint]string),
+		schemas:        make(map[uint]TypeSchema),
+		fingerprints:   make(map[uint]uint64),
+		versions:       make(map[string]int),
+		structures:     make(map[uint][]wireField),
+		synthesizing:   make(map[uint]bool),
+		typeMap:        make(map[uint]reflect.Type),
+		wireTypes:      make(map[wireKey]*wireType),
+		generic:        make(map[uint]*interface{}),
+		genericPending: make(map[uint]bool),
+		unresolved:     make(map[uint]error),
+		fieldNames:     make(map[uint32]string),
+		strs:           make(map[uint32]string),
+		ptrMap:         make(map[uint]reflect.Value),
+		pending:        make(map[uint]bool),
+		ptrOffsets:     make(map[uint]int64),
+	}
+}
+
+// Reset discards the decoder's state, and prepares it to read a new
+// stream from r, reusing its internal storage. The new stream's header
+// is read, as by NewDecoder. The decoder's options and registry are kept.
+func (d *Decoder) Reset(r io.Reader) (err error) {
+	defer d.recoverPanic(&err)
+	d.reader.r.Reset(r)
+	d.reader.record, d.reader.stream, d.reader.n = 0, 0, 0
+	d.reader.tee = nil
+	d.flags = 0
+	d.objects = 0
+	d.parts = nil
+	clear(d.typeNames)
+	clear(d.schemas)
+	clear(d.fingerprints)
+	clear(d.versions)
+	clear(d.structures)
+	clear(d.typeMap)
+	clear(d.wireTypes)
+	clear(d.generic)
+	clear(d.genericPending)
+	clear(d.unresolved)
+	clear(d.fieldNames)
+	clear(d.strs)
+	clear(d.ptrMap)
+	clear(d.pending)
+	clear(d.ptrOffsets)
+	d.ptrIndex = nil
+	d.objIndex = nil
+	d.keys = nil
+	d.setSource(r)
+	d.done = false
+	d.footerRead = false
+	d.depth = 0
+	d.consumed = 0
+	d.path = d.path[:0]
+	d.encrypted = false
+	d.metadata = nil
+	d.damaged = false
+	d.skipped = nil
+	d.frames = d.frames[:0]
+	d.tokenPtrs = 0
+	d.tokenHeader = false
+	d.inRecords = false
+	if err := d.readHeader(); err != nil {
+		return err
+	}
+	if d.flags&flagEncrypted != 0 {
+		if r, err = d.unseal(r); err != nil {
+			return err
+		}
+		d.setSource(r)
+		if err := d.readHeader(); err != nil {
+			return err
+		}
+		if d.flags&flagEncrypted != 0 {
+			return CorruptStream{"header"}
+		}
+	}
+	if rs, ok := r.(io.ReadSeeker); ok && d.flags&flagFooter != 0 {
+		return d.seekFooter(rs)
+	}
+	return nil
+}
+
+// setSource sets the decoder's source for reading at random to r, if it
+// is both an io.ReadSeeker and an io.ReaderAt, finding its size without
+// moving the position it's read from. Otherwise there is no source.
+func (d *Decoder) setSource(r io.Reader) {
+	d.source, d.size = nil, 0
+	rs, ok := r.(io.ReadSeeker)
+	ra, ok2 := r.(io.ReaderAt)
+	if !ok || !ok2 {
+		return
+	}
+	pos, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return
+	}
+	if _, err := rs.Seek(pos, io.SeekStart); err != nil {
+		return
+	}
+	d.source, d.size = ra, size
+}
+
 // Read returns the next object from the stream. If the end of stream
 // has been reached, it returns an error.
-func (d *Decoder) Read() (interface{}, error) {
+func (d *Decoder) Read() (value interface{}, err error) {
+	for {
+		value, err = d.readObject()
+		if !d.resync(err) {
+			return value, err
+		}
+	}
+}
+
+// readObject reads the next object from the stream, for Read.
+func (d *Decoder) readObject() (value interface{}, err error) {
+	defer d.recoverPanic(&err)
+	t, err := d.beginType()
+	if err != nil {
+		return nil, err
+	}
+	value, err = d.read(t)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.endObject(); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// ReadInto decodes the next object from the stream into the value pointed
+// to by ptr, reusing any storage it already holds where possible. If the
+// object is a pointer and ptr points to its element type, the pointed-to
+// value is copied instead. Struct fields that aren't present in the stream
+// are left untouched.
+func (d *Decoder) ReadInto(ptr interface{}) (err error) {
+	for {
+		err = d.readObjectInto(ptr)
+		if !d.resync(err) {
+			return err
+		}
+	}
+}
+
+// readObjectInto reads the next object from the stream into the value
+// pointed to by ptr, for ReadInto.
+func (d *Decoder) readObjectInto(ptr interface{}) (err error) {
+	defer d.recoverPanic(&err)
+	dst := reflect.ValueOf(ptr)
+	if !dst.IsValid() || !isPtr(dst.Type()) || dst.IsNil() {
+		return InvalidTarget{reflect.TypeOf(ptr)}
+	}
+	t, err := d.beginType()
+	if err != nil {
+		return err
+	}
+	if t == dst.Type().Elem() {
+		if err := d.readValue(dst.Elem()); err != nil {
+			return withRoot(err, t)
+		}
+		return d.endObject()
+	}
+	value, err := d.read(t)
+	if err != nil {
+		return err
+	}
+	if err := d.endObject(); err != nil {
+		return err
+	}
+	return assign(ptr, value)
+}
+
+// beginObject starts reading the next object in the stream, and returns
+// its type.
+func (d *Decoder) beginObject() (*wireType, error) {
+	if d.flags&flagStreaming != 0 {
+		t, err := d.beginRecords()
+		if err == nil {
+			d.consumed++
+		}
+		return t, err
+	}
 	if d.objects == 0 {
 		return nil, EndOfStream{}
 	}
 	d.objects--
-	t, err := d.readType()
+	d.consumed++
+	d.reader.record = 0
+	offset := d.reader.n
+	wt, err := d.readWireType()
+	if err == nil && d.opts.Trace != nil {
+		d.path = d.path[:0]
+		d.tracef(offset, "object %s", d.wireName(wt))
+	}
+	return wt, err
+}
+
+// beginType starts reading the next object in the stream, and returns its
+// Go type.
+func (d *Decoder) beginType() (reflect.Type, error) {
+	wt, err := d.beginObject()
 	if err != nil {
 		return nil, err
 	}
-	return d.read(t)
+	return d.resolve(wt)
+}
+
+// endObject finishes reading an object, verifying its checksum and, after
+// the last object, the checksum of the entire stream.
+func (d *Decoder) endObject() error {
+	if err := d.resolvePending(); err != nil {
+		return err
+	}
+	if d.flags&flagChecksums == 0 {
+		return nil
+	}
+	if err := d.verifyChecksum(d.reader.record, "object"); err != nil {
+		return err
+	}
+	if d.objects == 0 && d.flags&flagStreaming == 0 {
+		return d.verifyChecksum(d.reader.stream, "stream")
+	}
+	return nil
+}
+
+// recoverPanic turns a panic while decoding into a DecodePanic error, as
+// a last line of defence against malformed input. It must be deferred.
+func (d *Decoder) recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		d.depth = 0
+		*err = DecodePanic{r}
+	}
+}
+
+// enter is called on each level of nesting while decoding, and fails once
+// the nesting is deeper than any valid stream, rather than letting
+// malformed input exhaust the stack. Each call must be paired with leave.
+func (d *Decoder) enter() error {
+	d.depth++
+	if d.depth > maxDepth {
+		return CorruptStream{"nesting"}
+	}
+	return nil
+}
+
+// leave undoes enter.
+func (d *Decoder) leave() {
+	d.depth--
+}
+
+// verifyChecksum reads a checksum from the stream and compares it with
+// the expected one, returning CorruptStream if they differ.
+func (d *Decoder) verifyChecksum(expected uint32, section string) error {
+	actual, err := d.readUint32()
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return CorruptStream{section}
+	}
+	return nil
 }
 
 func (d *Decoder) readHeader() error {
 	var err error
+	if err = d.readMagic(); err != nil {
+		return err
+	}
+	if d.flags, err = d.readUint16(); err != nil {
+		return err
+	}
+	if d.flags&flagEncrypted != 0 {
+		return nil
+	}
+	if err = d.readMetadata(); err != nil {
+		return err
+	}
+	if d.flags&flagStreaming != 0 {
+		return d.readPreambleChecksum()
+	}
 	if d.objects, err = d.readInt(); err != nil {
 		return err
 	}
 	if err = d.readTypeMap(); err != nil {
 		return err
 	}
+	if d.flags&flagFieldIds != 0 {
+		if err = d.readFieldTable(); err != nil {
+			return err
+		}
+	}
+	if d.flags&flagStringIds != 0 {
+		if err = d.readStringTable(); err != nil {
+			return err
+		}
+	}
+	if d.opts.Tokens {
+		// The pointer table is left for Token to read.
+		d.tokenPtrs, err = d.readInt()
+		d.tokenHeader = true
+		return err
+	}
 	if err = d.readPtrMap(); err != nil {
 		return err
 	}
+	return d.endHeader()
+}
+
+// endHeader verifies the header's checksum, following the pointer table,
+// along with that of the stream if it has no objects.
+func (d *Decoder) endHeader() error {
+	if d.flags&flagChecksums != 0 {
+		if err := d.verifyChecksum(d.reader.record, "header"); err != nil {
+			return err
+		}
+		if d.objects == 0 {
+			return d.verifyChecksum(d.reader.stream, "stream")
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) readMagic() error {
+	for _, b := range magic {
+		u, err := d.readUint8()
+		if err != nil {
+			return err
+		}
+		if u != b {
+			return InvalidMagic{}
+		}
+	}
+	return d.readVersion()
+}
+
+// readVersion reads the format version, which must be the current one.
+func (d *Decoder) readVersion() error {
+	version, err := d.readUint8()
+	if err != nil {
+		return err
+	}
+	if version != formatVersion {
+		return UnsupportedVersion{version}
+	}
 	return nil
 }
 
@@ -71,175 +516,318 @@ func (d *Decoder) readTypeMap() error {
 		return err
 	}
 	for i := 0; i < n; i++ {
-		name, err := d.readString()
-		if err != nil {
+		if err := d.readTypeEntry(); err != nil {
 			return err
 		}
-		id, err := d.readUint()
+	}
+	return nil
+}
+
+// readTypeEntry reads a type name, the id it is referred to by in the rest
+// of the stream, its fingerprint, its version and any schema or structure
+// written with it. The name is resolved when the id is first used.
+func (d *Decoder) readTypeEntry() error {
+	offset := d.reader.n
+	name, err := d.readString()
+	if err != nil {
+		return err
+	}
+	id, err := d.readUint()
+	if err != nil {
+		return err
+	}
+	if d.opts.Trace != nil {
+		d.tracef(offset, "type %d %s", id, name)
+	}
+	d.typeNames[id] = name
+	if d.fingerprints[id], err = d.readUint64(); err != nil {
+		return err
+	}
+	version, err := d.readInt()
+	if err != nil {
+		return err
+	}
+	d.versions[name] = version
+	if d.flags&flagSchema != 0 {
+		s, err := d.readSchema(name)
 		if err != nil {
 			return err
 		}
-		t, ok := typeMap[name]
-		if !ok {
-			return MissingTypeName{name}
+		s.Version = version
+		d.schemas[id] = s
+	}
+	return d.readStructure(id)
+}
+
+// readFieldTable reads the table of field names from a stream written with
+// field ids.
+func (d *Decoder) readFieldTable() error {
+	n, err := d.readInt()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if err := d.readFieldEntry(); err != nil {
+			return err
 		}
-		d.typeMap[id] = t
 	}
 	return nil
 }
 
-func (d *Decoder) readPtrMap() error {
+// readFieldEntry reads a field name and the id it is referred to by in the
+// rest of the stream.
+func (d *Decoder) readFieldEntry() error {
+	offset := d.reader.n
+	name, err := d.readString()
+	if err != nil {
+		return err
+	}
+	id, err := d.readUint32()
+	if err != nil {
+		return err
+	}
+	if d.opts.Trace != nil {
+		d.tracef(offset, "name %d %s", id, name)
+	}
+	d.fieldNames[id] = name
+	return nil
+}
+
+// readFieldName reads the name of a struct field, which is written either
+// in full or as an id into the field table.
+func (d *Decoder) readFieldName() (string, error) {
+	if d.flags&flagFieldIds == 0 {
+		return d.readString()
+	}
+	id, err := d.readUint32()
+	if err != nil {
+		return "", err
+	}
+	name, ok := d.fieldNames[id]
+	if !ok {
+		return "", MissingFieldId{id}
+	}
+	return name, nil
+}
+
+// readMetadata reads the metadata following the flags of a stream, if it
+// has any.
+func (d *Decoder) readMetadata() error {
+	if d.flags&flagMetadata == 0 {
+		return nil
+	}
 	n, err := d.readInt()
 	if err != nil {
 		return err
 	}
-	objs := make([]reflect.Value, n)
+	if n < 0 {
+		return CorruptStream{"metadata"}
+	}
+	d.metadata = make(map[string]string, preallocLength(n, 32))
 	for i := 0; i < n; i++ {
-		ptr, err := d.readUintptr()
+		key, err := d.readString()
 		if err != nil {
 			return err
 		}
-		t, err := d.readType()
-		if err != nil {
+		if d.metadata[key], err = d.readString(); err != nil {
 			return err
 		}
-		v := reflect.New(t)
-		value, err := d.read(t)
-		if err != nil {
+	}
+	return nil
+}
+
+// Metadata returns the key/value pairs attached to the stream with
+// Encoder.SetMetadata, or nil if there are none.
+func (d *Decoder) Metadata() map[string]string {
+	return maps.Clone(d.metadata)
+}
+
+// readStringTable reads the table of string values from a stream written
+// with string ids.
+func (d *Decoder) readStringTable() error {
+	n, err := d.readInt()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if err := d.readStringEntry(); err != nil {
 			return err
 		}
-		v.Elem().Set(reflect.ValueOf(value))
-		objs[i] = v.Elem()
-		d.ptrMap[ptr] = v.Pointer()
-	}
-	for _, obj := range objs {
-		d.patch(obj)
 	}
 	return nil
 }
 
-func (d *Decoder) patch(v reflect.Value) {
-	switch v.Type().Kind() {
-	case reflect.Slice:
-		d.patchSlice(v)
-	case reflect.Map:
-		d.patchMap(v)
-	case reflect.Struct:
-		d.patchStruct(v)
-	case reflect.Ptr:
-		d.patchPtr(v)
+// readStringEntry reads a string value and the id it is referred to by in
+// the rest of the stream.
+func (d *Decoder) readStringEntry() error {
+	offset := d.reader.n
+	s, err := d.readString()
+	if err != nil {
+		return err
+	}
+	id, err := d.readUint32()
+	if err != nil {
+		return err
 	}
+	if d.opts.Trace != nil {
+		d.tracef(offset, "string %d", id)
+	}
+	d.strs[id] = s
+	return nil
 }
 
-func (d *Decoder) patchPtr(v reflect.Value) {
-	if isPtr(v.Type()) {
-		ptr := unsafe.Pointer(d.ptrMap[v.Pointer()])
-		newval := reflect.NewAt(v.Type().Elem(), ptr)
-		v.Set(newval)
+// readStringValue reads a string value, which is written either in full
+// or as an id into the string table.
+func (d *Decoder) readStringValue() (string, error) {
+	if d.flags&flagStringIds == 0 {
+		return d.readString()
+	}
+	id, err := d.readUint32()
+	if err != nil {
+		return "", err
+	}
+	s, ok := d.strs[id]
+	if !ok {
+		return "", MissingStringId{id}
 	}
+	return s, nil
 }
 
-func (d *Decoder) patchSlice(v reflect.Value) {
-	n := v.Len()
-	for i := 0; i < n; i++ {
-		d.patch(v.Index(i))
+// resolveType returns the type with the given id, looking its name up in
+// the registry the first time.
+func (d *Decoder) resolveType(id uint) (reflect.Type, error) {
+	if t, ok := d.typeMap[id]; ok {
+		return t, nil
 	}
+	name, ok := d.typeNames[id]
+	if !ok {
+		return nil, MissingTypeId{id}
+	}
+	t, ok := d.localType(name)
+	if !ok {
+		return d.synthesize(id, name)
+	}
+	if d.opts.CheckSchema && d.versions[name] >= typeVersion(t) {
+		local := describeType(d.registry, name, t, d.opts.Unexported)
+		if fp := d.fingerprints[id]; fp != 0 && local.Fingerprint() != fp {
+			var diff []string
+			if s, ok := d.schemas[id]; ok {
+				diff = diffSchemas(s, local)
+			}
+			return nil, SchemaMismatch{name, diff}
+		}
+	}
+	d.typeMap[id] = t
+	return t, nil
 }
 
-func (d *Decoder) patchMap(v reflect.Value) {
-	for _, key := range v.MapKeys() {
-		d.patch(key)
-		d.patch(v.MapIndex(key))
+// localType finds the type a name in the type table refers to, in the
+// RemapTypes option or the registries.
+func (d *Decoder) localType(name string) (reflect.Type, bool) {
+	if t, ok := d.opts.RemapTypes[name]; ok {
+		return t, true
 	}
+	return lookup(d.registry, name)
 }
 
-func (d *Decoder) patchStruct(v reflect.Value) {
-	n := v.NumField()
-	t := v.Type()
+func (d *Decoder) readPtrMap() error {
+	n, err := d.readInt()
+	if err != nil {
+		return err
+	}
 	for i := 0; i < n; i++ {
-		f := t.Field(i)
-		if !privateField(f) {
-			d.patch(v.Field(i))
+		if err := d.readPtrEntry(); err != nil {
+			return err
 		}
 	}
+	return d.resolvePending()
 }
 
-func (d *Decoder) readType() (reflect.Type, error) {
-	id, err := d.readUint8()
+// readPtrEntry reads a pointer's reference id and the value it points to,
+// and decodes the value into that pointer's allocation. If the pointer was
+// already read, for instance out of order, the value is decoded but
+// discarded so that its existing copy is kept. Pointers whose types aren't
+// registered are decoded generically, in case they're only needed by
+// ReadGeneric; reading them otherwise fails.
+func (d *Decoder) readPtrEntry() error {
+	offset := d.reader.n
+	ref, err := d.readUint()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	kind := reflect.Kind(id)
-
-	switch kind {
-	case reflect.Bool:
-		return reflect.TypeOf(false), nil
-	case reflect.Int:
-		return reflect.TypeOf(int(0)), nil
-	case reflect.Int8:
-		return reflect.TypeOf(int8(0)), nil
-	case reflect.Int16:
-		return reflect.TypeOf(int16(0)), nil
-	case reflect.Int32:
-		return reflect.TypeOf(int32(0)), nil
-	case reflect.Int64:
-		return reflect.TypeOf(int64(0)), nil
-	case reflect.Uint:
-		return reflect.TypeOf(uint(0)), nil
-	case reflect.Uint8:
-		return reflect.TypeOf(uint8(0)), nil
-	case reflect.Uint16:
-		return reflect.TypeOf(uint16(0)), nil
-	case reflect.Uint32:
-		return reflect.TypeOf(uint32(0)), nil
-	case reflect.Uint64:
-		return reflect.TypeOf(uint64(0)), nil
-	case reflect.Uintptr:
-		return reflect.TypeOf(uintptr(0)), nil
-	case reflect.Float32:
-		return reflect.TypeOf(float32(0)), nil
-	case reflect.Float64:
-		return reflect.TypeOf(float64(0)), nil
-	case reflect.Complex64:
-		return reflect.TypeOf(complex64(0)), nil
-	case reflect.Complex128:
-		return reflect.TypeOf(complex128(0)), nil
-	case reflect.Map:
-		key, err := d.readType()
-		if err != nil {
-			return nil, err
+	wt, err := d.readWireType()
+	if err != nil {
+		return err
+	}
+	if d.opts.Trace != nil {
+		d.path = d.path[:0]
+		d.tracef(offset, "pointer %d %s", ref, d.wireName(wt))
+	}
+	if d.source != nil {
+		d.ptrOffsets[ref] = offset
+	}
+	if wt.kind == nilKind {
+		return CorruptStream{"type"}
+	}
+	if d.genericPending[ref] || d.tagged {
+		return d.readGenericPtrEntry(ref, wt)
+	}
+	t, err := d.resolve(wt)
+	if unregistered(err) && !d.pending[ref] {
+		d.unresolved[ref] = err
+		return d.readGenericPtrEntry(ref, wt)
+	} else if err != nil {
+		return err
+	}
+	p, ok := d.ptrMap[ref]
+	if ok && !d.pending[ref] {
+		p = reflect.New(t)
+	} else if !ok {
+		if p, err = d.newPtr(ref, t); err != nil {
+			return err
 		}
-		elem, err := d.readType()
-		if err != nil {
-			return nil, err
+		d.ptrMap[ref] = p
+	} else if p.Type().Elem() != t {
+		return TypeMismatch{t, p.Type().Elem()}
+	}
+	delete(d.pending, ref)
+	if _, ok := lookupCodec(d.registry, t); !ok {
+		d.inPlace = wireKind(t) == reflect.Slice
+	}
+	return withRoot(d.readValue(p.Elem()), p.Type())
+}
+
+// resolvePending makes sure that every pointer referred to so far has been
+// read. When decoding out of order, missing pointer records are loaded from
+// the stream; otherwise their absence means the stream is corrupt.
+func (d *Decoder) resolvePending() error {
+	for len(d.pending) > 0 || len(d.genericPending) > 0 {
+		if err := d.loadPending(d.pending); err != nil {
+			return err
 		}
-		return reflect.MapOf(key, elem), nil
-	case reflect.Ptr:
-		t, err := d.readType()
-		if err != nil {
-			return nil, err
+		if err := d.loadPending(d.genericPending); err != nil {
+			return err
 		}
-		return reflect.PtrTo(t), nil
-	case reflect.Slice:
-		t, err := d.readType()
-		if err != nil {
-			return nil, err
+	}
+	return nil
+}
+
+// loadPending loads the pointer records for the given set of pending
+// pointers from the stream.
+func (d *Decoder) loadPending(pending map[uint]bool) error {
+	for ref := range pending {
+		offset, ok := d.ptrIndex[ref]
+		if !ok || d.source == nil {
+			return MissingPointer{ref}
 		}
-		return reflect.SliceOf(t), nil
-	case reflect.String:
-		return reflect.TypeOf(""), nil
-	case reflect.Struct, reflect.Interface:
-		id, err := d.readUint()
-		if err != nil {
-			return nil, err
+		if err := d.loadPtr(offset); err != nil {
+			return err
 		}
-		t, ok := d.typeMap[id]
-		if !ok {
-			return nil, MissingTypeId{id}
+		if pending[ref] {
+			return CorruptStream{"pointer index"}
 		}
-		return t, nil
 	}
-	return nil, UnsupportedRead{kind}
+	return nil
 }
 
 func (d *Decoder) readBool() (bool, error) {
@@ -249,47 +837,37 @@ func (d *Decoder) readBool() (bool, error) {
 
 func (d *Decoder) readInt() (int, error) {
 	i, err := d.readInt64()
+	if err == nil && int64(int(i)) != i {
+		return 0, Overflow{reflect.Int, uint64(i)}
+	}
 	return int(i), err
 }
 
 func (d *Decoder) readInt8() (int8, error) {
 	u, err := d.readUint8()
-	if u&1 != 0 {
-		return ^int8(u >> 1), err
-	} else {
-		return int8(u >> 1), err
-	}
+	return unzigzag[int8](u), err
 }
 
 func (d *Decoder) readInt16() (int16, error) {
 	u, err := d.readUint16()
-	if u&1 != 0 {
-		return ^int16(u >> 1), err
-	} else {
-		return int16(u >> 1), err
-	}
+	return unzigzag[int16](u), err
 }
 
 func (d *Decoder) readInt32() (int32, error) {
 	u, err := d.readUint32()
-	if u&1 != 0 {
-		return ^int32(u >> 1), err
-	} else {
-		return int32(u >> 1), err
-	}
+	return unzigzag[int32](u), err
 }
 
 func (d *Decoder) readInt64() (int64, error) {
 	u, err := d.readUint64()
-	if u&1 != 0 {
-		return ^int64(u >> 1), err
-	} else {
-		return int64(u >> 1), err
-	}
+	return unzigzag[int64](u), err
 }
 
 func (d *Decoder) readUint() (uint, error) {
 	u, err := d.readUint64()
+	if err == nil && uint64(uint(u)) != u {
+		return 0, Overflow{reflect.Uint, u}
+	}
 	return uint(u), err
 }
 
@@ -298,85 +876,36 @@ func (d *Decoder) readUint8() (uint8, error) {
 }
 
 func (d *Decoder) readUint16() (uint16, error) {
-	u1, err := d.reader.ReadByte()
-	if err != nil {
-		return 0, err
-	}
-	u2, err := d.reader.ReadByte()
-	if err != nil {
-		return 0, err
-	}
-	return (uint16(u2) << 8) | uint16(u1), nil
+	buf, err := d.readWord(2)
+	return byteOrder.Uint16(buf), err
 }
 
 func (d *Decoder) readUint32() (uint32, error) {
-	u1, err := d.reader.ReadByte()
-	if err != nil {
-		return 0, err
-	}
-	u2, err := d.reader.ReadByte()
-	if err != nil {
-		return 0, err
-	}
-	u3, err := d.reader.ReadByte()
-	if err != nil {
-		return 0, err
-	}
-	u4, err := d.reader.ReadByte()
-	if err != nil {
-		return 0, err
-	}
-	return (uint32(u4) << 24) |
-		(uint32(u3) << 16) |
-		(uint32(u2) << 8) |
-		uint32(u1), nil
+	buf, err := d.readWord(4)
+	return byteOrder.Uint32(buf), err
 }
 
 func (d *Decoder) readUint64() (uint64, error) {
-	u1, err := d.reader.ReadByte()
-	if err != nil {
-		return 0, err
-	}
-	u2, err := d.reader.ReadByte()
-	if err != nil {
-		return 0, err
-	}
-	u3, err := d.reader.ReadByte()
-	if err != nil {
-		return 0, err
-	}
-	u4, err := d.reader.ReadByte()
-	if err != nil {
-		return 0, err
-	}
-	u5, err := d.reader.ReadByte()
-	if err != nil {
-		return 0, err
-	}
-	u6, err := d.reader.ReadByte()
-	if err != nil {
-		return 0, err
-	}
-	u7, err := d.reader.ReadByte()
-	if err != nil {
-		return 0, err
-	}
-	u8, err := d.reader.ReadByte()
-	if err != nil {
-		return 0, err
+	buf, err := d.readWord(8)
+	return byteOrder.Uint64(buf), err
+}
+
+// readWord reads n bytes, up to 8, into the decoder's word buffer. The
+// buffer is zeroed if they can't all be read.
+func (d *Decoder) readWord(n int) ([]byte, error) {
+	buf := d.word[:n]
+	if _, err := io.ReadFull(d.reader, buf); err != nil {
+		clear(buf)
+		return buf, err
 	}
-	return (uint64(u8) << 56) |
-		(uint64(u7) << 48) |
-		(uint64(u6) << 40) |
-		(uint64(u5) << 32) |
-		(uint64(u4) << 24) |
-		(uint64(u3) << 16) |
-		(uint64(u2) << 8) |
-		uint64(u1), nil
+	return buf, nil
 }
 
 func (d *Decoder) readUintptr() (uintptr, error) {
 	u, err := d.readUint64()
+	if err == nil && uint64(uintptr(u)) != u {
+		return 0, Overflow{reflect.Uintptr, u}
+	}
 	return uintptr(u), err
 }
 
@@ -414,159 +943,650 @@ func (d *Decoder) readComplex128() (complex128, error) {
 	return complex(math.Float64frombits(r), math.Float64frombits(i)), nil
 }
 
-func (d *Decoder) readMap(t reflect.Type) (interface{}, error) {
-	n, err := d.readInt()
+func (d *Decoder) readTime() (time.Time, error) {
+	sec, err := d.readInt64()
 	if err != nil {
-		return nil, err
+		return time.Time{}, err
+	}
+	nsec, err := d.readInt32()
+	if err != nil {
+		return time.Time{}, err
+	}
+	name, err := d.readString()
+	if err != nil {
+		return time.Time{}, err
+	}
+	offset, err := d.readInt32()
+	if err != nil {
+		return time.Time{}, err
+	}
+	var loc *time.Location
+	switch name {
+	case "UTC":
+		loc = time.UTC
+	case "Local":
+		loc = time.Local
+	default:
+		if loc, err = time.LoadLocation(name); err != nil {
+			loc = time.FixedZone(name, int(offset))
+		}
+	}
+	return time.Unix(sec, int64(nsec)).In(loc), nil
+}
+
+func (d *Decoder) readMap(v reflect.Value) error {
+	n, err := d.readMapLength()
+	if err != nil {
+		return err
+	}
+	t := v.Type()
+	switch n {
+	case nilLength:
+		v.Set(reflect.Zero(t))
+		return nil
+	case sharedLength:
+		return d.readSharedMap(v)
+	}
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(t, preallocLength(n, t.Key().Size()+t.Elem().Size())))
+	} else {
+		v.Clear()
 	}
-	m := reflect.MakeMap(t)
 	keyType := t.Key()
 	elemType := t.Elem()
 	for i := 0; i < n; i++ {
-		k, err := d.read(keyType)
-		if err != nil {
-			return nil, err
+		if err := checkContext(d.ctx, i); err != nil {
+			return err
 		}
-		v, err := d.read(elemType)
-		if err != nil {
-			return nil, err
+		key := reflect.New(keyType).Elem()
+		if err := d.readValue(key); err != nil {
+			return err
+		}
+		elem := reflect.New(elemType).Elem()
+		if d.opts.Trace != nil {
+			d.tracePath(fmt.Sprintf("[%v]", key))
+		}
+		if err := d.readValue(elem); err != nil {
+			return withPath(err, fmt.Sprintf("[%v]", key))
 		}
-		m.SetMapIndex(reflect.ValueOf(k), reflect.ValueOf(v))
+		if d.opts.Trace != nil {
+			d.leavePath()
+		}
+		if !key.Comparable() {
+			return CorruptStream{"map key"}
+		}
+		v.SetMapIndex(key, elem)
 	}
-	return m.Interface(), nil
+	return nil
 }
 
-func (d *Decoder) readPtr(t reflect.Type) (interface{}, error) {
-	addr, err := d.readUintptr()
+// readPtr reads a pointer's reference id. The first time an id is seen,
+// memory for the value it points to is allocated; the value itself is
+// filled in when the pointer's record is read, which may be later. Memory
+// is reused from the graph being read into by ReadIntoGraph, if any.
+func (d *Decoder) readPtr(v reflect.Value) error {
+	ref, err := d.readUint()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if d.postHeader {
-		patched, ok := d.ptrMap[addr]
-		if !ok {
-			return nil, MissingPointer{addr}
+	if ref == nilRef {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if err, ok := d.unresolved[ref]; ok {
+		return err
+	}
+	p, ok := d.ptrMap[ref]
+	if !ok {
+		if p, err = d.newPtr(ref, v.Type().Elem()); err != nil {
+			return err
 		}
-		addr = patched
+		d.ptrMap[ref] = p
+		d.pending[ref] = true
 	}
-	ptr := unsafe.Pointer(addr)
-	return reflect.NewAt(t.Elem(), ptr).Interface(), nil
+	if !p.Type().AssignableTo(v.Type()) {
+		return TypeMismatch{p.Type(), v.Type()}
+	}
+	v.Set(p)
+	return nil
 }
 
-func (d *Decoder) readSlice(t reflect.Type) (interface{}, error) {
-	n, err := d.readInt()
+// alloc allocates memory for a pointer's value of the given type, with the
+// decoder's Alloc option if it has one.
+func (d *Decoder) alloc(t reflect.Type) (reflect.Value, error) {
+	if d.opts.Alloc == nil {
+		return reflect.New(t), nil
+	}
+	p := d.opts.Alloc(t)
+	if !p.IsValid() {
+		return p, InvalidAlloc{t, nil}
+	}
+	if p.Type() != reflect.PointerTo(t) || p.IsNil() {
+		return p, InvalidAlloc{t, p.Type()}
+	}
+	return p, nil
+}
+
+// readSlice decodes a slice, reusing v's storage if it is large enough.
+// Otherwise the slice is allocated up front, with the capacity it was
+// written with, unless it is large, in which case it grows as its elements
+// are read so that a corrupt length can't cause a huge allocation, and is
+// given its capacity at the end. A slice already of the right length is
+// read into without changing it, as other goroutines may be slicing it.
+// So is the value of a pointer record, which is allocated in full first,
+// since it may be a backing array whose elements slice it.
+func (d *Decoder) readSlice(v reflect.Value) error {
+	inPlace := d.inPlace
+	d.inPlace = false
+	n, c, err := d.readSliceCap()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	t := v.Type()
+	fresh := false
+	switch {
+	case n == nilLength:
+		v.Set(reflect.Zero(t))
+		return nil
+	case n == sharedLength:
+		return d.readSharedSlice(v)
+	case !v.IsNil() && v.Len() == n:
+	case inPlace:
+		if d.source != nil && int64(c) > d.size {
+			return CorruptStream{"slice"}
+		}
+		v.Set(reflect.MakeSlice(t, n, c))
+	case !v.IsNil() && v.Cap() >= n:
+		v.SetLen(0)
+	default:
+		v.Set(reflect.MakeSlice(t, 0, preallocLength(c, t.Elem().Size())))
+		fresh = true
 	}
-	inner := t.Elem()
-	v := reflect.MakeSlice(t, 0, n)
 	for i := 0; i < n; i++ {
-		elem, err := d.read(inner)
-		if err != nil {
-			return nil, err
+		if err := checkContext(d.ctx, i); err != nil {
+			return err
+		}
+		if i == v.Cap() {
+			v.Grow(min(i, n-i))
+		}
+		if i >= v.Len() {
+			v.SetLen(i + 1)
+		}
+		if d.opts.Trace != nil {
+			d.tracePath("[" + strconv.Itoa(i) + "]")
+		}
+		if err := d.readValue(v.Index(i)); err != nil {
+			return withPath(err, "["+strconv.Itoa(i)+"]")
+		}
+		if d.opts.Trace != nil {
+			d.leavePath()
 		}
-		v = reflect.Append(v, reflect.ValueOf(elem))
 	}
-	return v.Interface(), nil
+	if v.Cap() < c || fresh && v.Cap() != c {
+		s := reflect.MakeSlice(t, n, c)
+		reflect.Copy(s, v)
+		v.Set(s)
+	}
+	return nil
 }
 
+// readString reads a string through the decoder's scratch buffer, so
+// that only the string itself is allocated.
 func (d *Decoder) readString() (string, error) {
-	n, err := d.readInt()
+	buf, err := d.appendBytes(d.scratch[:0])
+	d.scratch = buf
+	return string(buf), err
+}
+
+func (d *Decoder) readBytes() ([]byte, error) {
+	return d.appendBytes(nil)
+}
+
+// appendBytes reads a length-prefixed byte sequence and appends it to buf.
+// Long sequences are read in chunks, so that memory is only allocated for
+// bytes which are actually present.
+func (d *Decoder) appendBytes(buf []byte) ([]byte, error) {
+	n, err := d.readLength()
 	if err != nil {
-		return "", err
+		return buf, err
 	}
-	buf := make([]byte, n)
-	for i := 0; i < n; i++ {
-		if buf[i], err = d.reader.ReadByte(); err != nil {
-			return "", err
+	return d.appendN(buf, n)
+}
+
+// appendN reads n bytes and appends them to buf, as appendBytes does once
+// it has read their length.
+func (d *Decoder) appendN(buf []byte, n int) ([]byte, error) {
+	if n < 0 {
+		return buf, CorruptStream{"length"}
+	}
+	for n > 0 {
+		if err := checkContext(d.ctx, 0); err != nil {
+			return buf, err
+		}
+		chunk := preallocLength(n, 1)
+		buf = slices.Grow(buf, chunk)
+		m, err := io.ReadFull(d.reader, buf[len(buf):len(buf)+chunk])
+		buf = buf[:len(buf)+m]
+		if err != nil {
+			return buf, err
+		}
+		n -= chunk
+	}
+	return buf, nil
+}
+
+// readLength reads the length of a map, slice or byte sequence, which is
+// either non-negative or nilLength.
+func (d *Decoder) readLength() (int, error) {
+	n, err := d.readInt()
+	if err == nil && n < nilLength {
+		return 0, CorruptStream{"length"}
+	}
+	return n, err
+}
+
+// readMapLength reads the length of a map, which may also be nilLength or
+// sharedLength.
+func (d *Decoder) readMapLength() (int, error) {
+	n, err := d.readInt()
+	if err == nil && n < sharedLength {
+		return 0, CorruptStream{"length"}
+	}
+	return n, err
+}
+
+// readSliceLength reads the length of a slice, which may also be
+// sharedLength, skipping its capacity.
+func (d *Decoder) readSliceLength() (int, error) {
+	n, _, err := d.readSliceCap()
+	return n, err
+}
+
+// readSliceCap reads the length and capacity of a slice. The capacity is
+// the length unless it was written as greater; it's meaningless for nil
+// slices and those sharing their backing array.
+func (d *Decoder) readSliceCap() (n, c int, err error) {
+	if n, err = d.readInt(); err != nil {
+		return 0, 0, err
+	}
+	if n != cappedLength {
+		if n < sharedLength {
+			return 0, 0, CorruptStream{"length"}
 		}
+		return n, n, nil
+	}
+	if c, err = d.readInt(); err != nil {
+		return 0, 0, err
+	}
+	if n, err = d.readLength(); err != nil {
+		return 0, 0, err
 	}
-	return string(buf), nil
+	if n < 0 || c <= n {
+		return 0, 0, CorruptStream{"length"}
+	}
+	return n, c, nil
+}
+
+func (d *Decoder) readBinary(v reflect.Value) error {
+	data, err := d.readBytes()
+	if err != nil {
+		return err
+	}
+	return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
 }
 
-func (d *Decoder) readStruct(t reflect.Type) (interface{}, error) {
+func (d *Decoder) readStruct(v reflect.Value) error {
+	t := v.Type()
+	if name, version, ok := d.staleVersion(t); ok {
+		return d.migrateStruct(v, name, version)
+	}
 	n, err := d.readInt()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	v := reflect.New(t).Elem()
+	var unknown *UnknownFields
+	if i, ok := unknownFieldsIndex(t); ok {
+		unknown = v.Field(i).Addr().Interface().(*UnknownFields)
+		unknown.fields = nil
+	}
+	var read []string
+	depth := len(d.path)
 	for i := 0; i < n; i++ {
-		name, err := d.readString()
+		offset := d.reader.n
+		name, err := d.readFieldName()
 		if err != nil {
-			return nil, err
+			return err
+		}
+		ft, err := d.readWireType()
+		if err != nil {
+			return err
+		}
+		if d.opts.Trace != nil {
+			d.path = d.path[:depth]
+			d.traceField(offset, name, ft)
+		}
+		f, ok := lookupField(t, name, d.opts.Unexported)
+		if !ok && unknown != nil {
+			ut, err := d.resolve(ft)
+			if err != nil {
+				return withPath(err, "."+name)
+			}
+			if ut == nil {
+				ut = emptyInterfaceType
+			}
+			value := reflect.New(ut).Elem()
+			if err := d.readField(value, ft); err != nil {
+				return withPath(err, "."+name)
+			}
+			unknown.fields = append(unknown.fields, unknownField{name, value})
+			continue
 		}
-		field, ok := t.FieldByName(name)
 		if !ok {
-			return nil, MissingField{t, name}
+			if !d.opts.IgnoreUnknownFields {
+				return MissingField{t, name}
+			}
+			if err := d.skip(ft); err != nil {
+				return withPath(err, "."+name)
+			}
+			continue
+		}
+		if f.unsupported && !d.opts.IgnoreUnknownFields {
+			return UnsupportedField{"." + name, f.typ}
+		}
+		if d.opts.IgnoreUnknownFields && (f.unsupported || d.incompatible(f.typ, ft)) {
+			if err := d.skip(ft); err != nil {
+				return withPath(err, "."+name)
+			}
+			continue
+		}
+		read = append(read, name)
+		if err := d.readField(fieldValue(v, f), ft); err != nil {
+			return withPath(err, "."+name)
+		}
+	}
+	if d.opts.Trace != nil {
+		d.path = d.path[:depth]
+	}
+	if d.flags&flagOmitZero != 0 {
+		zeroOmitted(v, read, d.opts.Unexported)
+	}
+	return nil
+}
+
+// zeroOmitted sets the fields of a struct which weren't read to zero, as
+// a stream written with OmitZero leaves out those which are zero.
+func zeroOmitted(v reflect.Value, read []string, unexported bool) {
+	for _, f := range structFields(v.Type(), unexported) {
+		if !f.unsupported && !slices.Contains(read, f.name) {
+			fieldValue(v, f).SetZero()
+		}
+	}
+}
+
+// readField decodes a struct field or interface value whose type has
+// already been read. Interfaces take the read type as their dynamic type;
+// other values are decoded as their own type.
+func (d *Decoder) readField(v reflect.Value, wt *wireType) error {
+	if wt.kind == nilKind {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if wt.kind == errorKind {
+		return d.readError(v)
+	}
+	if wt.kind == typedNilKind {
+		return d.readTypedNil(v, wt)
+	}
+	if !isInterface(v.Type()) {
+		if err := d.checkType(v.Type(), wt); err != nil {
+			return err
+		}
+		return d.readValue(v)
+	}
+	t, err := d.resolve(wt)
+	if err != nil || !t.AssignableTo(v.Type()) {
+		if candidates := implementations(d.registry, v.Type()); candidates != nil && d.unknownType(t, err) {
+			return UnknownImplementation{v.Type(), d.wireName(wt), candidates}
 		}
-		value, err := d.read(field.Type)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		v.FieldByName(name).Set(reflect.ValueOf(value))
+		return TypeMismatch{t, v.Type()}
 	}
-	return v.Interface(), nil
+	elem := reflect.New(t).Elem()
+	if err := d.readValue(elem); err != nil {
+		return err
+	}
+	v.Set(elem)
+	return nil
 }
 
-func (d *Decoder) read(t reflect.Type) (interface{}, error) {
-	var err error
-	if isInterface(t) {
-		if t, err = d.readType(); err != nil {
-			return nil, err
+// checkType fails with TypeMismatch if the values of a wire type can't be
+// read as the given type, as their kinds differ somewhere in their
+// structure, so that they aren't misread as something else. Values of an
+// extension or codec can only be read as a type with the same one, and
+// unknown extensions fail with UnknownExtension.
+func (d *Decoder) checkType(t reflect.Type, wt *wireType) error {
+	c, custom := lookupCodec(d.registry, t)
+	switch {
+	case custom:
+		if c.kind == wt.kind {
+			return nil
 		}
+	case wt.kind == namedKind:
+		return d.checkType(t, wt.elem)
+	case portableKind(wt.kind) == portableKind(wireKind(t)):
+		switch wt.kind {
+		case reflect.Map:
+			if err := d.checkType(t.Key(), wt.key); err != nil {
+				return err
+			}
+			return d.checkType(t.Elem(), wt.elem)
+		case reflect.Ptr, reflect.Slice:
+			return d.checkType(t.Elem(), wt.elem)
+		}
+		return nil
+	}
+	from, err := d.resolve(wt)
+	if err != nil {
+		return err
 	}
+	return TypeMismatch{from, t}
+}
 
-	var value interface{}
+// portableKind returns the kind a platform-sized kind is written as, so
+// that they're read as those kinds too.
+func portableKind(k reflect.Kind) reflect.Kind {
+	switch k {
+	case reflect.Int:
+		return reflect.Int64
+	case reflect.Uint, reflect.Uintptr:
+		return reflect.Uint64
+	}
+	return k
+}
 
-	switch t.Kind() {
+// incompatible returns whether a struct field of the given type can't
+// hold the values of the wire type it was written with, for the
+// IgnoreUnknownFields option to skip them.
+func (d *Decoder) incompatible(t reflect.Type, wt *wireType) bool {
+	switch wt.kind {
+	case nilKind, errorKind, typedNilKind:
+		return false
+	}
+	if isInterface(t) {
+		return false
+	}
+	_, ok := d.checkType(t, wt).(TypeMismatch)
+	return ok
+}
+
+// readTypedNil reads a typed nil into v, keeping its type if v is an
+// interface. If the type isn't registered, v is set to nil instead, as
+// nothing but the type is lost.
+func (d *Decoder) readTypedNil(v reflect.Value, wt *wireType) error {
+	if !isInterface(v.Type()) {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	t, err := d.resolve(wt.elem)
+	switch {
+	case err == nil && t.AssignableTo(v.Type()):
+		v.Set(reflect.Zero(t))
+	case unregistered(err) || err == nil && d.unknownType(t, nil):
+		v.Set(reflect.Zero(v.Type()))
+	case err != nil:
+		return err
+	default:
+		return TypeMismatch{t, v.Type()}
+	}
+	return nil
+}
+
+// unregistered returns whether resolving a type failed because it, or the
+// extension it was written as, isn't registered.
+func unregistered(err error) bool {
+	switch err.(type) {
+	case MissingTypeName, UnknownExtension:
+		return true
+	}
+	return false
+}
+
+// unknownType returns whether a type couldn't be resolved because it isn't
+// registered, or was synthesized from its structure for the same reason.
+func (d *Decoder) unknownType(t reflect.Type, err error) bool {
+	if err != nil {
+		var missing MissingTypeName
+		return errors.As(err, &missing)
+	}
+	for isPtr(t) {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && t.Name() == ""
+}
+
+// read decodes a value of the given type and returns it.
+func (d *Decoder) read(t reflect.Type) (interface{}, error) {
+	if t == nil {
+		return nil, nil
+	}
+	v := reflect.New(t).Elem()
+	if err := d.readValue(v); err != nil {
+		return nil, withRoot(err, t)
+	}
+	return v.Interface(), nil
+}
+
+// readValue decodes a value directly into v, which must be settable.
+// Values of interface type are preceded by their dynamic type.
+func (d *Decoder) readValue(v reflect.Value) error {
+	defer d.leave()
+	if err := d.enter(); err != nil {
+		return err
+	}
+	if c, ok := lookupCodec(d.registry, v.Type()); ok {
+		return d.readCustom(c, v)
+	}
+	var err error
+	switch wireKind(v.Type()) {
 	case reflect.Bool:
-		value, err = d.readBool()
+		var b bool
+		b, err = d.readBool()
+		v.SetBool(b)
 	case reflect.Int:
-		value, err = d.readInt()
+		var i int
+		i, err = d.readInt()
+		v.SetInt(int64(i))
 	case reflect.Int8:
-		value, err = d.readInt8()
+		var i int8
+		i, err = d.readInt8()
+		v.SetInt(int64(i))
 	case reflect.Int16:
-		value, err = d.readInt16()
+		var i int16
+		i, err = d.readInt16()
+		v.SetInt(int64(i))
 	case reflect.Int32:
-		value, err = d.readInt32()
+		var i int32
+		i, err = d.readInt32()
+		v.SetInt(int64(i))
 	case reflect.Int64:
-		value, err = d.readInt64()
+		var i int64
+		i, err = d.readInt64()
+		v.SetInt(i)
 	case reflect.Uint:
-		value, err = d.readUint()
+		var u uint
+		u, err = d.readUint()
+		v.SetUint(uint64(u))
 	case reflect.Uint8:
-		value, err = d.readUint8()
+		var u uint8
+		u, err = d.readUint8()
+		v.SetUint(uint64(u))
 	case reflect.Uint16:
-		value, err = d.readUint16()
+		var u uint16
+		u, err = d.readUint16()
+		v.SetUint(uint64(u))
 	case reflect.Uint32:
-		value, err = d.readUint32()
+		var u uint32
+		u, err = d.readUint32()
+		v.SetUint(uint64(u))
 	case reflect.Uint64:
-		value, err = d.readUint64()
+		var u uint64
+		u, err = d.readUint64()
+		v.SetUint(u)
 	case reflect.Uintptr:
-		value, err = d.readUintptr()
+		var u uintptr
+		u, err = d.readUintptr()
+		v.SetUint(uint64(u))
 	case reflect.Float32:
-		value, err = d.readFloat32()
+		var f float32
+		f, err = d.readFloat32()
+		v.SetFloat(float64(f))
 	case reflect.Float64:
-		value, err = d.readFloat64()
+		var f float64
+		f, err = d.readFloat64()
+		v.SetFloat(f)
 	case reflect.Complex64:
-		value, err = d.readComplex64()
+		var c complex64
+		c, err = d.readComplex64()
+		v.SetComplex(complex128(c))
 	case reflect.Complex128:
-		value, err = d.readComplex128()
+		var c complex128
+		c, err = d.readComplex128()
+		v.SetComplex(c)
 	case reflect.Interface:
-		it, err := d.readType()
-		if err == nil {
-			value, err = d.read(it)
+		var wt *wireType
+		if wt, err = d.readWireType(); err == nil {
+			err = d.readField(v, wt)
 		}
 	case reflect.Map:
-		value, err = d.readMap(t)
+		err = d.readMap(v)
 	case reflect.Ptr:
-		value, err = d.readPtr(t)
+		err = d.readPtr(v)
 	case reflect.Slice:
-		value, err = d.readSlice(t)
+		err = d.readSlice(v)
 	case reflect.String:
-		value, err = d.readString()
+		var str string
+		str, err = d.readStringValue()
+		v.SetString(str)
 	case reflect.Struct:
-		value, err = d.readStruct(t)
+		if err = d.readStruct(v); err == nil {
+			err = afterDecode(v)
+		}
+	case binaryKind:
+		err = d.readBinary(v)
+	case timeKind:
+		var tm time.Time
+		tm, err = d.readTime()
+		v.Set(reflect.ValueOf(tm))
+	case durationKind:
+		var i int64
+		i, err = d.readInt64()
+		v.SetInt(i)
+	case bigIntKind, bigFloatKind, bigRatKind:
+		err = d.readBig(v)
 	default:
-		err = UnsupportedRead{t.Kind()}
+		err = UnsupportedRead{v.Kind()}
 	}
-	return value, err
+	return err
 }
@@ -0,0 +1,287 @@
+package lager
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+)
+
+// Difference is a place where two streams compared by Diff differ.
+type Difference struct {
+	// Object is the index of the object holding the difference, and Path
+	// its path within the object, as in ".Users[3].Name", or empty for the
+	// object itself.
+	Object int
+	Path   string
+
+	// A and B are the values at the path in each stream, decoded as by
+	// ReadGeneric, or nil where a stream has no value there.
+	A, B interface{}
+
+	// Reason says how the values differ: "value" where they aren't equal,
+	// "type" where they hold different types, "only in a" or "only in b"
+	// where a stream has an object, field, element or key which the other
+	// doesn't, and "sharing" where a pointer in one stream is shared with
+	// some other place in it but the pointer in the other stream isn't.
+	Reason string
+}
+
+func (d Difference) String() string {
+	s := "object " + strconv.Itoa(d.Object)
+	if d.Path != "" {
+		s += " " + d.Path
+	}
+	switch d.Reason {
+	case "only in a":
+		return fmt.Sprintf("%s: only in a: %s", s, describe(d.A))
+	case "only in b":
+		return fmt.Sprintf("%s: only in b: %s", s, describe(d.B))
+	}
+	return fmt.Sprintf("%s: %s differs: %s != %s", s, d.Reason, describe(d.A), describe(d.B))
+}
+
+// describe returns a short description of a generic value for a
+// Difference, summarizing structs, slices and maps.
+func describe(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return strconv.Quote(v)
+	case []byte:
+		return fmt.Sprintf("%x", v)
+	case map[string]interface{}:
+		return fmt.Sprintf("struct with %d fields", len(v))
+	case []interface{}:
+		return fmt.Sprintf("slice of %d", len(v))
+	case map[interface{}]interface{}:
+		return fmt.Sprintf("map of %d", len(v))
+	case *interface{}:
+		if _, ok := (*v).(*interface{}); ok {
+			return "pointer to pointer"
+		}
+		return "pointer to " + describe(*v)
+	}
+	return fmt.Sprint(value)
+}
+
+// Diff compares the lager streams read from a and b object by object,
+// without needing their types to be registered, and returns where they
+// differ. Objects are decoded as by ReadGeneric; those at the same index
+// are compared field by field, element by element and key by key. Both
+// streams' pointers are matched up as they're found, so that a pointer
+// shared between two places in one stream, but not in the other, is
+// reported along with the values pointed to.
+func Diff(a, b io.Reader) ([]Difference, error) {
+	da, db := newDecoder(DecoderOptions{}), newDecoder(DecoderOptions{})
+	da.tagged, db.tagged = true, true
+	if err := da.Reset(a); err != nil {
+		return nil, err
+	}
+	if err := db.Reset(b); err != nil {
+		return nil, err
+	}
+	c := &differ{
+		ab:    make(map[*interface{}]*interface{}),
+		ba:    make(map[*interface{}]*interface{}),
+		untag: make(map[*interface{}]*interface{}),
+	}
+	for ; ; c.object++ {
+		wa, va, errA := da.readGenericObject()
+		if errA != nil && errA != (EndOfStream{}) {
+			return nil, errA
+		}
+		wb, vb, errB := db.readGenericObject()
+		if errB != nil && errB != (EndOfStream{}) {
+			return nil, errB
+		}
+		switch {
+		case errA != nil && errB != nil:
+			return c.diffs, nil
+		case errB != nil:
+			c.add("", taggedValue{da.wireName(wa), va}, nil, "only in a")
+		case errA != nil:
+			c.add("", nil, taggedValue{db.wireName(wb), vb}, "only in b")
+		default:
+			c.compare("", taggedValue{da.wireName(wa), va}, taggedValue{db.wireName(wb), vb})
+		}
+	}
+}
+
+// differ holds the state of a Diff: the differences found so far, and the
+// pointers of each stream matched up with those of the other.
+type differ struct {
+	object int
+	diffs  []Difference
+	ab, ba map[*interface{}]*interface{}
+	untag  map[*interface{}]*interface{}
+}
+
+// add records a difference between two values at a path in the current
+// object.
+func (c *differ) add(path string, a, b interface{}, reason string) {
+	c.diffs = append(c.diffs, Difference{c.object, path, c.untagged(a), c.untagged(b), reason})
+}
+
+// compare records the differences between two generic values at a path.
+func (c *differ) compare(path string, a, b interface{}) {
+	if ta, ok := a.(taggedValue); ok {
+		tb, ok := b.(taggedValue)
+		if !ok || ta.name != tb.name {
+			c.add(path, a, b, "type")
+			return
+		}
+		c.compare(path, ta.value, tb.value)
+		return
+	}
+	if _, ok := b.(taggedValue); ok {
+		c.add(path, a, b, "type")
+		return
+	}
+	if a == nil || b == nil {
+		if a != nil || b != nil {
+			c.add(path, a, b, "value")
+		}
+		return
+	}
+	if reflect.TypeOf(a) != reflect.TypeOf(b) {
+		c.add(path, a, b, "type")
+		return
+	}
+	switch va := a.(type) {
+	case *interface{}:
+		vb := b.(*interface{})
+		if c.ab[va] == vb {
+			return
+		}
+		if c.ab[va] != nil || c.ba[vb] != nil {
+			c.add(path, a, b, "sharing")
+			return
+		}
+		c.ab[va], c.ba[vb] = vb, va
+		c.compare(path, *va, *vb)
+	case map[string]interface{}:
+		vb := b.(map[string]interface{})
+		names := slices.Sorted(maps.Keys(va))
+		for name := range vb {
+			if _, ok := va[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			compareIn(c, path+"."+name, va, vb, name)
+		}
+	case []interface{}:
+		vb := b.([]interface{})
+		if (va == nil) != (vb == nil) {
+			c.add(path, a, b, "value")
+			return
+		}
+		for i := 0; i < max(len(va), len(vb)); i++ {
+			elem := path + "[" + strconv.Itoa(i) + "]"
+			switch {
+			case i >= len(vb):
+				c.add(elem, va[i], nil, "only in a")
+			case i >= len(va):
+				c.add(elem, nil, vb[i], "only in b")
+			default:
+				c.compare(elem, va[i], vb[i])
+			}
+		}
+	case map[interface{}]interface{}:
+		vb := b.(map[interface{}]interface{})
+		if (va == nil) != (vb == nil) {
+			c.add(path, a, b, "value")
+			return
+		}
+		keys := make(map[string]interface{}, len(va)+len(vb))
+		for key := range va {
+			keys[keyText(key)] = key
+		}
+		for key := range vb {
+			keys[keyText(key)] = key
+		}
+		for _, text := range slices.Sorted(maps.Keys(keys)) {
+			compareIn(c, path+"["+text+"]", va, vb, keys[text])
+		}
+	case []byte:
+		if !bytes.Equal(va, b.([]byte)) {
+			c.add(path, a, b, "value")
+		}
+	default:
+		if !reflect.DeepEqual(a, b) {
+			c.add(path, a, b, "value")
+		}
+	}
+}
+
+// compareIn compares the values held by two maps under the same key,
+// which may be missing from either.
+func compareIn[K comparable](c *differ, path string, a, b map[K]interface{}, key K) {
+	va, okA := a[key]
+	vb, okB := b[key]
+	switch {
+	case !okB:
+		c.add(path, va, nil, "only in a")
+	case !okA:
+		c.add(path, nil, vb, "only in b")
+	default:
+		c.compare(path, va, vb)
+	}
+}
+
+// keyText returns the text of a map key in a Difference's path.
+func keyText(key interface{}) string {
+	if k, ok := key.(taggedValue); ok {
+		return keyText(k.value)
+	}
+	return fmt.Sprint(key)
+}
+
+// untagged returns a generic value as ReadGeneric would, without the
+// type names of the values held in interfaces. Pointers are copied once,
+// so that sharing and cycles are kept.
+func (c *differ) untagged(value interface{}) interface{} {
+	switch v := value.(type) {
+	case taggedValue:
+		return c.untagged(v.value)
+	case *interface{}:
+		if p, ok := c.untag[v]; ok {
+			return p
+		}
+		p := new(interface{})
+		c.untag[v] = p
+		*p = c.untagged(*v)
+		return p
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for name, elem := range v {
+			m[name] = c.untagged(elem)
+		}
+		return m
+	case []interface{}:
+		if v == nil {
+			return v
+		}
+		s := make([]interface{}, len(v))
+		for i, elem := range v {
+			s[i] = c.untagged(elem)
+		}
+		return s
+	case map[interface{}]interface{}:
+		if v == nil {
+			return v
+		}
+		m := make(map[interface{}]interface{}, len(v))
+		for key, elem := range v {
+			m[c.untagged(key)] = c.untagged(elem)
+		}
+		return m
+	}
+	return value
+}
@@ -2,101 +2,887 @@ package lager
 
 import (
 	"bytes"
+	"context"
+	"encoding"
+	"fmt"
 	"io"
+	"maps"
 	"math"
+	"os"
 	"reflect"
+	"slices"
+	"strconv"
+	"time"
 )
 
 // Encoder is used to serialize objects to an encoded stream of bytes.
 // Please note that the encoder is not thread-safe, and should only be
 // used by a single goroutine.
 type Encoder struct {
-	buf     *bytes.Buffer
-	writer  io.Writer
-	nextId  uint
-	objects int
-	typeIds map[reflect.Type]uint
-	ptrMap  map[uintptr]interface{}
+	buf       *bytes.Buffer
+	writer    io.Writer
+	opts      EncoderOptions
+	registry  *Registry
+	nextId    uint
+	objects   int
+	typeIds   map[reflect.Type]uint
+	nextRef   uint
+	refs      map[ptrKey]uint
+	ptrMap    map[uint]reflect.Value
+	backings  map[ptrKey]backing
+	arrays    map[uint]bool
+	plain     bool
+	mapRefs   map[ptrKey]uint
+	cyclic    map[containerKey]bool
+	active    map[containerKey]bool
+	depth     int
+	retry     bool
+	types     []reflect.Type
+	newPtrs   []uint
+	started   bool
+	sentType  int
+	fieldIds  map[string]uint32
+	fields    []string
+	sentField int
+	stringIds map[string]uint32
+	strs      []string
+	sentStr   int
+	word      [8]byte
+	ctx       context.Context
+	sum       uint32
+	sent      int64
+	ptrIndex  []ptrOffset
+	objIndex  []int64
+	sealed    *sealedWriter
+	missing   reflect.Type
+	metadata  map[string]string
+	keys      map[string]int64
+	last      int64
+	tally     *tally
+	ptrBytes  int64
+	tracing   bool
+	traced    []traceLine
+	shifted   int
+	path      []string
+	spillFile *os.File
+	spilled   int64
+	tok       *tokenState
+	parts     *[]interface{}
+}
+
+// EncoderOptions selects optional features of the encoded stream. The
+// zero value is the default used by NewEncoder.
+type EncoderOptions struct {
+	// Checksums adds a CRC-32C checksum after the header and after each
+	// object, and a checksum of the entire stream at its end, so that
+	// corruption is detected by the decoder.
+	Checksums bool
+
+	// Streaming writes each object to the output as soon as it is passed
+	// to Write, rather than buffering everything until Finish. Type and
+	// pointer definitions are sent just before the first object needing
+	// them, and values are not kept once they've been sent.
+	Streaming bool
+
+	// Footer implies Streaming, and also ends the stream with a footer
+	// holding the object count, type table and the offset of each pointer
+	// definition, which a decoder reading from an io.ReadSeeker loads
+	// before anything else.
+	Footer bool
+
+	// Markers implies Streaming, and also precedes each object's records
+	// with a marker: a distinctive sequence of bytes and the object's
+	// index. A decoder with the Recover option can then skip past an
+	// object which is corrupted to the next marker, and read on.
+	Markers bool
+
+	// Index implies Footer, and also records the offset of each object in
+	// the footer, so that a decoder reading from an io.ReaderAt can jump
+	// straight to any object using ReadAt.
+	Index bool
+
+	// FieldIds writes each struct field name only once, in a table
+	// alongside the type table, and refers to it by a small id in each
+	// struct written. This makes streams of many small structs much
+	// smaller, and decoding still matches fields by name.
+	FieldIds bool
+
+	// StringIds writes each distinct string value only once, in a table
+	// alongside the type table, and refers to it by a small id wherever it
+	// is used. This makes streams which repeat the same strings many times
+	// much smaller, but the encoder keeps every string it has written.
+	StringIds bool
+
+	// SkipUnsupported leaves out struct fields whose types can't be
+	// encoded, such as channels, functions and sync.Mutex, so that they
+	// are left zero when decoded. Otherwise, writing a struct with such a
+	// field fails with UnsupportedField.
+	SkipUnsupported bool
+
+	// Errors writes the errors held by values of interface types such as
+	// error as their messages, followed by the errors themselves if their
+	// types are registered. Decoders read them back as they were if they
+	// know their types too, and otherwise as errors.New of their messages,
+	// so that errors from other packages, which usually can't be encoded,
+	// are kept.
+	Errors bool
+
+	// Unshared writes each object independently of the others, so that a
+	// pointer shared by several objects is written again for each of them,
+	// and decodes as a separate value for each. Pointers are still shared
+	// within each object.
+	Unshared bool
+
+	// ShareSlices writes slices which share a backing array as references
+	// to it, like pointers, so that they share one array again when
+	// decoded, keeping their lengths and capacities. Each array is written
+	// from as far back as the first slice written from it reaches; slices
+	// reaching further back, or whose capacity was cut short by a full
+	// slice expression, get arrays of their own. Streams written with this
+	// option can't be read as tokens.
+	ShareSlices bool
+
+	// Canonical writes map entries sorted by key, so that equal values
+	// always encode to identical bytes. The type and pointer tables are
+	// always written in id order. Maps keyed by pointers aren't sorted in
+	// a way that's stable between runs.
+	Canonical bool
+
+	// Unexported writes the unexported fields of structs as well as the
+	// exported ones. Individual fields can instead be tagged with
+	// `lager:",export"`. The decoder needs the matching option to read
+	// them back.
+	Unexported bool
+
+	// Schema embeds a description of each type alongside its entry in the
+	// type table, which readers can get from Decoder.Header to check their
+	// compatibility before decoding any objects.
+	Schema bool
+
+	// OmitZero leaves out struct fields which hold their zero value, so
+	// that structs which are mostly zero take little space. The decoder
+	// sets fields left out to zero, even when reading into a value which
+	// already holds something.
+	OmitZero bool
+
+	// Stats counts the bytes written for each type and struct field, for
+	// Encoder.Stats. This slows encoding down.
+	Stats bool
+
+	// SpillThreshold moves the objects buffered before Finish, without the
+	// Streaming option, to a temporary file whenever there are at least
+	// this many bytes of them, and copies them back to the output in
+	// Finish, so that huge streams don't have to be held in memory. The
+	// file is removed by Finish or Reset. Zero keeps everything in memory.
+	SpillThreshold int
+
+	// SpillDir is the directory in which the SpillThreshold option creates
+	// its file, or the default directory for temporary files if empty.
+	SpillDir string
+
+	// Trace receives a line for each record and struct field written, with
+	// its offset in the stream, its type and its field path, for debugging.
+	Trace io.Writer
+
+	// Registry is used for looking up and registering the types written,
+	// in place of the global registry.
+	Registry *Registry
+
+	// RequireRegistered makes Write fail with UnregisteredType when an
+	// object uses a defined type which wasn't registered other than by
+	// being written, as decoders in another process won't know it.
+	RequireRegistered bool
+
+	// EncryptionKey encrypts the stream with AES-GCM, using a key of 16,
+	// 24 or 32 bytes. Only the key's id and a random nonce are written in
+	// the clear, and decoders need the same key to read the stream. The
+	// stream is still seekable, so footers and indexes work as usual, but
+	// in streaming mode the last part of it isn't sent until Finish.
+	// Sessions and records ignore this option.
+	EncryptionKey []byte
 }
 
 // NewEncoder constructs a new encoder whose output stream is the
 // given io.Writer.
 func NewEncoder(w io.Writer) *Encoder {
-	return &Encoder{
-		writer:  w,
-		nextId:  1,
-		objects: 0,
-		buf:     new(bytes.Buffer),
-		typeIds: make(map[reflect.Type]uint),
-		ptrMap:  make(map[uintptr]interface{}),
+	return NewEncoderWithOptions(w, EncoderOptions{})
+}
+
+// NewEncoderWithOptions constructs a new encoder whose output stream is
+// the given io.Writer, using the given options.
+func NewEncoderWithOptions(w io.Writer, opts EncoderOptions) *Encoder {
+	e := &Encoder{
+		writer:    w,
+		opts:      opts,
+		registry:  opts.Registry,
+		nextId:    1,
+		objects:   0,
+		buf:       new(bytes.Buffer),
+		typeIds:   make(map[reflect.Type]uint),
+		nextRef:   nilRef + 1,
+		refs:      make(map[ptrKey]uint),
+		ptrMap:    make(map[uint]reflect.Value),
+		backings:  make(map[ptrKey]backing),
+		arrays:    make(map[uint]bool),
+		mapRefs:   make(map[ptrKey]uint),
+		cyclic:    make(map[containerKey]bool),
+		active:    make(map[containerKey]bool),
+		fieldIds:  make(map[string]uint32),
+		stringIds: make(map[string]uint32),
+		keys:      make(map[string]int64),
+	}
+	if opts.EncryptionKey != nil {
+		e.sealed = newSealedWriter(w, opts.EncryptionKey)
+		e.writer = e.sealed
+	}
+	if opts.Stats {
+		e.tally = newTally()
+	}
+	e.tracing = opts.Trace != nil
+	return e
+}
+
+// Reset discards everything written so far, and prepares the encoder to
+// write a new stream to w, reusing its internal storage. The encoder's
+// options and registry are kept.
+func (e *Encoder) Reset(w io.Writer) {
+	e.writer = w
+	if e.opts.EncryptionKey != nil {
+		e.sealed = newSealedWriter(w, e.opts.EncryptionKey)
+		e.writer = e.sealed
+	}
+	e.buf.Reset()
+	e.nextId = 1
+	e.objects = 0
+	clear(e.typeIds)
+	e.nextRef = nilRef + 1
+	clear(e.refs)
+	clear(e.ptrMap)
+	clear(e.backings)
+	clear(e.arrays)
+	e.plain = false
+	clear(e.mapRefs)
+	clear(e.cyclic)
+	clear(e.active)
+	e.depth = 0
+	e.types = e.types[:0]
+	e.newPtrs = e.newPtrs[:0]
+	e.started = false
+	e.sentType = 0
+	e.sum = 0
+	e.sent = 0
+	e.ptrIndex = e.ptrIndex[:0]
+	e.objIndex = e.objIndex[:0]
+	clear(e.fieldIds)
+	e.fields = e.fields[:0]
+	e.sentField = 0
+	clear(e.stringIds)
+	e.strs = e.strs[:0]
+	e.sentStr = 0
+	e.metadata = nil
+	clear(e.keys)
+	e.ptrBytes = 0
+	e.traced = nil
+	e.shifted = 0
+	e.path = e.path[:0]
+	e.removeSpill()
+	e.tok = nil
+	if e.tally != nil {
+		e.tally.reset()
 	}
 }
 
-// Write encodes the given object and places it into the stream.
-// Objects are buffered until Finish() is called, because the header
-// information must come first on the stream for decoding to work.
-func (e *Encoder) Write(value interface{}) {
-	e.write(value, true)
+// Write encodes the given object and places it into the stream. The
+// object can be a value of any supported kind, including a pointer to a
+// primitive or nil, and is encoded as its dynamic type. Objects are
+// buffered until Finish() is called, because the header information must
+// come first on the stream for decoding to work. If the object contains a
+// value that can't be encoded, an error is returned and nothing is added
+// to the stream, including the types and pointers it used.
+//
+// Pointers are shared between all the objects in a stream: a pointer
+// which several objects refer to is written once, as it was when first
+// written, and decodes as a single value shared by all of them, in every
+// mode. The Unshared option limits this to pointers within each object.
+// Maps and slices which contain themselves are written as references too,
+// so that they contain themselves again when decoded.
+func (e *Encoder) Write(value interface{}) error {
+	if e.tokensOpen() {
+		return UnfinishedTokens{}
+	}
+	if !e.streaming() {
+		if err := e.spill(); err != nil {
+			return err
+		}
+	}
+	if e.opts.Unshared {
+		clear(e.refs)
+		clear(e.backings)
+		clear(e.mapRefs)
+	}
+	n, lines, tables := e.buf.Len(), len(e.traced), e.saveTables()
+	if err := e.writeObject(value); err != nil {
+		e.discard(n, lines)
+		e.restoreTables(tables)
+		return withFieldRoot(err, reflect.TypeOf(value))
+	}
 	e.objects++
+	if e.streaming() {
+		if err := e.writeRecords(); err != nil {
+			e.discardTrace(lines)
+			return err
+		}
+	} else if e.opts.Checksums {
+		e.writeUint32(checksum(0, e.buf.Bytes()[n:]))
+	}
+	if e.tally != nil {
+		e.tally.commit()
+	}
+	return nil
+}
+
+// writeObject writes an object to the buffer. If a map or slice in it is
+// found to contain itself, it's written as a reference from then on, and
+// the object is written again so that it refers to it from the outside
+// too.
+func (e *Encoder) writeObject(value interface{}) error {
+	n, lines := e.buf.Len(), len(e.traced)
+	for {
+		e.retry = false
+		if e.tracing {
+			e.tracef("object %s", e.traceName(reflect.TypeOf(value)))
+		}
+		err := e.checkWrite(e.write(reflect.ValueOf(value), true))
+		if err != nil || !e.retry {
+			return err
+		}
+		e.discard(n, lines)
+	}
+}
+
+// discard drops what was written for an object from the buffer, which
+// held n bytes and the given number of trace lines before it.
+func (e *Encoder) discard(n, lines int) {
+	e.buf.Truncate(n)
+	if e.tally != nil {
+		e.tally.discard()
+	}
+	e.discardTrace(lines)
+}
+
+// tables marks how far the encoder's type, pointer, field and string
+// tables had grown, so that what a failed Write added to them can be
+// taken back.
+type tables struct {
+	nextId, nextRef uint
+	types, ptrs     int
+	fields, strs    int
+}
+
+// saveTables returns how far the encoder's tables have grown.
+func (e *Encoder) saveTables() tables {
+	return tables{e.nextId, e.nextRef, len(e.types), len(e.newPtrs), len(e.fields), len(e.strs)}
+}
+
+// restoreTables takes back every type, pointer, field name and string
+// added to the encoder's tables since they were saved, along with the
+// structures of the types.
+func (e *Encoder) restoreTables(t tables) {
+	for _, typ := range e.types[t.types:] {
+		delete(e.typeIds, typ)
+	}
+	e.types = e.types[:t.types]
+	e.nextId = t.nextId
+	for ref := t.nextRef; ref < e.nextRef; ref++ {
+		delete(e.ptrMap, ref)
+		delete(e.arrays, ref)
+	}
+	maps.DeleteFunc(e.refs, func(_ ptrKey, ref uint) bool { return ref >= t.nextRef })
+	maps.DeleteFunc(e.mapRefs, func(_ ptrKey, ref uint) bool { return ref >= t.nextRef })
+	maps.DeleteFunc(e.backings, func(_ ptrKey, b backing) bool { return b.ref >= t.nextRef })
+	e.newPtrs = e.newPtrs[:t.ptrs]
+	e.nextRef = t.nextRef
+	for _, name := range e.fields[t.fields:] {
+		delete(e.fieldIds, name)
+	}
+	e.fields = e.fields[:t.fields]
+	for _, str := range e.strs[t.strs:] {
+		delete(e.stringIds, str)
+	}
+	e.strs = e.strs[:t.strs]
+}
+
+// WriteKeyed writes an object as Write does, and records its offset under
+// the given key in the stream's footer, so that Decoder.ReadKey can jump
+// straight to it. This requires the Footer or Index option, without which
+// it fails with NoIndex. Each key can only be used once in a stream.
+func (e *Encoder) WriteKeyed(key string, value interface{}) error {
+	if !e.footer() {
+		return NoIndex{}
+	}
+	if _, ok := e.keys[key]; ok {
+		return DuplicateKey{key}
+	}
+	if err := e.Write(value); err != nil {
+		return err
+	}
+	e.keys[key] = e.last
+	return nil
+}
+
+// Finish should be called to terminate the stream. This writes the
+// stream's magic sequence, format version and flags, collects type
+// information and a map of pointers and pushes them to the output stream,
+// followed by the buffered objects and, if enabled, the stream checksum.
+// In streaming mode, everything but the end of the stream and its footer
+// has already been sent. The output is then flushed as by Flush.
+func (e *Encoder) Finish() error {
+	if e.tokensOpen() {
+		return UnfinishedTokens{}
+	}
+	if err := e.missingTokenPtr(); err != nil {
+		return err
+	}
+	err := e.finish()
+	if err == nil && e.sealed != nil {
+		err = e.sealed.Close()
+	}
+	if err == nil {
+		err = e.flushWriter()
+	}
+	return err
+}
+
+// Flush sends everything written so far to the output, so that a stream
+// cut short by a crash can be read up to the last object flushed, and
+// past damage with the Markers and Recover options. If the output has a
+// Flush method, as a bufio.Writer does, that is called too; files need
+// to be synced separately to survive a system crash. Objects are already
+// sent as they're written in streaming mode, so Flush only needs to send
+// the header if no object has been written yet. Encrypted streams keep
+// back the part of the stream which doesn't fill a whole chunk. Without
+// the Streaming option, nothing can be sent before Finish, and Flush
+// fails with NotStreaming.
+func (e *Encoder) Flush() error {
+	if !e.streaming() {
+		return NotStreaming{}
+	}
+	if err := e.flushRecords(); err != nil {
+		return err
+	}
+	return e.flushWriter()
+}
+
+// flushWriter calls the Flush method of the encoder's output, if it has
+// one.
+func (e *Encoder) flushWriter() error {
+	w := e.writer
+	if e.sealed != nil {
+		w = e.sealed.w
+	}
+	if f, ok := w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
 }
 
-// Finish should be called to terminate the stream. This collects
-// type information and a map of pointers and pushes them to the
-// output stream, followed by the buffered objects.
-func (e *Encoder) Finish() {
-	tmp := e.buf
-	e.buf = new(bytes.Buffer)
+func (e *Encoder) finish() error {
+	if e.streaming() {
+		return e.finishRecords()
+	}
+	body := e.buf
+	e.shiftTrace()
+	bodyTrace := e.takeTrace()
+	header := getBuffer()
+	e.buf = header
+	defer func() {
+		putBuffer(header)
+		body.Reset()
+		e.buf = body
+		e.removeSpill()
+	}()
+	e.writePreamble()
 	e.writeInt(e.objects)
-	e.writeInt(len(e.typeIds))
-	for t, id := range e.typeIds {
-		e.writeString(t.String())
-		e.writeUint(id)
+	e.writeTypeTable()
+	if e.opts.FieldIds {
+		e.writeFieldTable()
+	}
+	if e.opts.StringIds {
+		e.writeStringTable()
+	}
+	start := e.buf.Len()
+	if err := e.writePtrTable(); err != nil {
+		return err
+	}
+	e.ptrBytes += int64(e.buf.Len() - start)
+	if e.tally != nil {
+		e.tally.commit()
 	}
-	e.writeInt(len(e.ptrMap))
-	for ptr, v := range e.ptrMap {
-		e.writeUintptr(ptr)
-		e.write(v, true)
+	if e.opts.Checksums {
+		e.writeUint32(checksum(0, e.buf.Bytes()))
+	}
+	e.buf = body
+	if e.tracing {
+		e.sendTrace(0, e.takeTrace())
+		e.sendTrace(int64(header.Len()), bodyTrace)
+	}
+	sum := checksum(0, header.Bytes())
+	e.sent = int64(header.Len())
+	if _, err := header.WriteTo(e.writer); err != nil {
+		return err
+	}
+	if e.spillFile != nil {
+		var err error
+		if sum, err = e.unspill(sum); err != nil {
+			return err
+		}
+		e.sent += e.spilled
 	}
-	e.buf.WriteTo(e.writer)
-	tmp.WriteTo(e.writer)
-	e.buf = new(bytes.Buffer)
+	if e.opts.Checksums {
+		e.writeUint32(checksum(sum, body.Bytes()))
+	}
+	e.sent += int64(body.Len())
+	_, err := body.WriteTo(e.writer)
+	return err
+}
+
+// SetMetadata attaches the given key/value pairs to the stream's header,
+// replacing any set before, so that they can be read back with
+// Decoder.Metadata. In streaming mode the header is sent along with the
+// first object, after which SetMetadata fails with HeaderSent.
+func (e *Encoder) SetMetadata(metadata map[string]string) error {
+	if e.started {
+		return HeaderSent{}
+	}
+	e.metadata = maps.Clone(metadata)
+	return nil
 }
 
+// writePtrTable writes the value of every pointer written so far, keyed
+// by reference id.
+func (e *Encoder) writePtrTable() error {
+	e.writeInt(len(e.ptrMap) + e.tokenPtrCount())
+	for ref := uint(nilRef + 1); ref < e.nextRef; ref++ {
+		if data, name, ok := e.takeTokenPtr(ref); ok {
+			if e.tracing {
+				e.tracef("pointer %d %s", ref, name)
+			}
+			e.writeUint(ref)
+			e.buf.Write(data)
+			continue
+		}
+		v, ok := e.ptrMap[ref]
+		if !ok {
+			continue
+		}
+		if e.tracing {
+			e.tracef("pointer %d %s", ref, e.traceName(v.Type()))
+		}
+		e.writeUint(ref)
+		if err := e.writeEntry(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePreamble writes the magic sequence, format version and flags which
+// begin every stream.
+func (e *Encoder) writePreamble() {
+	e.buf.Write(magic[:])
+	e.writeUint8(formatVersion)
+	e.writeUint16(e.flags())
+	if len(e.metadata) > 0 {
+		e.writeMetadata()
+	}
+}
+
+// writeMetadata writes the metadata set by SetMetadata, sorted by key.
+func (e *Encoder) writeMetadata() {
+	e.writeInt(len(e.metadata))
+	for _, key := range slices.Sorted(maps.Keys(e.metadata)) {
+		e.writeString(key)
+		e.writeString(e.metadata[key])
+	}
+}
+
+// flags returns the header flags for the encoder's options.
+func (e *Encoder) flags() uint16 {
+	var flags uint16
+	if e.opts.Checksums {
+		flags |= flagChecksums
+	}
+	if e.streaming() {
+		flags |= flagStreaming
+	}
+	if e.footer() {
+		flags |= flagFooter | flagKeys
+	}
+	if e.opts.Index {
+		flags |= flagIndex
+	}
+	if e.opts.FieldIds {
+		flags |= flagFieldIds
+	}
+	if e.opts.Schema {
+		flags |= flagSchema
+	}
+	if e.opts.OmitZero {
+		flags |= flagOmitZero
+	}
+	if e.opts.StringIds {
+		flags |= flagStringIds
+	}
+	if len(e.metadata) > 0 {
+		flags |= flagMetadata
+	}
+	if e.opts.Markers {
+		flags |= flagMarkers
+	}
+	return flags
+}
+
+// streaming returns whether objects are sent as records when written.
+func (e *Encoder) streaming() bool {
+	return e.opts.Streaming || e.opts.Markers || e.footer()
+}
+
+// footer returns whether the stream ends with a footer.
+func (e *Encoder) footer() bool {
+	return e.opts.Footer || e.opts.Index
+}
+
+// checkWrite returns the error from writing a value, or if there was none,
+// UnregisteredType if the value used a type which isn't registered.
+func (e *Encoder) checkWrite(err error) error {
+	if err == nil && e.missing != nil {
+		err = UnregisteredType{e.missing}
+	}
+	e.missing = nil
+	return err
+}
+
+// TypesUsed returns the names of the types in the stream's type table so
+// far, in the order they were first used. A decoder must be able to find
+// each of them, apart from the struct types written with their structure.
+// Struct types only known by name, from WriteToken, come last.
+func (e *Encoder) TypesUsed() []string {
+	names := make([]string, len(e.types))
+	for i, t := range e.types {
+		names[i] = e.typeName(t)
+	}
+	return append(names, e.tokenTypeNames()...)
+}
+
+// registerType returns the id of a type in the type table, adding it, and
+// the types of its structure if it has one, if it isn't there yet. If the
+// Write using it fails, restoreTables takes them back out together.
 func (e *Encoder) registerType(t reflect.Type) uint {
-	RegisterType(t)
+	if e.opts.RequireRegistered && e.missing == nil && t.Name() != "" && !isExplicit(e.registry, t) {
+		e.missing = t
+	}
+	if e.registry != nil {
+		e.registry.autoRegister(t)
+	} else {
+		defaultRegistry.autoRegister(t)
+	}
 	id, ok := e.typeIds[t]
 	if !ok {
 		id = e.nextId
 		e.typeIds[t] = id
+		e.types = append(e.types, t)
 		e.nextId++
+		if e.hasStructure(t) {
+			e.registerStructure(t)
+		}
 	}
 	return id
 }
 
-func (e *Encoder) storePtr(w reflect.Value, ptr uintptr) {
-	if _, ok := e.ptrMap[ptr]; !ok {
-		e.ptrMap[ptr] = w.Elem().Interface()
-		tmp := e.buf
-		e.buf = new(bytes.Buffer)
-		e.write(e.ptrMap[ptr], false)
-		e.buf = tmp
+// storePtr returns the reference id of the given pointer, assigning the
+// next id if the pointer hasn't been seen before. A copy of the value it
+// points to is kept, to be written to the stream later.
+func (e *Encoder) storePtr(w reflect.Value) (uint, error) {
+	key := ptrKey{w.Pointer(), w.Type().Elem()}
+	if ref, ok := e.refs[key]; ok {
+		return ref, nil
+	}
+	ref := e.nextRef
+	e.nextRef++
+	e.refs[key] = ref
+	elem := reflect.New(w.Type().Elem()).Elem()
+	elem.Set(w.Elem())
+	if err := e.storeRef(ref, elem); err != nil {
+		delete(e.refs, key)
+		return 0, err
+	}
+	return ref, nil
+}
+
+// storeRef keeps the value of a new pointer or backing array under its
+// reference id, to be written to the stream later. The value is written
+// once now, and discarded, to find the types and pointers it uses.
+func (e *Encoder) storeRef(ref uint, elem reflect.Value) error {
+	e.ptrMap[ref] = elem
+	tmp, missing, tally, tracing := e.buf, e.missing, e.tally, e.tracing
+	e.buf, e.missing, e.tally, e.tracing = getBuffer(), nil, nil, false
+	err := e.checkWrite(e.writeEntry(ref))
+	putBuffer(e.buf)
+	e.buf, e.missing, e.tally, e.tracing = tmp, missing, tally, tracing
+	if err != nil {
+		delete(e.ptrMap, ref)
+		return err
+	}
+	e.newPtrs = append(e.newPtrs, ref)
+	return nil
+}
+
+// writeEntry writes the value kept under a reference id. Backing arrays
+// and maps which contain themselves are written plainly, rather than as
+// references to themselves.
+func (e *Encoder) writeEntry(ref uint) error {
+	e.plain = e.arrays[ref]
+	return e.writeElem(e.ptrMap[ref])
+}
+
+// writeElem writes the value a pointer points to, preceded by its type.
+// Interfaces are written as the interface type followed by their dynamic
+// type and value, so that pointers to interfaces decode as such.
+func (e *Encoder) writeElem(w reflect.Value) error {
+	if w.Kind() == reflect.Interface {
+		e.writeType(w.Type())
+	}
+	return e.write(w, true)
+}
+
+// writeFieldName writes the name of a struct field, or its id if the
+// encoder is using field ids, assigning the next id to new names.
+func (e *Encoder) writeFieldName(name string) {
+	if !e.opts.FieldIds {
+		e.writeString(name)
+		return
+	}
+	id, ok := e.fieldIds[name]
+	if !ok {
+		id = uint32(len(e.fields))
+		e.fieldIds[name] = id
+		e.fields = append(e.fields, name)
+	}
+	e.writeUint32(id)
+}
+
+// writeStringValue writes a string value, or its id if the encoder is
+// using string ids, assigning the next id to new strings.
+func (e *Encoder) writeStringValue(s string) {
+	if !e.opts.StringIds {
+		e.writeString(s)
+		return
+	}
+	id, ok := e.stringIds[s]
+	if !ok {
+		id = uint32(len(e.strs))
+		e.stringIds[s] = id
+		e.strs = append(e.strs, s)
+	}
+	e.writeUint32(id)
+}
+
+// writeTypeTable writes every type seen so far.
+func (e *Encoder) writeTypeTable() {
+	names := e.tokenTypeNames()
+	e.writeInt(len(e.types) + len(names))
+	for _, t := range e.types {
+		e.writeTypeEntry(t)
+	}
+	for _, name := range names {
+		e.writeTokenTypeEntry(name)
+	}
+}
+
+// writeTypeEntry writes a type's name, id, fingerprint and version, its
+// schema if enabled, and its structure if it has one.
+func (e *Encoder) writeTypeEntry(t reflect.Type) {
+	name := e.typeName(t)
+	s := describeType(e.registry, name, t, e.opts.Unexported)
+	if e.tracing {
+		e.tracef("type %d %s", e.typeIds[t], name)
+	}
+	e.writeString(name)
+	e.writeUint(e.typeIds[t])
+	e.writeUint64(s.Fingerprint())
+	e.writeInt(s.Version)
+	if e.opts.Schema {
+		e.writeSchema(s)
+	}
+	e.writeStructure(t)
+}
+
+// writeFieldTable writes every field name seen so far, with its id.
+func (e *Encoder) writeFieldTable() {
+	e.writeInt(len(e.fields))
+	for id, name := range e.fields {
+		if e.tracing {
+			e.tracef("name %d %s", id, name)
+		}
+		e.writeString(name)
+		e.writeUint32(uint32(id))
+	}
+}
+
+// writeStringTable writes every string value seen so far, with its id.
+func (e *Encoder) writeStringTable() {
+	e.writeInt(len(e.strs))
+	for id, s := range e.strs {
+		if e.tracing {
+			e.tracef("string %d", id)
+		}
+		e.writeString(s)
+		e.writeUint32(uint32(id))
 	}
 }
 
 func (e *Encoder) writeType(t reflect.Type) {
-	e.writeUint8(uint8(t.Kind()))
-	switch t.Kind() {
+	if c, ok := lookupCodec(e.registry, t); ok {
+		e.writeUint8(uint8(c.kind))
+		if c.kind == codecKind {
+			e.writeUint(e.registerType(t))
+		}
+		return
+	}
+	if e.isNamed(t) {
+		e.writeUint8(uint8(namedKind))
+		e.writeUint(e.registerType(t))
+		e.writeUnderlying(t)
+		return
+	}
+	kind := wireKind(t)
+	e.writeUint8(uint8(kind))
+	switch kind {
 	case reflect.Map:
 		e.writeType(t.Key())
 		e.writeType(t.Elem())
 	case reflect.Ptr, reflect.Slice:
 		e.writeType(t.Elem())
-	case reflect.Struct, reflect.Interface:
+	case reflect.Struct, reflect.Interface, binaryKind:
 		id := e.registerType(t)
 		e.writeUint(id)
 	}
 }
 
+// writeUnderlying writes the underlying type of a named type, so that its
+// values can be read without knowing the named type.
+func (e *Encoder) writeUnderlying(t reflect.Type) {
+	kind := t.Kind()
+	e.writeUint8(uint8(kind))
+	switch kind {
+	case reflect.Map:
+		e.writeType(t.Key())
+		e.writeType(t.Elem())
+	case reflect.Ptr, reflect.Slice:
+		e.writeType(t.Elem())
+	}
+}
+
 func (e *Encoder) writeBool(v bool) {
 	if v {
 		e.writeUint8(1)
@@ -110,43 +896,19 @@ func (e *Encoder) writeInt(v int) {
 }
 
 func (e *Encoder) writeInt8(v int8) {
-	var u uint8
-	if v < 0 {
-		u = uint8(^v<<1) | 1
-	} else {
-		u = uint8(v << 1)
-	}
-	e.writeUint8(u)
+	e.writeUint8(zigzag[uint8](v))
 }
 
 func (e *Encoder) writeInt16(v int16) {
-	var u uint16
-	if v < 0 {
-		u = uint16(^v<<1) | 1
-	} else {
-		u = uint16(v << 1)
-	}
-	e.writeUint16(u)
+	e.writeUint16(zigzag[uint16](v))
 }
 
 func (e *Encoder) writeInt32(v int32) {
-	var u uint32
-	if v < 0 {
-		u = uint32(^v<<1) | 1
-	} else {
-		u = uint32(v << 1)
-	}
-	e.writeUint32(u)
+	e.writeUint32(zigzag[uint32](v))
 }
 
 func (e *Encoder) writeInt64(v int64) {
-	var u uint64
-	if v < 0 {
-		u = uint64(^v<<1) | 1
-	} else {
-		u = uint64(v << 1)
-	}
-	e.writeUint64(u)
+	e.writeUint64(zigzag[uint64](v))
 }
 
 func (e *Encoder) writeUint(v uint) {
@@ -158,37 +920,15 @@ func (e *Encoder) writeUint8(v uint8) {
 }
 
 func (e *Encoder) writeUint16(v uint16) {
-	e.buf.WriteByte(byte(v))
-	v >>= 8
-	e.buf.WriteByte(byte(v))
+	e.buf.Write(byteOrder.AppendUint16(e.word[:0], v))
 }
 
 func (e *Encoder) writeUint32(v uint32) {
-	e.buf.WriteByte(byte(v))
-	v >>= 8
-	e.buf.WriteByte(byte(v))
-	v >>= 8
-	e.buf.WriteByte(byte(v))
-	v >>= 8
-	e.buf.WriteByte(byte(v))
+	e.buf.Write(byteOrder.AppendUint32(e.word[:0], v))
 }
 
 func (e *Encoder) writeUint64(v uint64) {
-	e.buf.WriteByte(byte(v))
-	v >>= 8
-	e.buf.WriteByte(byte(v))
-	v >>= 8
-	e.buf.WriteByte(byte(v))
-	v >>= 8
-	e.buf.WriteByte(byte(v))
-	v >>= 8
-	e.buf.WriteByte(byte(v))
-	v >>= 8
-	e.buf.WriteByte(byte(v))
-	v >>= 8
-	e.buf.WriteByte(byte(v))
-	v >>= 8
-	e.buf.WriteByte(byte(v))
+	e.buf.Write(byteOrder.AppendUint64(e.word[:0], v))
 }
 
 func (e *Encoder) writeUintptr(v uintptr) {
@@ -213,32 +953,123 @@ func (e *Encoder) writeComplex128(v complex128) {
 	e.writeUint64(math.Float64bits(imag(v)))
 }
 
-func (e *Encoder) writeMap(v interface{}) {
-	w := reflect.ValueOf(v)
+// writeTime writes a time without its monotonic clock reading. The location
+// is kept by name, along with the zone offset in case the decoder can't
+// load a location of that name.
+func (e *Encoder) writeTime(v time.Time) {
+	_, offset := v.Zone()
+	e.writeInt64(v.Unix())
+	e.writeInt32(int32(v.Nanosecond()))
+	e.writeString(v.Location().String())
+	e.writeInt32(int32(offset))
+}
+
+func (e *Encoder) writeMap(w reflect.Value) error {
+	plain := e.plain
+	e.plain = false
+	if w.IsNil() {
+		e.writeInt(nilLength)
+		return nil
+	}
+	if plain {
+		return e.writeMapEntries(w)
+	}
+	if e.enter(w) {
+		return e.writeSharedMap(w)
+	}
+	err := e.writeMapEntries(w)
+	e.leave(w)
+	return err
+}
+
+// writeMapEntries writes a map's length and entries.
+func (e *Encoder) writeMapEntries(w reflect.Value) error {
 	e.writeInt(w.Len())
-	keyIsInterface := w.Type().Key().Kind() == reflect.Interface
-	valIsInterface := w.Type().Elem().Kind() == reflect.Interface
-	for _, key := range w.MapKeys() {
-		e.write(key.Interface(), keyIsInterface)
-		e.write(w.MapIndex(key).Interface(), valIsInterface)
+	keyIsInterface := isInterface(w.Type().Key())
+	valIsInterface := isInterface(w.Type().Elem())
+	keys := w.MapKeys()
+	if e.opts.Canonical {
+		sortKeys(keys)
+	}
+	for i, key := range keys {
+		if err := checkContext(e.ctx, i); err != nil {
+			return err
+		}
+		if err := e.write(key, keyIsInterface); err != nil {
+			return err
+		}
+		if e.tracing {
+			e.tracePath(fmt.Sprintf("[%v]", key))
+		}
+		if err := e.write(w.MapIndex(key), valIsInterface); err != nil {
+			return withFieldPath(err, fmt.Sprintf("[%v]", key))
+		}
+		if e.tracing {
+			e.leavePath()
+		}
+	}
+	return nil
+}
+
+func (e *Encoder) writePtr(w reflect.Value) error {
+	if w.IsNil() {
+		e.writeUint(nilRef)
+		return nil
 	}
+	ref, err := e.storePtr(w)
+	if err != nil {
+		return err
+	}
+	e.writeUint(ref)
+	return nil
 }
 
-func (e *Encoder) writePtr(v interface{}) {
-	w := reflect.ValueOf(v)
-	ptr := w.Pointer()
-	e.storePtr(w, ptr)
-	e.writeUintptr(ptr)
+func (e *Encoder) writeSlice(w reflect.Value) error {
+	plain := e.plain
+	e.plain = false
+	if w.IsNil() {
+		e.writeInt(nilLength)
+		return nil
+	}
+	if e.opts.ShareSlices && !plain && w.Cap() > 0 && w.Type().Elem().Size() > 0 {
+		return e.writeSharedSlice(w)
+	}
+	if plain {
+		return e.writeSliceElems(w)
+	}
+	if e.enter(w) {
+		return e.writeSharedSlice(w)
+	}
+	err := e.writeSliceElems(w)
+	e.leave(w)
+	return err
 }
 
-func (e *Encoder) writeSlice(v interface{}) {
-	w := reflect.ValueOf(v)
+// writeSliceElems writes a slice's length, preceded by its capacity if
+// that's greater, and elements.
+func (e *Encoder) writeSliceElems(w reflect.Value) error {
+	if w.Cap() > w.Len() {
+		e.writeInt(cappedLength)
+		e.writeInt(w.Cap())
+	}
 	e.writeInt(w.Len())
 	isInterface := isInterface(w.Type().Elem())
 	n := w.Len()
 	for i := 0; i < n; i++ {
-		e.write(w.Index(i).Interface(), isInterface)
+		if err := checkContext(e.ctx, i); err != nil {
+			return err
+		}
+		if e.tracing {
+			e.tracePath("[" + strconv.Itoa(i) + "]")
+		}
+		if err := e.write(w.Index(i), isInterface); err != nil {
+			return withFieldPath(err, "["+strconv.Itoa(i)+"]")
+		}
+		if e.tracing {
+			e.leavePath()
+		}
 	}
+	return nil
 }
 
 func (e *Encoder) writeString(v string) {
@@ -246,73 +1077,172 @@ func (e *Encoder) writeString(v string) {
 	e.buf.WriteString(v)
 }
 
-func (e *Encoder) writeStruct(v interface{}) {
-	w := reflect.ValueOf(v)
+func (e *Encoder) writeBytes(v []byte) {
+	e.writeInt(len(v))
+	e.buf.Write(v)
+}
+
+func (e *Encoder) writeBinary(w reflect.Value) error {
 	t := w.Type()
 	e.registerType(t)
-	e.writeInt(numPublicFields(t))
-	n := t.NumField()
-	for i := 0; i < n; i++ {
-		f := t.Field(i)
-		if privateField(f) {
+	m, ok := w.Interface().(encoding.BinaryMarshaler)
+	if !ok {
+		p := reflect.New(t)
+		p.Elem().Set(w)
+		m = p.Interface().(encoding.BinaryMarshaler)
+	}
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	e.writeBytes(data)
+	return nil
+}
+
+func (e *Encoder) writeStruct(w reflect.Value) error {
+	t := w.Type()
+	e.registerType(t)
+	w, err := beforeEncode(w)
+	if err != nil {
+		return err
+	}
+	fields := structFields(t, e.opts.Unexported)
+	if !w.CanAddr() && slices.ContainsFunc(fields, func(f field) bool { return f.private }) {
+		addressable := reflect.New(t).Elem()
+		addressable.Set(w)
+		w = addressable
+	}
+	var unknown []unknownField
+	if i, ok := unknownFieldsIndex(t); ok {
+		unknown = w.Field(i).Interface().(UnknownFields).fields
+	}
+	n := len(fields) + len(unknown)
+	for _, f := range fields {
+		if f.unsupported && !e.opts.SkipUnsupported {
+			return UnsupportedField{"." + f.name, f.typ}
+		}
+		if e.omitted(w, f) {
+			n--
+		}
+	}
+	e.writeInt(n)
+	for _, f := range fields {
+		if e.omitted(w, f) {
 			continue
 		}
-		e.writeString(f.Name)
-		e.write(w.Field(i).Interface(), isInterface(f.Type))
+		start := e.buf.Len()
+		if e.tracing {
+			e.traceField(f.name, e.traceName(dynamicType(fieldValue(w, f))))
+		}
+		e.writeFieldName(f.name)
+		if err := e.write(fieldValue(w, f), true); err != nil {
+			return withFieldPath(err, "."+f.name)
+		}
+		if e.tracing {
+			e.leavePath()
+		}
+		if e.tally != nil {
+			e.countField(t, f.name, start)
+		}
+	}
+	for _, f := range unknown {
+		e.writeFieldName(f.name)
+		if err := e.write(f.value, true); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// omitted returns whether a struct field is left out of the stream.
+func (e *Encoder) omitted(w reflect.Value, f field) bool {
+	return f.unsupported || e.opts.OmitZero && fieldValue(w, f).IsZero()
 }
 
-func (e *Encoder) write(v interface{}, sendType bool) {
-	t := reflect.TypeOf(v)
+// write encodes the given value, preceded by its type if sendType is
+// set. Interface values are unwrapped and encoded as their dynamic value.
+func (e *Encoder) write(w reflect.Value, sendType bool) error {
+	if w.Kind() == reflect.Interface {
+		if sendType && isTypedNil(w.Elem()) {
+			e.writeUint8(uint8(typedNilKind))
+			e.writeType(w.Elem().Type())
+			return nil
+		}
+		if e.opts.Errors && sendType && !w.IsNil() && w.Type().Implements(errorType) {
+			return e.writeError(w.Elem())
+		}
+		w = w.Elem()
+	}
+	if !w.IsValid() {
+		if !sendType {
+			return UnsupportedWrite{reflect.Invalid}
+		}
+		e.writeUint8(uint8(nilKind))
+		return nil
+	}
+	t := w.Type()
+	if e.tally != nil {
+		defer e.countType(t, e.buf.Len())
+	}
 	if sendType {
 		e.writeType(t)
 	}
-	switch t.Kind() {
+	if c, ok := lookupCodec(e.registry, t); ok {
+		return e.writeCustom(c, w)
+	}
+	switch wireKind(t) {
 	case reflect.Bool:
-		e.writeBool(v.(bool))
+		e.writeBool(w.Bool())
 	case reflect.Int:
-		e.writeInt(v.(int))
+		e.writeInt(int(w.Int()))
 	case reflect.Int8:
-		e.writeInt8(v.(int8))
+		e.writeInt8(int8(w.Int()))
 	case reflect.Int16:
-		e.writeInt16(v.(int16))
+		e.writeInt16(int16(w.Int()))
 	case reflect.Int32:
-		e.writeInt32(v.(int32))
+		e.writeInt32(int32(w.Int()))
 	case reflect.Int64:
-		e.writeInt64(v.(int64))
+		e.writeInt64(w.Int())
 	case reflect.Uint:
-		e.writeUint(v.(uint))
+		e.writeUint(uint(w.Uint()))
 	case reflect.Uint8:
-		e.writeUint8(v.(uint8))
+		e.writeUint8(uint8(w.Uint()))
 	case reflect.Uint16:
-		e.writeUint16(v.(uint16))
+		e.writeUint16(uint16(w.Uint()))
 	case reflect.Uint32:
-		e.writeUint32(v.(uint32))
+		e.writeUint32(uint32(w.Uint()))
 	case reflect.Uint64:
-		e.writeUint64(v.(uint64))
+		e.writeUint64(w.Uint())
 	case reflect.Uintptr:
-		e.writeUintptr(v.(uintptr))
+		e.writeUintptr(uintptr(w.Uint()))
 	case reflect.Float32:
-		e.writeFloat32(v.(float32))
+		e.writeFloat32(float32(w.Float()))
 	case reflect.Float64:
-		e.writeFloat64(v.(float64))
+		e.writeFloat64(w.Float())
 	case reflect.Complex64:
-		e.writeComplex64(v.(complex64))
+		e.writeComplex64(complex64(w.Complex()))
 	case reflect.Complex128:
-		e.writeComplex128(v.(complex128))
-	case reflect.Array, reflect.Chan, reflect.Func, reflect.Interface:
-		panic("Can't write " + t.Kind().String() + " types")
+		e.writeComplex128(w.Complex())
 	case reflect.Map:
-		e.writeMap(v)
+		return e.writeMap(w)
 	case reflect.Ptr:
-		e.writePtr(v)
+		return e.writePtr(w)
 	case reflect.Slice:
-		e.writeSlice(v)
+		return e.writeSlice(w)
 	case reflect.String:
-		e.writeString(v.(string))
+		e.writeStringValue(w.String())
 	case reflect.Struct:
-		e.writeStruct(v)
+		return e.writeStruct(w)
+	case binaryKind:
+		return e.writeBinary(w)
+	case timeKind:
+		e.writeTime(w.Interface().(time.Time))
+	case durationKind:
+		e.writeInt64(w.Int())
+	case bigIntKind, bigFloatKind, bigRatKind:
+		return e.writeBig(w)
 	default:
-		panic("Unknown type kind: " + t.Kind().String())
+		return UnsupportedWrite{t.Kind()}
 	}
+	return nil
 }
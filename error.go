@@ -1,9 +1,20 @@
 package lager
 
 import (
+	"fmt"
+	"io"
 	"reflect"
+	"slices"
+	"strconv"
+	"strings"
 )
 
+// The errors returned by this package are structs whose fields are read
+// through accessor methods. As with ==, errors.Is only matches an error
+// equal to its target, so errors.As is used to check for any error of a
+// given type. Those which also match errors from io, or hold slices which
+// == can't compare, have Is methods of their own.
+
 // UnsupportedRead is returned when the serialized data contains
 // type information that the decoder doesn't know how to read.
 type UnsupportedRead struct {
@@ -14,7 +25,160 @@ func (err UnsupportedRead) Error() string {
 	return "Can't read " + err.kind.String() + " types"
 }
 
-// MissingtypeId is returned when a unique type ID from the
+// Kind returns the kind which can't be read.
+func (err UnsupportedRead) Kind() reflect.Kind {
+	return err.kind
+}
+
+// InvalidMagic is returned when a stream doesn't begin with the magic
+// sequence written by the encoder, meaning it isn't lager data at all.
+type InvalidMagic struct{}
+
+func (_ InvalidMagic) Error() string {
+	return "Stream does not begin with lager magic sequence"
+}
+
+// WrongKey is returned when a stream is encrypted with a different key
+// from the decoder's, or the decoder has none.
+type WrongKey struct{}
+
+func (_ WrongKey) Error() string {
+	return "Stream is encrypted with a different key"
+}
+
+// HeaderSent is returned by Encoder.SetMetadata once a streaming-mode
+// encoder has sent the stream's header.
+type HeaderSent struct{}
+
+func (_ HeaderSent) Error() string {
+	return "Stream header has already been sent"
+}
+
+// UnregisteredType is returned by Write when the RequireRegistered option
+// is set and an object uses a type which wasn't registered.
+type UnregisteredType struct {
+	t reflect.Type
+}
+
+func (err UnregisteredType) Error() string {
+	return "Type " + err.t.String() + " is not registered"
+}
+
+// Type returns the type which isn't registered.
+func (err UnregisteredType) Type() reflect.Type {
+	return err.t
+}
+
+// UnsupportedVersion is returned when a stream was written using a
+// format version which this decoder can't read.
+type UnsupportedVersion struct {
+	version uint8
+}
+
+func (err UnsupportedVersion) Error() string {
+	return "Unsupported lager format version " + strconv.Itoa(int(err.version))
+}
+
+// Version returns the format version the stream was written with.
+func (err UnsupportedVersion) Version() uint8 {
+	return err.version
+}
+
+// CorruptStream is returned when a checksum in the stream doesn't match
+// the data it covers, or a section of the stream is malformed, meaning the
+// stream was truncated or damaged.
+type CorruptStream struct {
+	section string
+}
+
+func (err CorruptStream) Error() string {
+	return "Stream is corrupt in " + err.section
+}
+
+// Section returns the section of the stream which is corrupt.
+func (err CorruptStream) Section() string {
+	return err.section
+}
+
+// Overflow is returned when a value of a platform-sized kind, such as an
+// int, reference id or length, is too large for this platform. Such values
+// are always written as 64 bits, so a stream written on a 64-bit platform
+// may hold values which a 32-bit one can't represent.
+type Overflow struct {
+	kind  reflect.Kind
+	value uint64
+}
+
+func (err Overflow) Error() string {
+	value := strconv.FormatUint(err.value, 10)
+	if err.kind == reflect.Int {
+		value = strconv.FormatInt(int64(err.value), 10)
+	}
+	return "Value " + value + " overflows " + err.kind.String()
+}
+
+// Kind returns the kind of the value which overflowed.
+func (err Overflow) Kind() reflect.Kind {
+	return err.kind
+}
+
+// UnknownRecord is returned when a streaming-mode stream contains a
+// record tag which the decoder doesn't recognize. This could happen if the
+// data was invalid or corrupt.
+type UnknownRecord struct {
+	tag uint8
+}
+
+func (err UnknownRecord) Error() string {
+	return "Encountered unknown record tag " + strconv.Itoa(int(err.tag))
+}
+
+// Tag returns the unrecognized record tag.
+func (err UnknownRecord) Tag() uint8 {
+	return err.tag
+}
+
+// OutOfSequence is returned when a Session is given a message other than
+// the next one marshaled by its peer, for instance because a message was
+// lost or delivered twice. Later messages may refer to types defined in
+// earlier ones, so they must be decoded in order.
+type OutOfSequence struct {
+	expected uint
+	actual   uint
+}
+
+func (err OutOfSequence) Error() string {
+	return "Expected session message " + strconv.FormatUint(uint64(err.expected), 10) +
+		" but got " + strconv.FormatUint(uint64(err.actual), 10)
+}
+
+// Expected returns the sequence number of the next message.
+func (err OutOfSequence) Expected() uint {
+	return err.expected
+}
+
+// Actual returns the sequence number of the message given.
+func (err OutOfSequence) Actual() uint {
+	return err.actual
+}
+
+// UnsupportedWrite is returned when an object passed to the encoder
+// contains a value whose kind can't be serialized, such as a channel
+// or function.
+type UnsupportedWrite struct {
+	kind reflect.Kind
+}
+
+func (err UnsupportedWrite) Error() string {
+	return "Can't write " + err.kind.String() + " types"
+}
+
+// Kind returns the kind which can't be written.
+func (err UnsupportedWrite) Kind() reflect.Kind {
+	return err.kind
+}
+
+// MissingTypeId is returned when a unique type ID from the
 // serialized data cannot be found by the decoder. This could happen
 // if the data was invalid or corrupt.
 type MissingTypeId struct {
@@ -22,30 +186,263 @@ type MissingTypeId struct {
 }
 
 func (err MissingTypeId) Error() string {
-	return "Encountered unknown type id " + string(err.id)
+	return "Encountered unknown type id " + strconv.FormatUint(uint64(err.id), 10)
+}
+
+// Id returns the type id which is missing.
+func (err MissingTypeId) Id() uint {
+	return err.id
 }
 
 // MissingTypeName is returned when a named struct or interface type
 // is present in the serialized data, but has not been registered. You
-// can fix this by calling Register or RegisterType before reading from
-// the decoder.
+// can fix this by calling Register or RegisterType, or registering the
+// type with the decoder, before reading objects of that type. Each
+// instantiation of a generic type has to be registered on its own.
 type MissingTypeName struct {
 	name string
 }
 
 func (err MissingTypeName) Error() string {
+	if strings.HasSuffix(err.name, "]") && !strings.HasPrefix(err.name, "map[") {
+		return "Encountered unknown type name " + err.name + "; you should register this instantiation of a generic type!"
+	}
 	return "Encountered unknown type name " + err.name + "; you should register this type!"
 }
 
+// Name returns the name of the type which isn't registered.
+func (err MissingTypeName) Name() string {
+	return err.name
+}
+
 // MissingPointer is returned when a pointer contained in a serialized
-// object cannot be remapped by the deocder. This could happen if the data
-// is invalid or corrupt.
+// object refers to a pointer record which isn't in the stream. This could
+// happen if the data is invalid or corrupt. Encoder.WriteToken returns it
+// for a Ref to a pointer which hasn't been written.
 type MissingPointer struct {
-	ptr uintptr
+	ref uint
 }
 
 func (err MissingPointer) Error() string {
-	return "Missing pointer in map: " + string(err.ptr)
+	return "Missing pointer record for reference " + strconv.FormatUint(uint64(err.ref), 10)
+}
+
+// Ref returns the reference id of the missing pointer.
+func (err MissingPointer) Ref() uint {
+	return err.ref
+}
+
+// MissingFieldId is returned when a struct field in a stream written with
+// field ids refers to an id which isn't in the stream's field table. This
+// could happen if the data is invalid or corrupt.
+type MissingFieldId struct {
+	id uint32
+}
+
+func (err MissingFieldId) Error() string {
+	return "Encountered unknown field id " + strconv.FormatUint(uint64(err.id), 10)
+}
+
+// Id returns the field id which is missing.
+func (err MissingFieldId) Id() uint32 {
+	return err.id
+}
+
+// MissingStringId is returned when a string value in a stream written with
+// string ids refers to an id which isn't in the stream's string table. This
+// could happen if the data is invalid or corrupt.
+type MissingStringId struct {
+	id uint32
+}
+
+func (err MissingStringId) Error() string {
+	return "Encountered unknown string id " + strconv.FormatUint(uint64(err.id), 10)
+}
+
+// Id returns the string id which is missing.
+func (err MissingStringId) Id() uint32 {
+	return err.id
+}
+
+// DecodePanic is returned when decoding panics, which means the stream is
+// malformed in a way the decoder failed to detect, or that a type's
+// UnmarshalBinary method panicked. It holds the value the panic was
+// called with.
+type DecodePanic struct {
+	value interface{}
+}
+
+func (err DecodePanic) Error() string {
+	return fmt.Sprint("Decoding panicked: ", err.value)
+}
+
+// Unwrap returns the value the panic was called with, if it's an error.
+func (err DecodePanic) Unwrap() error {
+	e, _ := err.value.(error)
+	return e
+}
+
+// Value returns the value the panic was called with.
+func (err DecodePanic) Value() interface{} {
+	return err.value
+}
+
+// SchemaMismatch is returned by decoders with the CheckSchema option when a
+// registered type is encoded differently than the type of the same name
+// in the stream, for instance because fields were added or removed.
+type SchemaMismatch struct {
+	name string
+	diff []string
+}
+
+func (err SchemaMismatch) Error() string {
+	msg := "Schema of " + err.name + " differs from stream"
+	if len(err.diff) > 0 {
+		msg += ": " + strings.Join(err.diff, ", ")
+	}
+	return msg
+}
+
+// Name returns the name of the mismatched type.
+func (err SchemaMismatch) Name() string {
+	return err.name
+}
+
+// Diff returns how the registered type differs from the one in the
+// stream, one line per difference: "+Name type" for fields only in the
+// registered type, "-Name type" for those only in the stream, and
+// "~Name: old -> new" for those whose types differ. It is only known if
+// the stream was written with the Schema option, and is nil otherwise.
+func (err SchemaMismatch) Diff() []string {
+	return err.diff
+}
+
+// Is reports whether target is an equal SchemaMismatch, which == can't
+// tell because of its diff.
+func (err SchemaMismatch) Is(target error) bool {
+	t, ok := target.(SchemaMismatch)
+	return ok && t.name == err.name && slices.Equal(t.diff, err.diff)
+}
+
+// MissingMigration is returned when a struct was written with an older
+// version of its type, and no migration from that version is registered.
+type MissingMigration struct {
+	name    string
+	version int
+}
+
+func (err MissingMigration) Error() string {
+	return "No migration for " + err.name + " from version " + strconv.Itoa(err.version)
+}
+
+// Name returns the name of the type.
+func (err MissingMigration) Name() string {
+	return err.name
+}
+
+// Version returns the version with no migration.
+func (err MissingMigration) Version() int {
+	return err.version
+}
+
+// UnsupportedField is returned when writing a struct with a field whose
+// type can't be encoded, such as a channel, function or sync.Mutex, or a
+// slice or map of them, unless the encoder has the SkipUnsupported option.
+// It's also returned when reading a field of another type into such a
+// field, unless the decoder has the IgnoreUnknownFields option. It unwraps
+// to UnsupportedWrite.
+type UnsupportedField struct {
+	path string
+	t    reflect.Type
+}
+
+func (err UnsupportedField) Error() string {
+	return "Can't encode field " + err.path + " of type " + err.t.String()
+}
+
+// Path returns the path to the field from the object written, such as
+// "Config.Servers[0].Lock".
+func (err UnsupportedField) Path() string {
+	return err.path
+}
+
+// Type returns the type of the field.
+func (err UnsupportedField) Type() reflect.Type {
+	return err.t
+}
+
+// Unwrap returns the UnsupportedWrite for the field's kind.
+func (err UnsupportedField) Unwrap() error {
+	return UnsupportedWrite{err.t.Kind()}
+}
+
+// InvalidImplementation is returned when registering implementations of
+// an interface type, if one of them doesn't implement it, or the type
+// isn't an interface at all.
+type InvalidImplementation struct {
+	iface reflect.Type
+	t     reflect.Type
+}
+
+func (err InvalidImplementation) Error() string {
+	if err.t == nil {
+		return err.iface.String() + " is not an interface type"
+	}
+	return err.t.String() + " does not implement " + err.iface.String()
+}
+
+// Interface returns the interface type implementations were registered for.
+func (err InvalidImplementation) Interface() reflect.Type {
+	return err.iface
+}
+
+// Type returns the type which doesn't implement the interface, or nil if
+// the interface type isn't one.
+func (err InvalidImplementation) Type() reflect.Type {
+	return err.t
+}
+
+// UnknownImplementation is returned when a value decoded into a field of
+// an interface type with registered implementations has a type which isn't
+// registered, or which doesn't implement the interface. It lists the
+// registered implementations, and unwraps to MissingTypeName.
+type UnknownImplementation struct {
+	iface      reflect.Type
+	name       string
+	candidates []string
+}
+
+func (err UnknownImplementation) Error() string {
+	return "Encountered unknown type name " + err.name + " for " + err.iface.String() +
+		"; registered implementations are " + strings.Join(err.candidates, ", ")
+}
+
+// Interface returns the interface type being decoded into.
+func (err UnknownImplementation) Interface() reflect.Type {
+	return err.iface
+}
+
+// Name returns the name of the unknown type.
+func (err UnknownImplementation) Name() string {
+	return err.name
+}
+
+// Candidates returns the registered names of the interface's
+// implementations, in sorted order.
+func (err UnknownImplementation) Candidates() []string {
+	return err.candidates
+}
+
+// Unwrap returns the MissingTypeName for the unknown type.
+func (err UnknownImplementation) Unwrap() error {
+	return MissingTypeName{err.name}
+}
+
+// Is reports whether target is an equal UnknownImplementation, which ==
+// can't tell because of its candidates.
+func (err UnknownImplementation) Is(target error) bool {
+	t, ok := target.(UnknownImplementation)
+	return ok && t.iface == err.iface && t.name == err.name && slices.Equal(t.candidates, err.candidates)
 }
 
 // MissingField is returned when a named field of a struct contained in the data
@@ -61,10 +458,368 @@ func (err MissingField) Error() string {
 	return "Missing field " + err.name + " in struct " + err.t.String()
 }
 
+// Type returns the struct type missing the field.
+func (err MissingField) Type() reflect.Type {
+	return err.t
+}
+
+// Name returns the name of the missing field.
+func (err MissingField) Name() string {
+	return err.name
+}
+
+// InvalidTarget is returned when the destination given for a decoded
+// object is not a non-nil pointer.
+type InvalidTarget struct {
+	t reflect.Type
+}
+
+func (err InvalidTarget) Error() string {
+	if err.t == nil {
+		return "Can't decode into nil"
+	}
+	return "Can't decode into non-pointer or nil " + err.t.String()
+}
+
+// Type returns the type of the invalid destination.
+func (err InvalidTarget) Type() reflect.Type {
+	return err.t
+}
+
+// InvalidAlloc is returned when the Alloc decoder option returns something
+// other than a non-nil pointer to the type it was asked for.
+type InvalidAlloc struct {
+	t, got reflect.Type
+}
+
+func (err InvalidAlloc) Error() string {
+	got := "nil"
+	if err.got != nil {
+		got = err.got.String()
+	}
+	return "Alloc returned " + got + " for " + err.t.String()
+}
+
+// Type returns the type which was to be allocated.
+func (err InvalidAlloc) Type() reflect.Type {
+	return err.t
+}
+
+// Got returns the type of the value Alloc returned, or nil if it wasn't
+// valid.
+func (err InvalidAlloc) Got() reflect.Type {
+	return err.got
+}
+
+// TypeMismatch is returned when a decoded object can't be stored in the
+// destination given for it, because its type isn't assignable.
+type TypeMismatch struct {
+	from, to reflect.Type
+}
+
+func (err TypeMismatch) Error() string {
+	return "Can't store decoded " + err.from.String() + " in " + err.to.String()
+}
+
+// From returns the type of the decoded value.
+func (err TypeMismatch) From() reflect.Type {
+	return err.from
+}
+
+// To returns the type of the destination.
+func (err TypeMismatch) To() reflect.Type {
+	return err.to
+}
+
+// InvalidJSON is returned by FromJSON when a JSON value doesn't have the
+// form expected for the type it is converted to.
+type InvalidJSON struct {
+	t reflect.Type
+}
+
+func (err InvalidJSON) Error() string {
+	return "Can't convert JSON value to " + err.t.String()
+}
+
+// Type returns the type the JSON value was being converted to.
+func (err InvalidJSON) Type() reflect.Type {
+	return err.t
+}
+
+// NoIndex is returned by ReadAt and ReadKey when the stream wasn't written
+// with an index, or the decoder's source doesn't support random access, by
+// ReadLazy in the latter case, and by WriteKeyed when the encoder isn't
+// writing a footer.
+type NoIndex struct{}
+
+func (_ NoIndex) Error() string {
+	return "Stream has no object index, or can't be read at random"
+}
+
+// NotStreaming is returned by Encoder.Flush when the encoder isn't in
+// streaming mode, so that nothing can be sent before Finish.
+type NotStreaming struct{}
+
+func (_ NotStreaming) Error() string {
+	return "Encoder is not streaming, so can't flush before Finish"
+}
+
+// NoTokens is returned by Decoder.Token when the decoder wasn't created
+// with the Tokens option.
+type NoTokens struct{}
+
+func (_ NoTokens) Error() string {
+	return "Decoder can't read tokens without the Tokens option"
+}
+
+// InvalidToken is returned by Encoder.WriteToken when given a token which
+// can't be written where it is, such as an EndSlice inside a struct, or a
+// value of a different kind from the slice holding it.
+type InvalidToken struct {
+	tok Token
+}
+
+func (err InvalidToken) Error() string {
+	return fmt.Sprintf("Can't write token %v here", err.tok)
+}
+
+// Token returns the token which couldn't be written.
+func (err InvalidToken) Token() Token {
+	return err.tok
+}
+
+// UnfinishedTokens is returned by Encoder.Write and Encoder.Finish while a
+// value written with WriteToken hasn't been finished.
+type UnfinishedTokens struct{}
+
+func (_ UnfinishedTokens) Error() string {
+	return "Encoder is in the middle of a value written as tokens"
+}
+
+// OutsideCodec is returned by Encoder.EncodeValue and Decoder.DecodeValue
+// when they're called other than by a codec registered with RegisterCodec.
+type OutsideCodec struct{}
+
+func (_ OutsideCodec) Error() string {
+	return "EncodeValue and DecodeValue can only be called by a codec"
+}
+
+// InvalidExtension is returned by RegisterExtension when the id is above
+// MaxExtensionId or already given to another type, or the type has no
+// codec or already has another id.
+type InvalidExtension struct {
+	id uint8
+	t  reflect.Type
+}
+
+func (err InvalidExtension) Error() string {
+	return "Can't register " + err.t.String() + " as extension " + strconv.Itoa(int(err.id))
+}
+
+// Id returns the extension id.
+func (err InvalidExtension) Id() uint8 {
+	return err.id
+}
+
+// Type returns the type the id was to be given to.
+func (err InvalidExtension) Type() reflect.Type {
+	return err.t
+}
+
+// UnknownExtension is returned when a stream contains values of an
+// extension whose id wasn't registered with RegisterExtension.
+type UnknownExtension struct {
+	id uint8
+}
+
+func (err UnknownExtension) Error() string {
+	return "Encountered unknown extension id " + strconv.Itoa(int(err.id)) + "; you should register this extension!"
+}
+
+// Id returns the extension id which isn't registered.
+func (err UnknownExtension) Id() uint8 {
+	return err.id
+}
+
+// NotRecords is returned by ToCSV when an object in the stream isn't a
+// struct of the same type as the first.
+type NotRecords struct {
+	name string
+}
+
+func (err NotRecords) Error() string {
+	return "Can't write objects of type " + err.name + " as records of the stream's first type"
+}
+
+// Name returns the name of the type of the object which isn't a record.
+func (err NotRecords) Name() string {
+	return err.name
+}
+
+// IndexOutOfRange is returned by ReadAt when asked for an object beyond
+// the end of the stream.
+type IndexOutOfRange struct {
+	i int
+}
+
+func (err IndexOutOfRange) Error() string {
+	return "Object index " + strconv.Itoa(err.i) + " is out of range"
+}
+
+// Index returns the object index asked for.
+func (err IndexOutOfRange) Index() int {
+	return err.i
+}
+
+// InvalidAccess is returned by the methods of Lazy when asked for a field
+// of a value which isn't a struct or has no such field, or an element of a
+// value which isn't a slice or is too short.
+type InvalidAccess struct {
+	path, access string
+}
+
+func (err InvalidAccess) Error() string {
+	return "Can't access " + err.access + " of " + err.path
+}
+
+// Path returns the path of the value accessed, starting with the type of
+// the object holding it.
+func (err InvalidAccess) Path() string {
+	return err.path
+}
+
+// Access returns what was asked for, such as ".Name", "[3]" or "fields".
+func (err InvalidAccess) Access() string {
+	return err.access
+}
+
+// MissingKey is returned by ReadKey when no object was written with the
+// given key.
+type MissingKey struct {
+	key string
+}
+
+func (err MissingKey) Error() string {
+	return "No object has key " + strconv.Quote(err.key)
+}
+
+// Key returns the key asked for.
+func (err MissingKey) Key() string {
+	return err.key
+}
+
+// DuplicateKey is returned by WriteKeyed when an object was already written
+// with the given key.
+type DuplicateKey struct {
+	key string
+}
+
+func (err DuplicateKey) Error() string {
+	return "An object was already written with key " + strconv.Quote(err.key)
+}
+
+// Key returns the key which was used twice.
+func (err DuplicateKey) Key() string {
+	return err.key
+}
+
 // EndOfStream is returned when there are no more objects left in the encoded
-// stream and a call to Read() is made.
+// stream and a call to Read() is made. It matches io.EOF with errors.Is.
 type EndOfStream struct{}
 
 func (_ EndOfStream) Error() string {
 	return "End of stream reached, no more objects to return"
 }
+
+// Is reports whether target is io.EOF.
+func (_ EndOfStream) Is(target error) bool {
+	return target == io.EOF
+}
+
+// UnexpectedEOF is returned when the input ends before the stream does,
+// meaning it was truncated. It matches io.ErrUnexpectedEOF with errors.Is,
+// and never io.EOF, so a truncated stream isn't mistaken for a complete one.
+type UnexpectedEOF struct{}
+
+func (_ UnexpectedEOF) Error() string {
+	return "Input ended unexpectedly, stream is truncated"
+}
+
+// Is reports whether target is io.ErrUnexpectedEOF.
+func (_ UnexpectedEOF) Is(target error) bool {
+	return target == io.ErrUnexpectedEOF
+}
+
+// DecodeError is returned when decoding a value nested inside an object
+// fails. It records the path to the value from the object, such as
+// "Config.Servers[3].Addr", and wraps the error which caused the failure.
+type DecodeError struct {
+	path string
+	err  error
+}
+
+func (err DecodeError) Error() string {
+	return "Error decoding " + err.path + ": " + err.err.Error()
+}
+
+// Path returns the path to the value which failed to decode.
+func (err DecodeError) Path() string {
+	return err.path
+}
+
+// Unwrap returns the error which caused decoding to fail.
+func (err DecodeError) Unwrap() error {
+	return err.err
+}
+
+// withPath prefixes the path of a DecodeError with the given segment,
+// wrapping err in a new DecodeError if it isn't one already.
+func withPath(err error, segment string) error {
+	if de, ok := err.(DecodeError); ok {
+		de.path = segment + de.path
+		return de
+	}
+	return DecodeError{segment, err}
+}
+
+// withRoot prefixes the path of a DecodeError with the name of the type
+// of the object it belongs to. Other errors are returned unchanged.
+func withRoot(err error, t reflect.Type) error {
+	name := t.Name()
+	if name == "" {
+		name = t.String()
+	}
+	return withRootName(err, name)
+}
+
+// withRootName is like withRoot, given the name of the object's type.
+func withRootName(err error, name string) error {
+	if de, ok := err.(DecodeError); ok {
+		de.path = name + de.path
+		return de
+	}
+	return err
+}
+
+// withFieldPath adds a path segment to the front of an UnsupportedField's
+// path, as it is returned up through the value containing the field.
+func withFieldPath(err error, segment string) error {
+	if uf, ok := err.(UnsupportedField); ok {
+		uf.path = segment + uf.path
+		return uf
+	}
+	return err
+}
+
+// withFieldRoot names the type of the object written at the start of an
+// UnsupportedField's path.
+func withFieldRoot(err error, t reflect.Type) error {
+	if t == nil {
+		return err
+	}
+	name := t.Name()
+	if name == "" {
+		name = t.String()
+	}
+	return withFieldPath(err, name)
+}
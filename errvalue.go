@@ -0,0 +1,94 @@
+package lager
+
+import (
+	"errors"
+	"reflect"
+)
+
+// writeError writes an error held by a value of an interface type, with
+// the Errors option, as its message and whether its value follows, which
+// it does with its type if that type is registered.
+func (e *Encoder) writeError(w reflect.Value) error {
+	e.writeUint8(uint8(errorKind))
+	e.writeString(w.Interface().(error).Error())
+	t := w.Type()
+	for isPtr(t) {
+		t = t.Elem()
+	}
+	registered := isExplicit(e.registry, t)
+	e.writeBool(registered)
+	if registered {
+		return e.write(w, true)
+	}
+	return nil
+}
+
+// readError reads an error written with the Errors option into v, as the
+// value it was written from if that value follows and its type is
+// registered, and otherwise as errors.New of its message.
+func (d *Decoder) readError(v reflect.Value) error {
+	msg, wt, err := d.readErrorHead()
+	if err != nil {
+		return err
+	}
+	if wt != nil {
+		t, err := d.resolve(wt)
+		if err == nil && t != nil && t.AssignableTo(v.Type()) {
+			elem := reflect.New(t).Elem()
+			if err := d.readValue(elem); err != nil {
+				return err
+			}
+			v.Set(elem)
+			return nil
+		}
+		if err != nil && !unregistered(err) {
+			return err
+		}
+		if err := d.skip(wt); err != nil {
+			return err
+		}
+	}
+	value := reflect.ValueOf(errors.New(msg))
+	if !value.Type().AssignableTo(v.Type()) {
+		return TypeMismatch{value.Type(), v.Type()}
+	}
+	v.Set(value)
+	return nil
+}
+
+// readErrorHead reads the message of an error written with the Errors
+// option, and the type of its value if that follows, or nil.
+func (d *Decoder) readErrorHead() (string, *wireType, error) {
+	msg, err := d.readString()
+	if err != nil {
+		return "", nil, err
+	}
+	hasValue, err := d.readBool()
+	if err != nil || !hasValue {
+		return msg, nil, err
+	}
+	wt, err := d.readWireType()
+	return msg, wt, err
+}
+
+// readGenericError reads an error written with the Errors option as
+// errors.New of its message.
+func (d *Decoder) readGenericError() (interface{}, error) {
+	msg, wt, err := d.readErrorHead()
+	if err == nil && wt != nil {
+		err = d.skip(wt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return errors.New(msg), nil
+}
+
+// skipError reads past an error written with the Errors option.
+func (d *Decoder) skipError() error {
+	_, wt, err := d.readErrorHead()
+	if err != nil || wt == nil {
+		return err
+	}
+	return d.skip(wt)
+}
@@ -0,0 +1,78 @@
+package lager
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Explain writes an annotated breakdown of the lager stream read from r to
+// w, without needing its types to be registered. Each region of the stream
+// is printed as its range of offsets and what it encodes, such as the
+// header, an entry of the type table or a field of an object, followed by
+// its bytes in hex:
+//
+//	0-12      header
+//	          4c 41 47 52 09 00 00 00 01 01 01 07
+//	12-25     type 1 main.User
+//	          ...
+//	40-42     object 0 main.User
+//	42-50     field .Name string
+//
+// Encrypted streams can't be explained, as no key is given.
+func Explain(r io.Reader, w io.Writer) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var lines []traceLine
+	seen := make(map[traceLine]bool)
+	objects := 0
+	d := newDecoder(DecoderOptions{Trace: io.Discard})
+	d.tagged = true
+	d.explain = func(offset int64, text string) {
+		if name, ok := strings.CutPrefix(text, "object "); ok {
+			text = fmt.Sprintf("object %d %s", objects, name)
+			objects++
+		}
+		line := traceLine{int(offset), text}
+		if !seen[line] {
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+	if err := d.Reset(bytes.NewReader(data)); err != nil {
+		return err
+	}
+	for {
+		if _, _, err := d.readGenericObject(); err == (EndOfStream{}) {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	slices.SortStableFunc(lines, func(a, b traceLine) int {
+		return a.offset - b.offset
+	})
+	if len(lines) == 0 || lines[0].offset > 0 {
+		lines = slices.Insert(lines, 0, traceLine{0, "header"})
+	}
+
+	out := bufio.NewWriter(w)
+	for i, line := range lines {
+		end := len(data)
+		if i+1 < len(lines) {
+			end = lines[i+1].offset
+		}
+		fmt.Fprintf(out, "%-9s %s\n", fmt.Sprintf("%d-%d", line.offset, end), line.text)
+		for b := data[line.offset:end]; len(b) > 0; {
+			n := min(len(b), 16)
+			fmt.Fprintf(out, "%9s % x\n", "", b[:n])
+			b = b[n:]
+		}
+	}
+	return out.Flush()
+}
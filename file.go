@@ -0,0 +1,83 @@
+package lager
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// WriteFile encodes the given objects as a stream and writes it to the
+// named file atomically: the stream is written to a temporary file in the
+// same directory, which is synced and then renamed over the named one. If
+// anything fails, the named file is left as it was. A file which already
+// exists keeps its permissions; a new one is created with mode 0644.
+func WriteFile(path string, vs ...interface{}) error {
+	perm := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = writeFile(tmp, vs, perm)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// writeFile writes a stream of the given objects to a file, gives it the
+// given permissions, and syncs it.
+func writeFile(f *os.File, vs []interface{}, perm os.FileMode) error {
+	enc := NewEncoder(f)
+	for _, v := range vs {
+		if err := enc.Write(v); err != nil {
+			return err
+		}
+	}
+	if err := enc.Finish(); err != nil {
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// syncDir syncs a directory, so that a rename within it is durable. This
+// isn't possible on every platform, so failures are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// ReadFile reads every object from the stream in the named file.
+func ReadFile(path string) ([]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec, err := NewDecoder(f)
+	if err != nil {
+		return nil, err
+	}
+	var values []interface{}
+	for v, err := range dec.All() {
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
@@ -0,0 +1,75 @@
+package lager
+
+import (
+	"io"
+	"iter"
+)
+
+// Encode writes v to w as a complete, self-contained stream.
+func Encode[T any](w io.Writer, v T) error {
+	enc := NewEncoder(w)
+	if err := enc.Write(v); err != nil {
+		return err
+	}
+	return enc.Finish()
+}
+
+// Decode reads the first object of the stream in r as a T. If the object
+// is a pointer and T is its element type, the pointed-to value is returned.
+func Decode[T any](r io.Reader) (T, error) {
+	var v T
+	dec, err := NewDecoder(r)
+	if err != nil {
+		return v, err
+	}
+	err = dec.ReadInto(&v)
+	return v, err
+}
+
+// TypedDecoder reads objects of a single type T from a stream.
+type TypedDecoder[T any] struct {
+	dec *Decoder
+}
+
+// NewTypedDecoder creates a TypedDecoder reading from the given decoder.
+func NewTypedDecoder[T any](dec *Decoder) *TypedDecoder[T] {
+	return &TypedDecoder[T]{dec}
+}
+
+// Read returns the next object from the stream as a T. If the object
+// can't be stored in a T, it returns TypeMismatch.
+func (d *TypedDecoder[T]) Read() (T, error) {
+	var v T
+	err := d.dec.ReadInto(&v)
+	return v, err
+}
+
+// All returns an iterator over the objects left in the stream, as by
+// Decoder.All.
+func (d *TypedDecoder[T]) All() iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		for {
+			v, err := d.Read()
+			if err == (EndOfStream{}) {
+				return
+			}
+			if !yield(v, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Clone returns a deep copy of v, made by encoding and decoding it. Pointers
+// shared within v, including cyclic ones, are shared the same way within the
+// copy. Only what lager encodes is copied, so unexported fields are left
+// zero.
+func Clone[T any](v T) (T, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := Encode(buf, v); err != nil {
+		var zero T
+		return zero, err
+	}
+	return Decode[T](buf)
+}
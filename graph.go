@@ -0,0 +1,120 @@
+package lager
+
+import (
+	"maps"
+	"reflect"
+	"slices"
+)
+
+// ReadIntoGraph decodes the next object into the value pointed to by root,
+// as ReadInto does, but updates the graph of pointers root holds in place
+// rather than allocating a new one, so that a large graph can be reloaded
+// from snapshots without the garbage of replacing it. Each pointer read is
+// matched with the graph's pointer of the same reference id, and if both
+// point to the same type, its value is decoded into the existing memory,
+// reusing the storage of its slices and maps. Otherwise new memory is
+// allocated, as usual.
+//
+// The graph's reference ids are those it was last read with by the
+// decoder, or for a graph it hasn't read, those an encoder would write it
+// with. Pointers reached through maps are only matched reliably between
+// snapshots written with the Canonical option.
+//
+// Streams which aren't streaming hold their pointers in their header,
+// which is read before ReadIntoGraph is called, so their pointers only
+// reuse the graph's when the decoder has already read into it and is Reset
+// to each new snapshot. The decoder keeps the graph until ReadIntoGraph is
+// called with a different root, so other reads of those streams share its
+// pointers too.
+func (d *Decoder) ReadIntoGraph(root interface{}) error {
+	v := reflect.ValueOf(root)
+	if !v.IsValid() || !isPtr(v.Type()) || v.IsNil() {
+		return InvalidTarget{reflect.TypeOf(root)}
+	}
+	if root != d.graphRoot {
+		d.graphRoot = root
+		d.graph = graphPtrs(v.Elem(), d.opts.Unexported)
+	}
+	if err := d.ReadInto(root); err != nil {
+		return err
+	}
+	clear(d.graph)
+	maps.Copy(d.graph, d.ptrMap)
+	return nil
+}
+
+// newPtr allocates memory for the value of the pointer with the given
+// reference id, reusing that of the graph being read into where it holds
+// the same type.
+func (d *Decoder) newPtr(ref uint, t reflect.Type) (reflect.Value, error) {
+	if p, ok := d.graph[ref]; ok && p.Type().Elem() == t {
+		return p, nil
+	}
+	return d.alloc(t)
+}
+
+// graphPtrs returns the pointers reachable from v, keyed by the reference
+// ids an encoder would give them.
+func graphPtrs(v reflect.Value, unexported bool) map[uint]reflect.Value {
+	g := &graphWalker{
+		unexported: unexported,
+		seen:       make(map[ptrKey]bool),
+		ptrs:       make(map[uint]reflect.Value),
+	}
+	g.walk(v, 0)
+	return g.ptrs
+}
+
+// graphWalker finds the pointers of a graph in the order an encoder
+// writes them, for graphPtrs.
+type graphWalker struct {
+	unexported bool
+	seen       map[ptrKey]bool
+	ptrs       map[uint]reflect.Value
+}
+
+// walk visits the pointers held by v, to a depth which only a corrupt or
+// cyclic graph of values other than pointers reaches.
+func (g *graphWalker) walk(v reflect.Value, depth int) {
+	if depth > maxDepth || isUnsupported(v.Type()) {
+		return
+	}
+	switch wireKind(v.Type()) {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return
+		}
+		key := ptrKey{v.Pointer(), v.Type().Elem()}
+		if g.seen[key] {
+			return
+		}
+		g.seen[key] = true
+		g.ptrs[uint(len(g.ptrs))+nilRef+1] = v
+		g.walk(v.Elem(), depth+1)
+	case reflect.Interface:
+		if !v.IsNil() {
+			g.walk(v.Elem(), depth+1)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			g.walk(v.Index(i), depth+1)
+		}
+	case reflect.Map:
+		for iter := v.MapRange(); iter.Next(); {
+			g.walk(iter.Key(), depth+1)
+			g.walk(iter.Value(), depth+1)
+		}
+	case reflect.Struct:
+		fields := structFields(v.Type(), g.unexported)
+		if !v.CanAddr() && slices.ContainsFunc(fields, func(f field) bool { return f.private }) {
+			addressable := reflect.New(v.Type()).Elem()
+			addressable.Set(v)
+			v = addressable
+		}
+		for _, f := range fields {
+			if !f.unsupported {
+				g.walk(fieldValue(v, f), depth+1)
+			}
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package lager
+
+import (
+	"io"
+	"maps"
+	"reflect"
+	"slices"
+)
+
+// Header describes a stream, as far as the decoder has read it.
+type Header struct {
+	// Checksums, Streaming, Footer, Index, FieldIds, StringIds, OmitZero
+	// and Markers record which of the corresponding EncoderOptions the
+	// stream was written with.
+	Checksums bool
+	Streaming bool
+	Footer    bool
+	Index     bool
+	FieldIds  bool
+	StringIds bool
+	OmitZero  bool
+	Markers   bool
+
+	// Encrypted records whether the stream was written with an
+	// EncryptionKey.
+	Encrypted bool
+
+	// Objects is the number of objects in the stream, or -1 if it isn't
+	// known, as for a streaming-mode stream whose footer hasn't been read.
+	Objects int
+
+	// Types holds the names of the types in the stream's type table, in
+	// the order they were defined.
+	Types []string
+
+	// Schema describes each type in Types, if the stream was written with
+	// the Schema option.
+	Schema []TypeSchema
+
+	// Keys holds the keys of the objects written with Encoder.WriteKeyed,
+	// in order, once the stream's footer has been read.
+	Keys []string
+
+	// Metadata holds the key/value pairs set with Encoder.SetMetadata, or
+	// nil if there are none.
+	Metadata map[string]string
+
+	// Pointers is the number of pointer records in the stream. For a
+	// streaming-mode stream without its footer, only those read so far
+	// are counted.
+	Pointers int
+}
+
+// Header returns a description of the stream being read. Streaming-mode
+// streams define their types and pointers as they go, so unless their
+// footer has been read, these are only the ones read so far.
+func (d *Decoder) Header() Header {
+	h := Header{
+		Checksums: d.flags&flagChecksums != 0,
+		Streaming: d.flags&flagStreaming != 0,
+		Footer:    d.flags&flagFooter != 0,
+		Index:     d.flags&flagIndex != 0,
+		FieldIds:  d.flags&flagFieldIds != 0,
+		StringIds: d.flags&flagStringIds != 0,
+		OmitZero:  d.flags&flagOmitZero != 0,
+		Markers:   d.flags&flagMarkers != 0,
+		Encrypted: d.encrypted,
+		Objects:   d.objects,
+		Types:     make([]string, 0, len(d.typeNames)),
+		Metadata:  d.Metadata(),
+		Pointers:  len(d.ptrMap) + len(d.generic),
+	}
+	if !h.Streaming {
+		h.Objects += d.consumed
+	} else if !d.footerRead {
+		h.Objects = -1
+	}
+	for _, id := range slices.Sorted(maps.Keys(d.typeNames)) {
+		h.Types = append(h.Types, d.typeNames[id])
+		if s, ok := d.schemas[id]; ok {
+			h.Schema = append(h.Schema, s)
+		}
+	}
+	if d.keys != nil {
+		h.Keys = slices.Sorted(maps.Keys(d.keys))
+	}
+	if d.ptrIndex != nil {
+		h.Pointers = len(d.ptrIndex)
+	}
+	return h
+}
+
+// TypeInfo describes a type in a stream's type table, as the decoder
+// resolves it.
+type TypeInfo struct {
+	// Name is the name the type was written under.
+	Name string
+
+	// Type is the Go type values of the type are read as, which for types
+	// that aren't registered is a struct type built from their structure
+	// if the stream holds it, and nil otherwise.
+	Type reflect.Type
+
+	// Resolved reports whether the name was found among the registered
+	// types or the RemapTypes option.
+	Resolved bool
+
+	// Err is the error reading values of the type fails with, such as
+	// MissingTypeName or SchemaMismatch, or nil.
+	Err error
+}
+
+// Types describes each type in the stream's type table, in the order they
+// were defined, so that before reading any objects, an application can
+// register fallbacks for types which don't resolve, read the stream with
+// ReadGeneric instead, or give up. Streaming-mode streams define their
+// types as they go, so unless their footer has been read, these are only
+// the ones read so far.
+func (d *Decoder) Types() []TypeInfo {
+	types := make([]TypeInfo, 0, len(d.typeNames))
+	for _, id := range slices.Sorted(maps.Keys(d.typeNames)) {
+		name := d.typeNames[id]
+		_, local := d.localType(name)
+		t, err := d.resolveType(id)
+		types = append(types, TypeInfo{name, t, local && err == nil, err})
+	}
+	return types
+}
+
+// ReadHeader reads the header of the stream read from r, without decoding
+// any objects or pointers, so that the types a stream needs and the number
+// of objects it holds can be checked first. For streaming-mode streams,
+// these are only known if the stream has a footer and r is an
+// io.ReadSeeker. Of an encrypted stream, only that it is encrypted is
+// known.
+func ReadHeader(r io.Reader) (h *Header, err error) {
+	d := newDecoder(DecoderOptions{})
+	defer d.recoverPanic(&err)
+	d.reader.r.Reset(r)
+	if err := d.readMagic(); err != nil {
+		return nil, err
+	}
+	if d.flags, err = d.readUint16(); err != nil {
+		return nil, err
+	}
+	if d.flags&flagEncrypted != 0 {
+		return &Header{Encrypted: true, Objects: -1}, nil
+	}
+	if err := d.readMetadata(); err != nil {
+		return nil, err
+	}
+	if d.flags&flagStreaming != 0 {
+		if rs, ok := r.(io.ReadSeeker); ok && d.flags&flagFooter != 0 {
+			if err := d.seekFooter(rs); err != nil {
+				return nil, err
+			}
+		}
+		header := d.Header()
+		return &header, nil
+	}
+	if d.objects, err = d.readInt(); err != nil {
+		return nil, err
+	}
+	if err := d.readTypeMap(); err != nil {
+		return nil, err
+	}
+	if d.flags&flagFieldIds != 0 {
+		if err := d.readFieldTable(); err != nil {
+			return nil, err
+		}
+	}
+	if d.flags&flagStringIds != 0 {
+		if err := d.readStringTable(); err != nil {
+			return nil, err
+		}
+	}
+	pointers, err := d.readInt()
+	if err != nil {
+		return nil, err
+	}
+	header := d.Header()
+	header.Pointers = pointers
+	return &header, nil
+}
@@ -0,0 +1,58 @@
+package lager
+
+import (
+	"reflect"
+)
+
+// PreEncoder is implemented by structs which need to prepare themselves
+// before being encoded, for instance by copying derived state into fields
+// which are encoded. BeforeEncodeLager is called on a copy of each struct
+// before its fields are written, so that changes it makes are written
+// without altering the original; an error stops the write.
+type PreEncoder interface {
+	BeforeEncodeLager() error
+}
+
+// PostDecoder is implemented by structs which need to finish themselves
+// after being decoded, for instance by recomputing unexported fields or
+// checking invariants. AfterDecodeLager is called on each struct once all
+// of its fields have been decoded; an error stops the read. Pointers held
+// by the struct may refer to values which are still being decoded, as in
+// cyclic structures.
+type PostDecoder interface {
+	AfterDecodeLager() error
+}
+
+var (
+	preEncoderType  = reflect.TypeOf((*PreEncoder)(nil)).Elem()
+	postDecoderType = reflect.TypeOf((*PostDecoder)(nil)).Elem()
+)
+
+// beforeEncode calls the BeforeEncodeLager method of a struct, if it has
+// one, and returns the value to be written, which is a copy if the method
+// needs a pointer.
+func beforeEncode(w reflect.Value) (reflect.Value, error) {
+	t := w.Type()
+	if t.Implements(preEncoderType) {
+		return w, w.Interface().(PreEncoder).BeforeEncodeLager()
+	}
+	if !reflect.PtrTo(t).Implements(preEncoderType) {
+		return w, nil
+	}
+	addressable := reflect.New(t).Elem()
+	addressable.Set(w)
+	w = addressable
+	return w, w.Addr().Interface().(PreEncoder).BeforeEncodeLager()
+}
+
+// afterDecode calls the AfterDecodeLager method of a decoded struct, if it
+// has one.
+func afterDecode(v reflect.Value) error {
+	if v.CanAddr() && reflect.PtrTo(v.Type()).Implements(postDecoderType) {
+		return v.Addr().Interface().(PostDecoder).AfterDecodeLager()
+	}
+	if v.Type().Implements(postDecoderType) {
+		return v.Interface().(PostDecoder).AfterDecodeLager()
+	}
+	return nil
+}
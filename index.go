@@ -0,0 +1,129 @@
+package lager
+
+import (
+	"bufio"
+	"io"
+)
+
+// ReadAt returns the i'th object in the stream, without decoding any of
+// the objects before it. This requires a stream written with the Index
+// option, and a decoder whose source is both an io.ReadSeeker and an
+// io.ReaderAt, such as an *os.File. Pointers are shared with objects
+// returned by Read, and ReadAt doesn't affect which object Read returns.
+func (d *Decoder) ReadAt(i int) (value interface{}, err error) {
+	defer d.recoverPanic(&err)
+	if d.source == nil || d.objIndex == nil {
+		return nil, NoIndex{}
+	}
+	if i < 0 || i >= len(d.objIndex) {
+		return nil, IndexOutOfRange{i}
+	}
+	return d.readObjectAt(d.objIndex[i])
+}
+
+// ReadKey returns the object written with the given key by
+// Encoder.WriteKeyed, without decoding any of the objects before it. As
+// with ReadAt, the decoder's source must be both an io.ReadSeeker and an
+// io.ReaderAt. If no object has the key, ReadKey fails with MissingKey.
+func (d *Decoder) ReadKey(key string) (value interface{}, err error) {
+	defer d.recoverPanic(&err)
+	if d.source == nil || d.keys == nil {
+		return nil, NoIndex{}
+	}
+	offset, ok := d.keys[key]
+	if !ok {
+		return nil, MissingKey{key}
+	}
+	return d.readObjectAt(offset)
+}
+
+// readObjectAt reads the object whose records start at the given offset,
+// and then returns to where the decoder left off.
+func (d *Decoder) readObjectAt(offset int64) (interface{}, error) {
+	body, done := d.reader, d.done
+	defer func() {
+		d.reader, d.done = body, done
+	}()
+	d.reader = d.readerAt(offset)
+	d.done = false
+	wt, err := d.beginRecords()
+	if err != nil {
+		return nil, err
+	}
+	t, err := d.resolve(wt)
+	if err != nil {
+		return nil, err
+	}
+	value, err := d.read(t)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.endObject(); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// readObjIndex reads the offset of each object from the footer.
+func (d *Decoder) readObjIndex() error {
+	n, err := d.readInt()
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return CorruptStream{"footer"}
+	}
+	d.objIndex = make([]int64, 0, preallocLength(n, 8))
+	for i := 0; i < n; i++ {
+		offset, err := d.readInt64()
+		if err != nil {
+			return err
+		}
+		d.objIndex = append(d.objIndex, offset)
+	}
+	return nil
+}
+
+// readKeyIndex reads the offset of each keyed object from the footer.
+func (d *Decoder) readKeyIndex() error {
+	n, err := d.readInt()
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return CorruptStream{"footer"}
+	}
+	d.keys = make(map[string]int64, preallocLength(n, 24))
+	for i := 0; i < n; i++ {
+		key, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if d.keys[key], err = d.readInt64(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPtr reads the pointer record at the given offset in the stream.
+func (d *Decoder) loadPtr(offset int64) error {
+	reader := d.reader
+	defer func() { d.reader = reader }()
+	d.reader = d.readerAt(offset)
+	tag, err := d.readUint8()
+	if err != nil {
+		return err
+	}
+	if tag != pointerRecord {
+		return CorruptStream{"pointer index"}
+	}
+	return d.readPtrEntry()
+}
+
+// readerAt returns a reader for the decoder's source which starts at the
+// given offset.
+func (d *Decoder) readerAt(offset int64) *checksumReader {
+	section := io.NewSectionReader(d.source, offset, d.size-offset)
+	return &checksumReader{r: bufio.NewReader(section), n: offset}
+}
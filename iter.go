@@ -0,0 +1,51 @@
+package lager
+
+import (
+	"iter"
+)
+
+// Len returns the number of objects left to read from the stream. For a
+// streaming-mode stream, this is only known once the footer has been read,
+// and -1 is returned otherwise.
+func (d *Decoder) Len() int {
+	if d.flags&flagStreaming == 0 {
+		return d.objects
+	}
+	if d.done {
+		return 0
+	}
+	if !d.footerRead {
+		return -1
+	}
+	return d.objects - d.consumed
+}
+
+// More returns whether there is another object to read from the stream.
+// If the input can't be read, it returns true so that the error is
+// reported by the next call to Read.
+func (d *Decoder) More() bool {
+	if d.flags&flagStreaming == 0 {
+		return d.objects > 0
+	}
+	if d.done {
+		return false
+	}
+	tag, err := d.reader.r.Peek(1)
+	return err != nil || tag[0] != endRecord
+}
+
+// All returns an iterator over the objects left in the stream. If an
+// object can't be read, the error is yielded and iteration stops.
+func (d *Decoder) All() iter.Seq2[interface{}, error] {
+	return func(yield func(interface{}, error) bool) {
+		for {
+			value, err := d.Read()
+			if err == (EndOfStream{}) {
+				return
+			}
+			if !yield(value, err) || err != nil {
+				return
+			}
+		}
+	}
+}
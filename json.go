@@ -0,0 +1,528 @@
+package lager
+
+import (
+	"bufio"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// taggedValue is a generic value read from an interface, along with the
+// name of its type, as decoded for ToJSON.
+type taggedValue struct {
+	name  string
+	value interface{}
+}
+
+// emptyInterfaceType is the type of interface{}, which doesn't need to be
+// registered to be converted from JSON.
+var emptyInterfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// ToJSON converts the lager stream read from r into a JSON document written
+// to w, without needing its types to be registered. The document is an
+// array holding an object for each object in the stream, of the form
+// {"type": name, "value": value}; values held in interfaces are written
+// the same way. Structs are written as JSON objects keyed by field name,
+// maps as JSON objects keyed by their keys as text, and byte slices and
+// types with their own binary encoding as base64. Times are written in
+// RFC 3339 format, durations as nanoseconds, and complex numbers,
+// non-finite floats and the numbers of math/big as strings, as are errors
+// written with the Errors option, as their messages. Pointers are written
+// as {"$id": n, "value": value} where first seen, and as {"$ref": n} after
+// that, so that shared and cyclic pointers are kept.
+func ToJSON(r io.Reader, w io.Writer) error {
+	d := newDecoder(DecoderOptions{})
+	d.tagged = true
+	if err := d.Reset(r); err != nil {
+		return err
+	}
+	c := jsonConverter{make(map[*interface{}]int)}
+	out := bufio.NewWriter(w)
+	out.WriteString("[")
+	for i := 0; ; i++ {
+		wt, value, err := d.readGenericObject()
+		if err == (EndOfStream{}) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(c.convert(taggedValue{d.wireName(wt), value}))
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			out.WriteString(",")
+		}
+		out.WriteString("\n")
+		out.Write(data)
+	}
+	out.WriteString("\n]\n")
+	return out.Flush()
+}
+
+// jsonConverter converts generic values into ones which encoding/json
+// writes in the form documented by ToJSON, numbering each pointer the
+// first time it is seen. Maps are visited in the order encoding/json
+// writes them, so that pointers are numbered in document order.
+type jsonConverter struct {
+	ids map[*interface{}]int
+}
+
+func (c jsonConverter) convert(value interface{}) interface{} {
+	switch v := value.(type) {
+	case taggedValue:
+		return map[string]interface{}{"type": v.name, "value": c.convert(v.value)}
+	case *interface{}:
+		if id, ok := c.ids[v]; ok {
+			return map[string]interface{}{"$ref": id}
+		}
+		id := len(c.ids) + 1
+		c.ids[v] = id
+		return map[string]interface{}{"$id": id, "value": c.convert(*v)}
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for _, name := range slices.Sorted(maps.Keys(v)) {
+			m[name] = c.convert(v[name])
+		}
+		return m
+	case map[interface{}]interface{}:
+		if v == nil {
+			return nil
+		}
+		keys := make(map[string]interface{}, len(v))
+		for key := range v {
+			keys[jsonKey(key)] = key
+		}
+		m := make(map[string]interface{}, len(v))
+		for _, text := range slices.Sorted(maps.Keys(keys)) {
+			m[text] = c.convert(v[keys[text]])
+		}
+		return m
+	case []interface{}:
+		if v == nil {
+			return nil
+		}
+		s := make([]interface{}, len(v))
+		for i, elem := range v {
+			s[i] = c.convert(elem)
+		}
+		return s
+	case float32:
+		return c.convert(float64(v))
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return strconv.FormatFloat(v, 'g', -1, 64)
+		}
+	case complex64:
+		return strconv.FormatComplex(complex128(v), 'g', -1, 64)
+	case complex128:
+		return strconv.FormatComplex(v, 'g', -1, 128)
+	case error:
+		return v.Error()
+	}
+	if text, ok := bigText(value); ok {
+		return text
+	}
+	return value
+}
+
+// jsonKey returns the text a map key is written as in JSON.
+func jsonKey(key interface{}) string {
+	switch k := key.(type) {
+	case string:
+		return k
+	case taggedValue:
+		return jsonKey(k.value)
+	case time.Time:
+		return k.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(key)
+}
+
+// FromJSON converts a JSON document in the form written by ToJSON, read
+// from r, back into a lager stream written to w with the given options.
+// The types named in the document must be registered, apart from those
+// built from basic types, such as []interface{} or map[string]int. Maps
+// whose keys aren't strings, numbers or booleans can't be converted back.
+func FromJSON(r io.Reader, w io.Writer, opts EncoderOptions) error {
+	in := json.NewDecoder(r)
+	in.UseNumber()
+	if tok, err := in.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('[') {
+		return InvalidJSON{reflect.TypeOf([]interface{}(nil))}
+	}
+	c := jsonReader{opts.Registry, opts.Unexported, make(map[string]reflect.Value), make(map[string]bool)}
+	enc := NewEncoderWithOptions(w, opts)
+	for i := 0; in.More(); i++ {
+		var obj interface{}
+		if err := in.Decode(&obj); err != nil {
+			return err
+		}
+		v := reflect.New(emptyInterfaceType).Elem()
+		if err := c.convert(v, obj); err != nil {
+			return withRootName(err, "["+strconv.Itoa(i)+"]")
+		}
+		if err := enc.Write(v.Interface()); err != nil {
+			return err
+		}
+	}
+	if _, err := in.Token(); err != nil {
+		return err
+	}
+	for ref := range c.pending {
+		id, _ := strconv.ParseUint(ref, 10, 64)
+		return MissingPointer{uint(id)}
+	}
+	return enc.Finish()
+}
+
+// jsonReader converts values decoded by encoding/json into Go values of
+// the types they were written from by ToJSON. Pointers are allocated when
+// their id is first seen, and are pending until their value is.
+type jsonReader struct {
+	registry   *Registry
+	unexported bool
+	ptrs       map[string]reflect.Value
+	pending    map[string]bool
+}
+
+// convert stores the given JSON value in v, which must be settable.
+func (c jsonReader) convert(v reflect.Value, value interface{}) error {
+	t := v.Type()
+	if value == nil {
+		v.Set(reflect.Zero(t))
+		return nil
+	}
+	switch wireKind(t) {
+	case timeKind:
+		s, ok := value.(string)
+		if !ok {
+			return InvalidJSON{t}
+		}
+		tm, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(tm))
+		return nil
+	case binaryKind:
+		s, ok := value.(string)
+		if !ok {
+			return InvalidJSON{t}
+		}
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+	case bigIntKind, bigFloatKind, bigRatKind:
+		if s, ok := value.(string); !ok || !setBig(v, s) {
+			return InvalidJSON{t}
+		}
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return InvalidJSON{t}
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := value.(json.Number)
+		if !ok {
+			return InvalidJSON{t}
+		}
+		i, err := strconv.ParseInt(string(n), 10, 64)
+		if err != nil || v.OverflowInt(i) {
+			return InvalidJSON{t}
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := value.(json.Number)
+		if !ok {
+			return InvalidJSON{t}
+		}
+		u, err := strconv.ParseUint(string(n), 10, 64)
+		if err != nil || v.OverflowUint(u) {
+			return InvalidJSON{t}
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		var s string
+		switch n := value.(type) {
+		case json.Number:
+			s = string(n)
+		case string:
+			s = n
+		default:
+			return InvalidJSON{t}
+		}
+		f, err := strconv.ParseFloat(s, t.Bits())
+		if err != nil {
+			return InvalidJSON{t}
+		}
+		v.SetFloat(f)
+	case reflect.Complex64, reflect.Complex128:
+		s, ok := value.(string)
+		if !ok {
+			return InvalidJSON{t}
+		}
+		z, err := strconv.ParseComplex(s, t.Bits())
+		if err != nil {
+			return InvalidJSON{t}
+		}
+		v.SetComplex(z)
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return InvalidJSON{t}
+		}
+		v.SetString(s)
+	case reflect.Interface:
+		return c.convertInterface(v, value)
+	case reflect.Ptr:
+		return c.convertPtr(v, value)
+	case reflect.Slice:
+		return c.convertSlice(v, value)
+	case reflect.Map:
+		return c.convertMap(v, value)
+	case reflect.Struct:
+		return c.convertStruct(v, value)
+	default:
+		return UnsupportedWrite{t.Kind()}
+	}
+	return nil
+}
+
+func (c jsonReader) convertInterface(v reflect.Value, value interface{}) error {
+	if msg, ok := value.(string); ok {
+		if err := reflect.ValueOf(errors.New(msg)); err.Type().AssignableTo(v.Type()) {
+			v.Set(err)
+			return nil
+		}
+	}
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return InvalidJSON{v.Type()}
+	}
+	name, ok := obj["type"].(string)
+	if !ok {
+		return InvalidJSON{v.Type()}
+	}
+	if name == "nil" {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	t, err := c.parseType(name)
+	if err != nil {
+		return err
+	}
+	if !t.AssignableTo(v.Type()) {
+		return TypeMismatch{t, v.Type()}
+	}
+	elem := reflect.New(t).Elem()
+	if err := c.convert(elem, obj["value"]); err != nil {
+		return err
+	}
+	v.Set(elem)
+	return nil
+}
+
+func (c jsonReader) convertPtr(v reflect.Value, value interface{}) error {
+	t := v.Type()
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return InvalidJSON{t}
+	}
+	if ref, ok := obj["$ref"].(json.Number); ok {
+		return c.lookupPtr(v, string(ref))
+	}
+	id, ok := obj["$id"].(json.Number)
+	if !ok {
+		return InvalidJSON{t}
+	}
+	if err := c.lookupPtr(v, string(id)); err != nil {
+		return err
+	}
+	if !c.pending[string(id)] {
+		return InvalidJSON{t}
+	}
+	delete(c.pending, string(id))
+	return c.convert(v.Elem(), obj["value"])
+}
+
+// lookupPtr stores the pointer with the given id in v, allocating it if
+// it hasn't been seen yet.
+func (c jsonReader) lookupPtr(v reflect.Value, id string) error {
+	p, ok := c.ptrs[id]
+	if !ok {
+		p = reflect.New(v.Type().Elem())
+		c.ptrs[id] = p
+		c.pending[id] = true
+	}
+	if p.Type() != v.Type() {
+		return TypeMismatch{p.Type(), v.Type()}
+	}
+	v.Set(p)
+	return nil
+}
+
+func (c jsonReader) convertSlice(v reflect.Value, value interface{}) error {
+	t := v.Type()
+	if s, ok := value.(string); ok && t.Elem().Kind() == reflect.Uint8 {
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.MakeSlice(t, len(data), len(data)))
+		reflect.Copy(v, reflect.ValueOf(data))
+		return nil
+	}
+	elems, ok := value.([]interface{})
+	if !ok {
+		return InvalidJSON{t}
+	}
+	v.Set(reflect.MakeSlice(t, len(elems), len(elems)))
+	for i, elem := range elems {
+		if err := c.convert(v.Index(i), elem); err != nil {
+			return withPath(err, "["+strconv.Itoa(i)+"]")
+		}
+	}
+	return nil
+}
+
+func (c jsonReader) convertMap(v reflect.Value, value interface{}) error {
+	t := v.Type()
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return InvalidJSON{t}
+	}
+	v.Set(reflect.MakeMapWithSize(t, len(obj)))
+	for text, elem := range obj {
+		key := reflect.New(t.Key()).Elem()
+		if err := c.convertKey(key, text); err != nil {
+			return err
+		}
+		e := reflect.New(t.Elem()).Elem()
+		if err := c.convert(e, elem); err != nil {
+			return withPath(err, "["+text+"]")
+		}
+		v.SetMapIndex(key, e)
+	}
+	return nil
+}
+
+// convertKey stores a map key written as text in v.
+func (c jsonReader) convertKey(v reflect.Value, text string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(text)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return InvalidJSON{v.Type()}
+		}
+		v.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		if wireKind(v.Type()) == durationKind {
+			break
+		}
+		return c.convert(v, json.Number(text))
+	}
+	return InvalidJSON{v.Type()}
+}
+
+func (c jsonReader) convertStruct(v reflect.Value, value interface{}) error {
+	t := v.Type()
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return InvalidJSON{t}
+	}
+	for name, elem := range obj {
+		f, ok := lookupField(t, name, c.unexported)
+		if !ok {
+			return MissingField{t, name}
+		}
+		if err := c.convert(fieldValue(v, f), elem); err != nil {
+			return withPath(err, "."+name)
+		}
+	}
+	return nil
+}
+
+// parseType finds the type with the given name, as written by ToJSON.
+// Registered names are looked up, and types built from other types, such
+// as pointers, slices and maps, are put together from their parts.
+func (c jsonReader) parseType(name string) (reflect.Type, error) {
+	if t, ok := lookup(c.registry, name); ok {
+		return t, nil
+	}
+	if name == emptyInterfaceType.String() {
+		return emptyInterfaceType, nil
+	}
+	if name == errorType.String() {
+		return errorType, nil
+	}
+	for _, t := range basicTypes {
+		if t.String() == name {
+			return t, nil
+		}
+	}
+	switch {
+	case strings.HasPrefix(name, "*"):
+		elem, err := c.parseType(name[1:])
+		if err != nil {
+			return nil, err
+		}
+		return reflect.PtrTo(elem), nil
+	case strings.HasPrefix(name, "[]"):
+		elem, err := c.parseType(name[2:])
+		if err != nil {
+			return nil, err
+		}
+		return reflect.SliceOf(elem), nil
+	case strings.HasPrefix(name, "map["):
+		depth := 0
+		for i := 3; i < len(name); i++ {
+			switch name[i] {
+			case '[':
+				depth++
+			case ']':
+				depth--
+			}
+			if depth > 0 {
+				continue
+			}
+			key, err := c.parseType(name[4:i])
+			if err != nil {
+				return nil, err
+			}
+			elem, err := c.parseType(name[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			if !key.Comparable() {
+				break
+			}
+			return reflect.MapOf(key, elem), nil
+		}
+	}
+	return nil, MissingTypeName{name}
+}
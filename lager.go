@@ -1,50 +1,409 @@
 package lager
 
 import (
+	"encoding"
+	"math/big"
 	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
 )
 
-// typeMap contains types by their full package name.
-// It holds both struct and interface types.
-var typeMap map[string]reflect.Type
+// magic is written at the very start of every stream, so that lager
+// data can be told apart from arbitrary bytes.
+var magic = [4]byte{'L', 'A', 'G', 'R'}
 
-// init builds the type map, which is the only package-wide data
-func init() {
-	typeMap = make(map[string]reflect.Type)
+// formatVersion is written after the magic sequence, and is incremented
+// whenever the encoding changes incompatibly.
+const formatVersion = 9
+
+// Header flags are written after the format version, and record which
+// optional features the stream was written with.
+const (
+	// flagChecksums marks streams with a checksum after the header and
+	// each object, and a checksum of the whole stream at the end.
+	flagChecksums uint16 = 1 << iota
+	// flagStreaming marks streams with no header beyond the flags, whose
+	// type and pointer definitions are instead sent as records alongside
+	// the objects which first need them.
+	flagStreaming
+	// flagFooter marks streaming-mode streams which end with a footer
+	// holding the object count, type table and the offset of each pointer
+	// record by reference id, followed by the footer's own offset.
+	flagFooter
+	// flagIndex marks footer-mode streams whose footer also holds the
+	// offset of each object, for random access.
+	flagIndex
+	// flagFieldIds marks streams whose struct fields are written as ids
+	// into a table of field names, rather than as the names themselves.
+	flagFieldIds
+	// flagSchema marks streams whose type table entries are each followed
+	// by a description of the type.
+	flagSchema
+	// flagEncrypted marks the envelope of an encrypted stream, which holds
+	// another stream with flags of its own.
+	flagEncrypted
+	// flagOmitZero marks streams whose structs leave out fields holding
+	// their zero value.
+	flagOmitZero
+	// flagStringIds marks streams whose string values are written as ids
+	// into a table of strings, rather than as the strings themselves.
+	flagStringIds
+	// flagMetadata marks streams whose flags are followed by a table of
+	// key/value metadata set by the producer.
+	flagMetadata
+	// flagKeys marks footer-mode streams whose footer also holds the
+	// offset of each object written with a key, by key.
+	flagKeys
+	// flagMarkers marks streaming-mode streams whose objects are each
+	// preceded by a marker record, so that a decoder can skip to the next
+	// object past corruption.
+	flagMarkers
+)
+
+// Record tags begin each record of a streaming-mode stream.
+const (
+	endRecord uint8 = iota
+	typeRecord
+	pointerRecord
+	objectRecord
+	fieldRecord
+	// sessionRecord begins each message of a Session, in place of the
+	// preamble of a stream, and is followed by the format version, flags
+	// and the message's sequence number.
+	sessionRecord
+	// stringRecord defines a string value and its id, for streams written
+	// with string ids.
+	stringRecord
+	// markerRecord begins the records of each object in streams written
+	// with markers, and is followed by syncMarker and the object's index.
+	markerRecord
+)
+
+// Values of the platform-sized kinds int, uint and uintptr, as well as
+// reference ids, type ids and lengths, are always written as 64 bits, so
+// that streams can be read regardless of the word size of the platform
+// which wrote them. Values which don't fit on a 32-bit platform fail to
+// decode there with Overflow, rather than being truncated.
+
+// nilLength is written in place of a length to mark a nil map or slice,
+// so that they can be told apart from empty ones.
+const nilLength = -1
+
+// sharedLength is written in place of a slice's length, by the ShareSlices
+// encoder option or for a slice which contains itself, to mark a slice
+// sharing its backing array with others. It's followed by the array's
+// reference id and length, and the slice's offset into the array and
+// length. In place of a map's length, it marks a map which contains itself,
+// and is followed by the map's reference id.
+const sharedLength = -2
+
+// cappedLength is written before the length of a slice whose capacity is
+// greater than its length, and followed by the capacity, so that slices
+// decode with room to be appended to as they had.
+const cappedLength = -3
+
+// maxPrealloc is the most memory, in bytes, allocated for a map, slice or
+// byte sequence before any of its contents are read. Longer ones grow as
+// they are read instead, so that a corrupt length can't exhaust memory.
+const maxPrealloc = 1 << 20
+
+// preallocLength returns how many of n elements of the given size should
+// be allocated up front.
+func preallocLength(n int, size uintptr) int {
+	if size == 0 {
+		return n
+	}
+	return min(n, maxPrealloc/int(size)+1)
 }
 
-// Register allows you to specify a struct or interface value.
-// The type of that value will be registered so that serialized objects
-// correctly decode as the proper type.
-func Register(value interface{}) {
-	RegisterType(reflect.TypeOf(value))
+// maxDepth is the deepest nesting of types and values the decoder accepts.
+const maxDepth = 10000
+
+// nilRef is written in place of a reference id to mark a nil pointer.
+// Pointers are otherwise identified by sequential ids starting from 1.
+const nilRef = 0
+
+// Wire kinds extend reflect.Kind with ids for types which are encoded
+// specially, rather than by walking their reflected structure. They are
+// numbered well above the reflect.Kind range so the two never collide.
+const (
+	// binaryKind is used for types implementing encoding.BinaryMarshaler
+	// and encoding.BinaryUnmarshaler.
+	binaryKind reflect.Kind = 64 + iota
+	// timeKind is used for time.Time, which is written as seconds and
+	// nanoseconds since the Unix epoch plus its location.
+	timeKind
+	// durationKind is used for time.Duration.
+	durationKind
+	// namedKind is used for registered defined types which aren't structs
+	// or interfaces, such as `type UserID int64`, so that the decoder can
+	// reconstruct the exact type rather than its underlying one. The
+	// underlying type follows the type id.
+	namedKind
+	// bigIntKind, bigFloatKind and bigRatKind are used for the numbers of
+	// math/big, which are written as their gob encoding.
+	bigIntKind
+	bigFloatKind
+	bigRatKind
+	// codecKind is used for types registered with RegisterCodec, and is
+	// followed by the type id. Values are written as the number of values
+	// the codec gave, and each of them with its type.
+	codecKind
+	// errorKind is used for errors written with the Errors option, which
+	// are written as their message and whether their value follows, with
+	// its type, as it does when that type is registered.
+	errorKind
+	// typedNilKind is written in place of the type of an interface value
+	// holding a nil pointer, map or slice, and is followed by the type of
+	// that nil. No value follows.
+	typedNilKind
+)
+
+// extensionKind is the first of the wire kinds reserved for extensions,
+// codecs given ids with RegisterExtension, which are written as
+// extensionKind plus their id in place of codecKind and a type id.
+const extensionKind reflect.Kind = 128
+
+// MaxExtensionId is the largest extension id. Ids from 0 up to it are
+// reserved for RegisterExtension, and never used by lager itself.
+const MaxExtensionId = 127
+
+// nilKind is written in place of a type for nil interface values, such as
+// the object written by Write(nil), which have no type of their own, as
+// opposed to those holding typed nils, which are written with typedNilKind.
+const nilKind = reflect.Invalid
+
+var (
+	timeType              = reflect.TypeOf(time.Time{})
+	durationType          = reflect.TypeOf(time.Duration(0))
+	bigIntType            = reflect.TypeOf(big.Int{})
+	bigFloatType          = reflect.TypeOf(big.Float{})
+	bigRatType            = reflect.TypeOf(big.Rat{})
+	errorType             = reflect.TypeOf((*error)(nil)).Elem()
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+// field describes a struct field as it appears in the encoded stream.
+// Its index is a path, as promoted fields of flattened embedded structs are
+// reached through the embedded field. Fields reached through any unexported
+// field are marked private, and are accessed using unsafe. Fields which can
+// never be encoded are marked unsupported.
+type field struct {
+	name        string
+	index       []int
+	typ         reflect.Type
+	private     bool
+	unsupported bool
 }
 
-// RegisterType allows you to specify a reflected struct or interface
-// type. It will be registered so that values of this type are
-// properly decoded.
-func RegisterType(typ reflect.Type) {
-	typeMap[typ.String()] = typ
+// fieldKey identifies a struct type and whether all of its unexported
+// fields are encoded, or only those tagged for export.
+type fieldKey struct {
+	t          reflect.Type
+	unexported bool
 }
 
+// fieldCache holds the encoded fields of each struct type seen so far,
+// as a []field keyed by fieldKey.
+var fieldCache sync.Map
+
 // privateField checks whether the given struct field is exported
 // (returns false) or not (returns true).
 func privateField(f reflect.StructField) bool {
 	return len(f.PkgPath) > 0
 }
 
-// numPublicFields returns the number of fields of the given struct
-// type which are exported, i.e. those that start with a capital letter.
-func numPublicFields(t reflect.Type) int {
-	n := t.NumField()
-	public := 0
-	for i := 0; i < n; i++ {
-		field := t.Field(i)
-		if !privateField(field) {
-			public++
+// fieldName returns the name a struct field is encoded under, taken
+// from its `lager:"name"` tag if it has one. It returns false if the
+// field is tagged `lager:"-"` and should not be encoded at all.
+func fieldName(f reflect.StructField) (string, bool) {
+	tag := f.Tag.Get("lager")
+	if tag == "-" {
+		return "", false
+	}
+	if name, _, _ := strings.Cut(tag, ","); name != "" {
+		return name, true
+	}
+	return f.Name, true
+}
+
+// hasTagOption returns whether the given struct field's `lager` tag has
+// the given option after its name, as in `lager:"name,option"`.
+func hasTagOption(f reflect.StructField, option string) bool {
+	_, opts, _ := strings.Cut(f.Tag.Get("lager"), ",")
+	for opts != "" {
+		var opt string
+		opt, opts, _ = strings.Cut(opts, ",")
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
+
+// structFields returns the fields of the given struct type which are
+// encoded, i.e. those which are not excluded by a tag and not holding
+// UnknownFields. Unexported fields are only included if they are tagged
+// `lager:",export"`, or if unexported is set.
+//
+// Embedded structs tagged `lager:",flatten"` are replaced by their own
+// fields, as with encoding/json: a promoted field is hidden by any field of
+// the same name nearer the top, and dropped if another at the same depth
+// has its name.
+func structFields(t reflect.Type, unexported bool) []field {
+	key := fieldKey{t, unexported}
+	if fields, ok := fieldCache.Load(key); ok {
+		return fields.([]field)
+	}
+	var all []field
+	var depths []int
+	collectFields(t, unexported, nil, false, func(f field, depth int) {
+		all = append(all, f)
+		depths = append(depths, depth)
+	})
+	shallowest := make(map[string]int)
+	count := make(map[string]int)
+	for i, f := range all {
+		if d, ok := shallowest[f.name]; !ok || depths[i] < d {
+			shallowest[f.name] = depths[i]
+			count[f.name] = 0
+		}
+		if depths[i] == shallowest[f.name] {
+			count[f.name]++
+		}
+	}
+	fields := make([]field, 0, len(all))
+	for i, f := range all {
+		if depths[i] == shallowest[f.name] && count[f.name] == 1 {
+			fields = append(fields, f)
+		}
+	}
+	fieldCache.Store(key, fields)
+	return fields
+}
+
+// collectFields calls add with each encoded field of a struct type and its
+// depth, descending into flattened embedded structs. The index path and
+// privacy of the struct itself are given.
+func collectFields(t reflect.Type, unexported bool, index []int, private bool, add func(field, int)) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		path := append(index[:len(index):len(index)], i)
+		flatten := f.Anonymous && f.Type.Kind() == reflect.Struct && wireKind(f.Type) == reflect.Struct &&
+			hasTagOption(f, "flatten")
+		fprivate := private || privateField(f)
+		if flatten {
+			collectFields(f.Type, unexported, path, fprivate, add)
+			continue
+		}
+		if privateField(f) && !unexported && !hasTagOption(f, "export") || f.Type == unknownFieldsType {
+			continue
+		}
+		if name, ok := fieldName(f); ok {
+			add(field{name, path, f.Type, fprivate, isUnsupported(f.Type)}, len(index))
+		}
+	}
+}
+
+// fieldValue returns the given field of a struct value. Fields reached
+// through unexported ones are accessed through their address, so the struct
+// must be addressable.
+func fieldValue(v reflect.Value, f field) reflect.Value {
+	for _, i := range f.index {
+		sf := v.Type().Field(i)
+		v = v.Field(i)
+		if f.private && !v.CanInterface() {
+			v = reflect.NewAt(sf.Type, unsafe.Pointer(v.UnsafeAddr())).Elem()
+		}
+	}
+	return v
+}
+
+// lookupField finds the encoded field of a struct type with the given
+// wire name.
+func lookupField(t reflect.Type, name string, unexported bool) (field, bool) {
+	for _, f := range structFields(t, unexported) {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return field{}, false
+}
+
+// wireKind returns the kind the given type is encoded as. This is its
+// reflected kind, unless the type is handled specially.
+func wireKind(t reflect.Type) reflect.Kind {
+	switch t {
+	case timeType:
+		return timeKind
+	case durationType:
+		return durationKind
+	case bigIntType:
+		return bigIntKind
+	case bigFloatType:
+		return bigFloatKind
+	case bigRatType:
+		return bigRatKind
+	}
+	if isBinary(t) {
+		return binaryKind
+	}
+	return t.Kind()
+}
+
+// isTypedNil returns whether a value held by an interface is a nil
+// pointer, map or slice.
+func isTypedNil(w reflect.Value) bool {
+	switch w.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		return w.IsNil()
+	}
+	return false
+}
+
+// isBinary returns whether the given type is encoded using its own
+// MarshalBinary and UnmarshalBinary methods. Pointers and interfaces
+// are never treated this way, so pointer identity is still preserved.
+func isBinary(t reflect.Type) bool {
+	if isPtr(t) || isInterface(t) {
+		return false
+	}
+	return (t.Implements(binaryMarshalerType) || reflect.PtrTo(t).Implements(binaryMarshalerType)) &&
+		reflect.PtrTo(t).Implements(binaryUnmarshalerType)
+}
+
+// isUnsupported returns whether values of the given type can never be
+// encoded: channels, functions, unsafe pointers, the synchronization types
+// of the sync and sync/atomic packages, and pointers, slices, arrays and
+// maps made of any of these.
+func isUnsupported(t reflect.Type) bool {
+	return unsupported(t, nil)
+}
+
+// unsupported is isUnsupported for a type inside the given defined types,
+// which are skipped if they come up again, as in type tree map[string]tree.
+func unsupported(t reflect.Type, outer []reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return true
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		if t.Name() != "" {
+			if slices.Contains(outer, t) {
+				return false
+			}
+			outer = append(outer, t)
+		}
+		if t.Kind() == reflect.Map && unsupported(t.Key(), outer) {
+			return true
 		}
+		return unsupported(t.Elem(), outer)
 	}
-	return public
+	pkg := t.PkgPath()
+	return pkg == "sync" || pkg == "sync/atomic"
 }
 
 // isInterface returns whether the given arbitrary type is an interface
@@ -0,0 +1,208 @@
+// Package lagercache encodes values for caches as single-object lager
+// streams, so that cached values keep their shared pointers and types.
+//
+// A Codec's Marshal and Unmarshal methods fit the byte slice values of
+// caches such as groupcache and ristretto, and Value adapts a value to the
+// encoding.BinaryMarshaler and encoding.BinaryUnmarshaler interfaces used
+// by go-redis:
+//
+//	codec := lagercache.NewCodec(lagercache.Options{Compress: true})
+//	err := rdb.Set(ctx, key, codec.Value(user), time.Hour).Err()
+//	err = rdb.Get(ctx, key).Scan(codec.Value(&user))
+//
+// Each value is a one-byte envelope saying how it's stored, followed by the
+// stream, compressed with DEFLATE if the codec compresses values and that
+// makes it smaller. Encoders, decoders and their buffers are pooled, so a
+// codec is cheap to use for many small values from many goroutines.
+package lagercache
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"strconv"
+	"sync"
+
+	lager "github.com/lowentropy/go-lager"
+)
+
+// The envelope byte which begins each value.
+const (
+	plainEnvelope   byte = 'L'
+	deflateEnvelope byte = 'Z'
+)
+
+// defaultMinCompressSize is the size of the smallest streams compressed,
+// unless the codec's options say otherwise.
+const defaultMinCompressSize = 512
+
+// Options configures a Codec. The zero value is the default.
+type Options struct {
+	// Encoder and Decoder are the options values are encoded and decoded
+	// with, such as the registry their types are found in. Options which
+	// only matter for streams of many objects, such as Streaming or Index,
+	// only make values larger.
+	Encoder lager.EncoderOptions
+	Decoder lager.DecoderOptions
+
+	// Compress compresses values with DEFLATE, where that makes them
+	// smaller.
+	Compress bool
+
+	// MinCompressSize is the size of the smallest encoded values which are
+	// compressed, in bytes. It defaults to 512.
+	MinCompressSize int
+}
+
+// Codec encodes and decodes cache values. It's safe for concurrent use.
+type Codec struct {
+	opts     Options
+	encoders sync.Pool
+	decoders sync.Pool
+}
+
+// encoder is an encoder kept for reuse, with the buffers it writes to.
+type encoder struct {
+	enc  *lager.Encoder
+	buf  bytes.Buffer
+	zbuf bytes.Buffer
+	zw   *flate.Writer
+}
+
+// decoder is a decoder kept for reuse, with the readers it reads from.
+type decoder struct {
+	dec *lager.Decoder
+	r   bytes.Reader
+	zr  io.ReadCloser
+}
+
+// NewCodec returns a codec with the given options.
+func NewCodec(opts Options) *Codec {
+	if opts.MinCompressSize == 0 {
+		opts.MinCompressSize = defaultMinCompressSize
+	}
+	return &Codec{opts: opts}
+}
+
+// Marshal encodes a value as a single-object stream in an envelope.
+func (c *Codec) Marshal(v interface{}) ([]byte, error) {
+	e, _ := c.encoders.Get().(*encoder)
+	if e == nil {
+		e = new(encoder)
+		e.enc = lager.NewEncoderWithOptions(&e.buf, c.opts.Encoder)
+	}
+	defer c.encoders.Put(e)
+	e.buf.Reset()
+	e.buf.WriteByte(plainEnvelope)
+	e.enc.Reset(&e.buf)
+	if err := e.enc.Write(v); err != nil {
+		return nil, err
+	}
+	if err := e.enc.Finish(); err != nil {
+		return nil, err
+	}
+	out := e.buf.Bytes()
+	if c.opts.Compress && len(out)-1 >= c.opts.MinCompressSize {
+		if err := e.compress(out[1:]); err != nil {
+			return nil, err
+		}
+		if e.zbuf.Len() < len(out) {
+			out = e.zbuf.Bytes()
+		}
+	}
+	return bytes.Clone(out), nil
+}
+
+// compress compresses a stream into the encoder's other buffer, in its
+// envelope.
+func (e *encoder) compress(stream []byte) error {
+	e.zbuf.Reset()
+	e.zbuf.WriteByte(deflateEnvelope)
+	if e.zw == nil {
+		var err error
+		if e.zw, err = flate.NewWriter(&e.zbuf, flate.DefaultCompression); err != nil {
+			return err
+		}
+	} else {
+		e.zw.Reset(&e.zbuf)
+	}
+	if _, err := e.zw.Write(stream); err != nil {
+		return err
+	}
+	return e.zw.Close()
+}
+
+// Unmarshal decodes a value written by Marshal, and stores it in the value
+// pointed to by out, as lager.Unmarshal does. Data which doesn't begin
+// with a known envelope fails with UnknownEnvelope.
+func (c *Codec) Unmarshal(data []byte, out interface{}) error {
+	if len(data) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	d, _ := c.decoders.Get().(*decoder)
+	if d == nil {
+		d = new(decoder)
+	}
+	defer c.decoders.Put(d)
+	d.r.Reset(data[1:])
+	var r io.Reader = &d.r
+	switch data[0] {
+	case plainEnvelope:
+	case deflateEnvelope:
+		if d.zr == nil {
+			d.zr = flate.NewReader(&d.r)
+		} else if err := d.zr.(flate.Resetter).Reset(&d.r, nil); err != nil {
+			return err
+		}
+		r = d.zr
+	default:
+		return UnknownEnvelope{data[0]}
+	}
+	if d.dec == nil {
+		var err error
+		if d.dec, err = lager.NewDecoderWithOptions(r, c.opts.Decoder); err != nil {
+			d.dec = nil
+			return err
+		}
+	} else if err := d.dec.Reset(r); err != nil {
+		return err
+	}
+	return d.dec.ReadInto(out)
+}
+
+// Value returns v adapted to the encoding.BinaryMarshaler and
+// encoding.BinaryUnmarshaler interfaces, using the codec. To be
+// unmarshaled into, v must be a pointer.
+func (c *Codec) Value(v interface{}) Value {
+	return Value{c, v}
+}
+
+// Value is a value adapted to be marshaled by a codec, as returned by
+// Codec.Value.
+type Value struct {
+	codec *Codec
+	v     interface{}
+}
+
+func (v Value) MarshalBinary() ([]byte, error) {
+	return v.codec.Marshal(v.v)
+}
+
+func (v Value) UnmarshalBinary(data []byte) error {
+	return v.codec.Unmarshal(data, v.v)
+}
+
+// UnknownEnvelope is returned by Unmarshal when a value doesn't begin with
+// an envelope written by Marshal.
+type UnknownEnvelope struct {
+	envelope byte
+}
+
+func (err UnknownEnvelope) Error() string {
+	return "Unknown cache value envelope " + strconv.Quote(string(rune(err.envelope)))
+}
+
+// Envelope returns the first byte of the value.
+func (err UnknownEnvelope) Envelope() byte {
+	return err.envelope
+}
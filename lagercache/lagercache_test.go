@@ -0,0 +1,103 @@
+package lagercache
+
+import (
+	"encoding"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	lager "github.com/lowentropy/go-lager"
+)
+
+type item struct {
+	Name  string
+	Tags  []string
+	Owner *item
+}
+
+func init() {
+	lager.Register(item{})
+}
+
+func TestCodec(t *testing.T) {
+	codec := NewCodec(Options{Compress: true})
+	owner := &item{Name: "owner"}
+	small := item{Name: "small", Owner: owner}
+	large := item{Name: strings.Repeat("large ", 200), Tags: []string{"a", "b"}, Owner: owner}
+	owner.Owner = owner
+
+	for _, test := range []struct {
+		in       item
+		envelope byte
+	}{
+		{small, plainEnvelope},
+		{large, deflateEnvelope},
+	} {
+		data, err := codec.Marshal(test.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[0] != test.envelope {
+			t.Errorf("%.10s: got envelope %q, want %q", test.in.Name, data[0], test.envelope)
+		}
+		var out item
+		if err := codec.Unmarshal(data, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Name != test.in.Name || len(out.Tags) != len(test.in.Tags) || out.Owner.Name != "owner" || out.Owner.Owner != out.Owner {
+			t.Errorf("%.10s: got %+v", test.in.Name, out)
+		}
+	}
+
+	// Values encode as encoding.BinaryMarshaler, as go-redis takes them.
+	var m encoding.BinaryMarshaler = codec.Value(small)
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out item
+	var u encoding.BinaryUnmarshaler = codec.Value(&out)
+	if err := u.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "small" {
+		t.Errorf("got %+v", out)
+	}
+
+	var unknown UnknownEnvelope
+	if err := codec.Unmarshal([]byte("?"), &out); !errors.As(err, &unknown) {
+		t.Errorf("got %v, want UnknownEnvelope", err)
+	} else if unknown.Envelope() != '?' {
+		t.Errorf("got envelope %q", unknown.Envelope())
+	}
+}
+
+func TestCodecConcurrent(t *testing.T) {
+	codec := NewCodec(Options{Compress: true, MinCompressSize: 1})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				in := item{Name: strings.Repeat("x", j), Tags: []string{"t"}}
+				data, err := codec.Marshal(in)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var out item
+				if err := codec.Unmarshal(data, &out); err != nil {
+					t.Error(err)
+					return
+				}
+				if out.Name != in.Name {
+					t.Errorf("got %q, want %q", out.Name, in.Name)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,389 @@
+// Package lagerdb is a small embedded key-value store for Go values, kept
+// in a single append-only log file using the lager format for values.
+//
+// Each Put or Delete appends an entry to the log, and an index of where
+// each key's latest value lies is rebuilt from the log by Open. Entries
+// left partially written by a crash are discarded when the log is opened.
+// Space taken by overwritten and deleted values is reclaimed by Compact,
+// which also runs automatically once most of the log is garbage.
+package lagerdb
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	lager "github.com/lowentropy/go-lager"
+)
+
+// Each entry in the log is written as the length and checksum of the rest
+// of the entry, which is an operation, the key's length and the key, and
+// for puts, the value as a lager record.
+const (
+	opPut uint8 = iota + 1
+	opDelete
+)
+
+// entryHeader is the size of an entry's length and checksum.
+const entryHeader = 8
+
+// compactThreshold is the amount of garbage in the log, in bytes, above
+// which it is compacted automatically once there's more garbage than live
+// data.
+const compactThreshold = 1 << 20
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// span locates a value in the log.
+type span struct {
+	offset int64
+	size   int
+}
+
+// DB is an open store. It is safe for concurrent use.
+type DB struct {
+	mu      sync.RWMutex
+	path    string
+	file    *os.File
+	index   map[string]span
+	size    int64
+	live    int64
+	garbage int64
+}
+
+// Open opens the store at the given path, creating it if it doesn't exist.
+func Open(path string) (*DB, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{path: path, file: file}
+	if err := db.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// load rebuilds the index from the log, and truncates any partially
+// written entry at its end. Entries damaged anywhere else fail with
+// CorruptLog, rather than losing the entries after them.
+func (db *DB) load() error {
+	db.index = make(map[string]span)
+	db.size, db.live, db.garbage = 0, 0, 0
+	data, err := io.ReadAll(db.file)
+	if err != nil {
+		return err
+	}
+	for len(data)-int(db.size) >= entryHeader {
+		entry := data[db.size:]
+		n := int(binary.LittleEndian.Uint32(entry))
+		if n < 5 || entryHeader+n > len(entry) || crc32.Checksum(entry[entryHeader:entryHeader+n], crcTable) != binary.LittleEndian.Uint32(entry[4:]) {
+			if torn(entry) {
+				break
+			}
+			return CorruptLog{db.size}
+		}
+		op, body := entry[entryHeader], entry[entryHeader+1:entryHeader+n]
+		keyLen := int(binary.LittleEndian.Uint32(body))
+		if 4+keyLen > len(body) {
+			return CorruptLog{db.size}
+		}
+		key := string(body[4 : 4+keyLen])
+		switch op {
+		case opPut:
+			db.drop(key)
+			db.index[key] = span{db.size + int64(entryHeader+1+4+keyLen), len(body) - 4 - keyLen}
+			db.live += int64(entryHeader + n)
+		case opDelete:
+			db.drop(key)
+			db.garbage += int64(entryHeader + n)
+		default:
+			return CorruptLog{db.size}
+		}
+		db.size += int64(entryHeader + n)
+	}
+	if db.size < int64(len(data)) {
+		return db.file.Truncate(db.size)
+	}
+	return nil
+}
+
+// torn returns whether a damaged entry, at the start of the rest of the
+// log, is the last one and was cut short by a crash: it reaches the end of
+// the log, or the log was only extended with zeros which were never
+// overwritten.
+func torn(rest []byte) bool {
+	n := int(binary.LittleEndian.Uint32(rest))
+	if n >= 5 && entryHeader+n >= len(rest) {
+		return true
+	}
+	return !slices.ContainsFunc(rest, func(b byte) bool { return b != 0 })
+}
+
+// drop forgets the current value of a key, counting it as garbage.
+func (db *DB) drop(key string) {
+	if s, ok := db.index[key]; ok {
+		n := int64(entryHeader + 1 + 4 + len(key) + s.size)
+		db.live -= n
+		db.garbage += n
+		delete(db.index, key)
+	}
+}
+
+// appendEntry appends an entry to the log. It's written at the end of the
+// last complete entry, so that one left incomplete by a failed write is
+// overwritten.
+func (db *DB) appendEntry(op uint8, key string, value []byte) error {
+	n := 1 + 4 + len(key) + len(value)
+	entry := make([]byte, entryHeader, entryHeader+n)
+	entry = append(entry, op)
+	entry = binary.LittleEndian.AppendUint32(entry, uint32(len(key)))
+	entry = append(entry, key...)
+	entry = append(entry, value...)
+	binary.LittleEndian.PutUint32(entry, uint32(n))
+	binary.LittleEndian.PutUint32(entry[4:], crc32.Checksum(entry[entryHeader:], crcTable))
+	if _, err := db.file.WriteAt(entry, db.size); err != nil {
+		return err
+	}
+	db.size += int64(len(entry))
+	return nil
+}
+
+// Put stores a value under the given key, replacing any value it had.
+func (db *DB) Put(key string, v interface{}) error {
+	value, err := lager.MarshalRecord(v)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.file == nil {
+		return os.ErrClosed
+	}
+	start := db.size
+	if err := db.appendEntry(opPut, key, value); err != nil {
+		return err
+	}
+	db.drop(key)
+	db.index[key] = span{db.size - int64(len(value)), len(value)}
+	db.live += db.size - start
+	return db.maybeCompact()
+}
+
+// Get decodes the value stored under the given key into the value pointed
+// to by out, as lager.Unmarshal does. It fails with NotFound if the key
+// has no value.
+func (db *DB) Get(key string, out interface{}) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.file == nil {
+		return os.ErrClosed
+	}
+	s, ok := db.index[key]
+	if !ok {
+		return NotFound{key}
+	}
+	value := make([]byte, s.size)
+	if _, err := db.file.ReadAt(value, s.offset); err != nil {
+		return err
+	}
+	return lager.UnmarshalRecord(value, out)
+}
+
+// Has returns whether the given key has a value.
+func (db *DB) Has(key string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	_, ok := db.index[key]
+	return ok
+}
+
+// Delete removes the value stored under the given key, if there is one.
+func (db *DB) Delete(key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.file == nil {
+		return os.ErrClosed
+	}
+	if _, ok := db.index[key]; !ok {
+		return nil
+	}
+	start := db.size
+	if err := db.appendEntry(opDelete, key, nil); err != nil {
+		return err
+	}
+	db.drop(key)
+	db.garbage += db.size - start
+	return db.maybeCompact()
+}
+
+// Len returns the number of keys with values.
+func (db *DB) Len() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.index)
+}
+
+// Keys iterates over the keys with values beginning with the given
+// prefix, in sorted order. The keys are collected when iteration starts,
+// so the store may be changed while iterating.
+func (db *DB) Keys(prefix string) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		db.mu.RLock()
+		keys := make([]string, 0, len(db.index))
+		for key := range db.index {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		db.mu.RUnlock()
+		slices.Sort(keys)
+		for _, key := range keys {
+			if !yield(key) {
+				return
+			}
+		}
+	}
+}
+
+// maybeCompact compacts the log once most of it is garbage.
+func (db *DB) maybeCompact() error {
+	if db.garbage > compactThreshold && db.garbage > db.live {
+		return db.compact()
+	}
+	return nil
+}
+
+// Compact rewrites the log with only the current value of each key, and
+// replaces the old log with it atomically.
+func (db *DB) Compact() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.file == nil {
+		return os.ErrClosed
+	}
+	return db.compact()
+}
+
+func (db *DB) compact() error {
+	info, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(db.path), ".lagerdb-*")
+	if err != nil {
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := db.writeLive(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	db.file.Close()
+	db.file = tmp
+	syncDir(filepath.Dir(db.path))
+	return db.load()
+}
+
+// writeLive writes an entry for the current value of each key to a new
+// log, and moves it into place of the store's log.
+func (db *DB) writeLive(tmp *os.File) error {
+	keys := make([]string, 0, len(db.index))
+	for key := range db.index {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	compacted := &DB{file: tmp}
+	for _, key := range keys {
+		s := db.index[key]
+		value := make([]byte, s.size)
+		if _, err := db.file.ReadAt(value, s.offset); err != nil {
+			return err
+		}
+		if err := compacted.appendEntry(opPut, key, value); err != nil {
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), db.path)
+}
+
+// syncDir syncs a directory, so that a rename within it is durable. This
+// isn't possible on every platform, so failures are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Sync commits the log to stable storage.
+func (db *DB) Sync() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.file == nil {
+		return os.ErrClosed
+	}
+	return db.file.Sync()
+}
+
+// Close syncs and closes the store.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.file == nil {
+		return os.ErrClosed
+	}
+	err := db.file.Sync()
+	if cerr := db.file.Close(); err == nil {
+		err = cerr
+	}
+	db.file = nil
+	return err
+}
+
+// CorruptLog is returned by Open when the log holds a damaged entry before
+// its end, which unlike one left partially written at the end by a crash
+// isn't discarded, or an intact entry which isn't a put or a delete, for
+// instance because it was written by a newer version of this package.
+type CorruptLog struct {
+	offset int64
+}
+
+func (err CorruptLog) Error() string {
+	return "Log has a corrupt or unknown entry at offset " + strconv.FormatInt(err.offset, 10)
+}
+
+// Offset returns the offset of the corrupt or unknown entry in the log.
+func (err CorruptLog) Offset() int64 {
+	return err.offset
+}
+
+// NotFound is returned by Get when a key has no value.
+type NotFound struct {
+	key string
+}
+
+func (err NotFound) Error() string {
+	return "No value for key " + err.key
+}
+
+// Key returns the key which has no value.
+func (err NotFound) Key() string {
+	return err.key
+}
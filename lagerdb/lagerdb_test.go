@@ -0,0 +1,176 @@
+package lagerdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	lager "github.com/lowentropy/go-lager"
+)
+
+type user struct {
+	Name    string
+	Friends []*user
+}
+
+func init() {
+	lager.Register(user{})
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ann := &user{Name: "ann"}
+	bob := &user{Name: "bob", Friends: []*user{ann}}
+	ann.Friends = []*user{bob}
+	if err := db.Put("user/ann", ann); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("user/bob", bob); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("count", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("count", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("user/bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A partially written entry at the end of the log is discarded.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{40, 0, 0, 0, 1, 2})
+	f.Close()
+
+	db, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var out user
+	if err := db.Get("user/ann", &out); err != nil || out.Name != "ann" || out.Friends[0].Friends[0].Name != "ann" {
+		t.Fatal("Expected ann to be stored but got", out, err)
+	}
+	var count int
+	if err := db.Get("count", &count); err != nil || count != 2 {
+		t.Fatal("Expected the latest count but got", count, err)
+	}
+	if err := db.Get("user/bob", &out); !errors.As(err, new(NotFound)) {
+		t.Fatal("Expected bob to be deleted but got", err)
+	}
+	if keys := slices.Collect(db.Keys("user/")); !slices.Equal(keys, []string{"user/ann"}) {
+		t.Fatal("Expected only ann's key but got", keys)
+	}
+
+	before, _ := os.Stat(path)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Fatal("Expected compaction to shrink the log from", before.Size(), "but got", after.Size())
+	}
+	if err := db.Put("user/cat", user{Name: "cat"}); err != nil {
+		t.Fatal(err)
+	}
+	if keys := slices.Collect(db.Keys("")); !slices.Equal(keys, []string{"count", "user/ann", "user/cat"}) {
+		t.Fatal("Expected all keys after compaction but got", keys)
+	}
+	if err := db.Get("user/cat", &out); err != nil || out.Name != "cat" {
+		t.Fatal("Expected cat to be stored after compaction but got", out, err)
+	}
+}
+
+func TestCorruptLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ends []int64
+	for _, name := range []string{"ann", "bob", "cat"} {
+		if err := db.Put("user/"+name, user{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+		info, _ := os.Stat(path)
+		ends = append(ends, info.Size())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A damaged entry in the middle of the log fails to open, rather than
+	// losing the entries after it.
+	corrupt := slices.Clone(data)
+	corrupt[ends[1]-1] ^= 0xff
+	if err := os.WriteFile(path, corrupt, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var cl CorruptLog
+	if _, err := Open(path); !errors.As(err, &cl) || cl.Offset() != ends[0] {
+		t.Fatal("Expected CorruptLog at", ends[0], "but got", err)
+	}
+	if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+		t.Fatal("Expected the corrupt log to be left alone but it has", info.Size(), "bytes")
+	}
+
+	// Whereas a damaged last entry, or zeros after the last entry, were
+	// left by a crash and are discarded.
+	for _, torn := range [][]byte{
+		append(slices.Clone(data[:ends[2]-1]), data[ends[2]-1]^0xff),
+		append(slices.Clone(data), make([]byte, 64)...),
+	} {
+		if err := os.WriteFile(path, torn, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		db, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out user
+		if err := db.Get("user/bob", &out); err != nil || out.Name != "bob" {
+			t.Fatal("Expected bob to be stored but got", out, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCompactKeepsMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := os.Chmod(path, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o640 {
+		t.Fatal("Expected compaction to keep the log's mode but got", info.Mode(), err)
+	}
+}
@@ -0,0 +1,67 @@
+// Package lagerhttp exchanges lager-encoded values over HTTP. A handler
+// writes a value with WriteResponse, and the client reads it back with
+// Decode.
+package lagerhttp
+
+import (
+	"mime"
+	"net/http"
+
+	lager "github.com/lowentropy/go-lager"
+)
+
+// ContentType is the media type of lager streams.
+const ContentType = "application/x-lager"
+
+func init() {
+	mime.AddExtensionType(".lgr", ContentType)
+}
+
+// WriteResponse writes a value to an HTTP response as a lager stream, with
+// the lager Content-Type. If encoding fails, nothing has been written, so
+// the handler can still report the error.
+func WriteResponse(w http.ResponseWriter, v interface{}) error {
+	data, err := lager.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", ContentType)
+	_, err = w.Write(data)
+	return err
+}
+
+// Decode reads a value written by WriteResponse from the body of an HTTP
+// response into the value pointed to by out. It fails with ContentTypeError
+// if the response isn't a lager stream, for instance because the server
+// replied with an error page. The caller must still close the body.
+func Decode(resp *http.Response, out interface{}) error {
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != ContentType {
+		return ContentTypeError{resp.Status, resp.Header.Get("Content-Type")}
+	}
+	dec, err := lager.NewDecoder(resp.Body)
+	if err != nil {
+		return err
+	}
+	return dec.ReadInto(out)
+}
+
+// ContentTypeError is returned by Decode when a response doesn't have the
+// lager Content-Type.
+type ContentTypeError struct {
+	status      string
+	contentType string
+}
+
+func (err ContentTypeError) Error() string {
+	return "Response with status " + err.status + " has Content-Type " + err.contentType + ", not " + ContentType
+}
+
+// Status returns the status of the response.
+func (err ContentTypeError) Status() string {
+	return err.status
+}
+
+// ContentType returns the Content-Type of the response.
+func (err ContentTypeError) ContentType() string {
+	return err.contentType
+}
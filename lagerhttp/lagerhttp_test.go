@@ -0,0 +1,64 @@
+package lagerhttp
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	lager "github.com/lowentropy/go-lager"
+)
+
+type Team struct {
+	Name    string
+	Members []*Member
+}
+
+type Member struct {
+	Name string
+	Team *Team
+}
+
+func init() {
+	lager.Register(Team{})
+	lager.Register(Member{})
+}
+
+func TestRoundTrip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		team := &Team{Name: "core"}
+		team.Members = []*Member{{"ann", team}, {"bob", team}}
+		if err := WriteResponse(w, team); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var team Team
+	if err := Decode(resp, &team); err != nil {
+		t.Fatal(err)
+	}
+	if team.Name != "core" || len(team.Members) != 2 || team.Members[1].Team != team.Members[0].Team {
+		t.Fatal("Expected the team to be decoded but got", team)
+	}
+
+	resp, err = http.Get(server.URL + "/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	err = Decode(resp, &team)
+	var mismatch ContentTypeError
+	if !errors.As(err, &mismatch) || mismatch.Status() != "404 Not Found" {
+		t.Fatal("Expected ContentTypeError but got", err)
+	}
+}
@@ -0,0 +1,260 @@
+// Package lagerstate persists an in-memory state value, such as a graph of
+// pointers, as periodic snapshots plus a write-ahead log of the records
+// applied to it in between.
+//
+// Each record is appended to the log, and then applied to the state by a
+// function given to Open. Every so many records, the whole state is written
+// as a new snapshot and the log is started afresh. Restoring reads the
+// latest snapshot and applies the records logged since, so the function
+// must apply records deterministically.
+package lagerstate
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	lager "github.com/lowentropy/go-lager"
+)
+
+// Options configures a Store. The zero value is the default.
+type Options struct {
+	// SnapshotEvery is the number of records after which a snapshot is
+	// taken automatically. It defaults to 1000; a negative value disables
+	// automatic snapshots.
+	SnapshotEvery int
+
+	// Sync commits the log to stable storage after each record, so that
+	// no record which was applied is lost in a crash.
+	Sync bool
+}
+
+// snapshotFile holds the latest snapshot. Each snapshot has a generation,
+// and the records applied since are logged in the log file of the same
+// generation. Log files of other generations are left over from crashes,
+// and are removed.
+const snapshotFile = "snapshot.lgr"
+
+func logFile(gen int) string {
+	return fmt.Sprintf("log-%d.wal", gen)
+}
+
+// Each log entry is the length and checksum of the record, followed by the
+// record, as written by lager.MarshalRecord.
+const entryHeader = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Store holds a state value of type T, and persists it in a directory. It
+// isn't safe for concurrent use.
+type Store[T any] struct {
+	dir     string
+	apply   func(*T, interface{}) error
+	opts    Options
+	state   *T
+	gen     int
+	log     *os.File
+	size    int64
+	records int
+}
+
+// Open opens the store in the given directory, creating it if needed, and
+// restores its state. Records are applied to the state using apply.
+func Open[T any](dir string, apply func(state *T, record interface{}) error, opts Options) (*Store[T], error) {
+	if opts.SnapshotEvery == 0 {
+		opts.SnapshotEvery = 1000
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &Store[T]{dir: dir, apply: apply, opts: opts}
+	if err := s.Restore(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// State returns the current state.
+func (s *Store[T]) State() *T {
+	return s.state
+}
+
+// Records returns the number of records logged since the last snapshot.
+func (s *Store[T]) Records() int {
+	return s.records
+}
+
+// Restore discards the current state, and restores it from the latest
+// snapshot and the records logged since. A record left partially written
+// by a crash is discarded.
+func (s *Store[T]) Restore() error {
+	if s.log != nil {
+		s.log.Close()
+		s.log = nil
+	}
+	s.state, s.gen, s.records, s.size = new(T), 0, 0, 0
+	if err := s.readSnapshot(); err != nil {
+		return err
+	}
+	log, err := os.OpenFile(filepath.Join(s.dir, logFile(s.gen)), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	s.log = log
+	if err := s.replay(); err != nil {
+		return err
+	}
+	return s.removeStale()
+}
+
+// readSnapshot reads the latest snapshot's generation and state, if there
+// is one.
+func (s *Store[T]) readSnapshot() error {
+	f, err := os.Open(filepath.Join(s.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec, err := lager.NewDecoder(f)
+	if err != nil {
+		return err
+	}
+	if err := dec.ReadInto(&s.gen); err != nil {
+		return err
+	}
+	return dec.ReadInto(s.state)
+}
+
+// replay applies each complete record in the log to the state, and
+// truncates the log after the last one.
+func (s *Store[T]) replay() error {
+	data, err := io.ReadAll(s.log)
+	if err != nil {
+		return err
+	}
+	for len(data)-int(s.size) >= entryHeader {
+		entry := data[s.size:]
+		n := int(binary.LittleEndian.Uint32(entry))
+		if entryHeader+n > len(entry) || crc32.Checksum(entry[entryHeader:entryHeader+n], crcTable) != binary.LittleEndian.Uint32(entry[4:]) {
+			break
+		}
+		var record interface{}
+		if err := lager.UnmarshalRecord(entry[entryHeader:entryHeader+n], &record); err != nil {
+			return err
+		}
+		if err := s.apply(s.state, record); err != nil {
+			return err
+		}
+		s.size += int64(entryHeader + n)
+		s.records++
+	}
+	if s.size < int64(len(data)) {
+		return s.log.Truncate(s.size)
+	}
+	return nil
+}
+
+// removeStale removes log files of generations other than the current one.
+func (s *Store[T]) removeStale() error {
+	logs, err := filepath.Glob(filepath.Join(s.dir, "log-*.wal"))
+	if err != nil {
+		return err
+	}
+	for _, log := range logs {
+		if filepath.Base(log) != logFile(s.gen) {
+			if err := os.Remove(log); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Apply appends a record to the log, and then applies it to the state, so
+// that the state never holds a record the log lacks. If the record can't be
+// logged, the state is left as it was; if it fails to apply, it's taken
+// back out of the log. A snapshot is taken once enough records have been
+// logged.
+func (s *Store[T]) Apply(record interface{}) error {
+	if s.log == nil {
+		return os.ErrClosed
+	}
+	data, err := lager.MarshalRecord(record)
+	if err != nil {
+		return err
+	}
+	entry := make([]byte, entryHeader, entryHeader+len(data))
+	binary.LittleEndian.PutUint32(entry, uint32(len(data)))
+	binary.LittleEndian.PutUint32(entry[4:], crc32.Checksum(data, crcTable))
+	entry = append(entry, data...)
+	err = s.writeEntry(entry)
+	if err == nil {
+		err = s.apply(s.state, record)
+	}
+	if err != nil {
+		// The record isn't in the state, so it mustn't be replayed either.
+		if terr := s.log.Truncate(s.size); terr != nil {
+			return terr
+		}
+		return err
+	}
+	s.size += int64(len(entry))
+	s.records++
+	if s.opts.SnapshotEvery > 0 && s.records >= s.opts.SnapshotEvery {
+		return s.Snapshot()
+	}
+	return nil
+}
+
+// writeEntry writes an entry at the end of the log, syncing it if the
+// Sync option is set.
+func (s *Store[T]) writeEntry(entry []byte) error {
+	if _, err := s.log.WriteAt(entry, s.size); err != nil {
+		return err
+	}
+	if s.opts.Sync {
+		return s.log.Sync()
+	}
+	return nil
+}
+
+// Snapshot writes the whole state as a new snapshot, replacing the old one
+// atomically, and starts a new log.
+func (s *Store[T]) Snapshot() error {
+	if s.log == nil {
+		return os.ErrClosed
+	}
+	gen := s.gen + 1
+	log, err := os.OpenFile(filepath.Join(s.dir, logFile(gen)), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := lager.WriteFile(filepath.Join(s.dir, snapshotFile), gen, s.state); err != nil {
+		log.Close()
+		return err
+	}
+	s.log.Close()
+	s.log, s.gen, s.size, s.records = log, gen, 0, 0
+	return s.removeStale()
+}
+
+// Close syncs and closes the log. The state isn't snapshotted, as the
+// log already holds every record applied since the last snapshot.
+func (s *Store[T]) Close() error {
+	if s.log == nil {
+		return os.ErrClosed
+	}
+	err := s.log.Sync()
+	if cerr := s.log.Close(); err == nil {
+		err = cerr
+	}
+	s.log = nil
+	return err
+}
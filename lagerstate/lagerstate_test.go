@@ -0,0 +1,147 @@
+package lagerstate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	lager "github.com/lowentropy/go-lager"
+)
+
+type node struct {
+	Name  string
+	Links []*node
+}
+
+type graph struct {
+	Nodes map[string]*node
+}
+
+type addNode struct {
+	Name string
+}
+
+type link struct {
+	From, To string
+}
+
+func init() {
+	lager.Register(node{})
+	lager.Register(graph{})
+	lager.Register(addNode{})
+	lager.Register(link{})
+}
+
+func apply(g *graph, record interface{}) error {
+	if g.Nodes == nil {
+		g.Nodes = make(map[string]*node)
+	}
+	switch r := record.(type) {
+	case addNode:
+		g.Nodes[r.Name] = &node{Name: r.Name}
+	case link:
+		from, to := g.Nodes[r.From], g.Nodes[r.To]
+		if from == nil || to == nil {
+			return errors.New("no such node")
+		}
+		from.Links = append(from.Links, to)
+	default:
+		return fmt.Errorf("unknown record %T", record)
+	}
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, apply, Options{SnapshotEvery: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []interface{}{addNode{"a"}, addNode{"b"}, link{"a", "b"}, link{"b", "a"}, addNode{"c"}, link{"c", "a"}}
+	for _, r := range records {
+		if err := store.Apply(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Apply(link{"a", "z"}); err == nil || store.Records() != 2 {
+		t.Fatal("Expected a failed record not to be logged but got", err, store.Records())
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if logs, _ := filepath.Glob(filepath.Join(dir, "log-*.wal")); len(logs) != 1 || filepath.Base(logs[0]) != "log-1.wal" {
+		t.Fatal("Expected only the log after the snapshot but got", logs)
+	}
+
+	// A partially written record at the end of the log is discarded.
+	f, err := os.OpenFile(filepath.Join(dir, "log-1.wal"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{100, 0, 0, 0, 1})
+	f.Close()
+
+	store, err = Open(dir, apply, Options{SnapshotEvery: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	g := store.State()
+	a, b, c := g.Nodes["a"], g.Nodes["b"], g.Nodes["c"]
+	if len(g.Nodes) != 3 || a.Links[0] != b || b.Links[0] != a || c.Links[0] != a {
+		t.Fatal("Expected the graph to be restored but got", g)
+	}
+	if store.Records() != 2 {
+		t.Fatal("Expected two records since the snapshot but got", store.Records())
+	}
+	if err := store.Apply(link{"a", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if g := store.State(); len(g.Nodes["a"].Links) != 2 || g.Nodes["a"].Links[1] != g.Nodes["c"] {
+		t.Fatal("Expected the record after the torn one to be restored but got", g.Nodes["a"])
+	}
+}
+
+func TestApplyLogsFirst(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, apply, Options{Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Apply(addNode{"a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record which can't be logged isn't applied either.
+	store.log.Close()
+	if err := store.Apply(addNode{"b"}); err == nil {
+		t.Fatal("Expected the failed write to fail Apply")
+	}
+	if g := store.State(); len(g.Nodes) != 1 || g.Nodes["b"] != nil || store.Records() != 1 {
+		t.Fatal("Expected the unlogged record not to be applied but got", g.Nodes, store.Records())
+	}
+
+	// And one which fails to apply isn't replayed.
+	if err := store.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Apply(link{"a", "z"}); err == nil {
+		t.Fatal("Expected the link to a missing node to fail")
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, err = Open(dir, apply, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if g := store.State(); len(g.Nodes) != 1 || len(g.Nodes["a"].Links) != 0 || store.Records() != 1 {
+		t.Fatal("Expected only the applied record to be restored but got", g.Nodes, store.Records())
+	}
+}
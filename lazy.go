@@ -0,0 +1,462 @@
+package lager
+
+import (
+	"reflect"
+	"slices"
+	"strconv"
+)
+
+// Lazy is a handle on a value in a stream which is only decoded when it is
+// asked for, so that reading a few fields of a large object doesn't mean
+// decoding all of it. Handles on whole objects are returned by
+// Decoder.ReadLazy and Decoder.ReadLazyAt, and handles on the values
+// inside them by Field and Index, which find those values by skipping over
+// the encoded values before them. A handle stays valid until its decoder
+// is Reset, and like its decoder, isn't safe for concurrent use.
+type Lazy struct {
+	d      *Decoder
+	wt     *wireType
+	offset int64
+
+	// root is the name of the type of the object holding the value, and
+	// path the value's path within it, as in ".Users[3].Name".
+	root, path string
+
+	// target is the value held once named types are unwrapped and
+	// pointers followed, whose fields or elements are found on first use.
+	target *Lazy
+	names  []string
+	fields map[string]*Lazy
+	elems  []*Lazy
+
+	decoded bool
+	value   interface{}
+	err     error
+}
+
+// nilWireType is the type of a Lazy for a nil pointer.
+var nilWireType = &wireType{wireKey: wireKey{kind: nilKind}}
+
+// ReadLazy returns a handle on the next object in the stream without
+// decoding it. The object is read past, verifying its checksum, and its
+// values are decoded when they're asked for by reading them again from
+// the decoder's source. This needs a source which is both an io.ReadSeeker
+// and an io.ReaderAt, such as an *os.File, or a memory-mapped file wrapped
+// in an io.NewSectionReader. Pointers are followed from the records they
+// were written in; in streams written with the Footer option, these are
+// only read when reached, too.
+func (d *Decoder) ReadLazy() (l *Lazy, err error) {
+	if d.source == nil {
+		return nil, NoIndex{}
+	}
+	for {
+		l, err = d.readLazy()
+		if !d.resync(err) {
+			return l, err
+		}
+	}
+}
+
+// readLazy reads past the next object in the stream, for ReadLazy.
+func (d *Decoder) readLazy() (l *Lazy, err error) {
+	defer d.recoverPanic(&err)
+	wt, err := d.beginObject()
+	if err != nil {
+		return nil, err
+	}
+	l = &Lazy{d: d, wt: wt, offset: d.reader.n, root: d.wireName(wt)}
+	if err := d.skip(wt); err != nil {
+		return nil, withRootName(err, l.root)
+	}
+	if err := d.endObject(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ReadLazyAt returns a handle on the i'th object in the stream, as ReadAt
+// would return the object itself, without reading any of it. Checksums
+// aren't verified.
+func (d *Decoder) ReadLazyAt(i int) (l *Lazy, err error) {
+	defer d.recoverPanic(&err)
+	if d.source == nil || d.objIndex == nil {
+		return nil, NoIndex{}
+	}
+	if i < 0 || i >= len(d.objIndex) {
+		return nil, IndexOutOfRange{i}
+	}
+	body, done := d.reader, d.done
+	defer func() {
+		d.reader, d.done = body, done
+	}()
+	d.reader = d.readerAt(d.objIndex[i])
+	d.done = false
+	wt, err := d.beginRecords()
+	if err != nil {
+		return nil, err
+	}
+	return &Lazy{d: d, wt: wt, offset: d.reader.n, root: d.wireName(wt)}, nil
+}
+
+// Type returns the name of the value's type in the stream. For a value
+// held in an interface, this is the type of the value, not the interface.
+func (l *Lazy) Type() string {
+	return l.d.wireName(l.wt)
+}
+
+// Value decodes the value and returns it. The value is decoded on the
+// first call only, and pointers in it are shared with other values read
+// from the decoder.
+func (l *Lazy) Value() (interface{}, error) {
+	if !l.decoded {
+		l.value, l.err = l.decode()
+		l.decoded = true
+	}
+	return l.value, l.err
+}
+
+// decode decodes the value, for Value.
+func (l *Lazy) decode() (interface{}, error) {
+	t, err := l.d.resolve(l.wt)
+	if err != nil || t == nil {
+		return nil, l.wrap(err)
+	}
+	v := reflect.New(t).Elem()
+	if err := l.readInto(v); err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
+}
+
+// Decode decodes the value into the value pointed to by ptr, reusing any
+// storage it already holds where possible, as for Decoder.ReadInto.
+func (l *Lazy) Decode(ptr interface{}) error {
+	dst := reflect.ValueOf(ptr)
+	if !dst.IsValid() || !isPtr(dst.Type()) || dst.IsNil() {
+		return InvalidTarget{reflect.TypeOf(ptr)}
+	}
+	t, err := l.d.resolve(l.wt)
+	if err != nil {
+		return l.wrap(err)
+	}
+	if t != nil && t == dst.Type().Elem() {
+		return l.readInto(dst.Elem())
+	}
+	value, err := l.Value()
+	if err != nil {
+		return err
+	}
+	return assign(ptr, value)
+}
+
+// readInto decodes the value into v, along with any pointers it refers to
+// which haven't been read yet.
+func (l *Lazy) readInto(v reflect.Value) error {
+	if l.wt.kind == typedNilKind {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	return l.at(l.offset, func() error {
+		if err := l.d.readValue(v); err != nil {
+			return l.wrap(err)
+		}
+		return l.d.resolvePending()
+	})
+}
+
+// Fields returns the names of the fields of the struct the value holds or
+// points to, in the order they were written.
+func (l *Lazy) Fields() ([]string, error) {
+	s, err := l.structure("fields")
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(s.names), nil
+}
+
+// Field returns a handle on the named field of the struct the value holds
+// or points to, failing with InvalidAccess if it has no such field. Fields
+// which were left out of the stream by the OmitZero option are missing.
+func (l *Lazy) Field(name string) (*Lazy, error) {
+	s, err := l.structure("." + name)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := s.fields[name]
+	if !ok {
+		return nil, InvalidAccess{l.root + l.path, "." + name}
+	}
+	return f, nil
+}
+
+// Len returns the number of elements of the slice the value holds or
+// points to.
+func (l *Lazy) Len() (int, error) {
+	s, err := l.elements("length")
+	if err != nil {
+		return 0, err
+	}
+	return len(s.elems), nil
+}
+
+// Index returns a handle on the i'th element of the slice the value holds
+// or points to.
+func (l *Lazy) Index(i int) (*Lazy, error) {
+	elem := "[" + strconv.Itoa(i) + "]"
+	s, err := l.elements(elem)
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 || i >= len(s.elems) {
+		return nil, InvalidAccess{l.root + l.path, elem}
+	}
+	return s.elems[i], nil
+}
+
+// structure returns the struct the value holds or points to, with the
+// offsets of its fields found. The access asked for is given for errors.
+func (l *Lazy) structure(access string) (*Lazy, error) {
+	s, err := l.deref()
+	if err != nil {
+		return nil, err
+	}
+	if s.wt.kind != reflect.Struct {
+		return nil, InvalidAccess{l.root + l.path, access}
+	}
+	if s.fields != nil {
+		return s, nil
+	}
+	d := s.d
+	var names []string
+	fields := make(map[string]*Lazy)
+	err = s.at(s.offset, func() error {
+		n, err := d.readLength()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			name, err := d.readFieldName()
+			if err != nil {
+				return err
+			}
+			f, err := s.child("."+name, true)
+			if err != nil {
+				return err
+			}
+			names = append(names, name)
+			fields[name] = f
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, s.wrap(err)
+	}
+	s.names, s.fields = names, fields
+	return s, nil
+}
+
+// elements returns the slice the value holds or points to, with the
+// offsets of its elements found. The access asked for is given for errors.
+func (l *Lazy) elements(access string) (*Lazy, error) {
+	s, err := l.deref()
+	if err != nil {
+		return nil, err
+	}
+	if s.wt.kind != reflect.Slice {
+		return nil, InvalidAccess{l.root + l.path, access}
+	}
+	if s.elems != nil {
+		return s, nil
+	}
+	elems := []*Lazy{}
+	shared := false
+	var ref uint
+	var offset, length int
+	err = s.at(s.offset, func() error {
+		n, err := s.d.readSliceLength()
+		if err != nil {
+			return err
+		}
+		if n == sharedLength {
+			shared = true
+			ref, _, offset, length, err = s.d.readSharedHeader()
+			return err
+		}
+		for i := 0; i < n; i++ {
+			elem, err := s.child("["+strconv.Itoa(i)+"]", false)
+			if err != nil {
+				return err
+			}
+			elems = append(elems, elem)
+		}
+		return nil
+	})
+	if err == nil && shared {
+		elems, err = s.sharedElements(ref, offset, length, access)
+	}
+	if err != nil {
+		return nil, s.wrap(err)
+	}
+	s.elems = elems
+	return s, nil
+}
+
+// sharedElements returns handles on the elements of a slice which shares
+// the backing array with the given reference id, from its record.
+func (l *Lazy) sharedElements(ref uint, offset, length int, access string) ([]*Lazy, error) {
+	p, err := l.followRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	if p.wt.kind != reflect.Slice || p.wt.elem != l.wt.elem {
+		return nil, CorruptStream{"slice"}
+	}
+	array, err := p.elements(access)
+	if err != nil {
+		return nil, err
+	}
+	if offset+length > len(array.elems) {
+		return nil, CorruptStream{"slice"}
+	}
+	elems := make([]*Lazy, length)
+	for i := range elems {
+		elem := *array.elems[offset+i]
+		elem.path = l.path + "[" + strconv.Itoa(i) + "]"
+		elems[i] = &elem
+	}
+	return elems, nil
+}
+
+// child returns a handle on the struct field or slice element at the
+// decoder's position, and reads past it. Fields are preceded by their
+// type, elements have that of the slice, and the values of interfaces by
+// their dynamic type.
+func (l *Lazy) child(elem string, field bool) (*Lazy, error) {
+	d := l.d
+	wt := l.wt.elem
+	if field {
+		var err error
+		if wt, err = d.readWireType(); err != nil {
+			return nil, err
+		}
+	}
+	if wt.kind == reflect.Interface {
+		var err error
+		if wt, err = d.readWireType(); err != nil {
+			return nil, err
+		}
+	}
+	c := &Lazy{d: d, wt: wt, offset: d.reader.n, root: l.root, path: l.path + elem}
+	if err := d.skip(wt); err != nil {
+		return nil, withPath(err, elem)
+	}
+	return c, nil
+}
+
+// deref returns the value held once named types are unwrapped and
+// pointers followed, or a handle of the type of nil for a nil pointer.
+func (l *Lazy) deref() (*Lazy, error) {
+	if l.target != nil {
+		return l.target, nil
+	}
+	t := l
+	followed := make(map[int64]bool)
+	for t.wt.kind == namedKind || t.wt.kind == reflect.Ptr {
+		if t.wt.kind == namedKind {
+			t = &Lazy{d: l.d, wt: t.wt.elem, offset: t.offset, root: l.root, path: l.path}
+			continue
+		}
+		if followed[t.offset] {
+			return nil, l.wrap(CorruptStream{"pointer"})
+		}
+		followed[t.offset] = true
+		var err error
+		if t, err = t.follow(); err != nil {
+			return nil, l.wrap(err)
+		}
+	}
+	l.target = t
+	return t, nil
+}
+
+// follow returns a handle on the value a pointer points to, in its pointer
+// record.
+func (l *Lazy) follow() (*Lazy, error) {
+	d := l.d
+	var ref uint
+	err := l.at(l.offset, func() (err error) {
+		ref, err = d.readUint()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l.followRef(ref)
+}
+
+// followRef returns a handle on the value of the pointer or backing array
+// with the given reference id, in its record.
+func (l *Lazy) followRef(ref uint) (*Lazy, error) {
+	d := l.d
+	p := &Lazy{d: d, wt: nilWireType, root: l.root, path: l.path}
+	if ref == nilRef {
+		return p, nil
+	}
+	offset, ok := d.ptrOffsets[ref]
+	indexed := false
+	if !ok {
+		if offset, ok = d.ptrIndex[ref]; !ok {
+			return nil, MissingPointer{ref}
+		}
+		indexed = true
+	}
+	err := l.at(offset, func() error {
+		if indexed {
+			if tag, err := d.readUint8(); err != nil {
+				return err
+			} else if tag != pointerRecord {
+				return CorruptStream{"pointer index"}
+			}
+		}
+		if id, err := d.readUint(); err != nil {
+			return err
+		} else if id != ref {
+			return CorruptStream{"pointer index"}
+		}
+		wt, err := d.readWireType()
+		if err != nil {
+			return err
+		}
+		if wt.kind == nilKind {
+			return CorruptStream{"type"}
+		}
+		p.wt, p.offset = wt, d.reader.n
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// at calls read with the decoder reading from the given offset in its
+// source, and then returns the decoder to where it left off.
+func (l *Lazy) at(offset int64, read func() error) (err error) {
+	d := l.d
+	defer d.recoverPanic(&err)
+	reader := d.reader
+	defer func() { d.reader = reader }()
+	d.reader = d.readerAt(offset)
+	return read()
+}
+
+// wrap adds the value's path to an error in decoding it.
+func (l *Lazy) wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	if l.path != "" {
+		err = withPath(err, l.path)
+	}
+	return withRootName(err, l.root)
+}
@@ -0,0 +1,76 @@
+package lager
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"reflect"
+)
+
+// Marshal encodes a single object into a complete, self-contained stream
+// and returns its bytes.
+func Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	if err := enc.Write(v); err != nil {
+		return nil, err
+	}
+	if err := enc.Finish(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the first object in the given stream and stores it in
+// the value pointed to by out. If the decoded object is a pointer and out
+// points to its element type, the pointed-to value is stored instead.
+func Unmarshal(data []byte, out interface{}) error {
+	dec, err := NewDecoder(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return dec.ReadInto(out)
+}
+
+// assign stores a decoded value into the destination pointer out.
+func assign(out interface{}, value interface{}) error {
+	dst := reflect.ValueOf(out)
+	if !dst.IsValid() || !isPtr(dst.Type()) || dst.IsNil() {
+		return InvalidTarget{reflect.TypeOf(out)}
+	}
+	dst = dst.Elem()
+	src := reflect.ValueOf(value)
+	if !src.IsValid() {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+	if !src.Type().AssignableTo(dst.Type()) && isPtr(src.Type()) && !src.IsNil() {
+		src = src.Elem()
+	}
+	if !src.Type().AssignableTo(dst.Type()) {
+		return TypeMismatch{src.Type(), dst.Type()}
+	}
+	dst.Set(src)
+	return nil
+}
+
+// Hash returns the SHA-256 hash of the canonical encoding of v, so that
+// equal object graphs hash equally, regardless of map order or where their
+// pointers are in memory. Types are named by their Go names and written
+// with their structure, whatever names they were registered under, so the
+// hash doesn't change with what the process has registered; codecs are
+// still used. Maps keyed by pointers don't hash stably.
+func Hash(v interface{}) ([32]byte, error) {
+	var sum [32]byte
+	h := sha256.New()
+	registry := NewRegistry()
+	registry.isolated = true
+	enc := NewEncoderWithOptions(h, EncoderOptions{Canonical: true, Registry: registry})
+	if err := enc.Write(v); err != nil {
+		return sum, err
+	}
+	if err := enc.Finish(); err != nil {
+		return sum, err
+	}
+	h.Sum(sum[:0])
+	return sum, nil
+}
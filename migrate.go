@@ -0,0 +1,167 @@
+package lager
+
+import (
+	"reflect"
+	"sync"
+)
+
+// Versioned is implemented by types whose encoding changes over time.
+// Each type's version is written to the stream along with its name, and
+// when a stream holds an older version of a struct than the registered
+// one, the decoder migrates it using the functions registered with
+// RegisterMigration. Versions start from 1; types without a version are
+// version 0.
+type Versioned interface {
+	LagerVersion() int
+}
+
+var versionedType = reflect.TypeOf((*Versioned)(nil)).Elem()
+
+// Migration converts a struct written with an older version of its type.
+// It is given the old value's fields by name, decoded as by ReadGeneric,
+// and returns either a map of the next version's fields, or a value of the
+// current type or a pointer to one. Fields of a returned map are assigned
+// to the current type where their values are assignable or convertible.
+type Migration func(old map[string]interface{}) interface{}
+
+// migration is a registered Migration and the version it converts to.
+type migration struct {
+	to int
+	fn Migration
+}
+
+// migrationKey identifies a migration by the name of its type and the
+// version it converts from.
+type migrationKey struct {
+	name string
+	from int
+}
+
+// RegisterMigration registers a function converting the type with the
+// given name from one version to a later one, in the global registry.
+func RegisterMigration(name string, from, to int, fn Migration) {
+	defaultRegistry.RegisterMigration(name, from, to, fn)
+}
+
+// RegisterMigration registers a function converting the type with the
+// given name from one version to a later one. Migrations are chained, so
+// that a value several versions old is migrated one step at a time.
+func (r *Registry) RegisterMigration(name string, from, to int, fn Migration) {
+	if to <= from {
+		panic("lager: migration must be to a later version")
+	}
+	r.lock()
+	defer r.mu.Unlock()
+	r.migrations[migrationKey{name, from}] = migration{to, fn}
+}
+
+// lookupMigration finds the migration from the given version of a type,
+// falling back to the global registry.
+func lookupMigration(r *Registry, name string, from int) (migration, bool) {
+	key := migrationKey{name, from}
+	for _, reg := range []*Registry{r, defaultRegistry} {
+		if reg == nil {
+			continue
+		}
+		unlock := reg.rlock()
+		m, ok := reg.migrations[key]
+		unlock()
+		if ok {
+			return m, true
+		}
+	}
+	return migration{}, false
+}
+
+// versionCache holds the version of each type seen so far.
+var versionCache sync.Map
+
+// typeVersion returns the current version of the given type, or 0 if it
+// doesn't implement Versioned.
+func typeVersion(t reflect.Type) int {
+	if v, ok := versionCache.Load(t); ok {
+		return v.(int)
+	}
+	version := 0
+	if t.Kind() != reflect.Interface && reflect.PtrTo(t).Implements(versionedType) {
+		version = reflect.New(t).Interface().(Versioned).LagerVersion()
+	}
+	versionCache.Store(t, version)
+	return version
+}
+
+// staleVersion returns the name of a struct type and the version it was
+// written with, if that is older than its current version.
+func (d *Decoder) staleVersion(t reflect.Type) (string, int, bool) {
+	current := typeVersion(t)
+	if current == 0 {
+		return "", 0, false
+	}
+	name, ok := nameOf(d.registry, t)
+	if !ok {
+		name = t.String()
+	}
+	version, ok := d.versions[name]
+	return name, version, ok && version < current
+}
+
+// migrateStruct reads a struct written with an older version of its type,
+// migrates it to the current version and stores it in v.
+func (d *Decoder) migrateStruct(v reflect.Value, name string, version int) error {
+	old, err := d.readGenericStruct()
+	if err != nil {
+		return err
+	}
+	t := v.Type()
+	value := old
+	for current := typeVersion(t); version < current; {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return TypeMismatch{reflect.TypeOf(value), reflect.TypeOf(fields)}
+		}
+		m, ok := lookupMigration(d.registry, name, version)
+		if !ok {
+			return MissingMigration{name, version}
+		}
+		value, version = m.fn(fields), m.to
+	}
+	if fields, ok := value.(map[string]interface{}); ok {
+		return d.assignFields(v, fields)
+	}
+	src := reflect.ValueOf(value)
+	if src.IsValid() && src.Type() == reflect.PtrTo(t) && !src.IsNil() {
+		src = src.Elem()
+	}
+	if !src.IsValid() || src.Type() != t {
+		return TypeMismatch{src.Type(), t}
+	}
+	v.Set(src)
+	return nil
+}
+
+// assignFields stores migrated fields by name in the struct v.
+func (d *Decoder) assignFields(v reflect.Value, fields map[string]interface{}) error {
+	t := v.Type()
+	for name, value := range fields {
+		f, ok := lookupField(t, name, d.opts.Unexported)
+		if !ok {
+			if d.opts.IgnoreUnknownFields {
+				continue
+			}
+			return MissingField{t, name}
+		}
+		fv := fieldValue(v, f)
+		src := reflect.ValueOf(value)
+		switch {
+		case !src.IsValid():
+			fv.Set(reflect.Zero(f.typ))
+		case src.Type().AssignableTo(f.typ):
+			fv.Set(src)
+		case src.Type().ConvertibleTo(f.typ):
+			fv.Set(src.Convert(f.typ))
+		default:
+			return withPath(TypeMismatch{src.Type(), f.typ}, "."+name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package lager
+
+import (
+	"io"
+	"maps"
+	"reflect"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// ReadParallel returns every object in the stream, decoded by the given
+// number of goroutines, or one for each CPU if workers isn't positive. As
+// for ReadAt, this requires a stream written with the Index option, and a
+// decoder whose source is both an io.ReadSeeker and an io.ReaderAt.
+//
+// Memory for every pointer in the stream is allocated up front, from the
+// types in the pointer records, so that the workers share it. The values
+// pointed to are then decoded, with the pointer records split between the
+// workers, followed by the objects themselves. Pointers are shared with
+// objects returned by Read and ReadAt, and ReadParallel doesn't affect
+// which object Read returns. AfterDecodeLager methods may be called from
+// several goroutines at once, and the Trace option is ignored.
+func (d *Decoder) ReadParallel(workers int) (values []interface{}, err error) {
+	defer d.recoverPanic(&err)
+	if d.source == nil || d.objIndex == nil {
+		return nil, NoIndex{}
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if err := d.allocPtrs(); err != nil {
+		return nil, err
+	}
+	d.resolveWireTypes()
+	source := d.source
+	if d.encrypted {
+		source = &lockedReaderAt{r: d.source}
+	}
+	fork := func() *Decoder {
+		return d.fork(source)
+	}
+
+	refs := slices.Sorted(maps.Keys(d.pending))
+	err = parallel(workers, len(refs), fork, func(w *Decoder, lo, hi int) error {
+		for _, ref := range refs[lo:hi] {
+			w.pending[ref] = true
+		}
+		for _, ref := range refs[lo:hi] {
+			if err := w.loadPtr(d.ptrIndex[ref]); err != nil {
+				return err
+			}
+		}
+		return w.resolvePending()
+	})
+	if err != nil {
+		return nil, err
+	}
+	clear(d.pending)
+
+	values = make([]interface{}, len(d.objIndex))
+	err = parallel(workers, len(values), fork, func(w *Decoder, lo, hi int) error {
+		for i := lo; i < hi; i++ {
+			value, err := w.readObjectAt(d.objIndex[i])
+			if err != nil {
+				return err
+			}
+			values[i] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// parallel splits n items into a contiguous range for each worker, and
+// calls read for each range from its own goroutine, with a decoder of its
+// own made by fork. The error for the first range which failed is
+// returned.
+func parallel(workers, n int, fork func() *Decoder, read func(w *Decoder, lo, hi int) error) error {
+	workers = max(1, min(workers, n))
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := range workers {
+		lo, hi := i*n/workers, (i+1)*n/workers
+		w := fork()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer w.recoverPanic(&errs[i])
+			errs[i] = read(w, lo, hi)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocPtrs allocates memory for each pointer in the pointer index which
+// hasn't been read or allocated yet, marking them as pending. The type of
+// each is read from the start of its record, and maps are made, so that
+// values referring to them can be read first. Pointers whose types aren't
+// registered are left out, and fail to be read as usual.
+func (d *Decoder) allocPtrs() error {
+	for _, ref := range slices.Sorted(maps.Keys(d.ptrIndex)) {
+		if _, ok := d.ptrMap[ref]; ok {
+			continue
+		}
+		if _, ok := d.unresolved[ref]; ok {
+			continue
+		}
+		wt, n, err := d.readPtrType(ref, d.ptrIndex[ref])
+		if err != nil {
+			return err
+		}
+		t, err := d.resolve(wt)
+		if unregistered(err) {
+			d.unresolved[ref] = err
+			continue
+		} else if err != nil {
+			return err
+		}
+		p, err := d.alloc(t)
+		if err != nil {
+			return err
+		}
+		if t.Kind() == reflect.Slice && n > 0 {
+			p.Elem().Set(reflect.MakeSlice(t, n, n))
+		} else if t.Kind() == reflect.Map && p.Elem().IsNil() {
+			p.Elem().Set(reflect.MakeMap(t))
+		}
+		d.ptrMap[ref] = p
+		d.pending[ref] = true
+	}
+	return nil
+}
+
+// resolveWireTypes resolves each wire type read so far, which the
+// decoder's forks share, so that they don't cache their Go types from
+// several goroutines at once. Those which fail to resolve are left for
+// reading them to fail as usual, and are never cached.
+func (d *Decoder) resolveWireTypes() {
+	for _, wt := range d.wireTypes {
+		d.resolve(wt)
+	}
+}
+
+// readPtrType reads the type of the pointer record at the given offset,
+// checking that it is for the given reference id. The length of a slice
+// pointed to is read as well, so that backing arrays can be allocated
+// before the slices sharing them are read; it's -1 for other values.
+func (d *Decoder) readPtrType(ref uint, offset int64) (*wireType, int, error) {
+	reader := d.reader
+	defer func() { d.reader = reader }()
+	d.reader = d.readerAt(offset)
+	if tag, err := d.readUint8(); err != nil {
+		return nil, -1, err
+	} else if tag != pointerRecord {
+		return nil, -1, CorruptStream{"pointer index"}
+	}
+	if id, err := d.readUint(); err != nil {
+		return nil, -1, err
+	} else if id != ref {
+		return nil, -1, CorruptStream{"pointer index"}
+	}
+	wt, err := d.readWireType()
+	if err != nil {
+		return nil, -1, err
+	}
+	if wt.kind == nilKind {
+		return nil, -1, CorruptStream{"type"}
+	}
+	if wt.kind != reflect.Slice {
+		return wt, -1, nil
+	}
+	n, err := d.readInt()
+	if err == nil && d.size > 0 && int64(n) > d.size {
+		err = CorruptStream{"length"}
+	}
+	return wt, n, err
+}
+
+// fork returns a decoder which reads from the given source with copies of
+// the decoder's tables and pointers, so that it can be used from another
+// goroutine. The pointers' allocations themselves are shared.
+func (d *Decoder) fork(source io.ReaderAt) *Decoder {
+	w := newDecoder(d.opts)
+	w.opts.Trace = nil
+	w.registry = d.registry
+	w.flags = d.flags
+	w.objects = d.objects
+	maps.Copy(w.typeNames, d.typeNames)
+	maps.Copy(w.schemas, d.schemas)
+	maps.Copy(w.fingerprints, d.fingerprints)
+	maps.Copy(w.versions, d.versions)
+	maps.Copy(w.structures, d.structures)
+	maps.Copy(w.typeMap, d.typeMap)
+	maps.Copy(w.wireTypes, d.wireTypes)
+	maps.Copy(w.unresolved, d.unresolved)
+	maps.Copy(w.fieldNames, d.fieldNames)
+	maps.Copy(w.strs, d.strs)
+	maps.Copy(w.ptrMap, d.ptrMap)
+	w.ptrIndex = d.ptrIndex
+	w.objIndex = d.objIndex
+	w.source = source
+	w.size = d.size
+	w.footerRead = true
+	w.encrypted = d.encrypted
+	return w
+}
+
+// lockedReaderAt serializes reads from a source which isn't safe for
+// concurrent use, such as the decrypted contents of an encrypted file.
+type lockedReaderAt struct {
+	mu sync.Mutex
+	r  io.ReaderAt
+}
+
+func (l *lockedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.ReadAt(p, off)
+}
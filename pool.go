@@ -0,0 +1,30 @@
+package lager
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxPooledBuffer is the largest buffer capacity kept for reuse, so that
+// one huge object doesn't pin its memory in the pool forever.
+const maxPooledBuffer = 1 << 16
+
+// bufferPool holds scratch buffers for encoding, shared between encoders.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty scratch buffer from the pool.
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns a scratch buffer to the pool. The buffer must not be
+// used afterwards.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
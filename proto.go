@@ -0,0 +1,289 @@
+package lager
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// WriteProto writes a proto3 file to w, declaring a message for each struct
+// type in the schema in the given package, so that readers in other
+// languages have a model of the values a stream holds. The lager wire
+// format isn't protobuf, so this documents the values rather than how
+// they're encoded; fields are numbered in the order they're written, and
+// the numbers change when fields are added to or removed from a type.
+// Types are mapped on a best-effort basis:
+//
+//   - Fields keep their names, with characters not allowed in protobuf
+//     replaced, and messages are named after their types' names in
+//     CamelCase, so that "main.User" becomes MainUser.
+//   - Integers become sint64, sint32, uint64 or uint32, floats become float
+//     or double, complex numbers become Complex64 or Complex128 messages,
+//     times become google.protobuf.Timestamp, and durations become
+//     google.protobuf.Duration.
+//   - Named types become their underlying types, and byte slices and types
+//     with their own binary encoding become bytes.
+//   - Slices become repeated fields, and maps become map fields, or
+//     repeated entry messages when their keys can't be map keys. Slices and
+//     maps inside others are wrapped in messages of their own.
+//   - Pointers become Ref messages holding the reference id of the value
+//     pointed to, or 0 for nil. Each field's comment gives the type it
+//     points to.
+//   - Interfaces, and struct types the schema doesn't describe, become
+//     google.protobuf.Any.
+func (s Schema) WriteProto(w io.Writer, pkg string) error {
+	p := &protoWriter{
+		types:   make(map[string]TypeSchema),
+		names:   make(map[string]string),
+		used:    map[string]bool{"Ref": true, "Complex64": true, "Complex128": true},
+		helpers: make(map[string]string),
+		imports: make(map[string]bool),
+	}
+	for _, t := range s.Types {
+		p.types[t.Name] = t
+		if t.Kind == "struct" {
+			p.names[t.Name] = p.messageName(t.Name)
+		}
+	}
+	var body strings.Builder
+	for _, t := range s.Types {
+		if t.Kind == "struct" {
+			p.writeMessage(&body, t)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(p.helpers)) {
+		body.WriteString(p.helpers[name])
+	}
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "// Generated from a lager schema, format version %d.\n\n", s.Version)
+	out.WriteString("syntax = \"proto3\";\n")
+	if pkg != "" {
+		fmt.Fprintf(out, "\npackage %s;\n", pkg)
+	}
+	if len(p.imports) > 0 {
+		out.WriteString("\n")
+		for _, file := range slices.Sorted(maps.Keys(p.imports)) {
+			fmt.Fprintf(out, "import %q;\n", file)
+		}
+	}
+	out.WriteString(body.String())
+	return out.Flush()
+}
+
+// protoWriter maps the types of a schema to protobuf types, for
+// WriteProto.
+type protoWriter struct {
+	types map[string]TypeSchema
+
+	// names maps the names of struct types to their messages' names, and
+	// used holds every message name taken.
+	names map[string]string
+	used  map[string]bool
+
+	// helpers holds the messages declared as they're needed, such as
+	// Ref, keyed by name, and imports the files of well-known types used.
+	helpers map[string]string
+	imports map[string]bool
+}
+
+// protoType is a protobuf field type: a singular type, which may be
+// repeated, or the values of a map with the given key type.
+type protoType struct {
+	name     string
+	repeated bool
+	key      string
+}
+
+// String returns the type as it's written in a field declaration.
+func (t protoType) String() string {
+	switch {
+	case t.repeated:
+		return "repeated " + t.name
+	case t.key != "":
+		return "map<" + t.key + ", " + t.name + ">"
+	}
+	return t.name
+}
+
+// protoScalars maps the names of basic types to protobuf scalar types.
+var protoScalars = map[string]string{
+	"bool":    "bool",
+	"int":     "sint64",
+	"int8":    "sint32",
+	"int16":   "sint32",
+	"int32":   "sint32",
+	"int64":   "sint64",
+	"uint":    "uint64",
+	"uint8":   "uint32",
+	"uint16":  "uint32",
+	"uint32":  "uint32",
+	"uint64":  "uint64",
+	"uintptr": "uint64",
+	"float32": "float",
+	"float64": "double",
+	"string":  "string",
+}
+
+// writeMessage writes the message for a struct type.
+func (p *protoWriter) writeMessage(b *strings.Builder, t TypeSchema) {
+	name := p.names[t.Name]
+	fmt.Fprintf(b, "\n// %s is lager type %q", name, t.Name)
+	if t.Version != 0 {
+		fmt.Fprintf(b, ", version %d", t.Version)
+	}
+	fmt.Fprintf(b, ".\nmessage %s {\n", name)
+	for i, f := range t.Fields {
+		fmt.Fprintf(b, "  %s %s = %d; // %s\n", p.fieldType(f.Type, 0), protoIdent(f.Name), i+1, f.Type)
+	}
+	b.WriteString("}\n")
+}
+
+// fieldType returns the protobuf type of a field of the named type.
+// Named types are followed to their underlying types, up to a depth
+// which only a schema whose types refer to each other reaches.
+func (p *protoWriter) fieldType(typ string, depth int) protoType {
+	switch {
+	case strings.HasPrefix(typ, "*"):
+		return protoType{name: p.helper("Ref", "// Ref is a pointer, as the reference id of the value it points to, or 0\n"+
+			"// for nil. Pointers with the same id share the value they point to.\n"+
+			"message Ref {\n  uint64 id = 1;\n}\n")}
+	case typ == "[]uint8":
+		return protoType{name: "bytes"}
+	case strings.HasPrefix(typ, "[]"):
+		return protoType{name: p.singular(p.fieldType(typ[2:], depth)), repeated: true}
+	case strings.HasPrefix(typ, "map["):
+		key, elem, ok := splitMapType(typ)
+		if !ok {
+			break
+		}
+		kt, et := p.fieldType(key, depth), p.fieldType(elem, depth)
+		if protoMapKey(kt) {
+			return protoType{name: p.singular(et), key: kt.name}
+		}
+		k, v := p.singular(kt), p.singular(et)
+		name := "Entry_" + protoIdent(k) + "_" + protoIdent(v)
+		return protoType{name: p.helper(name, fmt.Sprintf("// %s is an entry of a map whose keys can't be map keys.\nmessage %s {\n  %s key = 1;\n  %s value = 2;\n}\n", name, name, k, v)), repeated: true}
+	case typ == "complex64" || typ == "complex128":
+		name := "C" + typ[1:]
+		elem := "float"
+		if typ == "complex128" {
+			elem = "double"
+		}
+		return protoType{name: p.helper(name, fmt.Sprintf("// %s is a complex number.\nmessage %s {\n  %s real = 1;\n  %s imag = 2;\n}\n", name, name, elem, elem))}
+	case typ == "time.Time":
+		p.imports["google/protobuf/timestamp.proto"] = true
+		return protoType{name: "google.protobuf.Timestamp"}
+	case typ == "time.Duration":
+		p.imports["google/protobuf/duration.proto"] = true
+		return protoType{name: "google.protobuf.Duration"}
+	}
+	if scalar, ok := protoScalars[typ]; ok {
+		return protoType{name: scalar}
+	}
+	if t, ok := p.types[typ]; ok {
+		switch t.Kind {
+		case "struct":
+			return protoType{name: p.names[typ]}
+		case "binary":
+			return protoType{name: "bytes"}
+		case "named":
+			if depth < maxDepth {
+				return p.fieldType(t.Underlying, depth+1)
+			}
+		}
+	}
+	p.imports["google/protobuf/any.proto"] = true
+	return protoType{name: "google.protobuf.Any"}
+}
+
+// singular returns a type which can be repeated or be the value of a
+// map, wrapping repeated and map types in a message.
+func (p *protoWriter) singular(t protoType) string {
+	switch {
+	case t.repeated:
+		name := "List_" + protoIdent(t.name)
+		return p.helper(name, fmt.Sprintf("// %s is a slice held in a slice or map.\nmessage %s {\n  repeated %s values = 1;\n}\n", name, name, t.name))
+	case t.key != "":
+		name := "Map_" + protoIdent(t.key) + "_" + protoIdent(t.name)
+		return p.helper(name, fmt.Sprintf("// %s is a map held in a slice or map.\nmessage %s {\n  %s entries = 1;\n}\n", name, name, t))
+	}
+	return t.name
+}
+
+// helper declares the given message, unless it's already declared, and
+// returns its name.
+func (p *protoWriter) helper(name, decl string) string {
+	if _, ok := p.helpers[name]; !ok {
+		p.helpers[name] = "\n" + decl
+	}
+	return name
+}
+
+// messageName returns a message name for a type's name which no other
+// message has.
+func (p *protoWriter) messageName(typ string) string {
+	var b strings.Builder
+	for _, part := range strings.FieldsFunc(typ, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		runes := []rune(part)
+		b.WriteRune(unicode.ToUpper(runes[0]))
+		b.WriteString(string(runes[1:]))
+	}
+	name := protoIdent(b.String())
+	unique := name
+	for i := 2; p.used[unique]; i++ {
+		unique = fmt.Sprintf("%s%d", name, i)
+	}
+	p.used[unique] = true
+	return unique
+}
+
+// protoIdent returns the given name with characters which aren't allowed
+// in protobuf identifiers replaced by underscores, and starting with a
+// letter.
+func protoIdent(name string) string {
+	ident := []byte(name)
+	for i, c := range ident {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			ident[i] = '_'
+		}
+	}
+	if len(ident) == 0 || !(ident[0] >= 'a' && ident[0] <= 'z' || ident[0] >= 'A' && ident[0] <= 'Z') {
+		return "X" + string(ident)
+	}
+	return string(ident)
+}
+
+// protoMapKey returns whether a type can be the key of a protobuf map.
+func protoMapKey(t protoType) bool {
+	if t.repeated || t.key != "" {
+		return false
+	}
+	switch t.name {
+	case "bool", "string", "sint32", "sint64", "uint32", "uint64":
+		return true
+	}
+	return false
+}
+
+// splitMapType returns the key and element types of a map type's name.
+func splitMapType(typ string) (key, elem string, ok bool) {
+	depth := 0
+	for i, c := range typ {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			if depth--; depth == 0 {
+				return typ[4:i], typ[i+1:], true
+			}
+		}
+	}
+	return "", "", false
+}
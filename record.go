@@ -0,0 +1,71 @@
+package lager
+
+import (
+	"bytes"
+	"reflect"
+)
+
+// recordMagic begins every record written by MarshalRecord, in place of
+// the magic sequence of a stream.
+var recordMagic = [2]byte{'L', 'R'}
+
+// MarshalRecord encodes a single object as a self-contained record, for
+// uses such as message queues where each message must be decodable on its
+// own. A record holds the format version, and the type and pointer tables
+// for just that object, followed by the object itself. Unlike a stream, it
+// has no flags, object count or checksums.
+func MarshalRecord(v interface{}) ([]byte, error) {
+	e := NewEncoder(nil)
+	if err := e.writeObject(v); err != nil {
+		return nil, withFieldRoot(err, reflect.TypeOf(v))
+	}
+	body := e.buf
+	e.buf = new(bytes.Buffer)
+	e.buf.Write(recordMagic[:])
+	e.writeUint8(formatVersion)
+	e.writeTypeTable()
+	if err := e.writePtrTable(); err != nil {
+		return nil, err
+	}
+	e.buf.Write(body.Bytes())
+	return e.buf.Bytes(), nil
+}
+
+// UnmarshalRecord decodes a record written by MarshalRecord, and stores
+// its object in the value pointed to by out, as Unmarshal does.
+func UnmarshalRecord(data []byte, out interface{}) error {
+	d := newDecoder(DecoderOptions{})
+	d.reader.r.Reset(bytes.NewReader(data))
+	if err := d.readRecordHeader(); err != nil {
+		return err
+	}
+	if err := d.ReadInto(out); err != nil {
+		return err
+	}
+	if d.reader.n != int64(len(data)) {
+		return CorruptStream{"record"}
+	}
+	return nil
+}
+
+// readRecordHeader reads everything in a record before its object.
+func (d *Decoder) readRecordHeader() (err error) {
+	defer d.recoverPanic(&err)
+	for _, b := range recordMagic {
+		u, err := d.readUint8()
+		if err != nil {
+			return err
+		}
+		if u != b {
+			return InvalidMagic{}
+		}
+	}
+	if err := d.readVersion(); err != nil {
+		return err
+	}
+	d.objects = 1
+	if err := d.readTypeMap(); err != nil {
+		return err
+	}
+	return d.readPtrMap()
+}
@@ -0,0 +1,136 @@
+package lager
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// syncMarker follows the tag of each marker record, so that a decoder
+// which has lost its place in a stream can find the next object by
+// scanning for it.
+var syncMarker = [8]byte{0xff, 'L', 'A', 'G', 'R', 'S', 'Y', 'N'}
+
+// marker is the tag of a marker record followed by syncMarker.
+var marker = append([]byte{markerRecord}, syncMarker[:]...)
+
+// SkippedRange is a range of a stream which a decoder with the Recover
+// option skipped, having failed to read an object in it.
+type SkippedRange struct {
+	// Start and End are the offsets of the range in the stream. Start is
+	// that of the marker before the object which failed, and End that of
+	// the next marker found, or the end of the stream.
+	Start, End int64
+
+	// Err is the error the object failed with.
+	Err error
+}
+
+// Skipped returns the ranges of the stream skipped so far by a decoder
+// with the Recover option, in order.
+func (d *Decoder) Skipped() []SkippedRange {
+	return d.skipped
+}
+
+// writeMarker writes the marker record preceding each object of a stream
+// written with the Markers option, holding the object's index.
+func (e *Encoder) writeMarker() {
+	e.writeUint8(markerRecord)
+	if e.tracing {
+		e.tracef("marker %d", e.objects-1)
+	}
+	e.buf.Write(syncMarker[:])
+	e.writeInt(e.objects - 1)
+}
+
+// readMarker reads a marker record, following its tag.
+func (d *Decoder) readMarker() error {
+	offset := d.reader.n
+	for _, b := range syncMarker {
+		u, err := d.readUint8()
+		if err != nil {
+			return err
+		}
+		if u != b {
+			return CorruptStream{"marker"}
+		}
+	}
+	index, err := d.readInt()
+	if err != nil {
+		return err
+	}
+	if d.opts.Trace != nil {
+		d.tracef(offset, "marker %d", index)
+	}
+	return nil
+}
+
+// resync is called with the result of reading an object. If it failed,
+// and the decoder has the Recover option and the stream has markers, the
+// object is recorded as skipped and the decoder moves forward to the next
+// marker, or to the end of the stream if there are none left, and resync
+// returns true so that reading is tried again.
+func (d *Decoder) resync(err error) bool {
+	if err == nil || !d.opts.Recover || d.flags&flagMarkers == 0 || d.done {
+		return false
+	}
+	switch err.(type) {
+	case EndOfStream, InvalidTarget:
+		return false
+	}
+	if d.ctx != nil && d.ctx.Err() != nil {
+		return false
+	}
+	d.damaged = true
+	d.depth = 0
+	d.path = d.path[:0]
+	clear(d.pending)
+	clear(d.genericPending)
+	skipped := SkippedRange{Start: d.start, Err: err}
+	if !d.unreadMarker() && !d.seekMarker() {
+		d.done = true
+	}
+	skipped.End = d.reader.n
+	d.skipped = append(d.skipped, skipped)
+	return true
+}
+
+// unreadMarker looks for a marker record after the start of the object
+// which failed, among the bytes read since then, as a corrupt length may
+// have led the decoder to read well past the next marker. If there is
+// one, the input is put back to start there, and it returns true.
+func (d *Decoder) unreadMarker() bool {
+	if d.reader.tee == nil {
+		return false
+	}
+	read := d.reader.tee.Bytes()
+	i := bytes.Index(read[min(1, len(read)):], marker)
+	if i < 0 {
+		return false
+	}
+	rest := bytes.Clone(read[i+1:])
+	d.reader.r = bufio.NewReader(io.MultiReader(bytes.NewReader(rest), d.reader.r))
+	d.reader.n = d.start + int64(i+1)
+	return true
+}
+
+// seekMarker discards input up to the next marker record, and returns
+// whether one was found before the end of the stream.
+func (d *Decoder) seekMarker() bool {
+	r := d.reader.r
+	for {
+		buf, err := r.Peek(r.Size())
+		if i := bytes.Index(buf, marker); i >= 0 {
+			r.Discard(i)
+			d.reader.n += int64(i)
+			return true
+		}
+		if err != nil || len(buf) < len(marker) {
+			n, _ := r.Discard(len(buf))
+			d.reader.n += int64(n)
+			return false
+		}
+		n, _ := r.Discard(len(buf) - len(marker) + 1)
+		d.reader.n += int64(n)
+	}
+}
@@ -0,0 +1,349 @@
+package lager
+
+import (
+	"maps"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry maps type names to the types they were written from, so that
+// serialized objects decode as the proper type. The package-level Register
+// functions use a global registry; encoders and decoders can also be given
+// registries of their own, which shadow the global one. Registries are safe
+// for concurrent use, and once frozen they are read without locking.
+type Registry struct {
+	mu         sync.RWMutex
+	frozen     atomic.Bool
+	types      map[string]reflect.Type
+	names      map[reflect.Type]string
+	auto       map[reflect.Type]bool
+	impls      map[reflect.Type][]reflect.Type
+	migrations map[migrationKey]migration
+	codecs     map[reflect.Type]customCodec
+	extensions map[reflect.Kind]reflect.Type
+	hasCodecs  atomic.Bool
+	isolated   bool
+}
+
+// defaultRegistry is the global registry, which is the only package-wide
+// data.
+var defaultRegistry = NewRegistry()
+
+// NewRegistry creates an empty registry, which can be shared between any
+// number of encoders and decoders using their options.
+func NewRegistry() *Registry {
+	return &Registry{
+		types:      make(map[string]reflect.Type),
+		names:      make(map[reflect.Type]string),
+		auto:       make(map[reflect.Type]bool),
+		impls:      make(map[reflect.Type][]reflect.Type),
+		migrations: make(map[migrationKey]migration),
+		codecs:     make(map[reflect.Type]customCodec),
+		extensions: make(map[reflect.Kind]reflect.Type),
+	}
+}
+
+// Register allows you to specify a struct or interface value.
+// The type of that value will be registered so that serialized objects
+// correctly decode as the proper type.
+func Register(value interface{}) {
+	defaultRegistry.Register(value)
+}
+
+// RegisterAll registers the types of all the given values, as Register
+// does for each.
+func RegisterAll(values ...interface{}) {
+	defaultRegistry.RegisterAll(values...)
+}
+
+// FreezeRegistry freezes the global registry, as Registry.Freeze does.
+func FreezeRegistry() {
+	defaultRegistry.Freeze()
+}
+
+// RegisterType allows you to specify a reflected struct or interface
+// type. It will be registered so that values of this type are
+// properly decoded.
+func RegisterType(typ reflect.Type) {
+	defaultRegistry.RegisterType(typ)
+}
+
+// RegisterName is like Register, but the type is written to the stream
+// under the given name instead of its Go name, which includes its package.
+// This keeps existing data readable when the type is moved or renamed.
+func RegisterName(name string, value interface{}) {
+	defaultRegistry.RegisterName(name, value)
+}
+
+// RegisterInterface registers the interface type I along with the types
+// of the given values, which must each implement it. Values decoded into
+// fields of type I whose types aren't registered fail with an error listing
+// these implementations.
+func RegisterInterface[I any](impls ...interface{}) error {
+	return defaultRegistry.RegisterImplementations(reflect.TypeOf((*I)(nil)).Elem(), impls...)
+}
+
+// Register adds the type of the given value to the registry.
+func (r *Registry) Register(value interface{}) {
+	r.RegisterType(reflect.TypeOf(value))
+}
+
+// RegisterAll adds the types of all the given values to the registry.
+func (r *Registry) RegisterAll(values ...interface{}) {
+	r.lock()
+	defer r.mu.Unlock()
+	for _, value := range values {
+		r.registerType(reflect.TypeOf(value))
+	}
+}
+
+// RegisterType adds the given type to the registry.
+func (r *Registry) RegisterType(typ reflect.Type) {
+	r.lock()
+	defer r.mu.Unlock()
+	r.registerType(typ)
+}
+
+// Freeze stops the registry from changing, so that encoders and decoders
+// using it can read it without locking. Registering a type in a frozen
+// registry panics, and types written which aren't registered are no longer
+// added to it automatically. Freezing can't be undone, but Clone returns
+// an unfrozen copy.
+func (r *Registry) Freeze() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.frozen.Store(true)
+}
+
+// Clone returns a snapshot of the registry, which can be changed or frozen
+// independently of it.
+func (r *Registry) Clone() *Registry {
+	defer r.rlock()()
+	c := &Registry{
+		types:      maps.Clone(r.types),
+		names:      maps.Clone(r.names),
+		auto:       maps.Clone(r.auto),
+		impls:      make(map[reflect.Type][]reflect.Type, len(r.impls)),
+		migrations: maps.Clone(r.migrations),
+		codecs:     maps.Clone(r.codecs),
+		extensions: maps.Clone(r.extensions),
+	}
+	c.hasCodecs.Store(len(c.codecs) > 0)
+	for iface, impls := range r.impls {
+		c.impls[iface] = slices.Clone(impls)
+	}
+	return c
+}
+
+// lock locks the registry for changing it, and panics if it's frozen.
+func (r *Registry) lock() {
+	r.mu.Lock()
+	if r.frozen.Load() {
+		r.mu.Unlock()
+		panic("lager: registry is frozen")
+	}
+}
+
+// rlock locks the registry for reading, unless it's frozen, and returns
+// the function which unlocks it.
+func (r *Registry) rlock() (unlock func()) {
+	if r.frozen.Load() {
+		return func() {}
+	}
+	r.mu.RLock()
+	return r.mu.RUnlock
+}
+
+// registerType adds a type to the registry under its default name. The
+// name reflect gives instantiations of generic types is kept too, so that
+// data written under it can still be read.
+func (r *Registry) registerType(typ reflect.Type) {
+	name := typeString(typ)
+	r.types[name] = typ
+	if name != typ.String() {
+		r.types[typ.String()] = typ
+	}
+	if _, ok := r.names[typ]; !ok {
+		r.names[typ] = name
+	}
+	delete(r.auto, typ)
+}
+
+// RegisterImplementations adds the given interface type to the registry,
+// along with the types of the given values, which must each implement it.
+// Nothing is registered if any of them doesn't.
+func (r *Registry) RegisterImplementations(iface reflect.Type, impls ...interface{}) error {
+	if !isInterface(iface) {
+		return InvalidImplementation{iface, nil}
+	}
+	types := make([]reflect.Type, len(impls))
+	for i, impl := range impls {
+		types[i] = reflect.TypeOf(impl)
+		if types[i] == nil || !types[i].Implements(iface) {
+			return InvalidImplementation{iface, types[i]}
+		}
+	}
+	r.lock()
+	defer r.mu.Unlock()
+	r.registerType(iface)
+	for _, t := range types {
+		r.registerType(t)
+		if !slices.Contains(r.impls[iface], t) {
+			r.impls[iface] = append(r.impls[iface], t)
+		}
+	}
+	return nil
+}
+
+// implementations returns the sorted names of the implementations of an
+// interface type registered in the given registry or the global one.
+func implementations(r *Registry, iface reflect.Type) []string {
+	var names []string
+	for _, reg := range []*Registry{r, defaultRegistry} {
+		if reg == nil {
+			continue
+		}
+		unlock := reg.rlock()
+		impls := slices.Clone(reg.impls[iface])
+		unlock()
+		for _, t := range impls {
+			if name, ok := nameOf(r, t); ok && !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// autoRegister adds a type being written to the registry, unless it's
+// already registered, and remembers that it was registered automatically.
+// Frozen registries are left as they are.
+func (r *Registry) autoRegister(typ reflect.Type) {
+	if r.frozen.Load() {
+		return
+	}
+	r.mu.RLock()
+	_, named := r.names[typ]
+	name := typeString(typ)
+	known := named && r.types[name] == typ
+	r.mu.RUnlock()
+	if known {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.frozen.Load() {
+		return
+	}
+	r.types[name] = typ
+	if _, ok := r.names[typ]; !ok {
+		r.names[typ] = name
+		r.auto[typ] = true
+	}
+}
+
+// RegisterName adds the type of the given value to the registry, to be
+// written under the given name.
+func (r *Registry) RegisterName(name string, value interface{}) {
+	typ := reflect.TypeOf(value)
+	r.lock()
+	defer r.mu.Unlock()
+	r.types[name] = typ
+	r.names[typ] = name
+	delete(r.auto, typ)
+}
+
+// lookup finds a type by name in the given registry, falling back to the
+// global registry if it is nil or doesn't have the type.
+func lookup(r *Registry, name string) (reflect.Type, bool) {
+	if r != nil {
+		if t, ok := r.typeOf(name); ok {
+			return t, true
+		}
+	}
+	return defaultRegistry.typeOf(name)
+}
+
+func (r *Registry) typeOf(name string) (reflect.Type, bool) {
+	defer r.rlock()()
+	t, ok := r.types[name]
+	return t, ok
+}
+
+// isExplicit returns whether a type was registered other than by being
+// written, in the given registry or the global one.
+func isExplicit(r *Registry, t reflect.Type) bool {
+	if r != nil && r.isolated {
+		return r.isExplicit(t)
+	}
+	return r != nil && r.isExplicit(t) || defaultRegistry.isExplicit(t)
+}
+
+func (r *Registry) isExplicit(t reflect.Type) bool {
+	defer r.rlock()()
+	_, ok := r.names[t]
+	return ok && !r.auto[t]
+}
+
+// nameOf finds the name a type was registered under in the given registry,
+// falling back to the global registry unless the registry is isolated. It
+// returns false if the type isn't registered at all.
+func nameOf(r *Registry, t reflect.Type) (string, bool) {
+	if r != nil {
+		if name, ok := r.nameOf(t); ok || r.isolated {
+			return name, ok
+		}
+	}
+	return defaultRegistry.nameOf(t)
+}
+
+func (r *Registry) nameOf(t reflect.Type) (string, bool) {
+	defer r.rlock()()
+	name, ok := r.names[t]
+	return name, ok
+}
+
+// Register adds the type of the given value to the encoder's own registry,
+// creating one if the encoder doesn't have one yet. Once an encoder has a
+// registry, the types it writes are registered there instead of globally.
+func (e *Encoder) Register(value interface{}) {
+	if e.registry == nil {
+		e.registry = NewRegistry()
+	}
+	e.registry.Register(value)
+}
+
+// Register adds the type of the given value to the decoder's own registry,
+// creating one if the decoder doesn't have one yet. Types registered this
+// way take precedence over globally registered types of the same name.
+func (d *Decoder) Register(value interface{}) {
+	if d.registry == nil {
+		d.registry = NewRegistry()
+	}
+	d.registry.Register(value)
+}
+
+// isNamed returns whether the given type is a registered defined type
+// whose name is sent in place of its structure. Structs and interfaces
+// are always sent by name, and aren't included.
+func (e *Encoder) isNamed(t reflect.Type) bool {
+	if t.PkgPath() == "" || wireKind(t) != t.Kind() {
+		return false
+	}
+	if k := t.Kind(); k == reflect.Struct || k == reflect.Interface {
+		return false
+	}
+	_, ok := nameOf(e.registry, t)
+	return ok
+}
+
+// typeName returns the name a type is written to the stream under.
+func (e *Encoder) typeName(t reflect.Type) string {
+	if name, ok := nameOf(e.registry, t); ok {
+		return name
+	}
+	return typeString(t)
+}
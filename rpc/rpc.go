@@ -0,0 +1,186 @@
+// Package rpc implements lager codecs for net/rpc, so that services can
+// exchange values with cyclic and shared pointers in place of gob.
+//
+// Each connection carries one streaming-mode lager stream in each
+// direction, so type definitions are only sent once per connection. Each
+// request and response is written independently of the others, as with
+// the Unshared encoder option. The types of arguments and replies must be
+// registered with lager.Register, as for any other decoder.
+package rpc
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/rpc"
+
+	lager "github.com/lowentropy/go-lager"
+)
+
+// requestHeader and responseHeader are written before each request and
+// response body, in place of rpc.Request and rpc.Response, which have
+// unexported fields.
+type requestHeader struct {
+	ServiceMethod string
+	Seq           uint64
+}
+
+type responseHeader struct {
+	ServiceMethod string
+	Seq           uint64
+	Error         string
+}
+
+// registry holds the header types under names independent of this
+// package's import path. Other types fall back to the global registry.
+var registry = lager.NewRegistry()
+
+func init() {
+	registry.RegisterName("rpc.Request", requestHeader{})
+	registry.RegisterName("rpc.Response", responseHeader{})
+}
+
+// codec holds the encoder and decoder of a connection. The decoder is
+// created when the first message is read, as creating it reads the start
+// of the peer's stream.
+type codec struct {
+	rwc io.ReadWriteCloser
+	buf *bufio.Writer
+	enc *lager.Encoder
+	dec *lager.Decoder
+}
+
+func newCodec(conn io.ReadWriteCloser) *codec {
+	buf := bufio.NewWriter(conn)
+	return &codec{
+		rwc: conn,
+		buf: buf,
+		enc: lager.NewEncoderWithOptions(buf, lager.EncoderOptions{
+			Streaming: true,
+			Unshared:  true,
+			Registry:  registry,
+		}),
+	}
+}
+
+// write writes a header and body, and flushes them to the connection.
+func (c *codec) write(header, body interface{}) error {
+	if err := c.enc.Write(header); err != nil {
+		return err
+	}
+	if err := c.enc.Write(body); err != nil {
+		return err
+	}
+	return c.buf.Flush()
+}
+
+// readHeader reads the next message's header into ptr. The end of the
+// peer's stream is reported as io.EOF, as net/rpc expects.
+func (c *codec) readHeader(ptr interface{}) error {
+	if c.dec == nil {
+		dec, err := lager.NewDecoderWithOptions(c.rwc, lager.DecoderOptions{Registry: registry})
+		if err != nil {
+			return eof(err)
+		}
+		c.dec = dec
+	}
+	return eof(c.dec.ReadInto(ptr))
+}
+
+// readBody reads the current message's body into ptr, or skips it if ptr
+// is nil.
+func (c *codec) readBody(ptr interface{}) error {
+	if ptr == nil {
+		return c.dec.Skip()
+	}
+	return c.dec.ReadInto(ptr)
+}
+
+// Close ends the stream sent to the peer, and closes the connection.
+func (c *codec) Close() error {
+	err := c.enc.Finish()
+	if err == nil {
+		err = c.buf.Flush()
+	}
+	if cerr := c.rwc.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func eof(err error) error {
+	if errors.Is(err, lager.EndOfStream{}) || err == io.EOF {
+		return io.EOF
+	}
+	return err
+}
+
+type clientCodec struct {
+	*codec
+	resp responseHeader
+}
+
+// NewClientCodec returns a net/rpc ClientCodec which exchanges lager
+// streams over conn.
+func NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return &clientCodec{codec: newCodec(conn)}
+}
+
+// NewClient returns a net/rpc client using a lager codec over conn.
+func NewClient(conn io.ReadWriteCloser) *rpc.Client {
+	return rpc.NewClientWithCodec(NewClientCodec(conn))
+}
+
+func (c *clientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	return c.write(requestHeader{r.ServiceMethod, r.Seq}, body)
+}
+
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	c.resp = responseHeader{}
+	if err := c.readHeader(&c.resp); err != nil {
+		return err
+	}
+	r.ServiceMethod = c.resp.ServiceMethod
+	r.Seq = c.resp.Seq
+	r.Error = c.resp.Error
+	return nil
+}
+
+func (c *clientCodec) ReadResponseBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+type serverCodec struct {
+	*codec
+	req requestHeader
+}
+
+// NewServerCodec returns a net/rpc ServerCodec which exchanges lager
+// streams over conn.
+func NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return &serverCodec{codec: newCodec(conn)}
+}
+
+// ServeConn runs the default net/rpc server on conn using a lager codec,
+// blocking until the client hangs up.
+func ServeConn(conn io.ReadWriteCloser) {
+	rpc.ServeCodec(NewServerCodec(conn))
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	c.req = requestHeader{}
+	if err := c.readHeader(&c.req); err != nil {
+		return err
+	}
+	r.ServiceMethod = c.req.ServiceMethod
+	r.Seq = c.req.Seq
+	return nil
+}
+
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	return c.write(responseHeader{r.ServiceMethod, r.Seq, r.Error}, body)
+}
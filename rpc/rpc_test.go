@@ -0,0 +1,86 @@
+package rpc
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"testing"
+
+	lager "github.com/lowentropy/go-lager"
+)
+
+type Node struct {
+	Name string
+	Next *Node
+}
+
+type Ring struct {
+	Start *Node
+}
+
+type Rings struct{}
+
+// Reverse reverses the direction of a ring of nodes.
+func (Rings) Reverse(ring Ring, reply *Ring) error {
+	if ring.Start == nil {
+		return errors.New("empty ring")
+	}
+	nodes := []*Node{ring.Start}
+	for n := ring.Start.Next; n != ring.Start; n = n.Next {
+		nodes = append(nodes, n)
+	}
+	for i, n := range nodes {
+		n.Next = nodes[(i+len(nodes)-1)%len(nodes)]
+	}
+	*reply = ring
+	return nil
+}
+
+func init() {
+	lager.Register(Node{})
+	lager.Register(Ring{})
+}
+
+func TestRPC(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.Register(Rings{}); err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		server.ServeCodec(NewServerCodec(serverConn))
+		close(done)
+	}()
+	client := NewClient(clientConn)
+
+	a := &Node{Name: "a"}
+	b := &Node{Name: "b", Next: a}
+	c := &Node{Name: "c", Next: b}
+	a.Next = c
+	for i := 0; i < 2; i++ {
+		var reply Ring
+		if err := client.Call("Rings.Reverse", Ring{a}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		r := reply.Start
+		if r.Name != "a" || r.Next.Name != "b" || r.Next.Next.Name != "c" || r.Next.Next.Next != r {
+			t.Fatal("Expected the reversed ring but got", r)
+		}
+	}
+
+	var reply Ring
+	err := client.Call("Rings.Reverse", Ring{}, &reply)
+	if _, ok := err.(rpc.ServerError); !ok || err.Error() != "empty ring" {
+		t.Fatal("Expected the server's error but got", err)
+	}
+	if err := client.Call("Rings.Missing", Ring{a}, &reply); err == nil {
+		t.Fatal("Expected an error for a missing method")
+	}
+	if err := client.Call("Rings.Reverse", Ring{a}, &reply); err != nil {
+		t.Fatal("Expected the connection to survive errors but got", err)
+	}
+
+	client.Close()
+	<-done
+}
@@ -0,0 +1,216 @@
+package lager
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"maps"
+	"reflect"
+	"slices"
+)
+
+// Schema describes a set of registered types as they are written to
+// streams, so that readers can check their compatibility with writers.
+type Schema struct {
+	// Version is the version of the stream format the types are written
+	// in.
+	Version int
+
+	// Types describes each type, sorted by name.
+	Types []TypeSchema
+}
+
+// TypeSchema describes a single registered type.
+type TypeSchema struct {
+	// Name is the name the type is written to streams under.
+	Name string
+
+	// Kind is "struct", "interface", "binary" for types with their own
+	// binary encoding, "codec" for types with a codec registered with
+	// RegisterCodec, or "named" for other defined types.
+	Kind string
+
+	// Underlying is the type a named type is written as, such as "int64".
+	Underlying string
+
+	// Version is the type's version, if it implements Versioned.
+	Version int
+
+	// Fields describes the encoded fields of a struct, in order.
+	Fields []FieldSchema
+}
+
+// FieldSchema describes a struct field.
+type FieldSchema struct {
+	// Name is the name the field is written under.
+	Name string
+
+	// Type is the field's type, named as in the stream: registered types
+	// by their registered names, and others by their Go syntax, such as
+	// "map[string][]*pkg.Node".
+	Type string
+}
+
+// DescribeTypes returns the schema of every type in the global registry.
+func DescribeTypes() Schema {
+	return defaultRegistry.DescribeTypes()
+}
+
+// DescribeTypes returns the schema of every type in the registry. Types
+// registered under more than one name are described under each.
+func (r *Registry) DescribeTypes() Schema {
+	unlock := r.rlock()
+	types := maps.Clone(r.types)
+	unlock()
+	schema := Schema{Version: formatVersion}
+	for _, name := range slices.Sorted(maps.Keys(types)) {
+		schema.Types = append(schema.Types, describeType(r, name, types[name], false))
+	}
+	return schema
+}
+
+// describeType returns the schema of a registered type, written under the
+// given name.
+func describeType(r *Registry, name string, t reflect.Type, unexported bool) TypeSchema {
+	s := TypeSchema{Name: name, Version: typeVersion(t)}
+	if _, ok := lookupCodec(r, t); ok {
+		s.Kind = "codec"
+		return s
+	}
+	switch wireKind(t) {
+	case reflect.Struct:
+		s.Kind = "struct"
+		for _, f := range structFields(t, unexported) {
+			s.Fields = append(s.Fields, FieldSchema{f.name, describeField(r, f.typ)})
+		}
+	case reflect.Interface:
+		s.Kind = "interface"
+	case binaryKind:
+		s.Kind = "binary"
+	default:
+		s.Kind = "named"
+		s.Underlying = describeStructure(r, t)
+	}
+	return s
+}
+
+// describeField returns the name of a field's type as it is written in the
+// stream.
+func describeField(r *Registry, t reflect.Type) string {
+	switch wireKind(t) {
+	case reflect.Struct, reflect.Interface, binaryKind:
+		if name, ok := nameOf(r, t); ok {
+			return name
+		}
+		return typeString(t)
+	}
+	if name, ok := nameOf(r, t); ok && t.PkgPath() != "" {
+		return name
+	}
+	return describeStructure(r, t)
+}
+
+// describeStructure returns the name of a type's structure, ignoring its
+// own name if it is a named type.
+func describeStructure(r *Registry, t reflect.Type) string {
+	switch k := wireKind(t); k {
+	case reflect.Ptr:
+		return "*" + describeField(r, t.Elem())
+	case reflect.Slice:
+		return "[]" + describeField(r, t.Elem())
+	case reflect.Map:
+		return "map[" + describeField(r, t.Key()) + "]" + describeField(r, t.Elem())
+	default:
+		if bt, ok := basicTypes[k]; ok {
+			return bt.String()
+		}
+		return t.String()
+	}
+}
+
+// Fingerprint returns a hash of the type's kind and fields, not including
+// its name, which changes whenever the way it is encoded does.
+func (s TypeSchema) Fingerprint() uint64 {
+	h := fnv.New64a()
+	write := func(str string) {
+		h.Write(binary.AppendUvarint(nil, uint64(len(str))))
+		h.Write([]byte(str))
+	}
+	write(s.Kind)
+	write(s.Underlying)
+	for _, f := range s.Fields {
+		write(f.Name)
+		write(f.Type)
+	}
+	return h.Sum64()
+}
+
+// diffSchemas describes how the local schema of a type differs from the
+// schema written in a stream, one line per difference: "+" for fields only
+// in the local type, "-" for those only in the stream, and "~" for those
+// whose types differ.
+func diffSchemas(stream, local TypeSchema) []string {
+	var diff []string
+	if stream.Kind != local.Kind {
+		diff = append(diff, "~kind: "+stream.Kind+" -> "+local.Kind)
+	}
+	if stream.Underlying != local.Underlying {
+		diff = append(diff, "~underlying: "+stream.Underlying+" -> "+local.Underlying)
+	}
+	types := make(map[string]string, len(stream.Fields))
+	for _, f := range stream.Fields {
+		types[f.Name] = f.Type
+	}
+	for _, f := range local.Fields {
+		typ, ok := types[f.Name]
+		if !ok {
+			diff = append(diff, "+"+f.Name+" "+f.Type)
+		} else if typ != f.Type {
+			diff = append(diff, "~"+f.Name+": "+typ+" -> "+f.Type)
+		}
+		delete(types, f.Name)
+	}
+	for _, f := range stream.Fields {
+		if typ, ok := types[f.Name]; ok {
+			diff = append(diff, "-"+f.Name+" "+typ)
+		}
+	}
+	return diff
+}
+
+// writeSchema writes the schema of a type alongside its type table entry.
+func (e *Encoder) writeSchema(s TypeSchema) {
+	e.writeString(s.Kind)
+	e.writeString(s.Underlying)
+	e.writeInt(len(s.Fields))
+	for _, f := range s.Fields {
+		e.writeString(f.Name)
+		e.writeString(f.Type)
+	}
+}
+
+// readSchema reads the schema of the type with the given name.
+func (d *Decoder) readSchema(name string) (TypeSchema, error) {
+	var err error
+	s := TypeSchema{Name: name}
+	if s.Kind, err = d.readString(); err != nil {
+		return s, err
+	}
+	if s.Underlying, err = d.readString(); err != nil {
+		return s, err
+	}
+	n, err := d.readLength()
+	if err != nil {
+		return s, err
+	}
+	for i := 0; i < n; i++ {
+		var f FieldSchema
+		if f.Name, err = d.readString(); err != nil {
+			return s, err
+		}
+		if f.Type, err = d.readString(); err != nil {
+			return s, err
+		}
+		s.Fields = append(s.Fields, f)
+	}
+	return s, nil
+}
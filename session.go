@@ -0,0 +1,130 @@
+package lager
+
+import (
+	"bytes"
+)
+
+// Session encodes and decodes a sequence of messages, each holding one
+// value, for long-lived connections where a stream per message would be
+// wasteful. Both sides of a session keep a growing dictionary of types and
+// field names: the first message using a type carries its definition, and
+// later ones refer to it by id only. Each value is written independently
+// of the others, as with the Unshared encoder option.
+//
+// Messages must be unmarshaled by the peer's session in the order they were
+// marshaled, each exactly once; one which is out of order fails with
+// OutOfSequence. Marshal and Unmarshal may be called concurrently with each
+// other, but not with themselves.
+type Session struct {
+	out  bytes.Buffer
+	enc  *Encoder
+	sent uint
+	dec  *Decoder
+	in   bytes.Reader
+	next uint
+}
+
+// NewSession creates a session which uses the global registry.
+func NewSession() *Session {
+	return NewSessionWithOptions(EncoderOptions{}, DecoderOptions{})
+}
+
+// NewSessionWithOptions creates a session which marshals and unmarshals
+// values with the given options. The Streaming and Unshared encoder
+// options are always used, and Footer, Index and EncryptionKey never are.
+func NewSessionWithOptions(encOpts EncoderOptions, decOpts DecoderOptions) *Session {
+	encOpts.Streaming, encOpts.Unshared = true, true
+	encOpts.Footer, encOpts.Index = false, false
+	encOpts.EncryptionKey = nil
+	s := &Session{dec: newDecoder(decOpts)}
+	s.enc = NewEncoderWithOptions(&s.out, encOpts)
+	s.enc.started = true
+	return s
+}
+
+// Marshal encodes a value as the session's next message, along with the
+// definitions of any types it uses which no earlier message did.
+func (s *Session) Marshal(v interface{}) ([]byte, error) {
+	s.out.Reset()
+	s.enc.writeUint8(sessionRecord)
+	s.enc.writeUint8(formatVersion)
+	s.enc.writeUint16(s.enc.flags())
+	s.enc.writeUint(s.sent)
+	s.enc.buf.WriteTo(&s.out)
+	if err := s.enc.Write(v); err != nil {
+		return nil, err
+	}
+	s.sent++
+	return bytes.Clone(s.out.Bytes()), nil
+}
+
+// Unmarshal decodes the next message from the peer's session, and stores
+// its value in the value pointed to by out, as Decoder.ReadInto does.
+func (s *Session) Unmarshal(data []byte, out interface{}) error {
+	if err := s.begin(data); err != nil {
+		return err
+	}
+	if err := s.dec.ReadInto(out); err != nil {
+		return err
+	}
+	return s.end(data)
+}
+
+// read decodes the next message from the peer's session, and returns its
+// value.
+func (s *Session) read(data []byte) (interface{}, error) {
+	if err := s.begin(data); err != nil {
+		return nil, err
+	}
+	value, err := s.dec.Read()
+	if err != nil {
+		return nil, err
+	}
+	return value, s.end(data)
+}
+
+// begin reads the start of a message, up to its records. Once the message
+// is known to be the next in sequence, it counts as received, as the type
+// definitions it holds will be read and never sent again.
+func (s *Session) begin(data []byte) (err error) {
+	d := s.dec
+	defer d.recoverPanic(&err)
+	s.in.Reset(data)
+	d.reader.r.Reset(&s.in)
+	d.reader.n = 0
+	tag, err := d.readUint8()
+	if err != nil {
+		return err
+	}
+	if tag != sessionRecord {
+		return UnknownRecord{tag}
+	}
+	if err := d.readVersion(); err != nil {
+		return err
+	}
+	if d.flags, err = d.readUint16(); err != nil {
+		return err
+	}
+	if d.flags&flagStreaming == 0 {
+		return CorruptStream{"session"}
+	}
+	seq, err := d.readUint()
+	if err != nil {
+		return err
+	}
+	if seq != s.next {
+		return OutOfSequence{s.next, seq}
+	}
+	s.next++
+	clear(d.ptrMap)
+	d.done = false
+	return nil
+}
+
+// end checks that the whole of a message was read.
+func (s *Session) end(data []byte) error {
+	if s.dec.reader.n != int64(len(data)) {
+		return CorruptStream{"session"}
+	}
+	return nil
+}
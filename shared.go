@@ -0,0 +1,334 @@
+package lager
+
+import (
+	"maps"
+	"reflect"
+)
+
+// backing is a backing array of slices written with the ShareSlices
+// option: the reference id it's written under, and how many elements of
+// it are written, up to its end.
+type backing struct {
+	ref uint
+	n   int
+}
+
+// writeSharedSlice writes a slice as a reference to its backing array,
+// which is kept to be written like a pointer's value the first time it's
+// seen. Arrays are told apart by where they end, which every slice of an
+// array reaches unless its capacity was cut short.
+func (e *Encoder) writeSharedSlice(w reflect.Value) error {
+	elem := w.Type().Elem()
+	key := ptrKey{w.Pointer() + uintptr(w.Cap())*elem.Size(), elem}
+	b, ok := e.backings[key]
+	if !ok || w.Cap() > b.n {
+		ref := e.nextRef
+		e.nextRef++
+		e.backings[key] = backing{ref, w.Cap()}
+		e.arrays[ref] = true
+		if err := e.storeRef(ref, w.Slice(0, w.Cap()).Convert(reflect.SliceOf(elem))); err != nil {
+			if ok {
+				e.backings[key] = b
+			} else {
+				delete(e.backings, key)
+			}
+			delete(e.arrays, ref)
+			return err
+		}
+		b = e.backings[key]
+	}
+	e.writeInt(sharedLength)
+	e.writeUint(b.ref)
+	e.writeInt(b.n)
+	e.writeInt(b.n - w.Cap())
+	e.writeInt(w.Len())
+	return nil
+}
+
+// cycleDepth is how deeply maps and slices are nested before the encoder
+// starts checking whether they contain themselves, so that values without
+// cycles aren't slowed down by the check.
+const cycleDepth = 1000
+
+// containerKey identifies a map or slice by its header, to find those
+// which contain themselves.
+type containerKey struct {
+	addr     uintptr
+	len, cap int
+	t        reflect.Type
+}
+
+// containerOf returns the key of a map or slice.
+func containerOf(w reflect.Value) containerKey {
+	if w.Kind() == reflect.Map {
+		return containerKey{addr: w.Pointer(), t: w.Type()}
+	}
+	return containerKey{w.Pointer(), w.Len(), w.Cap(), w.Type()}
+}
+
+// enter is called before writing the contents of a map or slice, and
+// returns whether it contains itself, in which case it's written as a
+// reference instead, and the object being written is written again.
+// Otherwise, leave is called once its contents are written.
+func (e *Encoder) enter(w reflect.Value) bool {
+	if len(e.cyclic) > 0 && e.cyclic[containerOf(w)] {
+		return true
+	}
+	e.depth++
+	if e.depth <= cycleDepth {
+		return false
+	}
+	key := containerOf(w)
+	if e.active[key] {
+		e.depth--
+		e.cyclic[key] = true
+		e.retry = true
+		return true
+	}
+	e.active[key] = true
+	return false
+}
+
+// leave is called once the contents of a map or slice are written.
+func (e *Encoder) leave(w reflect.Value) {
+	if e.depth > cycleDepth {
+		delete(e.active, containerOf(w))
+	}
+	e.depth--
+}
+
+// writeSharedMap writes a map which contains itself as a reference to it,
+// which is kept to be written like a pointer's value the first time it's
+// seen.
+func (e *Encoder) writeSharedMap(w reflect.Value) error {
+	key := ptrKey{w.Pointer(), w.Type()}
+	ref, ok := e.mapRefs[key]
+	if !ok {
+		ref = e.nextRef
+		e.nextRef++
+		e.mapRefs[key] = ref
+		e.arrays[ref] = true
+		if err := e.storeRef(ref, w); err != nil {
+			delete(e.mapRefs, key)
+			delete(e.arrays, ref)
+			return err
+		}
+	}
+	e.writeInt(sharedLength)
+	e.writeUint(ref)
+	return nil
+}
+
+// readSharedRef reads the reference id of a map which contains itself,
+// after its sharedLength.
+func (d *Decoder) readSharedRef() (uint, error) {
+	ref, err := d.readUint()
+	if err == nil && ref == nilRef {
+		err = CorruptStream{"map"}
+	}
+	return ref, err
+}
+
+// readSharedMap reads a map which contains itself into v. The first time
+// it's seen, it's allocated empty, and its entries are filled in when its
+// record is read, which may be later.
+func (d *Decoder) readSharedMap(v reflect.Value) error {
+	ref, err := d.readSharedRef()
+	if err != nil {
+		return err
+	}
+	if err, ok := d.unresolved[ref]; ok {
+		return err
+	}
+	t := v.Type()
+	p, ok := d.ptrMap[ref]
+	if !ok {
+		if p, err = d.newPtr(ref, t); err != nil {
+			return err
+		}
+		d.ptrMap[ref] = p
+		d.pending[ref] = true
+	}
+	m := p.Elem()
+	if m.Kind() != reflect.Map {
+		return CorruptStream{"map"}
+	}
+	if !m.CanConvert(t) {
+		return TypeMismatch{m.Type(), t}
+	}
+	if m.IsNil() && d.pending[ref] {
+		m.Set(reflect.MakeMap(m.Type()))
+	}
+	v.Set(m.Convert(t))
+	return nil
+}
+
+// readSharedHeader reads the rest of a slice sharing its backing array,
+// after its sharedLength: the array's reference id and length, and the
+// slice's offset into the array and length.
+func (d *Decoder) readSharedHeader() (ref uint, n, offset, length int, err error) {
+	if ref, err = d.readUint(); err != nil {
+		return
+	}
+	if n, err = d.readInt(); err != nil {
+		return
+	}
+	if offset, err = d.readInt(); err != nil {
+		return
+	}
+	if length, err = d.readInt(); err != nil {
+		return
+	}
+	if ref == nilRef || n <= 0 || offset < 0 || offset >= n || length < 0 || length > n-offset ||
+		d.source != nil && int64(n) > d.size {
+		err = CorruptStream{"slice"}
+	}
+	return
+}
+
+// readSharedSlice reads a slice sharing its backing array with others into
+// v. The first time an array is seen, it's allocated at its full length,
+// and its elements are filled in when its record is read, which may be
+// later.
+func (d *Decoder) readSharedSlice(v reflect.Value) error {
+	ref, n, offset, length, err := d.readSharedHeader()
+	if err != nil {
+		return err
+	}
+	if err, ok := d.unresolved[ref]; ok {
+		return err
+	}
+	t := v.Type()
+	p, ok := d.ptrMap[ref]
+	if !ok {
+		if p, err = d.newPtr(ref, reflect.SliceOf(t.Elem())); err != nil {
+			return err
+		}
+		d.ptrMap[ref] = p
+		d.pending[ref] = true
+	}
+	array, err := d.backingArray(ref, p, n)
+	if err != nil {
+		return err
+	}
+	if array.Type().Elem() != t.Elem() {
+		return TypeMismatch{array.Type(), t}
+	}
+	v.Set(array.Slice3(offset, offset+length, n).Convert(t))
+	return nil
+}
+
+// backingArray returns the backing array held by the given pointer,
+// allocating it at the given length if its record hasn't been read yet.
+func (d *Decoder) backingArray(ref uint, p reflect.Value, n int) (reflect.Value, error) {
+	array := p.Elem()
+	if array.Kind() != reflect.Slice {
+		return array, CorruptStream{"slice"}
+	}
+	if array.Len() != n {
+		if !d.pending[ref] {
+			return array, CorruptStream{"slice"}
+		}
+		array.Set(reflect.MakeSlice(array.Type(), n, n))
+	}
+	return array, nil
+}
+
+// readGenericSharedSlice reads a slice sharing its backing array with
+// others generically. Arrays of unknown type are held as []interface{},
+// or []byte for bytes, and filled in when their record is read.
+func (d *Decoder) readGenericSharedSlice(wt *wireType) (interface{}, error) {
+	ref, n, offset, length, err := d.readSharedHeader()
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := d.ptrMap[ref]; ok {
+		array, err := d.backingArray(ref, p, n)
+		if err != nil {
+			return nil, err
+		}
+		return array.Slice3(offset, offset+length, n).Interface(), nil
+	}
+	cell, ok := d.generic[ref]
+	if !ok {
+		cell = new(interface{})
+		if wt.elem.kind == reflect.Uint8 {
+			*cell = make([]byte, n)
+		} else {
+			*cell = make([]interface{}, n)
+		}
+		d.generic[ref] = cell
+		d.genericPending[ref] = true
+	}
+	switch array := (*cell).(type) {
+	case []byte:
+		if len(array) == n {
+			return array[offset : offset+length : n], nil
+		}
+	case []interface{}:
+		if len(array) == n {
+			return array[offset : offset+length : n], nil
+		}
+	}
+	return nil, CorruptStream{"slice"}
+}
+
+// readGenericSharedMap reads a map which contains itself generically. Maps
+// of unknown type are held as map[interface{}]interface{}, and filled in
+// when their record is read.
+func (d *Decoder) readGenericSharedMap() (interface{}, error) {
+	ref, err := d.readSharedRef()
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := d.ptrMap[ref]; ok {
+		return p.Elem().Interface(), nil
+	}
+	cell, ok := d.generic[ref]
+	if !ok {
+		cell = new(interface{})
+		*cell = map[interface{}]interface{}{}
+		d.generic[ref] = cell
+		d.genericPending[ref] = true
+	}
+	if m, ok := (*cell).(map[interface{}]interface{}); ok {
+		return m, nil
+	}
+	return nil, CorruptStream{"map"}
+}
+
+// fillCell copies a generic value read from the record of a backing array
+// or map into the one allocated for it when it was first seen, and
+// returns whether it did so.
+func fillCell(cell *interface{}, value interface{}) bool {
+	switch held := (*cell).(type) {
+	case []byte:
+		if s, ok := value.([]byte); ok && len(s) == len(held) {
+			copy(held, s)
+			return true
+		}
+	case []interface{}:
+		if s, ok := value.([]interface{}); ok && len(s) == len(held) {
+			copy(held, s)
+			return true
+		}
+	case map[interface{}]interface{}:
+		if m, ok := value.(map[interface{}]interface{}); ok {
+			maps.Copy(held, m)
+			return true
+		}
+	}
+	return false
+}
+
+// readByteSlice reads the bytes of a byte slice of the given length, once
+// the length has been read.
+func (d *Decoder) readByteSlice(n int) ([]byte, error) {
+	switch n {
+	case nilLength:
+		return nil, nil
+	case 0:
+		return []byte{}, nil
+	}
+	return d.appendN(nil, n)
+}
@@ -0,0 +1,160 @@
+package lager
+
+import (
+	"io"
+	"reflect"
+)
+
+// Skip advances past the next object in the stream without decoding it,
+// using only the type information in the stream. In streaming mode, any
+// pointer records sent along with the object are decoded regardless, as
+// later objects may refer to them.
+func (d *Decoder) Skip() (err error) {
+	for {
+		err = d.skipObject()
+		if !d.resync(err) {
+			return err
+		}
+	}
+}
+
+// skipObject advances past the next object in the stream, for Skip.
+func (d *Decoder) skipObject() (err error) {
+	defer d.recoverPanic(&err)
+	wt, err := d.beginObject()
+	if err != nil {
+		return err
+	}
+	if err := d.skip(wt); err != nil {
+		if t, rerr := d.resolve(wt); rerr == nil {
+			err = withRoot(err, t)
+		}
+		return err
+	}
+	return d.endObject()
+}
+
+// skip reads past an encoded value of the given type without decoding it.
+// Pointers are skipped by reference id only, as their values are held in
+// separate records.
+func (d *Decoder) skip(wt *wireType) error {
+	defer d.leave()
+	if err := d.enter(); err != nil {
+		return err
+	}
+	switch wt.kind {
+	case nilKind, typedNilKind:
+		return nil
+	case reflect.Bool, reflect.Int8, reflect.Uint8:
+		return d.skipBytes(1)
+	case reflect.Int16, reflect.Uint16:
+		return d.skipBytes(2)
+	case reflect.Int32, reflect.Uint32, reflect.Float32:
+		return d.skipBytes(4)
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64, reflect.Uintptr,
+		reflect.Float64, reflect.Complex64, reflect.Ptr, durationKind:
+		return d.skipBytes(8)
+	case reflect.Complex128:
+		return d.skipBytes(16)
+	case reflect.String:
+		if d.flags&flagStringIds != 0 {
+			return d.skipBytes(4)
+		}
+		return d.skipString()
+	case binaryKind, bigIntKind, bigFloatKind, bigRatKind:
+		return d.skipString()
+	case timeKind:
+		if err := d.skipBytes(12); err != nil {
+			return err
+		}
+		if err := d.skipString(); err != nil {
+			return err
+		}
+		return d.skipBytes(4)
+	case namedKind:
+		return d.skip(wt.elem)
+	case codecKind:
+		return d.skipCustom()
+	case errorKind:
+		return d.skipError()
+	case reflect.Interface:
+		it, err := d.readWireType()
+		if err != nil {
+			return err
+		}
+		return d.skip(it)
+	case reflect.Map:
+		n, err := d.readMapLength()
+		if err != nil {
+			return err
+		}
+		if n == sharedLength {
+			_, err := d.readSharedRef()
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := d.skip(wt.key); err != nil {
+				return err
+			}
+			if err := d.skip(wt.elem); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Slice:
+		n, err := d.readSliceLength()
+		if err != nil {
+			return err
+		}
+		if n == sharedLength {
+			_, _, _, _, err := d.readSharedHeader()
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := d.skip(wt.elem); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Struct:
+		n, err := d.readLength()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if _, err := d.readFieldName(); err != nil {
+				return err
+			}
+			ft, err := d.readWireType()
+			if err != nil {
+				return err
+			}
+			if err := d.skip(ft); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if isExtension(wt.kind) {
+		return d.skipCustom()
+	}
+	return UnsupportedRead{wt.kind}
+}
+
+// skipString reads past a length-prefixed string or byte sequence.
+func (d *Decoder) skipString() error {
+	n, err := d.readLength()
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return CorruptStream{"length"}
+	}
+	return d.skipBytes(n)
+}
+
+// skipBytes reads past the given number of bytes.
+func (d *Decoder) skipBytes(n int) error {
+	_, err := io.CopyN(io.Discard, d.reader, int64(n))
+	return err
+}
@@ -0,0 +1,69 @@
+package lager
+
+import (
+	"io"
+	"os"
+)
+
+// spill moves the objects buffered so far by a non-streaming encoder to
+// its spill file, creating the file first if need be, once there are at
+// least SpillThreshold bytes of them. The buffer is written at its offset
+// in the file, so that after a failed write, the next one replaces it.
+func (e *Encoder) spill() error {
+	if e.opts.SpillThreshold <= 0 || e.buf.Len() < e.opts.SpillThreshold {
+		return nil
+	}
+	if e.spillFile == nil {
+		f, err := os.CreateTemp(e.opts.SpillDir, "lager-spill-*")
+		if err != nil {
+			return err
+		}
+		e.spillFile = f
+	}
+	if _, err := e.spillFile.WriteAt(e.buf.Bytes(), e.spilled); err != nil {
+		return err
+	}
+	e.shiftTrace()
+	e.spilled += int64(e.buf.Len())
+	e.buf.Reset()
+	return nil
+}
+
+// shiftTrace makes the offsets of the lines traced since the last spill
+// relative to the start of the body, rather than to the buffer.
+func (e *Encoder) shiftTrace() {
+	for i := e.shifted; i < len(e.traced); i++ {
+		e.traced[i].offset += int(e.spilled)
+	}
+	e.shifted = len(e.traced)
+}
+
+// unspill sends the objects spilled to the spill file to the output,
+// continuing the given checksum over them.
+func (e *Encoder) unspill(sum uint32) (uint32, error) {
+	r := io.NewSectionReader(e.spillFile, 0, e.spilled)
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := r.Read(buf)
+		sum = checksum(sum, buf[:n])
+		if _, werr := e.writer.Write(buf[:n]); werr != nil {
+			return sum, werr
+		}
+		if err == io.EOF {
+			return sum, nil
+		}
+		if err != nil {
+			return sum, err
+		}
+	}
+}
+
+// removeSpill closes and removes the spill file, if there is one.
+func (e *Encoder) removeSpill() {
+	if e.spillFile != nil {
+		e.spillFile.Close()
+		os.Remove(e.spillFile.Name())
+		e.spillFile = nil
+	}
+	e.spilled = 0
+}
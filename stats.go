@@ -0,0 +1,105 @@
+package lager
+
+import (
+	"maps"
+	"reflect"
+)
+
+// Stats describes what an encoder has written so far.
+type Stats struct {
+	// Objects is the number of objects written.
+	Objects int
+
+	// Bytes is the size of the stream sent to the output so far. Without
+	// the Streaming option, nothing is sent until Finish.
+	Bytes int64
+
+	// Pointers is the number of pointers written, and PointerBytes the
+	// size of their values in the pointer table or records.
+	Pointers     int
+	PointerBytes int64
+
+	// Types holds the number of bytes written for values of each type, by
+	// type name, including their type ids and the values they contain, so
+	// that a struct's bytes include those of its fields. Fields holds the
+	// same for each struct field, keyed by the struct's type name and the
+	// field name, as in "pkg.User.Name", including the field's name or id.
+	// Both are only kept with the Stats option.
+	Types  map[string]int64
+	Fields map[string]int64
+}
+
+// Stats returns what the encoder has written so far.
+func (e *Encoder) Stats() Stats {
+	s := Stats{
+		Objects:      e.objects,
+		Bytes:        e.sent,
+		Pointers:     int(e.nextRef - nilRef - 1),
+		PointerBytes: e.ptrBytes,
+	}
+	if e.tally != nil {
+		s.Types = maps.Clone(e.tally.types)
+		s.Fields = maps.Clone(e.tally.fields)
+	}
+	return s
+}
+
+// BytesRead returns the number of bytes of the stream read so far by Read
+// and ReadInto, including its header. Bytes read by ReadAt and ReadKey,
+// and footers read ahead of the objects, aren't counted.
+func (d *Decoder) BytesRead() int64 {
+	return d.reader.n
+}
+
+// tally counts the bytes written for each type and field. The counts for
+// an object are kept pending until it has been written successfully, so
+// that nothing is counted for objects which fail to encode.
+type tally struct {
+	types, fields               map[string]int64
+	pendingTypes, pendingFields map[string]int64
+}
+
+func newTally() *tally {
+	return &tally{
+		types:         make(map[string]int64),
+		fields:        make(map[string]int64),
+		pendingTypes:  make(map[string]int64),
+		pendingFields: make(map[string]int64),
+	}
+}
+
+// commit adds the pending counts to the totals.
+func (t *tally) commit() {
+	for name, n := range t.pendingTypes {
+		t.types[name] += n
+	}
+	for name, n := range t.pendingFields {
+		t.fields[name] += n
+	}
+	t.discard()
+}
+
+// discard forgets the pending counts.
+func (t *tally) discard() {
+	clear(t.pendingTypes)
+	clear(t.pendingFields)
+}
+
+// reset forgets all counts.
+func (t *tally) reset() {
+	clear(t.types)
+	clear(t.fields)
+	t.discard()
+}
+
+// countType counts the bytes written to the buffer since start as a value
+// of the given type. It is deferred while writing the value.
+func (e *Encoder) countType(t reflect.Type, start int) {
+	e.tally.pendingTypes[e.typeName(t)] += int64(e.buf.Len() - start)
+}
+
+// countField counts the bytes written to the buffer since start as the
+// given field of a struct type.
+func (e *Encoder) countField(t reflect.Type, name string, start int) {
+	e.tally.pendingFields[e.typeName(t)+"."+name] += int64(e.buf.Len() - start)
+}
@@ -0,0 +1,428 @@
+package lager
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"maps"
+	"reflect"
+	"slices"
+)
+
+// ptrKey identifies a pointer while encoding. The element type is part
+// of the key because a struct and its first field share an address.
+type ptrKey struct {
+	addr uintptr
+	elem reflect.Type
+}
+
+// ptrOffset records where in the stream a pointer record was written.
+type ptrOffset struct {
+	ref    uint
+	offset int64
+}
+
+// writeRecords sends the object just encoded into the buffer to the
+// output, preceded by records defining any types and pointers which were
+// first seen while encoding it. This is used in streaming mode.
+func (e *Encoder) writeRecords() error {
+	object := e.buf
+	out := getBuffer()
+	ptrs := getBuffer()
+	e.buf = out
+	defer func() {
+		putBuffer(out)
+		putBuffer(ptrs)
+		object.Reset()
+		e.buf = object
+	}()
+	e.writeStart()
+	start := out.Len()
+	e.last = e.sent + int64(start)
+	if e.opts.Index {
+		e.objIndex = append(e.objIndex, e.last)
+	}
+	objTrace := e.takeTrace()
+	if e.opts.Markers {
+		e.writeMarker()
+	}
+	markerTrace := e.takeTrace()
+
+	// Pointer records are written first, because writing their values
+	// may register types which must be defined before them.
+	e.buf = ptrs
+	offsets := make([]int64, len(e.newPtrs))
+	for i, ref := range e.newPtrs {
+		offsets[i] = int64(ptrs.Len())
+		e.writeUint8(pointerRecord)
+		if data, name, ok := e.takeTokenPtr(ref); ok {
+			if e.tracing {
+				e.tracef("pointer %d %s", ref, name)
+			}
+			e.writeUint(ref)
+			e.buf.Write(data)
+			continue
+		}
+		if e.tracing {
+			e.tracef("pointer %d %s", ref, e.traceName(e.ptrMap[ref].Type()))
+		}
+		e.writeUint(ref)
+		if err := e.writeEntry(ref); err != nil {
+			return err
+		}
+		delete(e.ptrMap, ref)
+		delete(e.arrays, ref)
+	}
+
+	e.ptrBytes += int64(ptrs.Len())
+	ptrTrace := e.takeTrace()
+	e.buf = out
+	for ; e.sentField < len(e.fields); e.sentField++ {
+		e.writeUint8(fieldRecord)
+		if e.tracing {
+			e.tracef("name %d %s", e.sentField, e.fields[e.sentField])
+		}
+		e.writeString(e.fields[e.sentField])
+		e.writeUint32(uint32(e.sentField))
+	}
+	for ; e.sentStr < len(e.strs); e.sentStr++ {
+		e.writeUint8(stringRecord)
+		if e.tracing {
+			e.tracef("string %d", e.sentStr)
+		}
+		e.writeString(e.strs[e.sentStr])
+		e.writeUint32(uint32(e.sentStr))
+	}
+	for ; e.sentType < len(e.types); e.sentType++ {
+		e.writeUint8(typeRecord)
+		e.writeTypeEntry(e.types[e.sentType])
+	}
+	for names := e.tokenTypeNames(); e.tok != nil && e.tok.sentName < len(names); e.tok.sentName++ {
+		e.writeUint8(typeRecord)
+		e.writeTokenTypeEntry(names[e.tok.sentName])
+	}
+	if e.footer() {
+		base := e.sent + int64(out.Len())
+		for i, ref := range e.newPtrs {
+			e.ptrIndex = append(e.ptrIndex, ptrOffset{ref, base + offsets[i]})
+		}
+	}
+	e.newPtrs = e.newPtrs[:0]
+	if e.tracing {
+		e.sendTrace(e.sent, markerTrace)
+		e.sendTrace(e.sent, e.takeTrace())
+		e.sendTrace(e.sent+int64(out.Len()), ptrTrace)
+		e.sendTrace(e.sent+int64(out.Len()+ptrs.Len()+1), objTrace)
+	}
+	out.Write(ptrs.Bytes())
+	e.writeUint8(objectRecord)
+	out.Write(object.Bytes())
+	if e.opts.Checksums {
+		e.writeUint32(checksum(0, out.Bytes()[start:]))
+	}
+	return e.send(out)
+}
+
+// writeStart writes the preamble of a streaming-mode stream to the
+// buffer, unless it has already been sent.
+func (e *Encoder) writeStart() {
+	if e.started {
+		return
+	}
+	start := e.buf.Len()
+	e.writePreamble()
+	if e.opts.Checksums {
+		e.writeUint32(checksum(0, e.buf.Bytes()[start:]))
+	}
+	e.started = true
+}
+
+// flushRecords sends the preamble of a streaming-mode stream, if it
+// hasn't been sent with an object yet.
+func (e *Encoder) flushRecords() error {
+	if e.started {
+		return nil
+	}
+	out := getBuffer()
+	tmp := e.buf
+	e.buf = out
+	defer func() {
+		putBuffer(out)
+		e.buf = tmp
+	}()
+	e.writeStart()
+	return e.send(out)
+}
+
+// finishRecords terminates a streaming-mode stream.
+func (e *Encoder) finishRecords() error {
+	out := getBuffer()
+	tmp := e.buf
+	e.buf = out
+	defer func() {
+		putBuffer(out)
+		e.buf = tmp
+	}()
+	e.writeStart()
+	if e.tracing {
+		e.tracef("end")
+	}
+	e.writeUint8(endRecord)
+	if e.opts.Checksums {
+		e.writeUint32(checksum(e.sum, out.Bytes()))
+	}
+	if e.footer() {
+		if e.tracing {
+			e.tracef("footer")
+		}
+		e.writeFooter(e.sent + int64(out.Len()))
+	}
+	if e.tracing {
+		e.sendTrace(e.sent, e.takeTrace())
+	}
+	return e.send(out)
+}
+
+// writeFooter writes the footer of a footer-mode stream, given the offset
+// at which it starts. The footer's offset is written last, at a fixed
+// distance from the end of the stream.
+func (e *Encoder) writeFooter(offset int64) {
+	start := e.buf.Len()
+	e.writeInt(e.objects)
+	e.writeTypeTable()
+	if e.opts.FieldIds {
+		e.writeFieldTable()
+	}
+	if e.opts.StringIds {
+		e.writeStringTable()
+	}
+	e.writeInt(len(e.ptrIndex))
+	for _, p := range e.ptrIndex {
+		e.writeUint(p.ref)
+		e.writeInt64(p.offset)
+	}
+	if e.opts.Index {
+		e.writeInt(len(e.objIndex))
+		for _, offset := range e.objIndex {
+			e.writeInt64(offset)
+		}
+	}
+	e.writeInt(len(e.keys))
+	for _, key := range slices.Sorted(maps.Keys(e.keys)) {
+		e.writeString(key)
+		e.writeInt64(e.keys[key])
+	}
+	if e.opts.Checksums {
+		e.writeUint32(checksum(0, e.buf.Bytes()[start:]))
+	}
+	e.writeUint64(uint64(offset))
+}
+
+// send writes the given bytes to the output, keeping a running checksum
+// of everything sent.
+func (e *Encoder) send(out *bytes.Buffer) error {
+	e.sum = checksum(e.sum, out.Bytes())
+	e.sent += int64(out.Len())
+	_, err := out.WriteTo(e.writer)
+	return err
+}
+
+// readPreambleChecksum verifies the checksum following the preamble of a
+// streaming-mode stream, which has no other header.
+func (d *Decoder) readPreambleChecksum() error {
+	if d.flags&flagChecksums == 0 {
+		return nil
+	}
+	return d.verifyChecksum(d.reader.record, "header")
+}
+
+// seekFooter loads the footer of a footer-mode stream before any of its
+// objects are read, then returns to where the decoder left off.
+func (d *Decoder) seekFooter(rs io.ReadSeeker) error {
+	body := d.reader
+	defer func() { d.reader = body }()
+	end, err := rs.Seek(-8, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	d.size = end + 8
+	d.reader = &checksumReader{r: bufio.NewReader(rs)}
+	offset, err := d.readUint64()
+	if err != nil {
+		return err
+	}
+	if offset >= uint64(end) {
+		return CorruptStream{"footer"}
+	}
+	if _, err := rs.Seek(int64(offset), io.SeekStart); err != nil {
+		return err
+	}
+	d.reader = &checksumReader{r: bufio.NewReader(rs), n: int64(offset)}
+	if err := d.readFooter(); err != nil {
+		return err
+	}
+	if _, err := rs.Seek(body.n, io.SeekStart); err != nil {
+		return err
+	}
+	body.r = bufio.NewReader(rs)
+	d.footerRead = true
+	if ra, ok := rs.(io.ReaderAt); ok {
+		d.source = ra
+	}
+	return nil
+}
+
+// readFooter reads the footer of a footer-mode stream: the object count,
+// the type table, the field and string tables when the stream uses field
+// or string ids, the pointer offsets, and the object and key indexes when
+// it has them.
+func (d *Decoder) readFooter() error {
+	var err error
+	if d.opts.Trace != nil {
+		d.tracef(d.reader.n, "footer")
+	}
+	d.reader.record = 0
+	if d.objects, err = d.readInt(); err != nil {
+		return err
+	}
+	if err = d.readTypeMap(); err != nil {
+		return err
+	}
+	if d.flags&flagFieldIds != 0 {
+		if err = d.readFieldTable(); err != nil {
+			return err
+		}
+	}
+	if d.flags&flagStringIds != 0 {
+		if err = d.readStringTable(); err != nil {
+			return err
+		}
+	}
+	n, err := d.readInt()
+	if err != nil {
+		return err
+	}
+	d.ptrIndex = make(map[uint]int64, preallocLength(n, 16))
+	for i := 0; i < n; i++ {
+		ref, err := d.readUint()
+		if err != nil {
+			return err
+		}
+		if d.ptrIndex[ref], err = d.readInt64(); err != nil {
+			return err
+		}
+	}
+	if d.flags&flagIndex != 0 {
+		if err := d.readObjIndex(); err != nil {
+			return err
+		}
+	}
+	if d.flags&flagKeys != 0 {
+		if err := d.readKeyIndex(); err != nil {
+			return err
+		}
+	}
+	if d.flags&flagChecksums != 0 {
+		return d.verifyChecksum(d.reader.record, "footer")
+	}
+	return nil
+}
+
+// readTrailingFooter reads the footer of a footer-mode stream once all of
+// its objects have been read, checking that it is where it claims to be.
+func (d *Decoder) readTrailingFooter() error {
+	start := d.reader.n
+	if err := d.readFooter(); err != nil {
+		return err
+	}
+	offset, err := d.readUint64()
+	if err != nil {
+		return err
+	}
+	if offset != uint64(start) {
+		return CorruptStream{"footer"}
+	}
+	return nil
+}
+
+// beginRecords reads records from a streaming-mode stream up to the start
+// of the next object, and returns the object's type.
+func (d *Decoder) beginRecords() (*wireType, error) {
+	if d.done {
+		return nil, EndOfStream{}
+	}
+	d.reader.record = 0
+	d.start = d.reader.n
+	if d.opts.Recover && d.flags&flagMarkers != 0 {
+		if d.reader.tee == nil {
+			d.reader.tee = new(bytes.Buffer)
+		}
+		d.reader.tee.Reset()
+	}
+	return d.nextRecord()
+}
+
+// nextRecord reads records up to the start of the next object, as for
+// beginRecords. A decoder with the Tokens option stops at pointer records
+// as well, just after their tag, and returns a nil type, so that Token can
+// read them.
+func (d *Decoder) nextRecord() (*wireType, error) {
+	for {
+		tag, err := d.readUint8()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case typeRecord:
+			if err := d.readTypeEntry(); err != nil {
+				return nil, err
+			}
+		case pointerRecord:
+			if d.opts.Tokens {
+				return nil, nil
+			}
+			if err := d.readPtrEntry(); err != nil {
+				return nil, err
+			}
+		case fieldRecord:
+			if err := d.readFieldEntry(); err != nil {
+				return nil, err
+			}
+		case stringRecord:
+			if err := d.readStringEntry(); err != nil {
+				return nil, err
+			}
+		case markerRecord:
+			if err := d.readMarker(); err != nil {
+				return nil, err
+			}
+		case objectRecord:
+			offset := d.reader.n
+			wt, err := d.readWireType()
+			if err == nil && d.opts.Trace != nil {
+				d.path = d.path[:0]
+				d.tracef(offset, "object %s", d.wireName(wt))
+			}
+			return wt, err
+		case endRecord:
+			if d.opts.Trace != nil {
+				d.tracef(d.reader.n-1, "end")
+			}
+			d.done = true
+			if d.flags&flagChecksums != 0 && !d.damaged {
+				if err := d.verifyChecksum(d.reader.stream, "stream"); err != nil {
+					return nil, err
+				}
+			}
+			if d.flags&flagFooter != 0 && !d.footerRead {
+				if err := d.readTrailingFooter(); err != nil {
+					return nil, err
+				}
+				d.footerRead = true
+			}
+			return nil, EndOfStream{}
+		default:
+			return nil, UnknownRecord{tag}
+		}
+	}
+}
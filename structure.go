@@ -0,0 +1,142 @@
+package lager
+
+import (
+	"fmt"
+	"go/token"
+	"reflect"
+)
+
+// wireField is a field of a struct type's structure, as read from a type
+// table entry.
+type wireField struct {
+	name string
+	typ  *wireType
+}
+
+// hasStructure returns whether the full structure of a type is written
+// with its type table entry. This is the case for struct types which the
+// decoder may not be able to find by name: anonymous ones, and those which
+// were never registered except by being written, such as types defined
+// inside functions.
+func (e *Encoder) hasStructure(t reflect.Type) bool {
+	if wireKind(t) != reflect.Struct {
+		return false
+	}
+	return t.Name() == "" || !isExplicit(e.registry, t)
+}
+
+// registerStructure registers the types of a struct type's fields, so
+// that they're in the type table along with its structure.
+func (e *Encoder) registerStructure(t reflect.Type) {
+	buf := e.buf
+	e.buf = getBuffer()
+	e.writeStructureFields(t)
+	putBuffer(e.buf)
+	e.buf = buf
+}
+
+// writeStructure writes whether a type's structure follows, and if so the
+// name and type of each of its fields.
+func (e *Encoder) writeStructure(t reflect.Type) {
+	if !e.hasStructure(t) {
+		e.writeBool(false)
+		return
+	}
+	e.writeBool(true)
+	e.writeStructureFields(t)
+}
+
+func (e *Encoder) writeStructureFields(t reflect.Type) {
+	fields := structFields(t, e.opts.Unexported)
+	n := 0
+	for _, f := range fields {
+		if !f.unsupported {
+			n++
+		}
+	}
+	e.writeInt(n)
+	for _, f := range fields {
+		if !f.unsupported {
+			e.writeString(f.name)
+			e.writeType(f.typ)
+		}
+	}
+}
+
+// readStructure reads the structure which may follow a type table entry.
+func (d *Decoder) readStructure(id uint) error {
+	ok, err := d.readBool()
+	if err != nil || !ok {
+		return err
+	}
+	n, err := d.readLength()
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return CorruptStream{"length"}
+	}
+	fields := make([]wireField, 0, preallocLength(n, 1))
+	for i := 0; i < n; i++ {
+		name, err := d.readString()
+		if err != nil {
+			return err
+		}
+		wt, err := d.readWireType()
+		if err != nil {
+			return err
+		}
+		fields = append(fields, wireField{name, wt})
+	}
+	d.structures[id] = fields
+	return nil
+}
+
+// synthesize creates a struct type from the structure written with a type
+// which isn't registered, using reflect.StructOf. Fields keep their wire
+// names in `lager` tags, and are given exported Go names. Types which refer
+// to themselves can't be created this way, and fail as unregistered.
+func (d *Decoder) synthesize(id uint, name string) (reflect.Type, error) {
+	fields, ok := d.structures[id]
+	if !ok {
+		return nil, MissingTypeName{name}
+	}
+	if d.synthesizing[id] {
+		return nil, MissingTypeName{name}
+	}
+	d.synthesizing[id] = true
+	defer delete(d.synthesizing, id)
+	sfs := make([]reflect.StructField, len(fields))
+	used := make(map[string]bool, len(fields))
+	for i, f := range fields {
+		ft, err := d.resolve(f.typ)
+		if err != nil {
+			if f.typ.kind != reflect.Interface {
+				return nil, err
+			}
+			ft = emptyInterfaceType
+		}
+		goName := goFieldName(f.name, i)
+		for used[goName] {
+			goName += "_"
+		}
+		used[goName] = true
+		sfs[i] = reflect.StructField{
+			Name: goName,
+			Type: ft,
+			Tag:  reflect.StructTag(fmt.Sprintf("lager:%q", f.name)),
+		}
+	}
+	t := reflect.StructOf(sfs)
+	d.typeMap[id] = t
+	return t, nil
+}
+
+// goFieldName returns the name of a synthesized struct field: its wire
+// name if that's an exported identifier, or else one made from its index.
+func goFieldName(name string, i int) string {
+	if token.IsIdentifier(name) && token.IsExported(name) {
+		return name
+	}
+	return fmt.Sprintf("F%d", i)
+}
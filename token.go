@@ -0,0 +1,950 @@
+package lager
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Token is an element of a stream as returned by Decoder.Token: one of the
+// delimiter types StartStruct, EndStruct, StartSlice, EndSlice, StartMap,
+// EndMap, StartPointer and EndPointer, a Field name, a Ref to a pointer, or
+// a value of a basic type. Basic values have the types ReadGeneric would
+// give them, such as int64, string or time.Time, and byte slices and types
+// with their own binary encoding are []byte. Nil pointers, interfaces,
+// slices and maps are nil.
+type Token interface{}
+
+// StartStruct begins a struct of the named type, whose fields follow, each
+// as a Field and then its value, up to an EndStruct.
+type StartStruct struct {
+	Type string
+}
+
+func (t StartStruct) String() string {
+	return t.Type + " {"
+}
+
+// EndStruct ends a struct.
+type EndStruct struct{}
+
+func (_ EndStruct) String() string {
+	return "}"
+}
+
+// Field is the name of a struct field, which is followed by its value.
+type Field string
+
+// StartSlice begins a slice of Len elements of type Elem, which follow up
+// to an EndSlice.
+type StartSlice struct {
+	Elem string
+	Len  int
+}
+
+func (t StartSlice) String() string {
+	return fmt.Sprintf("[]%s (%d) [", t.Elem, t.Len)
+}
+
+// EndSlice ends a slice.
+type EndSlice struct{}
+
+func (_ EndSlice) String() string {
+	return "]"
+}
+
+// StartMap begins a map of Len entries, with keys of type Key and values of
+// type Elem, which follow as a key and then its value up to an EndMap.
+type StartMap struct {
+	Key, Elem string
+	Len       int
+}
+
+func (t StartMap) String() string {
+	return fmt.Sprintf("map[%s]%s (%d) {", t.Key, t.Elem, t.Len)
+}
+
+// EndMap ends a map.
+type EndMap struct{}
+
+func (_ EndMap) String() string {
+	return "}"
+}
+
+// Ref is a non-nil pointer, identified by its reference id. The value it
+// points to is given once in the stream, between a StartPointer with the
+// same id and an EndPointer, which in streaming mode comes before the first
+// object referring to it, and otherwise before any objects.
+type Ref uint
+
+func (r Ref) String() string {
+	return fmt.Sprintf("&%d", uint(r))
+}
+
+// StartPointer begins the value pointed to by the pointers with the given
+// reference id, of the named type, which is followed by an EndPointer.
+type StartPointer struct {
+	Ref  uint
+	Type string
+}
+
+func (t StartPointer) String() string {
+	return fmt.Sprintf("&%d = %s", t.Ref, t.Type)
+}
+
+// EndPointer ends the value pointed to by a pointer.
+type EndPointer struct{}
+
+func (_ EndPointer) String() string {
+	return "end &"
+}
+
+// tokenFrame is a value which Token is in the middle of: what it is, its
+// type, and how many entries it has left to read.
+type tokenFrame struct {
+	role int
+	wt   *wireType
+	n    int
+}
+
+// The roles of token frames. A value frame is a struct field's value, read
+// after its Field. The entries of a map are its keys and values in turn.
+const (
+	objectFrame = iota
+	pointerFrame
+	valueFrame
+	structFrame
+	sliceFrame
+	mapFrame
+)
+
+// Token returns the next token in the stream, so that streams can be read
+// without their types being registered and without decoding any Go values
+// but basic ones. Each object is a single value, whose type is only given
+// by its tokens. Pointers are read as Refs, and the values they point to
+// between a StartPointer and an EndPointer, separately from the objects.
+// Token needs a decoder with the Tokens option, and returns EndOfStream at
+// the end of the stream.
+func (d *Decoder) Token() (tok Token, err error) {
+	defer d.recoverPanic(&err)
+	if !d.opts.Tokens {
+		return nil, NoTokens{}
+	}
+	for {
+		n := len(d.frames)
+		if n == 0 {
+			if tok, err := d.beginToken(); err != nil || tok != nil {
+				return tok, err
+			}
+			continue
+		}
+		f := &d.frames[n-1]
+		if f.n == 0 {
+			d.frames = d.frames[:n-1]
+			switch f.role {
+			case objectFrame:
+				if err := d.endObject(); err != nil {
+					return nil, err
+				}
+				continue
+			case pointerFrame:
+				return EndPointer{}, nil
+			case structFrame:
+				return EndStruct{}, nil
+			case sliceFrame:
+				return EndSlice{}, nil
+			case mapFrame:
+				return EndMap{}, nil
+			}
+			continue
+		}
+		f.n--
+		switch f.role {
+		case structFrame:
+			name, err := d.readFieldName()
+			if err != nil {
+				return nil, err
+			}
+			ft, err := d.readWireType()
+			if err != nil {
+				return nil, err
+			}
+			if err := d.pushFrame(valueFrame, ft, 1); err != nil {
+				return nil, err
+			}
+			return Field(name), nil
+		case sliceFrame:
+			return d.tokenValue(f.wt.elem)
+		case mapFrame:
+			if f.n%2 == 1 {
+				return d.tokenValue(f.wt.key)
+			}
+			return d.tokenValue(f.wt.elem)
+		}
+		return d.tokenValue(f.wt)
+	}
+}
+
+// beginToken starts reading the next pointer record or object. Pointer
+// records begin with a StartPointer, which is returned; objects begin with
+// their value, so nil is returned for them.
+func (d *Decoder) beginToken() (Token, error) {
+	if d.flags&flagStreaming == 0 {
+		if d.tokenPtrs > 0 {
+			d.tokenPtrs--
+			return d.beginTokenPtr()
+		}
+		if d.tokenHeader {
+			d.tokenHeader = false
+			if err := d.endHeader(); err != nil {
+				return nil, err
+			}
+		}
+		wt, err := d.beginObject()
+		if err != nil {
+			return nil, err
+		}
+		return nil, d.pushFrame(objectFrame, wt, 1)
+	}
+	var wt *wireType
+	var err error
+	if d.inRecords {
+		wt, err = d.nextRecord()
+	} else {
+		wt, err = d.beginRecords()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if wt == nil {
+		d.inRecords = true
+		return d.beginTokenPtr()
+	}
+	d.inRecords = false
+	d.consumed++
+	return nil, d.pushFrame(objectFrame, wt, 1)
+}
+
+// beginTokenPtr starts reading a pointer record, and returns its
+// StartPointer.
+func (d *Decoder) beginTokenPtr() (Token, error) {
+	offset := d.reader.n
+	ref, err := d.readUint()
+	if err != nil {
+		return nil, err
+	}
+	wt, err := d.readWireType()
+	if err != nil {
+		return nil, err
+	}
+	if d.opts.Trace != nil {
+		d.path = d.path[:0]
+		d.tracef(offset, "pointer %d %s", ref, d.wireName(wt))
+	}
+	if wt.kind == nilKind {
+		return nil, CorruptStream{"type"}
+	}
+	if err := d.pushFrame(pointerFrame, wt, 1); err != nil {
+		return nil, err
+	}
+	return StartPointer{ref, d.tokenName(wt)}, nil
+}
+
+// tokenValue reads the start of a value of the given type, and returns
+// its first token. Structs, slices and maps are left to be read entry by
+// entry.
+func (d *Decoder) tokenValue(wt *wireType) (Token, error) {
+	defer d.leave()
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	if isExtension(wt.kind) {
+		return nil, UnsupportedRead{wt.kind}
+	}
+	switch wt.kind {
+	case nilKind, typedNilKind:
+		return nil, nil
+	case namedKind:
+		return d.tokenValue(wt.elem)
+	case binaryKind:
+		return d.readBytes()
+	case codecKind, errorKind:
+		return nil, UnsupportedRead{wt.kind}
+	case reflect.Interface:
+		it, err := d.readWireType()
+		if err != nil {
+			return nil, err
+		}
+		return d.tokenValue(it)
+	case reflect.Ptr:
+		ref, err := d.readUint()
+		if err != nil || ref == nilRef {
+			return nil, err
+		}
+		return Ref(ref), nil
+	case reflect.Struct:
+		n, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		if err := d.pushFrame(structFrame, wt, n); err != nil {
+			return nil, err
+		}
+		return StartStruct{d.wireName(wt)}, nil
+	case reflect.Slice:
+		n, err := d.readSliceLength()
+		switch {
+		case err != nil:
+			return nil, err
+		case n == sharedLength:
+			return nil, UnsupportedRead{reflect.Slice}
+		case wt.elem.kind == reflect.Uint8:
+			return d.readByteSlice(n)
+		case n == nilLength:
+			return nil, nil
+		}
+		if err := d.pushFrame(sliceFrame, wt, n); err != nil {
+			return nil, err
+		}
+		return StartSlice{d.tokenName(wt.elem), n}, nil
+	case reflect.Map:
+		n, err := d.readMapLength()
+		switch {
+		case err != nil, n == nilLength:
+			return nil, err
+		case n == sharedLength:
+			return nil, UnsupportedRead{reflect.Map}
+		}
+		if err := d.pushFrame(mapFrame, wt, 2*n); err != nil {
+			return nil, err
+		}
+		return StartMap{d.tokenName(wt.key), d.tokenName(wt.elem), n}, nil
+	}
+	v := reflect.New(basicTypes[wt.kind]).Elem()
+	if err := d.readValue(v); err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
+}
+
+// tokenName returns the name of a type as given in tokens, which is that
+// of the values read as it: named types are given as their underlying
+// types, and types with their own binary encoding as []uint8.
+func (d *Decoder) tokenName(wt *wireType) string {
+	switch wt.kind {
+	case namedKind:
+		return d.tokenName(wt.elem)
+	case binaryKind:
+		return "[]uint8"
+	case reflect.Map:
+		return "map[" + d.tokenName(wt.key) + "]" + d.tokenName(wt.elem)
+	case reflect.Ptr:
+		return "*" + d.tokenName(wt.elem)
+	case reflect.Slice:
+		return "[]" + d.tokenName(wt.elem)
+	}
+	return d.wireName(wt)
+}
+
+// pushFrame starts reading a value with the given number of entries left,
+// failing once values are nested deeper than any valid stream.
+func (d *Decoder) pushFrame(role int, wt *wireType, n int) error {
+	if n < 0 {
+		return CorruptStream{"length"}
+	}
+	if len(d.frames) >= maxDepth {
+		return CorruptStream{"nesting"}
+	}
+	d.frames = append(d.frames, tokenFrame{role, wt, n})
+	return nil
+}
+
+// tokenState is the state of an encoder written to with WriteToken.
+type tokenState struct {
+	// scopes holds the values being written, innermost last.
+	scopes []tokenScope
+
+	// start and lines are the length of the buffer and of the trace when
+	// the object being written began, for discarding it.
+	start, lines int
+
+	// object holds the buffer of objects while a pointer's value is
+	// written, and ptr is that pointer's reference id.
+	object *bytes.Buffer
+	ptr    uint
+
+	// refs maps the reference ids given in tokens to those written, and
+	// ptrs holds the pointers started so far. Refs to pointers which
+	// haven't been started are mapped too, and fresh holds those mapped
+	// since the current object or pointer began.
+	refs  map[uint]uint
+	ptrs  map[uint]*tokenPtr
+	fresh []uint
+
+	// names and ids are the struct types only known by name, in the order
+	// they were first written, and the type ids given to them.
+	names    []string
+	ids      map[string]uint
+	sentName int
+}
+
+// tokenScope is a value which WriteToken is in the middle of, of the
+// given type.
+type tokenScope struct {
+	role int
+	typ  *tokenType
+
+	// n is the number of entries left in a slice or map, the number of
+	// fields written to a struct, or for a pointer, whether its value is
+	// still to be written.
+	n int
+
+	// at is the offset in the buffer of a struct's field count, which is
+	// filled in at its end. Between the name and the value of a field,
+	// field is set, and field type is the field's type if it's known.
+	at        int
+	field     bool
+	fieldType *tokenType
+}
+
+// tokenPtr is a pointer written with WriteToken: the type it points to,
+// and its encoded value, until that has been sent.
+type tokenPtr struct {
+	typ  *tokenType
+	data []byte
+}
+
+// tokenType is a type given in a token, by a name as in the Elem of a
+// StartSlice. Registered types and basic types have their Go type, and
+// other names are taken to be structs.
+type tokenType struct {
+	name      string
+	kind      reflect.Kind
+	t         reflect.Type
+	key, elem *tokenType
+}
+
+// tokenBasicTypes maps the names of basic types to them.
+var tokenBasicTypes = func() map[string]reflect.Type {
+	types := map[string]reflect.Type{emptyInterfaceType.String(): emptyInterfaceType}
+	for _, t := range basicTypes {
+		types[t.String()] = t
+	}
+	return types
+}()
+
+var bytesType = reflect.TypeOf([]byte(nil))
+
+// WriteToken adds a token to the stream, as returned by Decoder.Token, so
+// that streams can be built without Go values: objects from the tokens of
+// their values, and the values pointed to by Refs from a StartPointer, the
+// value and an EndPointer. Each object is written once its last token is.
+//
+// Types named in tokens which are registered are written as those types,
+// and the fields of registered structs with the types of the Go fields.
+// Other names are taken to be structs, whose fields are written with the
+// types of their values, and which decoders can only check against their
+// registered types by name. Interfaces other than interface{} must be
+// registered. A Ref can come before its StartPointer where the type
+// pointed to is known from the slice, map or field holding it; otherwise,
+// or if the pointer is never written, it fails with MissingPointer. In
+// streaming mode, every pointer an object refers to must be written before
+// the object ends.
+//
+// A token which doesn't fit where it's written fails with InvalidToken,
+// and discards the object or pointer it belongs to.
+func (e *Encoder) WriteToken(tok Token) error {
+	if e.tok == nil {
+		e.tok = &tokenState{
+			refs: make(map[uint]uint),
+			ptrs: make(map[uint]*tokenPtr),
+			ids:  make(map[string]uint),
+		}
+	}
+	if err := e.writeToken(tok); err != nil {
+		e.discardTokens()
+		return err
+	}
+	return nil
+}
+
+// writeToken adds a token to the stream, for WriteToken.
+func (e *Encoder) writeToken(tok Token) error {
+	s := e.tok
+	if len(s.scopes) == 0 {
+		s.fresh = s.fresh[:0]
+		if t, ok := tok.(StartPointer); ok {
+			return e.startTokenPtr(t)
+		}
+		if !e.streaming() {
+			if err := e.spill(); err != nil {
+				return err
+			}
+		}
+		s.start, s.lines = e.buf.Len(), len(e.traced)
+		if e.tracing {
+			e.tracef("object %s", e.tokenTypeName(tok))
+		}
+		s.scopes = append(s.scopes, tokenScope{role: objectFrame})
+		return e.writeTokenValue(tok, nil, true)
+	}
+	scope := &s.scopes[len(s.scopes)-1]
+	switch scope.role {
+	case pointerFrame:
+		if scope.n == 0 {
+			if _, ok := tok.(EndPointer); !ok {
+				return InvalidToken{tok}
+			}
+			return e.endTokenPtr()
+		}
+		return e.writeTokenValue(tok, scope.typ, false)
+	case structFrame:
+		if scope.field {
+			return e.writeTokenValue(tok, scope.fieldType, true)
+		}
+		switch t := tok.(type) {
+		case Field:
+			scope.field, scope.fieldType = true, nil
+			if st := scope.typ.t; st != nil {
+				if f, ok := lookupField(st, string(t), e.opts.Unexported); ok {
+					scope.fieldType = e.goTokenType(f.typ)
+				}
+			}
+			e.writeFieldName(string(t))
+			return nil
+		case EndStruct:
+			byteOrder.PutUint64(e.buf.Bytes()[scope.at:], zigzag[uint64](int64(scope.n)))
+			return e.endTokenScope()
+		}
+	case sliceFrame:
+		if _, ok := tok.(EndSlice); ok && scope.n == 0 {
+			return e.endTokenScope()
+		} else if ok || scope.n == 0 {
+			break
+		}
+		scope.n--
+		return e.writeTokenValue(tok, e.elemType(scope.typ), false)
+	case mapFrame:
+		if _, ok := tok.(EndMap); ok && scope.n == 0 {
+			return e.endTokenScope()
+		} else if ok || scope.n == 0 {
+			break
+		}
+		scope.n--
+		if scope.n%2 == 1 {
+			return e.writeTokenValue(tok, e.keyType(scope.typ), false)
+		}
+		return e.writeTokenValue(tok, e.elemType(scope.typ), false)
+	}
+	return InvalidToken{tok}
+}
+
+// writeTokenValue writes the start of the value a token begins, as a
+// value of the given type, preceded by that type if sendType is set. If
+// there's no type, or it's an interface, the value is written as its own
+// type, preceded by that. Values without any entries are finished at once.
+func (e *Encoder) writeTokenValue(tok Token, typ *tokenType, sendType bool) error {
+	tt, err := e.tokenValueType(tok, typ != nil && typ.kind == reflect.Ptr)
+	if err != nil {
+		return err
+	}
+	if typ != nil && typ.kind != reflect.Interface {
+		if !e.tokenTypeFits(tt, typ) {
+			return InvalidToken{tok}
+		}
+		if sendType {
+			e.writeTokenType(typ)
+		}
+		if tok == nil {
+			switch typ.kind {
+			case reflect.Ptr:
+				e.writeUint(nilRef)
+			default:
+				e.writeInt(nilLength)
+			}
+			return e.endTokenValue()
+		}
+		tt = typ
+	} else {
+		if tt.kind == reflect.Ptr && tt.elem == nil {
+			return MissingPointer{uint(tok.(Ref))}
+		}
+		e.writeTokenType(tt)
+	}
+	switch t := tok.(type) {
+	case nil:
+	case StartStruct:
+		e.tok.scopes = append(e.tok.scopes, tokenScope{role: structFrame, typ: tt, at: e.buf.Len()})
+		e.writeInt(0)
+		return nil
+	case StartSlice:
+		e.writeInt(t.Len)
+		e.tok.scopes = append(e.tok.scopes, tokenScope{role: sliceFrame, typ: tt, n: t.Len})
+		return nil
+	case StartMap:
+		e.writeInt(t.Len)
+		e.tok.scopes = append(e.tok.scopes, tokenScope{role: mapFrame, typ: tt, n: 2 * t.Len})
+		return nil
+	case Ref:
+		e.writeUint(e.tok.refs[uint(t)])
+	case []byte:
+		if tt.kind == binaryKind {
+			e.writeBytes(t)
+			break
+		}
+		if err := e.write(reflect.ValueOf(t), false); err != nil {
+			return err
+		}
+	default:
+		if err := e.write(reflect.ValueOf(tok), false); err != nil {
+			return err
+		}
+	}
+	return e.endTokenValue()
+}
+
+// endTokenScope finishes the innermost struct, slice or map being written.
+func (e *Encoder) endTokenScope() error {
+	e.tok.scopes = e.tok.scopes[:len(e.tok.scopes)-1]
+	return e.endTokenValue()
+}
+
+// endTokenValue moves on from a value which has been written, finishing
+// the object if it was the object itself.
+func (e *Encoder) endTokenValue() error {
+	s := e.tok
+	scope := &s.scopes[len(s.scopes)-1]
+	switch scope.role {
+	case objectFrame:
+		return e.endTokenObject()
+	case pointerFrame:
+		scope.n = 0
+	case structFrame:
+		scope.field = false
+		scope.n++
+	}
+	return nil
+}
+
+// endTokenObject adds an object written with WriteToken to the stream, as
+// Write does once it has encoded one.
+func (e *Encoder) endTokenObject() error {
+	s := e.tok
+	if e.streaming() {
+		if err := e.missingTokenPtr(); err != nil {
+			return err
+		}
+	}
+	s.scopes = s.scopes[:0]
+	e.objects++
+	if e.streaming() {
+		if err := e.writeRecords(); err != nil {
+			e.discardTrace(s.lines)
+			return err
+		}
+	} else if e.opts.Checksums {
+		e.writeUint32(checksum(0, e.buf.Bytes()[s.start:]))
+	}
+	if e.tally != nil {
+		e.tally.commit()
+	}
+	return nil
+}
+
+// startTokenPtr begins the value of a pointer, which is written to a
+// buffer of its own, preceded by the type it points to.
+func (e *Encoder) startTokenPtr(t StartPointer) error {
+	s := e.tok
+	typ, ok := e.parseTokenType(t.Type)
+	if !ok || t.Ref == nilRef {
+		return InvalidToken{t}
+	}
+	if _, ok := s.ptrs[s.refs[t.Ref]]; ok {
+		return InvalidToken{t}
+	}
+	ref := e.tokenRef(t.Ref)
+	s.ptrs[ref] = &tokenPtr{typ: typ}
+	s.object, s.ptr = e.buf, ref
+	e.buf = new(bytes.Buffer)
+	s.scopes = append(s.scopes, tokenScope{role: pointerFrame, typ: typ, n: 1})
+	e.writeTokenType(typ)
+	return nil
+}
+
+// endTokenPtr finishes the value of a pointer, keeping it to be written
+// to the stream as the values of other pointers are.
+func (e *Encoder) endTokenPtr() error {
+	s := e.tok
+	s.ptrs[s.ptr].data = e.buf.Bytes()
+	e.buf, s.object = s.object, nil
+	e.newPtrs = append(e.newPtrs, s.ptr)
+	s.scopes = s.scopes[:0]
+	return nil
+}
+
+// tokensOpen returns whether an object or pointer is being written with
+// WriteToken.
+func (e *Encoder) tokensOpen() bool {
+	return e.tok != nil && len(e.tok.scopes) > 0
+}
+
+// tokenRef returns the reference id written for one given in a token,
+// assigning the next id to new ones.
+func (e *Encoder) tokenRef(id uint) uint {
+	s := e.tok
+	ref, ok := s.refs[id]
+	if !ok {
+		ref = e.nextRef
+		e.nextRef++
+		s.refs[id] = ref
+		s.fresh = append(s.fresh, id)
+	}
+	return ref
+}
+
+// missingTokenPtr returns MissingPointer if a Ref was written to a pointer
+// which hasn't been.
+func (e *Encoder) missingTokenPtr() error {
+	if e.tok == nil {
+		return nil
+	}
+	for _, id := range slices.Sorted(maps.Keys(e.tok.refs)) {
+		if _, ok := e.tok.ptrs[e.tok.refs[id]]; !ok {
+			return MissingPointer{id}
+		}
+	}
+	return nil
+}
+
+// discardTokens forgets the object or pointer being written with
+// WriteToken, after a token failed.
+func (e *Encoder) discardTokens() {
+	s := e.tok
+	if len(s.scopes) == 0 {
+		return
+	}
+	if s.scopes[0].role == pointerFrame {
+		e.buf, s.object = s.object, nil
+		delete(s.ptrs, s.ptr)
+	} else {
+		e.buf.Truncate(s.start)
+		e.discardTrace(s.lines)
+		if e.tally != nil {
+			e.tally.discard()
+		}
+	}
+	for _, id := range s.fresh {
+		delete(s.refs, id)
+	}
+	s.scopes = s.scopes[:0]
+}
+
+// tokenValueType returns the type of the value a token begins. Refs to
+// pointers which haven't been started are only allowed where declared is
+// set, and their type has no element.
+func (e *Encoder) tokenValueType(tok Token, declared bool) (*tokenType, error) {
+	switch t := tok.(type) {
+	case nil:
+		return &tokenType{name: "nil", kind: nilKind}, nil
+	case StartStruct:
+		if tt, ok := e.parseTokenType(t.Type); ok && tt.kind == reflect.Struct {
+			return tt, nil
+		}
+	case StartSlice:
+		if tt, ok := e.parseTokenType("[]" + t.Elem); ok && t.Len >= 0 {
+			return tt, nil
+		}
+	case StartMap:
+		if tt, ok := e.parseTokenType("map[" + t.Key + "]" + t.Elem); ok && t.Len >= 0 {
+			return tt, nil
+		}
+	case Ref:
+		if t == nilRef {
+			break
+		}
+		if p, ok := e.tok.ptrs[e.tok.refs[uint(t)]]; ok {
+			return &tokenType{name: "*" + p.typ.name, kind: reflect.Ptr, elem: p.typ}, nil
+		}
+		if !declared {
+			return nil, MissingPointer{uint(t)}
+		}
+		e.tokenRef(uint(t))
+		return &tokenType{name: "*", kind: reflect.Ptr}, nil
+	case Field, EndStruct, EndSlice, EndMap, StartPointer, EndPointer:
+	default:
+		vt := reflect.TypeOf(tok)
+		if tokenBasicTypes[vt.String()] == vt || vt == bytesType {
+			return &tokenType{name: vt.String(), kind: wireKind(vt), t: vt}, nil
+		}
+	}
+	return nil, InvalidToken{tok}
+}
+
+// tokenTypeName returns the name of the type of the value a token begins,
+// for the encoder's trace.
+func (e *Encoder) tokenTypeName(tok Token) string {
+	if tt, err := e.tokenValueType(tok, false); err == nil {
+		return tt.name
+	}
+	return "?"
+}
+
+// parseTokenType returns the type of the given name, made of slices, maps
+// and pointers of basic and named types as in the tokens of Decoder.Token.
+func (e *Encoder) parseTokenType(name string) (*tokenType, bool) {
+	tt := &tokenType{name: name}
+	ok := true
+	switch {
+	case name == "":
+		return nil, false
+	case strings.HasPrefix(name, "[]"):
+		tt.kind = reflect.Slice
+		tt.elem, ok = e.parseTokenType(name[2:])
+	case strings.HasPrefix(name, "*"):
+		tt.kind = reflect.Ptr
+		tt.elem, ok = e.parseTokenType(name[1:])
+	case strings.HasPrefix(name, "map["):
+		key, elem, found := splitMapType(name)
+		if !found {
+			return nil, false
+		}
+		tt.kind = reflect.Map
+		if tt.key, ok = e.parseTokenType(key); ok {
+			tt.elem, ok = e.parseTokenType(elem)
+		}
+	default:
+		t, found := tokenBasicTypes[name]
+		if !found {
+			t, found = lookup(e.registry, name)
+		}
+		if !found {
+			tt.kind = reflect.Struct
+			break
+		}
+		tt.kind, tt.t = wireKind(t), t
+	}
+	return tt, ok
+}
+
+// tokenTypeFits returns whether a value of type tt can be written as one
+// of type typ: their kinds must be the same, as must the types of structs.
+// Byte slices can be written as types with their own binary encoding.
+func (e *Encoder) tokenTypeFits(tt, typ *tokenType) bool {
+	switch {
+	case tt.kind == nilKind:
+		return typ.kind == reflect.Ptr || typ.kind == reflect.Slice || typ.kind == reflect.Map
+	case tt.t == bytesType:
+		return typ.kind == binaryKind || typ.kind == reflect.Slice && e.elemType(typ).kind == reflect.Uint8
+	case tt.kind != typ.kind:
+		return false
+	case tt.kind == reflect.Struct:
+		return tt.t == typ.t && (tt.t != nil || tt.name == typ.name)
+	}
+	return true
+}
+
+// elemType returns the element type of a slice, map or pointer type.
+func (e *Encoder) elemType(tt *tokenType) *tokenType {
+	if tt.elem == nil {
+		tt.elem = e.goTokenType(tt.t.Elem())
+	}
+	return tt.elem
+}
+
+// keyType returns the key type of a map type.
+func (e *Encoder) keyType(tt *tokenType) *tokenType {
+	if tt.key == nil {
+		tt.key = e.goTokenType(tt.t.Key())
+	}
+	return tt.key
+}
+
+// goTokenType returns the token type of a Go type.
+func (e *Encoder) goTokenType(t reflect.Type) *tokenType {
+	return &tokenType{name: e.typeName(t), kind: wireKind(t), t: t}
+}
+
+// writeTokenType writes a type given in a token. Struct types only known
+// by name are added to the type table the first time they're written.
+func (e *Encoder) writeTokenType(tt *tokenType) {
+	if tt.t != nil {
+		e.writeType(tt.t)
+		return
+	}
+	e.writeUint8(uint8(tt.kind))
+	switch tt.kind {
+	case reflect.Map:
+		e.writeTokenType(tt.key)
+		e.writeTokenType(tt.elem)
+	case reflect.Ptr, reflect.Slice:
+		e.writeTokenType(tt.elem)
+	case reflect.Struct:
+		s := e.tok
+		id, ok := s.ids[tt.name]
+		if !ok {
+			id = e.nextId
+			e.nextId++
+			s.ids[tt.name] = id
+			s.names = append(s.names, tt.name)
+		}
+		e.writeUint(id)
+	}
+}
+
+// tokenTypeNames returns the struct types written with WriteToken which
+// are only known by name.
+func (e *Encoder) tokenTypeNames() []string {
+	if e.tok == nil {
+		return nil
+	}
+	return e.tok.names
+}
+
+// writeTokenTypeEntry writes the type table entry of a struct type only
+// known by name. It has no fingerprint or structure.
+func (e *Encoder) writeTokenTypeEntry(name string) {
+	id := e.tok.ids[name]
+	if e.tracing {
+		e.tracef("type %d %s", id, name)
+	}
+	e.writeString(name)
+	e.writeUint(id)
+	e.writeUint64(0)
+	e.writeInt(0)
+	if e.opts.Schema {
+		e.writeSchema(TypeSchema{Name: name, Kind: "struct"})
+	}
+	e.writeBool(false)
+}
+
+// takeTokenPtr returns the encoded value of a pointer written with
+// WriteToken, and the name of its type, unless it has already been taken.
+func (e *Encoder) takeTokenPtr(ref uint) ([]byte, string, bool) {
+	if e.tok == nil {
+		return nil, "", false
+	}
+	p, ok := e.tok.ptrs[ref]
+	if !ok || p.data == nil {
+		return nil, "", false
+	}
+	data := p.data
+	p.data = nil
+	return data, p.typ.name, true
+}
+
+// tokenPtrCount returns the number of pointers written with WriteToken
+// which haven't been taken yet.
+func (e *Encoder) tokenPtrCount() int {
+	n := 0
+	if e.tok != nil {
+		for _, p := range e.tok.ptrs {
+			if p.data != nil {
+				n++
+			}
+		}
+	}
+	return n
+}
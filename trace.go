@@ -0,0 +1,122 @@
+package lager
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Traces are written one line per record and struct field, each starting
+// with the offset in the stream of the bytes it describes, as in:
+//
+//	@17 type 1 main.User
+//	@52 pointer 2 main.Group
+//	@60 field .Members []*main.User
+//	@85 object main.User
+//	@94 field .Name string
+//	@110 field .Tags[0].Label string
+//
+// Field paths start at the object or pointer value holding them. Offsets
+// in encrypted streams are those of the stream inside the envelope.
+
+// traceLine is a line of an encoder's trace, held until the bytes it
+// describes are sent, when their offset in the stream is known.
+type traceLine struct {
+	offset int
+	text   string
+}
+
+// tracef adds a line describing the bytes about to be written to the
+// buffer to the encoder's trace.
+func (e *Encoder) tracef(format string, args ...interface{}) {
+	e.traced = append(e.traced, traceLine{e.buf.Len(), fmt.Sprintf(format, args...)})
+}
+
+// takeTrace returns the lines traced since the last call, and forgets
+// them.
+func (e *Encoder) takeTrace() []traceLine {
+	lines := e.traced
+	e.traced = nil
+	e.shifted = 0
+	return lines
+}
+
+// discardTrace forgets the lines traced since there were n, for an object
+// which failed to be written.
+func (e *Encoder) discardTrace(n int) {
+	e.traced = e.traced[:n]
+	e.path = e.path[:0]
+}
+
+// traceName returns the name of a type in the encoder's trace.
+func (e *Encoder) traceName(t reflect.Type) string {
+	if t == nil {
+		return "nil"
+	}
+	return e.typeName(t)
+}
+
+// dynamicType returns the type of the value held by v, unwrapping
+// interfaces, or nil if it holds nil.
+func dynamicType(v reflect.Value) reflect.Type {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return nil
+	}
+	return v.Type()
+}
+
+// sendTrace writes trace lines describing a buffer which is sent at the
+// given offset in the stream.
+func (e *Encoder) sendTrace(base int64, lines []traceLine) {
+	for _, line := range lines {
+		fmt.Fprintf(e.opts.Trace, "@%d %s\n", base+int64(line.offset), line.text)
+	}
+}
+
+// traceField adds a line for a struct field of the given name and type to
+// the trace, and enters the field's path until leavePath is called.
+func (e *Encoder) traceField(name, typ string) {
+	e.path = append(e.path, "."+name)
+	e.tracef("field %s %s", strings.Join(e.path, ""), typ)
+}
+
+// tracePath enters an element of a slice or map, until leavePath is
+// called.
+func (e *Encoder) tracePath(elem string) {
+	e.path = append(e.path, elem)
+}
+
+func (e *Encoder) leavePath() {
+	e.path = e.path[:len(e.path)-1]
+}
+
+// tracef writes a line describing the bytes at the given offset to the
+// decoder's trace.
+func (d *Decoder) tracef(offset int64, format string, args ...interface{}) {
+	text := fmt.Sprintf(format, args...)
+	if d.explain != nil {
+		d.explain(offset, text)
+		return
+	}
+	fmt.Fprintf(d.opts.Trace, "@%d %s\n", offset, text)
+}
+
+// traceField writes a line for a struct field of the given name and type
+// to the trace, and enters the field's path until leavePath is called.
+func (d *Decoder) traceField(offset int64, name string, wt *wireType) {
+	d.path = append(d.path, "."+name)
+	d.tracef(offset, "field %s %s", strings.Join(d.path, ""), d.wireName(wt))
+}
+
+// tracePath enters an element of a slice or map, until leavePath is
+// called.
+func (d *Decoder) tracePath(elem string) {
+	d.path = append(d.path, elem)
+}
+
+func (d *Decoder) leavePath() {
+	d.path = d.path[:len(d.path)-1]
+}
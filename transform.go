@@ -0,0 +1,46 @@
+package lager
+
+import (
+	"io"
+)
+
+// Transform copies the stream read from src to dst, passing each object
+// through fn, which returns the object to write in its place and whether
+// to keep it at all. Objects are decoded and encoded as usual, so their
+// types must be registered, and pointers shared by several objects are
+// still shared afterwards. The new stream is written with the options
+// and metadata recorded in the old one's header.
+func Transform(dst io.Writer, src io.Reader, fn func(interface{}) (interface{}, bool, error)) error {
+	dec, err := NewDecoder(src)
+	if err != nil {
+		return err
+	}
+	h := dec.Header()
+	enc := NewEncoderWithOptions(dst, EncoderOptions{
+		Checksums: h.Checksums,
+		Streaming: h.Streaming,
+		Footer:    h.Footer,
+		Index:     h.Index,
+		FieldIds:  h.FieldIds,
+		StringIds: h.StringIds,
+		OmitZero:  h.OmitZero,
+		Schema:    h.Schema != nil,
+	})
+	enc.SetMetadata(h.Metadata)
+	for v, err := range dec.All() {
+		if err != nil {
+			return err
+		}
+		v, keep, err := fn(v)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			continue
+		}
+		if err := enc.Write(v); err != nil {
+			return err
+		}
+	}
+	return enc.Finish()
+}
@@ -0,0 +1,96 @@
+package lager
+
+import (
+	"reflect"
+	"strings"
+)
+
+// RegisterGeneric registers instantiations of a generic type in the global
+// registry, as Registry.RegisterGeneric does.
+func RegisterGeneric(name string, values ...interface{}) {
+	defaultRegistry.RegisterGeneric(name, values...)
+}
+
+// RegisterGeneric adds the types of the given values, which are usually
+// instantiations of one generic type such as Cache[string, Item], to the
+// registry, each written under the given name followed by its type
+// arguments, such as "Cache[string,app.Item]". Like RegisterName, this
+// keeps existing data readable when the generic type is moved or renamed.
+// Values of types which aren't generic are registered under the name
+// alone.
+func (r *Registry) RegisterGeneric(name string, values ...interface{}) {
+	r.lock()
+	defer r.mu.Unlock()
+	for _, value := range values {
+		typ := reflect.TypeOf(value)
+		typName := name + typeArgs(typ)
+		r.types[typName] = typ
+		r.names[typ] = typName
+		delete(r.auto, typ)
+	}
+}
+
+// typeString returns the name a type is registered under by default. This
+// is the name reflect gives it, except for instantiations of generic types,
+// whose type arguments reflect names by their full import paths; those are
+// named by package like the generic type is, so that the name stays the
+// same when the module moves.
+func typeString(t reflect.Type) string {
+	args := typeArgs(t)
+	if args == "" {
+		return t.String()
+	}
+	s := t.String()
+	return s[:len(s)-len(args)] + shortenPaths(args, t.PkgPath(), packageName(t))
+}
+
+// typeArgs returns the bracketed type arguments at the end of the name of
+// an instantiated generic type, as reflect gives them, or "" if the type
+// isn't one.
+func typeArgs(t reflect.Type) string {
+	name := t.Name()
+	if i := strings.IndexByte(name, '['); i >= 0 && strings.HasSuffix(name, "]") {
+		return name[i:]
+	}
+	return ""
+}
+
+// packageName returns the name of the package a named type is defined in,
+// as it appears in the type's reflect name.
+func packageName(t reflect.Type) string {
+	s := t.String()
+	return s[:len(s)-len(t.Name())-1]
+}
+
+// shortenPaths replaces the import paths qualifying the types named in a
+// list of type arguments with the names of their packages: that of the
+// generic type for its own package, and the last element of the path for
+// others.
+func shortenPaths(args, pkgPath, pkgName string) string {
+	var b strings.Builder
+	for len(args) > 0 {
+		end := strings.IndexFunc(args, isTypeSeparator)
+		if end < 0 {
+			end = len(args)
+		} else if end == 0 {
+			end = 1
+		}
+		word := args[:end]
+		args = args[end:]
+		if slash := strings.LastIndexByte(word, '/'); slash >= 0 {
+			if rest, ok := strings.CutPrefix(word, pkgPath+"."); ok {
+				word = pkgName + "." + rest
+			} else {
+				word = word[slash+1:]
+			}
+		}
+		b.WriteString(word)
+	}
+	return b.String()
+}
+
+// isTypeSeparator returns whether a rune ends a qualified identifier in a
+// type's reflect name.
+func isTypeSeparator(r rune) bool {
+	return strings.ContainsRune("[](){}*, ;\"", r)
+}
@@ -0,0 +1,59 @@
+package lager
+
+import (
+	"reflect"
+	"sync"
+)
+
+// UnknownFields holds the struct fields read from a stream which don't
+// exist in the type they were decoded into. A struct with an exported
+// field of this type keeps its unknown fields there when decoded, and
+// writes them back out when encoded, so that records from newer versions
+// of a program can pass through older ones without losing data. The types
+// of unknown fields must still be registered.
+type UnknownFields struct {
+	fields []unknownField
+}
+
+// unknownField is a single field held by UnknownFields.
+type unknownField struct {
+	name  string
+	value reflect.Value
+}
+
+// Len returns the number of unknown fields held.
+func (u UnknownFields) Len() int {
+	return len(u.fields)
+}
+
+// Names returns the wire names of the unknown fields held.
+func (u UnknownFields) Names() []string {
+	names := make([]string, len(u.fields))
+	for i, f := range u.fields {
+		names[i] = f.name
+	}
+	return names
+}
+
+var unknownFieldsType = reflect.TypeOf(UnknownFields{})
+
+// unknownCache holds the index of the UnknownFields field of each struct
+// type seen so far, or -1 if it has none.
+var unknownCache sync.Map
+
+// unknownFieldsIndex returns the index of the given struct type's
+// UnknownFields field, if it has one.
+func unknownFieldsIndex(t reflect.Type) (int, bool) {
+	if i, ok := unknownCache.Load(t); ok {
+		return i.(int), i.(int) >= 0
+	}
+	index := -1
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.Type == unknownFieldsType && !privateField(f) {
+			index = i
+			break
+		}
+	}
+	unknownCache.Store(t, index)
+	return index, index >= 0
+}
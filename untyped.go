@@ -0,0 +1,261 @@
+package lager
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// ReadGeneric returns the next object from the stream as a generic value,
+// so that streams can be read without their types being registered, or
+// even known. Structs are decoded as map[string]interface{} keyed by field
+// name, slices as []interface{}, maps as map[interface{}]interface{}, and
+// byte slices and types with their own binary encoding as []byte. Other
+// values are decoded as their underlying Go types, such as int64 or
+// string. Pointers whose types are registered are decoded as usual; others
+// are decoded as a *interface{} holding the generic value they point to.
+// Errors written with the Errors option are decoded as errors.New of their
+// messages. Values written by codecs are decoded as a []interface{} of the values the
+// codec wrote, except those of registered extensions, which are decoded as
+// their own types.
+func (d *Decoder) ReadGeneric() (value interface{}, err error) {
+	for {
+		_, value, err = d.readGenericObject()
+		if !d.resync(err) {
+			return value, err
+		}
+	}
+}
+
+// readGenericObject reads the next object from the stream as a generic
+// value, and returns its wire type along with it.
+func (d *Decoder) readGenericObject() (wt *wireType, value interface{}, err error) {
+	defer d.recoverPanic(&err)
+	if wt, err = d.beginObject(); err != nil {
+		return nil, nil, err
+	}
+	if value, err = d.readGeneric(wt); err != nil {
+		return nil, nil, withRootName(err, d.wireName(wt))
+	}
+	if err := d.endObject(); err != nil {
+		return nil, nil, err
+	}
+	return wt, value, nil
+}
+
+// readGeneric decodes a value of the given wire type as a generic value.
+func (d *Decoder) readGeneric(wt *wireType) (interface{}, error) {
+	defer d.leave()
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	if isExtension(wt.kind) {
+		return d.readGenericExtension(wt)
+	}
+	switch wt.kind {
+	case nilKind, typedNilKind:
+		return nil, nil
+	case namedKind:
+		return d.readGeneric(wt.elem)
+	case binaryKind:
+		return d.readBytes()
+	case codecKind:
+		return d.readGenericCustom()
+	case errorKind:
+		return d.readGenericError()
+	case reflect.Interface:
+		it, err := d.readWireType()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.readGeneric(it)
+		if d.tagged && err == nil {
+			return taggedValue{d.wireName(it), value}, nil
+		}
+		return value, err
+	case reflect.Ptr:
+		return d.readGenericPtr()
+	case reflect.Slice:
+		return d.readGenericSlice(wt)
+	case reflect.Map:
+		return d.readGenericMap(wt)
+	case reflect.Struct:
+		return d.readGenericStruct()
+	}
+	v := reflect.New(basicTypes[wt.kind]).Elem()
+	if err := d.readValue(v); err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
+}
+
+func (d *Decoder) readGenericSlice(wt *wireType) (interface{}, error) {
+	n, err := d.readSliceLength()
+	switch {
+	case err != nil:
+		return nil, err
+	case n == sharedLength:
+		return d.readGenericSharedSlice(wt)
+	case wt.elem.kind == reflect.Uint8:
+		return d.readByteSlice(n)
+	case n == nilLength:
+		return []interface{}(nil), nil
+	}
+	s := make([]interface{}, 0, preallocLength(n, 16))
+	for i := 0; i < n; i++ {
+		if err := checkContext(d.ctx, i); err != nil {
+			return nil, err
+		}
+		if d.opts.Trace != nil {
+			d.tracePath("[" + strconv.Itoa(i) + "]")
+		}
+		elem, err := d.readGeneric(wt.elem)
+		if err != nil {
+			return nil, withPath(err, "["+strconv.Itoa(i)+"]")
+		}
+		if d.opts.Trace != nil {
+			d.leavePath()
+		}
+		s = append(s, elem)
+	}
+	return s, nil
+}
+
+func (d *Decoder) readGenericMap(wt *wireType) (interface{}, error) {
+	n, err := d.readMapLength()
+	switch {
+	case err != nil:
+		return nil, err
+	case n == sharedLength:
+		return d.readGenericSharedMap()
+	case n == nilLength:
+		return map[interface{}]interface{}(nil), nil
+	}
+	m := make(map[interface{}]interface{}, preallocLength(n, 32))
+	for i := 0; i < n; i++ {
+		if err := checkContext(d.ctx, i); err != nil {
+			return nil, err
+		}
+		key, err := d.readGeneric(wt.key)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil && !reflect.ValueOf(key).Comparable() {
+			return nil, UnsupportedRead{reflect.Map}
+		}
+		if d.opts.Trace != nil {
+			d.tracePath(fmt.Sprintf("[%v]", key))
+		}
+		elem, err := d.readGeneric(wt.elem)
+		if err != nil {
+			return nil, withPath(err, fmt.Sprintf("[%v]", key))
+		}
+		if d.opts.Trace != nil {
+			d.leavePath()
+		}
+		m[key] = elem
+	}
+	return m, nil
+}
+
+func (d *Decoder) readGenericStruct() (interface{}, error) {
+	n, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{}, preallocLength(n, 32))
+	depth := len(d.path)
+	for i := 0; i < n; i++ {
+		offset := d.reader.n
+		name, err := d.readFieldName()
+		if err != nil {
+			return nil, err
+		}
+		ft, err := d.readWireType()
+		if err != nil {
+			return nil, err
+		}
+		if d.opts.Trace != nil {
+			d.path = d.path[:depth]
+			d.traceField(offset, name, ft)
+		}
+		if m[name], err = d.readGeneric(ft); err != nil {
+			return nil, withPath(err, "."+name)
+		}
+	}
+	if d.opts.Trace != nil {
+		d.path = d.path[:depth]
+	}
+	return m, nil
+}
+
+// readGenericPtr reads a pointer's reference id, and returns the pointer
+// if its type is known, or otherwise a *interface{} which will hold its
+// generic value once its record is read.
+func (d *Decoder) readGenericPtr() (interface{}, error) {
+	ref, err := d.readUint()
+	if err != nil {
+		return nil, err
+	}
+	if ref == nilRef {
+		return nil, nil
+	}
+	if p, ok := d.ptrMap[ref]; ok {
+		return p.Interface(), nil
+	}
+	cell, ok := d.generic[ref]
+	if !ok {
+		cell = new(interface{})
+		d.generic[ref] = cell
+		d.genericPending[ref] = true
+	}
+	return cell, nil
+}
+
+// readGenericPtrEntry decodes the value of a pointer record generically.
+// If the pointer was already read, the value is decoded but discarded.
+// Backing arrays already sliced, and maps which contain themselves, are
+// filled in rather than replaced.
+func (d *Decoder) readGenericPtrEntry(ref uint, wt *wireType) error {
+	value, err := d.readGeneric(wt)
+	if err != nil {
+		return err
+	}
+	cell, ok := d.generic[ref]
+	if !ok {
+		cell = new(interface{})
+		d.generic[ref] = cell
+	} else if !d.genericPending[ref] {
+		return nil
+	}
+	delete(d.genericPending, ref)
+	if !fillCell(cell, value) {
+		*cell = value
+	}
+	return nil
+}
+
+// wireName returns a readable name for a wire type, using the names in
+// the type table.
+func (d *Decoder) wireName(wt *wireType) string {
+	switch wt.kind {
+	case nilKind:
+		return "nil"
+	case errorKind:
+		return "error"
+	case typedNilKind:
+		return d.wireName(wt.elem)
+	case reflect.Struct, reflect.Interface, binaryKind, namedKind, codecKind:
+		return d.typeNames[wt.id]
+	case reflect.Map:
+		return "map[" + d.wireName(wt.key) + "]" + d.wireName(wt.elem)
+	case reflect.Ptr:
+		return "*" + d.wireName(wt.elem)
+	case reflect.Slice:
+		return "[]" + d.wireName(wt.elem)
+	}
+	if isExtension(wt.kind) {
+		return "extension " + strconv.Itoa(int(wt.kind-extensionKind))
+	}
+	return basicTypes[wt.kind].String()
+}
@@ -0,0 +1,179 @@
+package lager
+
+import (
+	"reflect"
+)
+
+// wireKey identifies a type as it is written in a stream: by its wire
+// kind, the types it is made of, and for types which are named in the type
+// table, its type id. Named non-struct types also have their underlying
+// type as elem, so that they can be read without knowing the named type.
+type wireKey struct {
+	kind      reflect.Kind
+	key, elem *wireType
+	id        uint
+}
+
+// wireType is a type read from a stream, which may not have been
+// resolved to a Go type yet. Each decoder interns its wire types, so
+// equal ones are the same pointer and only need resolving once. Those
+// which are or are made of extensions are marked as such.
+type wireType struct {
+	wireKey
+	typ reflect.Type
+	ext bool
+}
+
+// basicTypes maps the wire kinds of types which are fully described by
+// their kind to those types.
+var basicTypes = map[reflect.Kind]reflect.Type{
+	reflect.Bool:       reflect.TypeOf(false),
+	reflect.Int:        reflect.TypeOf(int(0)),
+	reflect.Int8:       reflect.TypeOf(int8(0)),
+	reflect.Int16:      reflect.TypeOf(int16(0)),
+	reflect.Int32:      reflect.TypeOf(int32(0)),
+	reflect.Int64:      reflect.TypeOf(int64(0)),
+	reflect.Uint:       reflect.TypeOf(uint(0)),
+	reflect.Uint8:      reflect.TypeOf(uint8(0)),
+	reflect.Uint16:     reflect.TypeOf(uint16(0)),
+	reflect.Uint32:     reflect.TypeOf(uint32(0)),
+	reflect.Uint64:     reflect.TypeOf(uint64(0)),
+	reflect.Uintptr:    reflect.TypeOf(uintptr(0)),
+	reflect.Float32:    reflect.TypeOf(float32(0)),
+	reflect.Float64:    reflect.TypeOf(float64(0)),
+	reflect.Complex64:  reflect.TypeOf(complex64(0)),
+	reflect.Complex128: reflect.TypeOf(complex128(0)),
+	reflect.String:     reflect.TypeOf(""),
+	timeKind:           timeType,
+	durationKind:       durationType,
+	bigIntKind:         bigIntType,
+	bigFloatKind:       bigFloatType,
+	bigRatKind:         bigRatType,
+}
+
+// readType reads a type from the stream and resolves it to a Go type.
+func (d *Decoder) readType() (reflect.Type, error) {
+	wt, err := d.readWireType()
+	if err != nil {
+		return nil, err
+	}
+	return d.resolve(wt)
+}
+
+// readWireType reads a type from the stream without resolving it.
+func (d *Decoder) readWireType() (*wireType, error) {
+	defer d.leave()
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	u, err := d.readUint8()
+	if err != nil {
+		return nil, err
+	}
+	key := wireKey{kind: reflect.Kind(u)}
+	switch key.kind {
+	case nilKind, errorKind:
+	case reflect.Map:
+		if key.key, err = d.readElemType(); err != nil {
+			return nil, err
+		}
+		if key.elem, err = d.readElemType(); err != nil {
+			return nil, err
+		}
+	case reflect.Ptr, reflect.Slice, typedNilKind:
+		if key.elem, err = d.readElemType(); err != nil {
+			return nil, err
+		}
+	case reflect.Struct, reflect.Interface, binaryKind, codecKind:
+		if key.id, err = d.readUint(); err != nil {
+			return nil, err
+		}
+	case namedKind:
+		if key.id, err = d.readUint(); err != nil {
+			return nil, err
+		}
+		if key.elem, err = d.readElemType(); err != nil {
+			return nil, err
+		}
+	default:
+		if _, ok := basicTypes[key.kind]; !ok && !isExtension(key.kind) {
+			return nil, UnsupportedRead{key.kind}
+		}
+	}
+	if wt, ok := d.wireTypes[key]; ok {
+		return wt, nil
+	}
+	wt := &wireType{wireKey: key}
+	wt.ext = isExtension(key.kind) || key.key != nil && key.key.ext || key.elem != nil && key.elem.ext
+	d.wireTypes[key] = wt
+	return wt, nil
+}
+
+// readElemType reads a type which other types are made of, which can't be
+// the type of nil.
+func (d *Decoder) readElemType() (*wireType, error) {
+	wt, err := d.readWireType()
+	if err == nil && wt.kind == nilKind {
+		return nil, CorruptStream{"type"}
+	}
+	return wt, err
+}
+
+// resolve returns the Go type of the given wire type, looking up the names
+// of any types in the type table. The type of nil resolves to nil, and that
+// of a typed nil to the type of the nil.
+func (d *Decoder) resolve(wt *wireType) (reflect.Type, error) {
+	if wt.typ != nil {
+		return wt.typ, nil
+	}
+	var t reflect.Type
+	switch wt.kind {
+	case nilKind:
+		return nil, nil
+	case errorKind:
+		t = errorType
+	case typedNilKind:
+		return d.resolve(wt.elem)
+	case reflect.Map:
+		key, err := d.resolve(wt.key)
+		if err != nil {
+			return nil, err
+		}
+		elem, err := d.resolve(wt.elem)
+		if err != nil {
+			return nil, err
+		}
+		if !key.Comparable() {
+			return nil, CorruptStream{"type"}
+		}
+		t = reflect.MapOf(key, elem)
+	case reflect.Ptr:
+		elem, err := d.resolve(wt.elem)
+		if err != nil {
+			return nil, err
+		}
+		t = reflect.PtrTo(elem)
+	case reflect.Slice:
+		elem, err := d.resolve(wt.elem)
+		if err != nil {
+			return nil, err
+		}
+		t = reflect.SliceOf(elem)
+	case reflect.Struct, reflect.Interface, binaryKind, namedKind, codecKind:
+		var err error
+		if t, err = d.resolveType(wt.id); err != nil {
+			return nil, err
+		}
+	default:
+		if isExtension(wt.kind) {
+			var ok bool
+			if t, ok = lookupExtension(d.registry, wt.kind); !ok {
+				return nil, UnknownExtension{uint8(wt.kind - extensionKind)}
+			}
+			break
+		}
+		t = basicTypes[wt.kind]
+	}
+	wt.typ = t
+	return t, nil
+}